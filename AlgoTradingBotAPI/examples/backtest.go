@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/indicators"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// CrossoverStrategy - Стратегия на пересечении быстрой и медленной скользящих средних со стоп-лоссом.
+// Та же стратегия без изменений запускается на реальном счете через investgo.Engine.
+type CrossoverStrategy struct {
+	investgo.BaseStrategy
+	engine  *investgo.Engine
+	tracker *indicators.Tracker
+	// stops - Стоп-заявки по открытым позициям
+	stops map[string]string
+
+	// Lots - Кол-во лотов в одном поручении
+	Lots int64
+	// StopLoss - Процент убытка для стоп-лосса
+	StopLoss float64
+}
+
+func (s *CrossoverStrategy) Init(e *investgo.Engine) error {
+	s.engine = e
+	s.stops = make(map[string]string)
+	s.tracker = indicators.NewTracker(func() indicators.Set {
+		return indicators.Set{
+			"fast": indicators.NewEMA(9),
+			"slow": indicators.NewEMA(21),
+		}
+	})
+	return nil
+}
+
+func (s *CrossoverStrategy) OnCandle(candle *pb.Candle) error {
+	id := candle.GetInstrumentUid()
+	s.tracker.UpdateCandle(candle)
+	fast, okFast := s.tracker.Value(id, "fast")
+	slow, okSlow := s.tracker.Value(id, "slow")
+	if !okFast || !okSlow {
+		return nil
+	}
+	for _, o := range s.engine.ActiveOrders() {
+		if o.InstrumentUid == id {
+			return nil
+		}
+	}
+	instrument, _ := s.engine.Instrument(id)
+	position := s.engine.Position(id)
+	switch {
+	case fast > slow && position.Lots == 0:
+		if _, err := s.engine.Buy(id, s.Lots, nil); err != nil {
+			return err
+		}
+		stopPrice := investgo.FloatToQuotation(candle.GetClose().ToFloat()*(1-s.StopLoss/100), instrument.PriceStep)
+		stopId, err := s.engine.StopOrder(id, s.Lots, pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			pb.StopOrderType_STOP_ORDER_TYPE_STOP_LOSS, stopPrice, nil)
+		if err != nil {
+			return err
+		}
+		s.stops[id] = stopId
+	case fast < slow && position.Lots > 0:
+		if stopId, ok := s.stops[id]; ok {
+			// стоп-заявка могла уже сработать
+			_ = s.engine.CancelStopOrder(stopId)
+			delete(s.stops, id)
+		}
+		_, err := s.engine.Sell(id, position.Lots, nil)
+		return err
+	}
+	return nil
+}
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	config, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	// клиент нужен только для загрузки истории и информации об инструментах
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	ids := []string{"e6123145-9665-43e0-8413-cd61b8aa9b13", "6afa6f80-03a7-4d83-9cf0-c19d7d021f76"}
+	instrumentsService := client.NewInstrumentsServiceClient()
+	MarketDataService := client.NewMarketDataServiceClient()
+
+	instruments := make([]investgo.EngineInstrument, 0, len(ids))
+	candles := make(map[string][]*pb.HistoricCandle, len(ids))
+	for _, id := range ids {
+		resp, err := instrumentsService.InstrumentByUid(id)
+		if err != nil {
+			logger.Fatalf(err.Error())
+		}
+		instrument := resp.GetInstrument()
+		instruments = append(instruments, investgo.EngineInstrument{
+			Uid:       instrument.GetUid(),
+			Figi:      instrument.GetFigi(),
+			Ticker:    instrument.GetTicker(),
+			Lot:       int64(instrument.GetLot()),
+			Currency:  instrument.GetCurrency(),
+			PriceStep: instrument.GetMinPriceIncrement(),
+		})
+		candles[id], err = MarketDataService.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
+			Instrument: id,
+			Interval:   pb.CandleInterval_CANDLE_INTERVAL_5_MIN,
+			From:       time.Now().Add(-7 * investgo.DAY),
+			To:         time.Now(),
+		})
+		if err != nil {
+			logger.Fatalf(err.Error())
+		}
+	}
+
+	// лимитные поручения исполняются, только если цена прошла их цену, рыночные - с проскальзыванием в 1 шаг цены,
+	// за одну свечу исполняется не больше 10% ее объема
+	result, err := backtest.Run(ctx, &CrossoverStrategy{Lots: 1, StopLoss: 1}, backtest.Config{
+		Instruments:    instruments,
+		Candles:        candles,
+		CandleInterval: pb.CandleInterval_CANDLE_INTERVAL_5_MIN,
+		InitialCash:    100000,
+		Currency:       "RUB",
+		Fill:           backtest.FILL_TRADE_THROUGH,
+		Slippage:       backtest.Slippage{Ticks: 1},
+		Commission:     backtest.TariffTrader,
+		Participation:  0.1,
+		SellOut:        true,
+	})
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	logger.Infof("orders = %v, fills = %v, commission = %.2f", result.Orders, len(result.Fills), result.Commission)
+	logger.Infof("initial cash = %.2f, final equity = %.2f", result.InitialCash, result.FinalEquity)
+
+	// показатели, журнал сделок и кривая капитала сохраняются в html, json и csv
+	report := backtest.Analyze(result)
+	m := report.Metrics
+	logger.Infof("return = %.2f%%, max drawdown = %.2f%%, sharpe = %.2f, trades = %v, win rate = %.2f%%",
+		m.ReturnPercent, m.MaxDrawdownPercent, m.Sharpe, m.Trades, m.WinRate)
+	if err := report.Save("backtest_report", "Crossover backtest"); err != nil {
+		logger.Errorf(err.Error())
+	}
+
+	// устойчивость результата: 1000 прогонов с перевыборкой сделок блоками и случайным проскальзыванием
+	mc, err := backtest.MonteCarlo(report.Trades, result.InitialCash, backtest.MonteCarloConfig{
+		Runs:         1000,
+		Resampling:   backtest.RESAMPLE_BLOCK,
+		Slippage:     backtest.SlippageModel{Distribution: backtest.DIST_EXPONENTIAL, Mean: 0.02},
+		RuinDrawdown: 10,
+	})
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	logger.Infof("monte carlo: return 95%% = [%.2f%%, %.2f%%], max drawdown 95%% = [%.2f%%, %.2f%%], "+
+		"probability of loss = %.2f%%, probability of ruin = %.2f%%", mc.Return.Low, mc.Return.High, mc.Drawdown.Low,
+		mc.Drawdown.High, mc.ProbabilityOfLoss, mc.ProbabilityOfRuin)
+	if err := mc.Save("backtest_report"); err != nil {
+		logger.Errorf(err.Error())
+	}
+}
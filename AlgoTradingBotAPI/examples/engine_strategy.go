@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ImbalanceStrategy - Стратегия на дисбалансе стакана: покупка при перевесе покупателей и продажа
+// при перевесе продавцов. Подписки, позиции, проверка баланса и закрытие позиций в конце сессии - на движке.
+type ImbalanceStrategy struct {
+	investgo.BaseStrategy
+	engine *investgo.Engine
+
+	// Levels - Кол-во уровней стакана для расчета дисбаланса
+	Levels int
+	// Threshold - Порог дисбаланса от 0 до 1
+	Threshold float64
+	// Lots - Кол-во лотов в одном поручении
+	Lots int64
+}
+
+func (s *ImbalanceStrategy) Init(e *investgo.Engine) error {
+	s.engine = e
+	return nil
+}
+
+func (s *ImbalanceStrategy) OnOrderBook(input *pb.OrderBook) error {
+	id := input.GetInstrumentUid()
+	instrument, ok := s.engine.Instrument(id)
+	if !ok {
+		return nil
+	}
+	ob := orderbook.NewOrderBook(input, instrument.PriceStep)
+	imbalance := ob.Imbalance(s.Levels)
+	position := s.engine.Position(id)
+	// пока поручение по инструменту не исполнено, новые не выставляем
+	for _, o := range s.engine.ActiveOrders() {
+		if o.InstrumentUid == id {
+			return nil
+		}
+	}
+	switch {
+	case imbalance > s.Threshold && position.Lots == 0:
+		_, err := s.engine.Buy(id, s.Lots, nil)
+		return err
+	case imbalance < -s.Threshold && position.Lots > 0:
+		_, err := s.engine.Sell(id, position.Lots, nil)
+		return err
+	}
+	return nil
+}
+
+func (s *ImbalanceStrategy) OnOrderUpdate(trades *pb.OrderTrades) error {
+	p := s.engine.Position(trades.GetInstrumentUid())
+	s.engine.Logger().Infof("%v position = %v lots, realized pnl = %.2f", trades.GetInstrumentUid(), p.Lots, p.RealizedPnL)
+	return nil
+}
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	config, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	// создаем клиента для investAPI, он позволяет создавать нужные сервисы и уже
+	// через них вызывать нужные методы
+	client, err := investgo.NewClient(context.Background(), config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	strategy := &ImbalanceStrategy{
+		Levels:    10,
+		Threshold: 0.5,
+		Lots:      1,
+	}
+	// движок запускает сессию по расписанию MOEX и за 5 минут до конца торгов закрывает позиции
+	engine, err := investgo.NewEngine(ctx, client, strategy, investgo.EngineConfig{
+		Instruments:          []string{"e6123145-9665-43e0-8413-cd61b8aa9b13", "6afa6f80-03a7-4d83-9cf0-c19d7d021f76"},
+		OrderBookDepth:       20,
+		Exchange:             "MOEX",
+		CancelAhead:          5 * time.Minute,
+		SellOut:              true,
+		Currency:             "RUB",
+		RequiredMoneyBalance: 100000,
+	})
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	if err = engine.Run(); err != nil {
+		logger.Errorf(err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/indicators"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	config, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	defer cancel()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	// создаем клиента для investAPI, он позволяет создавать нужные сервисы и уже
+	// через них вызывать нужные методы
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	ids := []string{"BBG004730N88", "BBG00475KKY8", "BBG004RVFCY3"}
+
+	// для каждого инструмента трекер создает свой набор индикаторов
+	tracker := indicators.NewTracker(func() indicators.Set {
+		return indicators.Set{
+			"sma":  indicators.NewSMA(20),
+			"rsi":  indicators.NewRSI(14),
+			"macd": indicators.NewMACD(12, 26, 9),
+		}
+	})
+
+	// прогреваем индикаторы историей минутных свечей
+	MarketDataService := client.NewMarketDataServiceClient()
+	for _, id := range ids {
+		candles, err := MarketDataService.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
+			Instrument: id,
+			Interval:   pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			From:       time.Now().Add(-6 * time.Hour),
+			To:         time.Now(),
+		})
+		if err != nil {
+			logger.Fatalf(err.Error())
+		}
+		tracker.LoadHistory(id, candles)
+	}
+
+	// далее обновляем индикаторы свечами из стрима, незавершенная свеча обновляется на месте
+	MDClient := client.NewMarketDataStreamClient()
+	stream, err := MDClient.MarketDataStream()
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	candles, err := stream.SubscribeCandle(ids, pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE, false)
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+
+	go func() {
+		if err := stream.Listen(); err != nil {
+			logger.Errorf(err.Error())
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			stream.Stop()
+			return
+		case candle, ok := <-candles:
+			if !ok {
+				return
+			}
+			// в истории ключ - figi, поэтому обновляем по figi
+			tracker.Update(candle.GetFigi(), indicators.BarFromCandle(candle))
+			sma, _ := tracker.Value(candle.GetFigi(), "sma")
+			rsi, _ := tracker.Value(candle.GetFigi(), "rsi")
+			tracker.Do(candle.GetFigi(), func(set indicators.Set) {
+				macd := set["macd"].(*indicators.MACD)
+				logger.Infof("%v close = %v sma = %.4f rsi = %.2f macd histogram = %.4f", candle.GetFigi(),
+					candle.GetClose().ToFloat(), sma, rsi, macd.Histogram())
+			})
+		}
+	}
+}
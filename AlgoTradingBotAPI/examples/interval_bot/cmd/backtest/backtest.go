@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -9,7 +11,6 @@ import (
 	"os/signal"
 	"runtime"
 	"sort"
-	"strings"
 	"syscall"
 	"time"
 
@@ -17,100 +18,136 @@ import (
 	"github.com/sourcegraph/conc/pool"
 	"github.com/tinkoff/invest-api-go-sdk/examples/interval_bot/internal/bot"
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-// DISABLE_INFO_LOGS - Отключение подробных сообщений о сделках по инструментам
-const DISABLE_INFO_LOGS = true
+// disableInfoLogs - Отключение подробных сообщений о сделках по инструментам, вместо них показывается прогресс
+var disableInfoLogs bool
 
-// Параметры для изменения конфигурации бектеста
-var (
-	// Интервал для проверки
-	initDate = time.Date(2023, 5, 22, 0, 0, 0, 0, time.Local)
-	stopDate = time.Date(2023, 7, 22, 0, 0, 0, 0, time.Local)
-	// Критерий для отбора бумаг. Акции, фонды, акции и фонды
-	selection = SHARES_AND_ETFS
-	// Режим запуска теста, на одном конфиге или перебор сгенерированных конфигов
-	mode = TEST_WITH_CONFIG
-	// Конфигурация стратегии, остальные поля заполняются из конфига бектеста
-	intervalConfig = bot.IntervalStrategyConfig{
-		PreferredPositionPrice: 1000,
-		MaxPositionPrice:       5000,
-		TopInstrumentsQuantity: 10,
-		SellOut:                true,
-		StorageDBPath:          "candles/candles.db",
-		StorageCandleInterval:  pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
-		StorageFromTime:        time.Now().Add(-time.Hour * 24 * 180),
-		StorageUpdate:          false,
-	}
-	// Конфиг бектеста для режима TEST_WITH_CONFIG
-	configToTest = bot.BacktestConfig{
-		Analyse:                 bot.BEST_WIDTH,
-		LowPercentile:           0,
-		HighPercentile:          0,
-		MinProfit:               0.3,
-		DaysToCalculateInterval: 4,
-		StopLoss:                1.8,
-		// Для тарифа "Трейдер" комиссия за сделку с акцией составляет 0.05% от стоимости сделки
-		Commission: 0.05,
-	}
-	// Границы параметров конфига бектеста для генерации
-	stopLossMin = 1.0
-	stopLossMax = 2.0
-
-	daysToCalculateMin = 1
-	daysToCalculateMax = 5
-
-	minProfitMin = 0.2
-	minProfitMax = 0.8
-
-	percentileMin = 25.0
-	percentileMax = 30.0
-)
-
-// InstrumentsSelection - Типы инструментов для отбора
-type InstrumentsSelection int
-
-const (
-	// SHARES - Акции
-	SHARES InstrumentsSelection = iota
-	// ETFS - Фонды
-	ETFS
-	// SHARES_AND_ETFS - Акции и фонды
-	SHARES_AND_ETFS
-)
-
-// RunMode - Режим запуска бектеста
-type RunMode int
-
-const (
-	// TEST_WITH_CONFIG - Запуск бектеста на одном конфиге configToTest
-	TEST_WITH_CONFIG RunMode = iota
-	// TEST_WITH_MULTIPLE_CONFIGS - Запуск генерации конфигов полным перебором и проверка их всех
-	TEST_WITH_MULTIPLE_CONFIGS
-)
-
-const (
-	// INSTRUMENTS_MAX - Максимальное кол-во инструментов
-	INSTRUMENTS_MAX = 300
-	// EXCHANGE - Биржа на которой будет работать бот
-	EXCHANGE = "MOEX"
-	// CURRENCY - Валюта для работы бота
-	CURRENCY = "RUB"
-)
+// defaultConfig - Конфигурация бектеста по умолчанию, ее можно изменить yaml файлом стратегии (--config) и флагами,
+// итоговую конфигурацию выводит --print-config
+func defaultConfig() bot.Config {
+	return bot.Config{
+		// Критерий для отбора бумаг. Акции, фонды, акции и фонды
+		Instruments: bot.InstrumentsConfig{
+			Selection:      bot.SHARES_AND_ETFS,
+			ShareExchanges: []string{"MOEX"},
+			EtfExchanges:   []string{"MOEX"},
+			Currency:       "RUB",
+			Max:            300,
+		},
+		// Конфигурация стратегии, параметры анализа заполняются из конфига бектеста
+		Strategy: bot.IntervalStrategyConfig{
+			PreferredPositionPrice: 1000,
+			MaxPositionPrice:       5000,
+			TopInstrumentsQuantity: 10,
+			SellOut:                true,
+			StorageDBPath:          "candles/candles.db",
+			StorageCandleInterval:  pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			StorageFromTime:        time.Now().Add(-time.Hour * 24 * 180),
+			StorageUpdate:          false,
+			StorageAdjust:          true,
+		},
+		Backtest: bot.BacktestRunConfig{
+			// Интервал для проверки
+			From: bot.Date{Time: time.Date(2023, 5, 22, 0, 0, 0, 0, time.Local)},
+			To:   bot.Date{Time: time.Date(2023, 7, 22, 0, 0, 0, 0, time.Local)},
+			// Режим запуска теста, на одном конфиге, перебор сгенерированных конфигов или оптимизация
+			Mode: bot.TEST_WITH_CONFIG,
+			// Конфиг бектеста для режимов TEST_WITH_CONFIG и OPTIMIZE
+			Config: bot.BacktestConfig{
+				Analyse:                 bot.BEST_WIDTH,
+				LowPercentile:           0,
+				HighPercentile:          0,
+				MinProfit:               0.3,
+				DaysToCalculateInterval: 4,
+				StopLoss:                1.8,
+				// Для тарифа "Трейдер" комиссия за сделку с акцией составляет 0.05% от стоимости сделки
+				Commission: 0.05,
+			},
+			// Каталог для отчетов: html, json и csv со сделками и кривой капитала
+			ReportDir: "backtest_report",
+			// Границы параметров конфига бектеста для генерации в режиме TEST_WITH_MULTIPLE_CONFIGS
+			MultipleConfigs: bot.MultipleConfigsConfig{
+				StopLossMin:   1,
+				StopLossMax:   2,
+				DaysMin:       1,
+				DaysMax:       5,
+				MinProfitMin:  0.2,
+				MinProfitMax:  0.8,
+				PercentileMin: 25,
+				PercentileMax: 30,
+			},
+			Optimize: bot.OptimizeConfig{
+				Params: []bot.ParamConfig{
+					{Name: "Analyse", Values: []any{bot.BEST_WIDTH.String(), bot.MATH_STAT.String()}},
+					{Name: "StopLoss", Min: 1, Max: 2, Step: 0.2},
+					{Name: "DaysToCalculateInterval", Min: 1, Max: 4, Step: 1},
+					{Name: "MinProfit", Min: 0.2, Max: 0.8, Step: 0.1},
+					{Name: "LowPercentile", Min: 25, Max: 30, Step: 1},
+				},
+				Search:    backtest.SEARCH_HALVING,
+				Metric:    backtest.METRIC_SHARPE,
+				MinTrades: 20,
+				TrainDays: 30,
+				TestDays:  10,
+			},
+			Portfolio: bot.PortfolioConfig{
+				InitialCash: 100000,
+				Leverage:    1,
+				MarginRate:  18,
+				MarginCall:  25,
+			},
+			// Перевыборка сделок и проскальзывание 0.02% +- 0.02% на вход и выход
+			MonteCarlo: backtest.MonteCarloConfig{
+				Runs:       1000,
+				Resampling: backtest.RESAMPLE_BOOTSTRAP,
+				Slippage: backtest.SlippageModel{
+					Distribution: backtest.DIST_NORMAL,
+					Mean:         0.02,
+					Spread:       0.02,
+				},
+				Confidence:   0.95,
+				RuinDrawdown: 20,
+			},
+		},
+		DisableInfoLogs: true,
+	}
+}
 
 // Report - Отчет о тесте на конкретном конфиге
 type Report struct {
 	bc                      bot.BacktestConfig
 	totalProfit             float64
 	averageDayPercentProfit float64
+	// trades - Сделки за все дни теста
+	trades []backtest.Trade
+	// requiredMoney - Максимальная за день сумма для открытия позиций, начальный капитал для аналитики
+	requiredMoney float64
 }
 
 func main() {
+	config, opts, err := bot.LoadConfig(bot.CMD_BACKTEST, defaultConfig(), os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if opts.PrintConfig {
+		if err := config.WriteYAML(os.Stdout); err != nil {
+			log.Fatalf(err.Error())
+		}
+		return
+	}
+	disableInfoLogs = config.DisableInfoLogs
+	intervalConfig := config.Strategy
+	initDate, stopDate := config.Backtest.From.Time, config.Backtest.To.Time
 	// загружаем конфигурацию для сдк из .yaml файла
-	sdkConfig, err := investgo.LoadConfig("config.yaml")
+	sdkConfig, err := investgo.LoadConfig(opts.SDKConfigPath)
 	if err != nil {
 		log.Fatalf("config loading error %v", err.Error())
 	}
@@ -132,7 +169,7 @@ func main() {
 	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
 	zapConfig.EncoderConfig.TimeKey = "time"
 	// оставляем только сообщения об ошибках
-	if DISABLE_INFO_LOGS {
+	if disableInfoLogs {
 		zapConfig.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
 	}
 	l, err := zapConfig.Build()
@@ -160,71 +197,12 @@ func main() {
 		}
 	}()
 
-	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов,
-	// которыми предстоит торговать
-	// слайс идентификаторов торговых инструментов instrument_uid
-	instrumentIds := make([]string, 0, 300)
-	// instrumentIds := []string{"9654c2dd-6993-427e-80fa-04e80a1cf4da"}
+	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов
+	// instrument_uid по отбору из конфигурации
 	instrumentsService := client.NewInstrumentsServiceClient()
-	// получаем список фондов доступных для торговли через investAPI
-	etfsResp, err := instrumentsService.Etfs(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые фонды с московской биржи
-	etfs := etfsResp.GetInstruments()
-	// получаем список акций доступных для торговли через investAPI
-	sharesResp, err := instrumentsService.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+	instrumentIds, err := config.Instruments.Select(instrumentsService)
 	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые акции c московской биржи
-	shares := sharesResp.GetInstruments()
-
-	switch selection {
-	case SHARES:
-		for _, share := range shares {
-			if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-				break
-			}
-			exchange := strings.EqualFold(share.GetExchange(), EXCHANGE)
-			currency := strings.EqualFold(share.GetCurrency(), CURRENCY)
-			if exchange && currency && !share.GetForQualInvestorFlag() {
-				instrumentIds = append(instrumentIds, share.GetUid())
-			}
-		}
-	case ETFS:
-		for _, etf := range etfs {
-			if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-				break
-			}
-			exchange := strings.EqualFold(etf.GetExchange(), EXCHANGE)
-			currency := strings.EqualFold(etf.GetCurrency(), CURRENCY)
-			if exchange && currency {
-				instrumentIds = append(instrumentIds, etf.GetUid())
-			}
-		}
-	case SHARES_AND_ETFS:
-		for _, share := range shares {
-			if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-				break
-			}
-			exchange := strings.EqualFold(share.GetExchange(), EXCHANGE)
-			currency := strings.EqualFold(share.GetCurrency(), CURRENCY)
-			if exchange && currency && !share.GetForQualInvestorFlag() {
-				instrumentIds = append(instrumentIds, share.GetUid())
-			}
-		}
-		for _, etf := range etfs {
-			if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-				break
-			}
-			exchange := strings.EqualFold(etf.GetExchange(), EXCHANGE)
-			currency := strings.EqualFold(etf.GetCurrency(), CURRENCY)
-			if exchange && currency {
-				instrumentIds = append(instrumentIds, etf.GetUid())
-			}
-		}
+		logger.Fatalf(err.Error())
 	}
 	fmt.Println("Start backtest...")
 	logger.Infof("got %v instruments", len(instrumentIds))
@@ -256,6 +234,7 @@ func main() {
 			Ticker:          resp.GetInstrument().GetTicker(),
 			MinPriceInc:     resp.GetInstrument().GetMinPriceIncrement(),
 			StopLossPercent: intervalConfig.StopLossPercent,
+			ShortEnabled:    resp.GetInstrument().GetShortEnabledFlag(),
 		}
 		instrumentsForStorage[instrument] = bot.StorageInstrument{
 			CandleInterval: intervalConfig.StorageCandleInterval,
@@ -304,6 +283,8 @@ func main() {
 		RequiredInstruments: instrumentsForStorage,
 		Logger:              client.Logger,
 		MarketDataService:   marketDataService,
+		Adjust:              intervalConfig.StorageAdjust,
+		InstrumentsService:  instrumentsService,
 		From:                initDate,
 		To:                  stopDate,
 	})
@@ -311,42 +292,110 @@ func main() {
 		cancel()
 		logger.Fatalf(err.Error())
 	}
-	executor := bot.NewExecutor(ctx, client, instrumentsForExecutor)
+	executor := bot.NewExecutor(ctx, client, instrumentsForExecutor, nil, nil)
 	// создание интервального бота
 	intervalBot, err := bot.NewBot(ctx, client, storage, executor, intervalConfig)
 	if err != nil {
 		logger.Fatalf("interval bot creating fail %v", err.Error())
 	}
 	// выбираем режим запуска
-	switch mode {
-	case TEST_WITH_CONFIG:
-		TestWithConfig(ctx, intervalBot, logger, initDate, stopDate, configToTest)
-	case TEST_WITH_MULTIPLE_CONFIGS:
-		TestWithMultipleConfigs(ctx, intervalBot, logger, initDate, stopDate)
+	switch config.Backtest.Mode {
+	case bot.TEST_WITH_CONFIG:
+		TestWithConfig(ctx, intervalBot, logger, config.Backtest)
+	case bot.TEST_WITH_MULTIPLE_CONFIGS:
+		TestWithMultipleConfigs(ctx, intervalBot, logger, initDate, stopDate, config.Backtest)
+	case bot.OPTIMIZE:
+		Optimize(ctx, intervalBot, logger, config.Backtest)
+	case bot.PORTFOLIO:
+		TestPortfolio(intervalBot, logger, config.Backtest)
 	}
 }
 
-// TestWithConfig - Проверка на одном конфиге
-func TestWithConfig(ctx context.Context, b *bot.Bot, logger investgo.Logger, start, stop time.Time, config bot.BacktestConfig) {
-	r, err := testConfigWithBar(ctx, b, start, stop, config)
+// TestWithConfig - Проверка на одном конфиге c.Config
+func TestWithConfig(ctx context.Context, b *bot.Bot, logger investgo.Logger, c bot.BacktestRunConfig) {
+	r, err := testConfigWithBar(ctx, b, c.From.Time, c.To.Time, c.Config)
 	if err != nil {
 		logger.Errorf(err.Error())
 	}
 	fmt.Printf("total profit = %.3f\naverage day profit in percent = %.3f\n", r.totalProfit, r.averageDayPercentProfit)
+	// подробная аналитика по сделкам: просадки, Sharpe/Sortino, profit factor и т.д.
+	analytics := backtest.AnalyzeTrades(r.trades, r.requiredMoney)
+	m := analytics.Metrics
+	fmt.Printf("trades = %v\nwin rate = %.2f%%\nprofit factor = %.2f\nmax drawdown = %.2f%%\nsharpe = %.2f\nsortino = %.2f\n",
+		m.Trades, m.WinRate, m.ProfitFactor, m.MaxDrawdownPercent, m.Sharpe, m.Sortino)
+	if err := analytics.Save(c.ReportDir, "Interval bot backtest"); err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	fmt.Printf("report saved to %v\n", c.ReportDir)
+	monteCarlo(logger, c, r.trades, r.requiredMoney)
 }
 
-// TestWithMultipleConfigs - Генерация мнодетсва конфигов и проверка на них
-func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Logger, start, stop time.Time) {
+// TestPortfolio - Проверка на одном конфиге c.Config с общим денежным балансом c.Portfolio на весь период
+func TestPortfolio(b *bot.Bot, logger investgo.Logger, c bot.BacktestRunConfig) {
+	r, err := b.PortfolioBackTest(c.From.Time, c.To.Time, c.Config, c.Portfolio)
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	m := r.Report.Metrics
+	fmt.Printf("net profit = %.3f\nreturn = %.3f%%\ntrades = %v\nwin rate = %.2f%%\nprofit factor = %.2f\n"+
+		"max drawdown = %.2f%%\nsharpe = %.2f\nsortino = %.2f\ncommission = %.3f\n",
+		m.NetProfit, m.ReturnPercent, m.Trades, m.WinRate, m.ProfitFactor, m.MaxDrawdownPercent, m.Sharpe, m.Sortino,
+		m.Commission)
+	fmt.Printf("rejected entries = %v\nmax open positions = %v\nmax exposure = %.3f\nmargin calls = %v\n"+
+		"margin interest = %.3f\nopen positions at the end = %v\n",
+		r.Rejected, r.MaxOpenPositions, r.MaxExposure, r.MarginCalls, r.MarginInterest, r.OpenPositions)
+	if err := r.Report.Save(c.ReportDir, "Interval bot portfolio backtest"); err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	fmt.Printf("report saved to %v\n", c.ReportDir)
+	monteCarlo(logger, c, r.Report.Trades, c.Portfolio.InitialCash)
+}
+
+// monteCarlo - Анализ Монте-Карло по журналу сделок, результат сохраняется в каталог отчета
+func monteCarlo(logger investgo.Logger, c bot.BacktestRunConfig, trades []backtest.Trade, initial float64) {
+	if c.MonteCarlo.Runs == 0 || len(trades) == 0 {
+		return
+	}
+	mc, err := backtest.MonteCarlo(trades, initial, c.MonteCarlo)
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	fmt.Printf("\nmonte carlo, %v runs, %v resampling, %.0f%% confidence intervals:\n", mc.Runs, mc.Resampling,
+		mc.Confidence*100)
+	for _, e := range []struct {
+		name string
+		e    backtest.Estimate
+	}{
+		{"net profit", mc.NetProfit},
+		{"return, %", mc.Return},
+		{"max drawdown, %", mc.Drawdown},
+	} {
+		fmt.Printf("%v: median = %.3f, interval = [%.3f, %.3f], worst = %.3f\n", e.name, e.e.Median, e.e.Low, e.e.High,
+			e.e.Worst)
+	}
+	fmt.Printf("probability of loss = %.2f%%\nprobability of ruin = %.2f%%\n", mc.ProbabilityOfLoss, mc.ProbabilityOfRuin)
+	if err := mc.Save(c.ReportDir); err != nil {
+		logger.Errorf(err.Error())
+	}
+}
+
+// TestWithMultipleConfigs - Генерация мнодетсва конфигов в границах rc.MultipleConfigs и проверка на них
+func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Logger, start, stop time.Time, rc bot.BacktestRunConfig) {
+	bounds := rc.MultipleConfigs
 	// слайс конфигов для бекстеста
 	bc := make([]bot.BacktestConfig, 0)
 	// начальные значения для стоп-лосса в процентах и кол-ва дней для расчета интервала
-	stopLoss := stopLossMin
+	stopLoss := bounds.StopLossMin
 	// простым перебором генерируем конфиги с разными значениями
-	for stopLoss < stopLossMax {
-		daysToCalculate := daysToCalculateMin
-		for daysToCalculate < daysToCalculateMax {
-			minProfit := minProfitMin
-			for minProfit < minProfitMax {
+	for stopLoss < bounds.StopLossMax {
+		daysToCalculate := bounds.DaysMin
+		for daysToCalculate < bounds.DaysMax {
+			minProfit := bounds.MinProfitMin
+			for minProfit < bounds.MinProfitMax {
 				bc = append(bc, bot.BacktestConfig{
 					Analyse:                 bot.BEST_WIDTH,
 					LowPercentile:           0,
@@ -354,11 +403,11 @@ func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Lo
 					MinProfit:               minProfit,
 					StopLoss:                stopLoss,
 					DaysToCalculateInterval: daysToCalculate,
-					Commission:              0.05,
+					Commission:              rc.Config.Commission,
 				})
 
-				tempPerc := percentileMin
-				for tempPerc < percentileMax {
+				tempPerc := bounds.PercentileMin
+				for tempPerc < bounds.PercentileMax {
 					bc = append(bc, bot.BacktestConfig{
 						Analyse:                 bot.MATH_STAT,
 						LowPercentile:           math.Round(tempPerc),
@@ -366,7 +415,7 @@ func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Lo
 						MinProfit:               minProfit,
 						StopLoss:                stopLoss,
 						DaysToCalculateInterval: daysToCalculate,
-						Commission:              0.05,
+						Commission:              rc.Config.Commission,
 					})
 					tempPerc += 1
 				}
@@ -377,7 +426,7 @@ func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Lo
 		stopLoss += 0.1
 	}
 	bar := &progressbar.ProgressBar{}
-	if DISABLE_INFO_LOGS {
+	if disableInfoLogs {
 		bar = progressbar.Default(int64(len(bc)), "test all configs")
 	}
 	// Запускаем параллельно проверку всех конфигов, которые получили выше
@@ -385,9 +434,9 @@ func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Lo
 	for _, config := range bc {
 		c := config
 		rp.Go(func(ctx context.Context) (Report, error) {
-			return testConfig(ctx, b, start, stop, c)
+			return testConfig(ctx, b.Copy(), start, stop, c)
 		})
-		if DISABLE_INFO_LOGS {
+		if disableInfoLogs {
 			err := bar.Add(1)
 			if err != nil {
 				b.Client.Logger.Errorf(err.Error())
@@ -413,14 +462,98 @@ func TestWithMultipleConfigs(ctx context.Context, b *bot.Bot, logger investgo.Lo
 	}
 }
 
+// Optimize - Подбор параметров на скользящих окнах и проверка лучшего конфига на следующем за окном периоде
+func Optimize(ctx context.Context, b *bot.Bot, logger investgo.Logger, c bot.BacktestRunConfig) {
+	o := c.Optimize
+	params := make([]backtest.Param, 0, len(o.Params))
+	for _, p := range o.Params {
+		params = append(params, p.Param())
+	}
+	splits := backtest.WalkForward(c.From.Time, c.To.Time, time.Duration(o.TrainDays)*investgo.DAY,
+		time.Duration(o.TestDays)*investgo.DAY, o.Anchored)
+	bar := &progressbar.ProgressBar{}
+	if disableInfoLogs {
+		bar = progressbar.Default(-1, "optimize")
+	}
+	// бот считает каждый день отдельно и закрывает позиции в конце дня, поэтому дни кешируются по отдельности
+	optimizer, err := backtest.NewOptimizer(backtest.OptimizerConfig{
+		Params:    params,
+		Search:    o.Search,
+		Samples:   o.Samples,
+		Metric:    o.Metric,
+		MinTrades: o.MinTrades,
+		Splits:    splits,
+		Chunk:     investgo.DAY,
+		Progress: func() {
+			if disableInfoLogs {
+				if err := bar.Add(1); err != nil {
+					logger.Errorf(err.Error())
+				}
+			}
+		},
+		Logger: logger,
+	}, evaluateConfig(b, c.Config))
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	result, err := optimizer.Run(ctx)
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	fmt.Printf("\nevaluations = %v, from cache = %v\n\n", result.Evaluations, result.CacheHits)
+	for i, s := range result.Splits {
+		fmt.Printf("split %v:\ntrain = %v - %v\ntest = %v - %v\nbest config = %v\ntrain %v = %.3f, return = %.3f%%, trades = %v\n"+
+			"test %v = %.3f, return = %.3f%%, trades = %v\n\n",
+			i, s.Split.TrainStart.Format(time.DateOnly), s.Split.TrainEnd.Format(time.DateOnly),
+			s.Split.TestStart.Format(time.DateOnly), s.Split.TestEnd.Format(time.DateOnly), s.Best.Params,
+			o.Metric, s.Best.Score, s.Best.Metrics.ReturnPercent, s.Best.Metrics.Trades,
+			o.Metric, s.TestScore, s.Test.Metrics.ReturnPercent, s.Test.Metrics.Trades)
+	}
+	m := result.OutOfSample.Metrics
+	fmt.Printf("out of sample:\nreturn = %.3f%%\ntrades = %v\nwin rate = %.2f%%\nmax drawdown = %.2f%%\nsharpe = %.2f\n"+
+		"walk-forward efficiency = %.2f\n", m.ReturnPercent, m.Trades, m.WinRate, m.MaxDrawdownPercent, m.Sharpe, result.Efficiency)
+	if err := result.OutOfSample.Save(c.ReportDir, "Interval bot walk-forward out of sample"); err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
+	fmt.Printf("report saved to %v\n", c.ReportDir)
+}
+
+// evaluateConfig - Проверка значений параметров оптимизации на периоде, base - значения остальных полей конфига
+func evaluateConfig(b *bot.Bot, base bot.BacktestConfig) backtest.EvaluateFunc {
+	return func(ctx context.Context, p backtest.Params, from, to time.Time) (*backtest.Report, error) {
+		config := base
+		if err := p.Apply(&config); err != nil {
+			return nil, err
+		}
+		_, low := p["LowPercentile"]
+		_, high := p["HighPercentile"]
+		if low && !high {
+			config.HighPercentile = 100 - config.LowPercentile
+		}
+		// в выходные торгов нет, а хранилище вернет ошибку при отсутствии свечей
+		if wd := from.Weekday(); to.Sub(from) <= investgo.DAY && (wd == time.Saturday || wd == time.Sunday) {
+			return backtest.AnalyzeTrades(nil, 0), nil
+		}
+		r, err := testConfig(ctx, b.Copy(), from, to, config)
+		if err != nil {
+			return nil, err
+		}
+		return backtest.AnalyzeTrades(r.trades, r.requiredMoney), nil
+	}
+}
+
 // testConfig - Бектест для конфига на времени start-stop
 func testConfig(ctx context.Context, b *bot.Bot, start, stop time.Time, config bot.BacktestConfig) (Report, error) {
 	initDate := start
 	stopDate := stop
 
 	date := initDate
-	var totalPercentage, totalProfit float64
+	var totalPercentage, totalProfit, requiredMoney float64
 	var tradingDays int
+	trades := make([]backtest.Trade, 0)
 
 	var done bool
 	for date.Before(stopDate) && !done {
@@ -428,12 +561,14 @@ func testConfig(ctx context.Context, b *bot.Bot, start, stop time.Time, config b
 		case <-ctx.Done():
 			done = true
 		default:
-			profit, percentage, err := b.BackTest(date, config)
+			result, err := b.BackTest(date, config)
 			if err != nil {
 				return Report{}, err
 			}
-			totalPercentage += percentage
-			totalProfit += profit
+			totalPercentage += result.Percent
+			totalProfit += result.Profit
+			trades = append(trades, result.Trades...)
+			requiredMoney = math.Max(requiredMoney, result.RequiredMoney)
 			if totalProfit != 0 {
 				tradingDays++
 			}
@@ -449,6 +584,8 @@ func testConfig(ctx context.Context, b *bot.Bot, start, stop time.Time, config b
 		bc:                      config,
 		totalProfit:             totalProfit,
 		averageDayPercentProfit: ap,
+		trades:                  trades,
+		requiredMoney:           requiredMoney,
 	}, nil
 }
 
@@ -458,11 +595,12 @@ func testConfigWithBar(ctx context.Context, b *bot.Bot, start, stop time.Time, c
 	stopDate := stop
 
 	date := initDate
-	var totalPercentage, totalProfit float64
+	var totalPercentage, totalProfit, requiredMoney float64
 	var tradingDays int
+	trades := make([]backtest.Trade, 0)
 
 	bar := &progressbar.ProgressBar{}
-	if DISABLE_INFO_LOGS {
+	if disableInfoLogs {
 		dur := int64(stopDate.Sub(initDate).Hours())
 		bar = progressbar.Default(dur, "backtest")
 	}
@@ -473,16 +611,18 @@ func testConfigWithBar(ctx context.Context, b *bot.Bot, start, stop time.Time, c
 		case <-ctx.Done():
 			done = true
 		default:
-			profit, percentage, err := b.BackTest(date, config)
+			result, err := b.BackTest(date, config)
 			if err != nil {
 				return Report{}, err
 			}
-			totalPercentage += percentage
-			totalProfit += profit
+			totalPercentage += result.Percent
+			totalProfit += result.Profit
+			trades = append(trades, result.Trades...)
+			requiredMoney = math.Max(requiredMoney, result.RequiredMoney)
 			if totalProfit != 0 {
 				tradingDays++
 			}
-			if DISABLE_INFO_LOGS {
+			if disableInfoLogs {
 				err = bar.Add(24)
 				if err != nil {
 					b.Client.Logger.Errorf(err.Error())
@@ -500,5 +640,7 @@ func testConfigWithBar(ctx context.Context, b *bot.Bot, start, stop time.Time, c
 		bc:                      config,
 		totalProfit:             totalProfit,
 		averageDayPercentProfit: ap,
+		trades:                  trades,
+		requiredMoney:           requiredMoney,
 	}, nil
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/storage"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Параметры для изменения конфигурации проверки свечей
+var (
+	// FROM, TO - Проверяемый период
+	FROM = time.Now().Add(-time.Hour * 24 * 5)
+	TO   = time.Now()
+	// INTERVAL - Интервал проверяемых свечей
+	INTERVAL = pb.CandleInterval_CANDLE_INTERVAL_1_MIN
+)
+
+const (
+	// EXCHANGE - Биржа, по расписанию которой проверяются свечи
+	EXCHANGE = "MOEX"
+	// DB_PATH - Путь к базе данных sqlite
+	DB_PATH = "candles/candles.db"
+	// REPAIR - Если true, то пропущенные интервалы будут запрошены повторно
+	REPAIR = true
+)
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	sdkConfig, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	sigs := make(chan os.Signal, 1)
+	defer close(sigs)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	client, err := investgo.NewClient(ctx, sdkConfig, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	db, err := storage.NewCandlesStorage(DB_PATH, logger)
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Errorf(err.Error())
+		}
+	}()
+	// проверяем все инструменты, история которых есть в хранилище
+	updates, err := db.Updates(INTERVAL)
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	instrumentIds := make([]string, 0, len(updates))
+	for id := range updates {
+		instrumentIds = append(instrumentIds, id)
+	}
+
+	reports, err := db.Check(client.NewInstrumentsServiceClient(), storage.CheckRequest{
+		Instruments: instrumentIds,
+		Exchange:    EXCHANGE,
+		Interval:    INTERVAL,
+		From:        FROM,
+		To:          TO,
+	})
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+
+	mds := client.NewMarketDataServiceClient()
+	for _, report := range reports {
+		fmt.Println(report.String())
+		if report.Ok() || !REPAIR {
+			continue
+		}
+		restored, err := db.Repair(ctx, mds, report)
+		if err != nil {
+			logger.Errorf(err.Error())
+			return
+		}
+		fmt.Printf("%v restored %v/%v missing candles\n", report.InstrumentUid, restored, report.MissingCandles())
+	}
+}
@@ -3,49 +3,60 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/mattn/go-sqlite3"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/schollz/progressbar/v3"
+	"github.com/tinkoff/invest-api-go-sdk/examples/interval_bot/internal/bot"
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/storage"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-// Параметры для изменения конфигурации загрузчика свечей
-var (
-	// FROM - Стартовое время для загрузки свечей
-	// FROM = time.Date(2023, 1, 10, 0, 0, 0, 0, time.Local)
-	// Последние 180 суток
-	FROM = time.Now().Add(-time.Hour * 24 * 5)
-	// INTERVAL - Интервал для запроса свечей
-	INTERVAL = pb.CandleInterval_CANDLE_INTERVAL_1_MIN
-)
-
-const (
-	// INSTRUMENTS_MAX - Максимальное кол-во инструментов
-	INSTRUMENTS_MAX = 500
-	// EXCHANGE - Биржа на которой будет работать бот
-	EXCHANGE = "MOEX_PLUS"
-	// CURRENCY - Валюта для работы бота
-	CURRENCY = "RUB"
-	// DB_PATH - Путь к базе данных sqlite
-	DB_PATH = "candles/candles.db"
-	// DISABLE_INFO_LOGS - Отключение информационных сообщений
-	DISABLE_INFO_LOGS = true
-)
+// defaultConfig - Конфигурация загрузчика по умолчанию, ее можно изменить yaml файлом стратегии (--config) и флагами,
+// итоговую конфигурацию выводит --print-config
+func defaultConfig() bot.Config {
+	return bot.Config{
+		Instruments: bot.InstrumentsConfig{
+			Selection:       bot.SHARES_AND_ETFS,
+			ShareExchanges:  []string{"SPB", "SPB_MORNING", "MOEX_EVENING_WEEKEND", "MOEX_PLUS"},
+			EtfExchanges:    []string{"MOEX_PLUS"},
+			Currency:        "RUB",
+			ForQualInvestor: true,
+			Max:             500,
+		},
+		Strategy: bot.IntervalStrategyConfig{
+			StorageDBPath:         "candles/candles.db",
+			StorageCandleInterval: pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+		},
+		// последние 5 суток
+		Download:        bot.DownloadConfig{From: bot.Date{Time: time.Now().Add(-time.Hour * 24 * 5)}},
+		DisableInfoLogs: true,
+	}
+}
 
 func main() {
+	config, opts, err := bot.LoadConfig(bot.CMD_DOWNLOADER, defaultConfig(), os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if opts.PrintConfig {
+		if err := config.WriteYAML(os.Stdout); err != nil {
+			log.Fatalf(err.Error())
+		}
+		return
+	}
 	// загружаем конфигурацию для сдк из .yaml файла
-	sdkConfig, err := investgo.LoadConfig("config.yaml")
+	sdkConfig, err := investgo.LoadConfig(opts.SDKConfigPath)
 	if err != nil {
 		log.Fatalf("config loading error %v", err.Error())
 	}
@@ -66,7 +77,7 @@ func main() {
 	zapConfig := zap.NewDevelopmentConfig()
 	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
 	zapConfig.EncoderConfig.TimeKey = "time"
-	if DISABLE_INFO_LOGS {
+	if config.DisableInfoLogs {
 		zapConfig.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
 	}
 	l, err := zapConfig.Build()
@@ -94,50 +105,15 @@ func main() {
 		}
 	}()
 
-	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов,
-	// которыми предстоит торговать
-	// слайс идентификаторов торговых инструментов instrument_uid
-	instrumentIds := make([]string, 0, 300)
-	// instrumentIds := []string{"9654c2dd-6993-427e-80fa-04e80a1cf4da"}
-	insrtumentsService := client.NewInstrumentsServiceClient()
-	// получаем список фондов доступных для торговли через investAPI
-	etfsResp, err := insrtumentsService.Etfs(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые фонды с московской биржи
-	etfs := etfsResp.GetInstruments()
-	// получаем список акций доступных для торговли через investAPI
-	sharesResp, err := insrtumentsService.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+	// получаем список идентификаторов инструментов instrument_uid, для которых нужно загрузить свечи,
+	// по отбору из конфигурации
+	instrumentIds, err := config.Instruments.Select(client.NewInstrumentsServiceClient())
 	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые акции c московской биржи
-	shares := sharesResp.GetInstruments()
-
-	for _, share := range shares {
-		if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		//exchange := strings.EqualFold(share.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(share.GetCurrency(), CURRENCY)
-		if (share.Exchange == "SPB" || share.Exchange == "SPB_MORNING" || share.Exchange == "MOEX_EVENING_WEEKEND" || share.Exchange == "MOEX_PLUS") && currency {
-			instrumentIds = append(instrumentIds, share.GetUid())
-		}
-	}
-	for _, etf := range etfs {
-		if len(instrumentIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		exchange := strings.EqualFold(etf.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(etf.GetCurrency(), CURRENCY)
-		if exchange && currency {
-			instrumentIds = append(instrumentIds, etf.GetUid())
-		}
+		logger.Fatalf(err.Error())
 	}
 	logger.Infof("got %v instruments", len(instrumentIds))
-	// инициализируем sqlite для сохранения исторических свечей по инструментам
-	db, err := initDB(DB_PATH)
+	// открываем хранилище исторических свечей, старый candles.db будет смигрирован на новую схему
+	db, err := storage.NewCandlesStorage(config.Strategy.StorageDBPath, logger)
 	if err != nil {
 		logger.Fatalf(err.Error())
 	}
@@ -146,128 +122,26 @@ func main() {
 			logger.Errorf(err.Error())
 		}
 	}()
-	// прогресс бар для загрузки
-	bar := progressbar.Default(int64(len(instrumentIds)), "downloading candles")
-	// для каждого инструмента запрашиваем свечи и сохраняем в бд
+	// прогресс бар для загрузки, считаем запросы по всем инструментам
+	var bar *progressbar.ProgressBar
+	// загружаем в хранилище только недостающие свечи по инструментам, при прерывании загрузка
+	// продолжится с места остановки
 	mds := client.NewMarketDataServiceClient()
-	now := time.Now()
-	for i, id := range instrumentIds {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			candles, err := mds.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
-				Instrument: id,
-				Interval:   INTERVAL,
-				From:       FROM,
-				To:         now,
-				File:       false,
-				FileName:   "",
-			})
-
-			logger.Infof("got %v candles for %v", len(candles), id)
-
-			err = storeCandlesInDB(db, id, FROM, now, candles)
-			if err != nil {
-				logger.Errorf(err.Error())
+	err = db.Update(ctx, mds, storage.UpdateRequest{
+		Instruments: instrumentIds,
+		Interval:    config.Strategy.StorageCandleInterval,
+		From:        config.Download.From.Time,
+		To:          time.Now(),
+		OnProgress: func(p investgo.DownloadProgress) {
+			if bar == nil {
+				bar = progressbar.Default(int64(p.AllTotal), "downloading candles")
 			}
-			logger.Infof("store in db complete instrument %v/%v", i+1, len(instrumentIds))
-			err = bar.Add(1)
-			if err != nil {
+			if err := bar.Set(p.AllDone); err != nil {
 				logger.Errorf(err.Error())
 			}
-		}
-	}
-}
-
-var schema = `
-create table if not exists candles (
-    id integer primary key autoincrement,
-    instrument_uid text,
-	open real,
-	close real,
-	high real,
-	low real,
-	volume integer,
-	time integer,
-	is_complete integer,
-    unique (instrument_uid, time)
-);
-
-create table if not exists updates (
-	instrument_id text unique,
-	first_time integer,
-	last_time integer
-);
-`
-
-// initDB - Инициализация бд
-func initDB(path string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
-	}
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-	if _, err = db.Exec(schema); err != nil {
-		return nil, err
-	}
-	log.Printf("database initialized")
-	return db, nil
-}
-
-// storeCandlesInDB - Сохранение исторических свечей инструмента в бд
-func storeCandlesInDB(db *sqlx.DB, uid string, first, last time.Time, hc []*pb.HistoricCandle) error {
-	err := func() error {
-		tx, err := db.Begin()
-		if err != nil {
-			return err
-		}
-
-		defer func() {
-			if err = tx.Commit(); err != nil {
-				log.Printf(err.Error())
-			}
-		}()
-
-		insertCandle, err := tx.Prepare(`insert into candles (instrument_uid, open, close, high, low, volume, time, is_complete) 
-		values (?, ?, ?, ?, ?, ?, ?, ?) `)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err := insertCandle.Close(); err != nil {
-				log.Printf(err.Error())
-			}
-		}()
-
-		for _, candle := range hc {
-			_, err := insertCandle.Exec(uid,
-				candle.GetOpen().ToFloat(),
-				candle.GetClose().ToFloat(),
-				candle.GetHigh().ToFloat(),
-				candle.GetLow().ToFloat(),
-				candle.GetVolume(),
-				candle.GetTime().AsTime().Unix(),
-				candle.GetIsComplete())
-			if err != nil {
-				if errors.As(err, &sqlite3.Error{}) {
-					continue
-				} else {
-					return err
-				}
-			}
-		}
-		return nil
-	}()
+		},
+	})
 	if err != nil {
-		return err
-	}
-	// записываем в базу время последнего обновления
-	_, err = db.Exec(`insert or replace into updates(instrument_id, first_time, last_time) values (?, ?, ?)`, uid, first.Unix(), last.Unix())
-	if err != nil {
-		return err
+		logger.Errorf(err.Error())
 	}
-	return nil
 }
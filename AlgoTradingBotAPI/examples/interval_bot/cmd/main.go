@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,58 +20,65 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-// Параметры для изменения конфигурации бота
-var (
-	intervalConfig = bot.IntervalStrategyConfig{
-		PreferredPositionPrice:  400,
-		MaxPositionPrice:        1000,
-		TopInstrumentsQuantity:  5,
-		MinProfit:               0.3,
-		DaysToCalculateInterval: 1,
-		StopLossPercent:         1,
-		AnalyseLowPercentile:    0,
-		AnalyseHighPercentile:   0,
-		Analyse:                 bot.BEST_WIDTH,
-		// Параметры ниже не влияют на успех стратегии
-		IntervalUpdateDelay:   time.Minute * MINUTES,
-		SellOut:               false,
-		StorageDBPath:         "candles/candles.db",
-		StorageCandleInterval: pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
-		StorageFromTime:       time.Now().Add(-time.Hour * 6),
-		StorageUpdate:         true,
+// defaultConfig - Конфигурация бота по умолчанию, ее можно изменить yaml файлом стратегии (--config) и флагами,
+// итоговую конфигурацию выводит --print-config
+func defaultConfig() bot.Config {
+	return bot.Config{
+		Instruments: bot.InstrumentsConfig{
+			Selection:       bot.SHARES,
+			ShareExchanges:  []string{"MOEX_EVENING_WEEKEND", "MOEX_PLUS", "MOEX_EVENING"},
+			EtfExchanges:    []string{"MOEX_PLUS"},
+			Currency:        "RUB",
+			ExcludeTickers:  []string{"POLY"},
+			ForQualInvestor: true,
+			Max:             300,
+		},
+		Strategy: bot.IntervalStrategyConfig{
+			PreferredPositionPrice:  400,
+			MaxPositionPrice:        1000,
+			TopInstrumentsQuantity:  5,
+			MinProfit:               0.3,
+			DaysToCalculateInterval: 1,
+			StopLossPercent:         1,
+			AnalyseLowPercentile:    0,
+			AnalyseHighPercentile:   0,
+			Analyse:                 bot.BEST_WIDTH,
+			// Параметры ниже не влияют на успех стратегии
+			// Интервал обновления исторических свечей для расчета нового коридора цен
+			IntervalUpdateDelay:   time.Minute * 3,
+			SellOut:               false,
+			StorageDBPath:         "candles/candles.db",
+			StorageCandleInterval: pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			StorageFromTime:       time.Now().Add(-time.Hour * 6),
+			StorageUpdate:         true,
+			StorageAdjust:         false,
+		},
+		Bot: bot.RunConfig{
+			// Биржа на которой будет работать бот
+			Exchange: "MOEX_PLUS",
+			// Событие STOP для остановки будет отправлено в канал за CancelAhead до конца торгов
+			CancelAhead: time.Minute * 60,
+		},
 	}
-	// Критерий для отбора бумаг. Акции, фонды, акции и фонды
-	selection = SHARES
-	// cancelAhead - Событие STOP для остановки будет отправлено в канал за cancelAhead до конца торгов
-	cancelAhead = time.Minute * 60
-)
-
-const (
-	// INSTRUMENTS_MAX - Максимальное кол-во инструментов
-	INSTRUMENTS_MAX = 300
-	// EXCHANGE - Биржа на которой будет работать бот
-	EXCHANGE = "MOEX_PLUS"
-	// CURRENCY - Валюта для работы бота
-	CURRENCY = "RUB"
-	// MINUTES - Интервал обновления исторических свечей для расчета нового коридора цен в минутах
-	MINUTES = 3
-)
-
-// InstrumentsSelection - Типы инструментов для отбора
-type InstrumentsSelection int
-
-const (
-	// SHARES - Акции
-	SHARES InstrumentsSelection = iota
-	// ETFS - Фонды
-	ETFS
-	// SHARES_AND_ETFS - Акции и фонды
-	SHARES_AND_ETFS
-)
+}
 
 func main() {
+	config, opts, err := bot.LoadConfig(bot.CMD_BOT, defaultConfig(), os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if opts.PrintConfig {
+		if err := config.WriteYAML(os.Stdout); err != nil {
+			log.Fatalf(err.Error())
+		}
+		return
+	}
+	intervalConfig := config.Strategy
 	// загружаем конфигурацию для сдк из .yaml файла
-	sdkConfig, err := investgo.LoadConfig("config.yaml")
+	sdkConfig, err := investgo.LoadConfig(opts.SDKConfigPath)
 	if err != nil {
 		log.Fatalf("config loading error %v", err.Error())
 	}
@@ -111,62 +119,12 @@ func main() {
 		}
 	}()
 
-	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов,
-	// которыми предстоит торговать
-	// слайс идентификаторов торговых инструментов instrument_uid
-	instrumentIds := make([]string, 0, INSTRUMENTS_MAX)
+	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов
+	// instrument_uid, которыми предстоит торговать, по отбору из конфигурации
 	instrumentsService := client.NewInstrumentsServiceClient()
-	// получаем список фондов доступных для торговли через investAPI
-	etfsResp, err := instrumentsService.Etfs(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+	instrumentIds, err := config.Instruments.Select(instrumentsService)
 	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые фонды с московской биржи
-	etfs := etfsResp.GetInstruments()
-	// получаем список акций доступных для торговли через investAPI
-	sharesResp, err := instrumentsService.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые акции c московской биржи
-	shares := sharesResp.GetInstruments()
-	// результаты отбора фондов и акций по бирже и валюте
-	shareIds := make([]string, 0)
-	etfsIds := make([]string, 0)
-
-	for _, share := range shares {
-		if len(shareIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		//exchange := strings.EqualFold(share.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(share.GetCurrency(), CURRENCY)
-		//if (share.Exchange == "SPB") && currency && share.Ticker != "POLY" && share.Ticker != "TTCF" && share.Ticker != "HSKA" {
-
-		if (share.Exchange == "MOEX_EVENING_WEEKEND" || share.Exchange == "MOEX_PLUS" || share.Exchange == "MOEX_EVENING") && currency && share.Ticker != "POLY" {
-			shareIds = append(shareIds, share.GetUid())
-			//fmt.Printf("[Акции] добавлена %v, uid - %v, FIGI - %v, Биржа - %v \n", share.GetTicker(), share.GetUid(), share.GetFigi(), share.GetExchange())
-		}
-	}
-
-	for _, etf := range etfs {
-		if len(etfsIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		exchange := strings.EqualFold(etf.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(etf.GetCurrency(), CURRENCY)
-		if exchange && currency {
-			etfsIds = append(etfsIds, etf.GetUid())
-		}
-	}
-	// заполняем instrumentIds в зависимости от выбранного selection
-	switch selection {
-	case SHARES:
-		instrumentIds = shareIds
-	case ETFS:
-		instrumentIds = etfsIds
-	case SHARES_AND_ETFS:
-		instrumentIds = append(instrumentIds, shareIds...)
-		instrumentIds = append(instrumentIds, etfsIds...)
+		logger.Fatalf(err.Error())
 	}
 	logger.Infof("got %v instruments", len(instrumentIds))
 
@@ -199,6 +157,7 @@ func main() {
 			Ticker:          resp.GetInstrument().GetTicker(),
 			MinPriceInc:     resp.GetInstrument().GetMinPriceIncrement(),
 			StopLossPercent: intervalConfig.StopLossPercent,
+			ShortEnabled:    resp.GetInstrument().GetShortEnabledFlag(),
 		}
 		instrumentsForStorage[instrument] = bot.StorageInstrument{
 			CandleInterval: intervalConfig.StorageCandleInterval,
@@ -255,6 +214,8 @@ func main() {
 		RequiredInstruments: instrumentsForStorage,
 		Logger:              client.Logger,
 		MarketDataService:   marketDataService,
+		Adjust:              intervalConfig.StorageAdjust,
+		InstrumentsService:  instrumentsService,
 		From:                now.Add(-time.Hour * 24 * time.Duration(intervalConfig.DaysToCalculateInterval)),
 		To:                  now,
 	})
@@ -262,7 +223,7 @@ func main() {
 		cancel()
 		logger.Fatalf(err.Error())
 	}
-	executor := bot.NewExecutor(ctx, client, instrumentsForExecutor)
+	executor := bot.NewExecutor(ctx, client, instrumentsForExecutor, config.Bot.Risk, config.Bot.Sizing)
 	// создание интервального бота
 	intervalBot, err := bot.NewBot(ctx, client, storage, executor, intervalConfig)
 	if err != nil {
@@ -271,7 +232,7 @@ func main() {
 
 	wg := &sync.WaitGroup{}
 	// Таймер для Московской биржи, отслеживает расписание и дает сигналы, на остановку/запуск бота
-	t := investgo.NewTimer(client, EXCHANGE, cancelAhead)
+	t := investgo.NewTimer(client, config.Bot.Exchange, config.Bot.CancelAhead)
 
 	// запуск таймера
 	wg.Add(1)
@@ -12,43 +12,50 @@ import (
 
 	"github.com/montanaflynn/stats"
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 )
 
 // IntervalStrategyConfig - Конфигурация стратегии интервального бота
 type IntervalStrategyConfig struct {
-	// Instruments - Слайс идентификаторов инструментов первичный
-	Instruments []string
+	// Instruments - Слайс идентификаторов инструментов первичный, в yaml не задается, заполняется отбором инструментов
+	Instruments []string `yaml:"-"`
 	// PreferredPositionPrice - Предпочтительная стоимость открытия позиции в валюте
-	PreferredPositionPrice float64
+	PreferredPositionPrice float64 `yaml:"PreferredPositionPrice"`
 	// MaxPositionPrice - Максимальная стоимость открытия позиции в валюте
-	MaxPositionPrice float64
+	MaxPositionPrice float64 `yaml:"MaxPositionPrice"`
 	// MinProfit - Минимальный процент выгоды, с которым можно совершать сделки
-	MinProfit float64
+	MinProfit float64 `yaml:"MinProfit"`
 	// IntervalUpdateDelay - Время ожидания для перерасчета интервала цены
-	IntervalUpdateDelay time.Duration
+	IntervalUpdateDelay time.Duration `yaml:"IntervalUpdateDelay"`
 	// TopInstrumentsQuantity - Топ лучших инструментов по волатильности
-	TopInstrumentsQuantity int
+	TopInstrumentsQuantity int `yaml:"TopInstrumentsQuantity"`
 	// SellOut - Если true, то по достижению дедлайна бот выходит из всех активных позиций
-	SellOut bool
+	SellOut bool `yaml:"SellOut"`
+	// Side - Направление торговли, по умолчанию LONG. Короткие позиции открываются только по инструментам
+	// с ShortEnabledFlag при достаточном обеспечении на счете
+	Side TradeSide `yaml:"Side"`
 	// StorageDBPath - Путь к бд sqlite, в которой лежат исторические свечи по инструментам
-	StorageDBPath string
-	// StorageCandleInterval - Интервал для обновления и запроса исторических свечей
-	StorageCandleInterval pb.CandleInterval
+	StorageDBPath string `yaml:"StorageDBPath"`
+	// StorageCandleInterval - Интервал для обновления и запроса исторических свечей, в yaml задается названием,
+	// например CANDLE_INTERVAL_1_MIN
+	StorageCandleInterval pb.CandleInterval `yaml:"-"`
 	// StorageFromTime - Время, от которого будет хранилище будет загружать историю для новых инструментов
-	StorageFromTime time.Time
+	StorageFromTime time.Time `yaml:"StorageFromTime"`
 	// StorageUpdate - Если true, то в хранилище обновятся все свечи до now
-	StorageUpdate bool
+	StorageUpdate bool `yaml:"StorageUpdate"`
+	// StorageAdjust - Если true, то свечи для анализа корректируются на дивиденды и сплиты
+	StorageAdjust bool `yaml:"StorageAdjust"`
 	// DaysToCalculateInterval - Кол-во дней, на которых рассчитывается интервал цен для торговли
-	DaysToCalculateInterval int
+	DaysToCalculateInterval int `yaml:"DaysToCalculateInterval"`
 	// StopLossPercent - Процент изменения цены, для стоп-лосс заявки
-	StopLossPercent float64
+	StopLossPercent float64 `yaml:"StopLossPercent"`
 	// AnalyseLowPercentile - Нижний процентиль для расчета интервала
-	AnalyseLowPercentile float64
+	AnalyseLowPercentile float64 `yaml:"AnalyseLowPercentile"`
 	// AnalyseHighPercentile - Верхний процентиль для расчета интервала
-	AnalyseHighPercentile float64
+	AnalyseHighPercentile float64 `yaml:"AnalyseHighPercentile"`
 	// Analyse - Тип анализа исторических свечей при расчете интервала
-	Analyse AnalyseType
+	Analyse AnalyseType `yaml:"Analyse"`
 }
 
 // AnalyseType - Тип анализа исторических свечей при расчете интервала
@@ -67,7 +74,7 @@ const (
 	SIMPLEST
 )
 
-// Interval - Интервал цены. Low - для покупки, high - для продажи
+// Interval - Интервал цены. Low - для покупки и откупа короткой позиции, high - для продажи и открытия короткой позиции
 type Interval struct {
 	high, low float64
 }
@@ -116,6 +123,12 @@ func NewBot(ctx context.Context, client *investgo.Client, s *CandlesStorage, e *
 	return b, nil
 }
 
+// Copy - Копия бота для параллельных бектестов, BackTest меняет конфигурацию стратегии и функцию анализа свечей
+func (b *Bot) Copy() *Bot {
+	c := *b
+	return &c
+}
+
 // Run - Запуск интервального бота
 func (b *Bot) Run() error {
 	// отбор топ инструментов по волатильности
@@ -129,6 +142,9 @@ func (b *Bot) Run() error {
 
 	// запуск анализа инструментов по их историческим свечам
 	for _, id := range b.StrategyConfig.Instruments {
+		if !b.tradable(id) {
+			continue
+		}
 		tempId := id
 		hc, err := b.storage.Candles(tempId, from, to)
 		if err != nil {
@@ -184,7 +200,7 @@ func (b *Bot) Run() error {
 	}
 
 	// запуск исполнителя, он начнет торговать топовыми инструментами
-	err = b.executor.Start(topInstrumentsIntervals)
+	err = b.executor.Start(topInstrumentsIntervals, b.StrategyConfig.Side)
 	if err != nil {
 		return err
 	}
@@ -258,6 +274,12 @@ func (b *Bot) UpdateIntervals(from time.Time, ids []string) error {
 	return nil
 }
 
+// tradable - Инструмент подходит для выбранного направления торговли, в режиме SHORT нужен ShortEnabledFlag
+func (b *Bot) tradable(id string) bool {
+	instrument, ok := b.executor.instruments[id]
+	return ok && (b.StrategyConfig.Side != SHORT || instrument.ShortEnabled)
+}
+
 // checkMoneyBalance - проверка доступного баланса денежных средств
 func (b *Bot) checkMoneyBalance(currency string, required float64) error {
 	operationsService := b.Client.NewOperationsServiceClient()
@@ -588,25 +610,38 @@ func timeIntervalByDays(reqDays int, now time.Time) (from time.Time, to time.Tim
 	return from, to
 }
 
+// BacktestConfig - Параметры анализа свечей и комиссия для проверки стратегии на истории
 type BacktestConfig struct {
 	// Analyse - Тип анализа исторических свечей при расчете интервала
-	Analyse AnalyseType
+	Analyse AnalyseType `yaml:"Analyse"`
 	// LowPercent - Для анализа типа MathStat нижний перцентиль для расчета интервала
-	LowPercentile float64
+	LowPercentile float64 `yaml:"LowPercentile"`
 	// HighPercentile - Для анализа типа MathStat верхний перцентиль для расчета интервала
-	HighPercentile float64
+	HighPercentile float64 `yaml:"HighPercentile"`
 	// MinProfit - Минимальный профит для рассчета, с которым рассчитывается интервал
-	MinProfit float64
+	MinProfit float64 `yaml:"MinProfit"`
 	// StopLoss - Процент убытка для выставления стоп-лосс заявки
-	StopLoss float64
+	StopLoss float64 `yaml:"StopLoss"`
 	// DaysToCalculateInterval - Кол-во дней на которых рассчитывается интервал для цен для торговли
-	DaysToCalculateInterval int
+	DaysToCalculateInterval int `yaml:"DaysToCalculateInterval"`
 	// Commission - Комиссия за 1 сделку в процентах
-	Commission float64
+	Commission float64 `yaml:"Commission"`
+}
+
+// BacktestResult - Результат проверки стратегии за день
+type BacktestResult struct {
+	// Profit - Результат за день с учетом комиссий
+	Profit float64
+	// Percent - Результат в процентах от RequiredMoney
+	Percent float64
+	// RequiredMoney - Сумма для открытия позиций по отобранным инструментам
+	RequiredMoney float64
+	// Trades - Сделки за день
+	Trades []backtest.Trade
 }
 
-// BackTest - Проверка стратегии на исторических данных
-func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, error) {
+// applyBacktestConfig - Изменение конфигурации стратегии и функции анализа свечей по конфигу бектеста
+func (b *Bot) applyBacktestConfig(bc BacktestConfig) {
 	// по конфигу бектеста меняются конфигурация стратегии
 	switch bc.Analyse {
 	case MATH_STAT:
@@ -633,7 +668,11 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 	default:
 		b.analyseCandles = b.analyseCandlesBestWidth
 	}
+}
 
+// rankInstruments - Анализ свечей всех инструментов за DaysToCalculateInterval дней до start,
+// инструменты отсортированы по убыванию максимальной волатильности
+func (b *Bot) rankInstruments(start time.Time) ([]*analyseResponse, error) {
 	// загружаем минутные свечи по всем инструментам для анализа волатильности
 	from, to := timeIntervalByDays(b.StrategyConfig.DaysToCalculateInterval, start)
 	b.Client.Logger.Infof("Start backtest day =%v from = %v to = %v", start, from, to)
@@ -647,7 +686,7 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 		tempId := id
 		hc, err := b.storage.Candles(tempId, from, to)
 		if err != nil {
-			return 0, 0, err
+			return nil, err
 		}
 		// если нет свечей для инструмента, волатильность = 0
 		var resp *analyseResponse
@@ -664,7 +703,7 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 			resp, err = b.analyseCandles(tempId, hc)
 		}
 		if err != nil {
-			return 0, 0, err
+			return nil, err
 		}
 		analyseResult = append(analyseResult, resp)
 	}
@@ -673,11 +712,27 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 	sort.Slice(analyseResult, func(i, j int) bool {
 		return analyseResult[i].volatilityMax > analyseResult[j].volatilityMax
 	})
+	return analyseResult, nil
+}
+
+// BackTest - Проверка стратегии на исторических данных за день start
+func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (BacktestResult, error) {
+	b.applyBacktestConfig(bc)
+	ranked, err := b.rankInstruments(start)
+	if err != nil {
+		return BacktestResult{}, err
+	}
+	analyseResult := make([]*analyseResponse, 0, len(ranked))
+	for _, r := range ranked {
+		if b.tradable(r.id) {
+			analyseResult = append(analyseResult, r)
+		}
+	}
 
 	// берем первые топ TopInstrumentsQuantity инструментов по волатильности
 	topInstrumentsIntervals := make(map[string]Interval, b.StrategyConfig.TopInstrumentsQuantity)
 	if b.StrategyConfig.TopInstrumentsQuantity > len(analyseResult) {
-		return 0, 0, fmt.Errorf("TopInstrumentsQuantity = %v, but max value = %v\n",
+		return BacktestResult{}, fmt.Errorf("TopInstrumentsQuantity = %v, but max value = %v\n",
 			b.StrategyConfig.TopInstrumentsQuantity, len(analyseResult))
 	}
 
@@ -690,7 +745,7 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 	for id, i := range topInstrumentsIntervals {
 		currInstrument, ok := b.executor.instruments[id]
 		if !ok {
-			return 0, 0, fmt.Errorf("%v not found in executor map\n", id)
+			return BacktestResult{}, fmt.Errorf("%v not found in executor map\n", id)
 		}
 		requiredMoneyForStart += i.low * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
 	}
@@ -698,23 +753,53 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 
 	// проверяем на start дне
 	var totalProfit, instrumentProfit float64
+	trades := make([]backtest.Trade, 0)
 	for id, interval := range topInstrumentsIntervals {
 		b.Client.Logger.Infof("Start trading with %v, high = %.9f, low = %.9f", b.executor.ticker(id), interval.high, interval.low)
 		todayCandles, err := b.storage.Candles(id, start, start.Add(time.Hour*24))
 		if err != nil {
-			return 0, 0, err
+			return BacktestResult{}, err
 		}
 		currInstrument, ok := b.executor.instruments[id]
 		if !ok {
-			return 0, 0, fmt.Errorf("%v not found in executor map\n", id)
+			return BacktestResult{}, fmt.Errorf("%v not found in executor map\n", id)
+		}
+		// в короткую торгуются только инструменты с ShortEnabledFlag
+		canLong := b.StrategyConfig.Side != SHORT
+		canShort := b.StrategyConfig.Side != LONG && currInstrument.ShortEnabled
+		inStock, inShort := false, false
+		// открытая сделка, закрывается при продаже или откупе
+		var trade backtest.Trade
+		quantity := float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+		openTrade := func(direction pb.OrderDirection, entryTime time.Time, entryPrice, commission float64) {
+			trade = backtest.Trade{
+				InstrumentUid: id,
+				Direction:     direction,
+				Quantity:      int64(quantity),
+				EntryTime:     entryTime,
+				EntryPrice:    entryPrice,
+				Commission:    commission,
+			}
+		}
+		closeTrade := func(exitTime time.Time, exitPrice, commission float64) {
+			trade.ExitTime = exitTime
+			trade.ExitPrice = exitPrice
+			trade.PnL = (exitPrice - trade.EntryPrice) * quantity
+			if trade.Direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+				trade.PnL = -trade.PnL
+			}
+			trade.Commission += commission
+			trades = append(trades, trade)
 		}
-		inStock := false
 		// ширина интервала или разница в цене инструмента
 		delta := interval.high - interval.low
 		// выражение фиксируемого убытка в разнице цены инструмента
 		loss := interval.low * (b.StrategyConfig.StopLossPercent / 100)
 		// цена, по которой нужно фиксировать убытки
 		lossPrice := investgo.FloatToQuotation(interval.low-loss, currInstrument.MinPriceInc).ToFloat()
+		// для короткой позиции убыток фиксируется выше верхней границы интервала
+		shortLoss := interval.high * (b.StrategyConfig.StopLossPercent / 100)
+		shortLossPrice := investgo.FloatToQuotation(interval.high+shortLoss, currInstrument.MinPriceInc).ToFloat()
 		// идем по сегодняшним свечам инструмента
 		stopTradingToday := false
 		for i, candle := range todayCandles {
@@ -736,14 +821,18 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 					b.Client.Logger.Infof("default sell profit = %.3f in percent = %.3f", p, delta/interval.low*100)
 					instrumentProfit += p
 					inStock = false
-					instrumentProfit -= interval.high * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					commission := interval.high * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(candle.GetTime().AsTime(), interval.high, commission)
 					// если сработал стоп-лосс, продаем и заканчиваем торги на сегодня
 				case candle.GetLow().ToFloat() <= lossPrice:
 					tempLoss := -loss * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
 					instrumentProfit += tempLoss
 					b.Client.Logger.Infof("stop loss, loss = %.3f in percent = %.3f", tempLoss, -b.StrategyConfig.StopLossPercent)
 					inStock = false
-					instrumentProfit -= interval.high * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					commission := interval.high * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(candle.GetTime().AsTime(), interval.low-loss, commission)
 					// после стоп-лосса не заканчиваем торги на сегодня
 					// stopTradingToday = true
 					// если это последняя свеча на сегодня
@@ -752,25 +841,84 @@ func (b *Bot) BackTest(start time.Time, bc BacktestConfig) (float64, float64, er
 					instrumentProfit += p
 					b.Client.Logger.Infof("last day sell out, profit = %.3f in percent = %.3f", p, (lastCandle.GetClose().ToFloat()-interval.low)/interval.low*100)
 					inStock = false
-					instrumentProfit -= lastCandle.GetClose().ToFloat() * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					commission := lastCandle.GetClose().ToFloat() * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(lastCandle.GetTime().AsTime(), lastCandle.GetClose().ToFloat(), commission)
+				}
+			} else if inShort {
+				switch {
+				// штатный случай откупа короткой позиции по нижней границе интервала
+				case interval.low >= candle.GetLow().ToFloat():
+					b.Client.Logger.Infof("cover with candle high = %.3f, low = %.3f", candle.GetHigh().ToFloat(), candle.GetLow().ToFloat())
+					p := delta * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					b.Client.Logger.Infof("default cover profit = %.3f in percent = %.3f", p, delta/interval.high*100)
+					instrumentProfit += p
+					inShort = false
+					commission := interval.low * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(candle.GetTime().AsTime(), interval.low, commission)
+				// стоп-лосс короткой позиции, цена выросла выше входа
+				case candle.GetHigh().ToFloat() >= shortLossPrice:
+					tempLoss := -shortLoss * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit += tempLoss
+					b.Client.Logger.Infof("short stop loss, loss = %.3f in percent = %.3f", tempLoss, -b.StrategyConfig.StopLossPercent)
+					inShort = false
+					commission := (interval.high + shortLoss) * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(candle.GetTime().AsTime(), interval.high+shortLoss, commission)
+				case i == len(todayCandles)-1:
+					p := (interval.high - lastCandle.GetClose().ToFloat()) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit += p
+					b.Client.Logger.Infof("last day cover, profit = %.3f in percent = %.3f", p, (interval.high-lastCandle.GetClose().ToFloat())/interval.high*100)
+					inShort = false
+					commission := lastCandle.GetClose().ToFloat() * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					closeTrade(lastCandle.GetTime().AsTime(), lastCandle.GetClose().ToFloat(), commission)
 				}
 			} else {
 				// симуляция покупки по стоп лимит, если цена low не пересекает текущую свечу (она ниже) - считаем что ордер на покупку не выставится,
 				// но если цена пересекает свечу, считаем, что купили в эту же свечу лимиткой по low
 				// предполагаем что лимитная заявка исполнится если цена поручения выше минимальной в этой свече
-				if interval.low <= candle.GetHigh().ToFloat() && interval.low >= candle.GetLow().ToFloat() && i < len(todayCandles)-1 {
-					// if interval.low >= candle.GetLow().ToFloat() && interval.high <= candle.GetHigh().ToFloat() {
+				buy := canLong && interval.low <= candle.GetHigh().ToFloat() && interval.low >= candle.GetLow().ToFloat() && i < len(todayCandles)-1
+				// продажа в короткую симулируется так же по верхней границе интервала
+				short := canShort && interval.high <= candle.GetHigh().ToFloat() && interval.high >= candle.GetLow().ToFloat() && i < len(todayCandles)-1
+				// если свеча пересекает обе границы, как и исполнитель, входим у ближайшей к цене открытия свечи
+				if buy && short {
+					open := candle.GetOpen().ToFloat()
+					if interval.high-open < open-interval.low {
+						buy = false
+					} else {
+						short = false
+					}
+				}
+				switch {
+				case buy:
 					// могли бы купить
 					inStock = true
-					instrumentProfit -= interval.low * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					commission := interval.low * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					openTrade(pb.OrderDirection_ORDER_DIRECTION_BUY, candle.GetTime().AsTime(), interval.low, commission)
 					b.Client.Logger.Infof("buy with candle high = %.3f, low = %.3f", candle.GetHigh().ToFloat(), candle.GetLow().ToFloat())
+				case short:
+					// могли бы продать в короткую
+					inShort = true
+					commission := interval.high * (bc.Commission / 100) * float64(currInstrument.Lot) * float64(currInstrument.Quantity)
+					instrumentProfit -= commission
+					openTrade(pb.OrderDirection_ORDER_DIRECTION_SELL, candle.GetTime().AsTime(), interval.high, commission)
+					b.Client.Logger.Infof("short with candle high = %.3f, low = %.3f", candle.GetHigh().ToFloat(), candle.GetLow().ToFloat())
 				}
 			}
 		}
-		b.Client.Logger.Infof("Stop trading with %v, instock = %v, profit = %.9f", b.executor.ticker(id), inStock, instrumentProfit)
+		b.Client.Logger.Infof("Stop trading with %v, instock = %v, inshort = %v, profit = %.9f", b.executor.ticker(id), inStock,
+			inShort, instrumentProfit)
 		totalProfit += instrumentProfit
 		instrumentProfit = 0
 	}
 
-	return totalProfit, (totalProfit / requiredMoneyForStart) * 100, nil
+	return BacktestResult{
+		Profit:        totalProfit,
+		Percent:       (totalProfit / requiredMoneyForStart) * 100,
+		RequiredMoney: requiredMoneyForStart,
+		Trades:        trades,
+	}, nil
 }
@@ -1,15 +1,13 @@
 package bot
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"reflect"
+	"sort"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/mattn/go-sqlite3"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/storage"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 )
 
@@ -22,36 +20,20 @@ type StorageInstrument struct {
 	Ticker         string
 }
 
-// CandlesStorage - Локально хранилище свечей в sqlite
+// CandlesStorage - Локальное хранилище свечей, поверх storage.CandlesStorage держит в памяти свечи
+// за интервал, нужный боту
 type CandlesStorage struct {
 	instruments map[string]StorageInstrument
 	candles     map[string][]*pb.HistoricCandle
 	mds         *investgo.MarketDataServiceClient
 	logger      investgo.Logger
-	db          *sqlx.DB
+	db          *storage.CandlesStorage
+	// adjust - Свечи в памяти скорректированы на корпоративные действия, при обновлении история перечитывается
+	// целиком, чтобы вся серия была скорректирована на действия до последней свечи
+	adjust bool
+	is     *investgo.InstrumentsServiceClient
 }
 
-var schema = `
-create table if not exists candles (
-    id integer primary key autoincrement,
-    instrument_uid text,
-	open real,
-	close real,
-	high real,
-	low real,
-	volume integer,
-	time integer,
-	is_complete integer,
-    unique (instrument_uid, time)
-);
-
-create table if not exists updates (
-    instrument_id text unique ,
-	first_time integer,
-	last_time integer
-);
-`
-
 // NewCandlesStorageRequest - Параметры для создания хранилища свечей
 type NewCandlesStorageRequest struct {
 	// DBPath - Путь к файлу sqlite
@@ -64,6 +46,16 @@ type NewCandlesStorageRequest struct {
 	MarketDataService   *investgo.MarketDataServiceClient
 	// From, To - Интервал,
 	From, To time.Time
+	// Adjust - Если true, то свечи корректируются на дивиденды и сплиты из хранилища, сырые свечи в бд не меняются
+	Adjust bool
+	// InstrumentsService - Нужен для получения дивидендов при Adjust = true
+	InstrumentsService *investgo.InstrumentsServiceClient
+}
+
+// updateGroup - Инструменты с одинаковыми параметрами загрузки истории
+type updateGroup struct {
+	interval pb.CandleInterval
+	from     time.Time
 }
 
 // NewCandlesStorage - Создание хранилища свечей
@@ -73,92 +65,61 @@ func NewCandlesStorage(req NewCandlesStorageRequest) (*CandlesStorage, error) {
 		instruments: make(map[string]StorageInstrument),
 		candles:     make(map[string][]*pb.HistoricCandle),
 		logger:      req.Logger,
+		adjust:      req.Adjust,
+		is:          req.InstrumentsService,
 	}
-	// инициализируем бд
-	db, err := cs.initDB(req.DBPath)
+	// открываем бд, старые файлы candles.db будут смигрированы на новую схему
+	db, err := storage.NewCandlesStorage(req.DBPath, req.Logger)
 	if err != nil {
 		return nil, err
 	}
 	cs.db = db
-	// получаем время первого и последнего обновления инструментов, которые уже есть в бд
-	DBUpdates, err := cs.lastUpdates()
-	if err != nil {
-		return nil, err
-	}
-	cs.logger.Infof("got %v unique instruments from storage", len(DBUpdates))
-	// если инструмента в бд нет, то загружаем данные по нему, если есть, но недостаточно, то догружаем свечи
-	now := time.Now()
+	// если инструмента в бд нет, то загружаем данные по нему, если есть, но недостаточно, то догружаем свечи,
+	// если нужно обновить историю до now, то обновляем все инструменты
+	groups := make(map[updateGroup][]string)
+	updates := make(map[pb.CandleInterval]map[string]storage.UpdateInfo)
 	for id, instrument := range req.RequiredInstruments {
-		if _, ok := DBUpdates[id]; !ok {
-			cs.logger.Infof("candles for %v not found, downloading...", id)
-			newCandles, err := cs.mds.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
-				Instrument: id,
-				Interval:   instrument.CandleInterval,
-				From:       instrument.FirstUpdate,
-				To:         now,
-				File:       false,
-				FileName:   "",
-			})
-			if err != nil {
-				return nil, err
-			}
-			instrument.LastUpdate = now
-			// обновляем значение последнего запроса
-			cs.instruments[id] = instrument
-			err = cs.storeCandlesInDB(id, now, newCandles)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// first time check
-			// если все ок, то просто обновляем время обновления
-			if instrument.FirstUpdate.After(DBUpdates[id].FirstUpdate) {
-				instrument.FirstUpdate = DBUpdates[id].FirstUpdate
-				instrument.LastUpdate = DBUpdates[id].LastUpdate
-				cs.instruments[id] = instrument
-			} else {
-				cs.logger.Infof("older candles for %v not found, downloading...", cs.ticker(id))
-				// если нужно догрузить более старые свечи
-				oldCandles, err := cs.mds.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
-					Instrument: id,
-					Interval:   instrument.CandleInterval,
-					From:       instrument.FirstUpdate,
-					To:         DBUpdates[id].FirstUpdate,
-					File:       false,
-					FileName:   "",
-				})
-				if err != nil {
-					return nil, err
-				}
-				instrument.LastUpdate = DBUpdates[id].LastUpdate
-				cs.instruments[id] = instrument
-				err = cs.storeCandlesInDB(id, instrument.LastUpdate, oldCandles)
-				if err != nil {
-					return nil, err
-				}
-			}
-		}
-	}
-	// если нужно обновить с lastUpdate до сейчас
-	if req.Update {
-		// обновляем в бд данные по всем инструментам
-		for id := range req.RequiredInstruments {
-			err = cs.UpdateCandlesHistory(id)
+		cs.instruments[id] = instrument
+		if _, ok := updates[instrument.CandleInterval]; !ok {
+			u, err := db.Updates(instrument.CandleInterval)
 			if err != nil {
 				return nil, err
 			}
+			cs.logger.Infof("got %v unique instruments from storage", len(u))
+			updates[instrument.CandleInterval] = u
+		}
+		u, ok := updates[instrument.CandleInterval][id]
+		if !req.Update && ok && !instrument.FirstUpdate.Before(u.FirstUpdate) {
+			continue
+		}
+		g := updateGroup{interval: instrument.CandleInterval, from: instrument.FirstUpdate}
+		groups[g] = append(groups[g], id)
+	}
+	for g, ids := range groups {
+		err = db.Update(context.Background(), cs.mds, storage.UpdateRequest{
+			Instruments: ids,
+			Interval:    g.interval,
+			From:        g.from,
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 	// загрузка всех свечей из бд в мапу
 	for id, instrument := range req.RequiredInstruments {
-		tmp, err := cs.loadCandlesFromDB(id, instrument.PriceStep, req.From, req.To)
-		// tmp, err := cs.CandlesAll(id)
+		var tmp []*pb.HistoricCandle
+		if req.Adjust {
+			tmp, err = db.AdjustedCandles(req.InstrumentsService, id, instrument.CandleInterval, req.From, req.To)
+		} else {
+			tmp, err = db.Candles(id, instrument.CandleInterval, req.From, req.To)
+		}
 		if err != nil {
 			return nil, err
 		}
+		cs.logger.Infof("%v %v candles downloaded from storage", cs.ticker(id), len(tmp))
 		cs.candles[id] = tmp
 	}
-	return cs, err
+	return cs, nil
 }
 
 // Close - Закрытие хранилища свечей
@@ -175,43 +136,35 @@ func (c *CandlesStorage) ticker(key string) string {
 	return t.Ticker
 }
 
-// Candles - Получение исторических свечей по uid инструмента
-//func (c *CandlesStorage) Candles(id string, from, to time.Time) ([]*pb.HistoricCandle, error) {
-//	instrument, ok := c.instruments[id]
-//	if !ok {
-//		return nil, fmt.Errorf("%v instrument not found, at first LoadCandlesHistory()", id)
-//	}
-//	return c.loadCandlesFromDB(id, instrument.PriceStep, from, to)
-//}
-
 // Candles - Получение исторических свечей по uid инструмента
 func (c *CandlesStorage) Candles(id string, from, to time.Time) ([]*pb.HistoricCandle, error) {
-	allCandles, ok := c.candles[id]
-	if !ok {
-		return nil, fmt.Errorf("%v instrument not found, at first LoadCandlesHistory() or use candles_dowloader", id)
-	}
-	indexes := [2]int{}
-	times := [2]time.Time{from, to}
-	currIndex := 0
-	for i, candle := range allCandles {
-		if currIndex < 2 {
-			if candle.GetTime().AsTime().After(times[currIndex]) {
-				indexes[currIndex] = i
-				currIndex++
-			}
-		} else {
-			break
-		}
+	candles, err := c.candlesInRange(id, from, to)
+	if err != nil {
+		return nil, err
 	}
-	if currIndex == 0 {
-		//return nil, fmt.Errorf("%v candles not found in storage, try to UpdateCandlesHistory() from = %v or use candles_downloader\n", c.ticker(id), from)
+	if len(candles) == 0 {
 		return nil, fmt.Errorf("%v candles not found in storage, try to UpdateCandlesHistory() from = %v or use candles_downloader\n", c.ticker(id), from)
+	}
+	return candles, nil
+}
 
+// candlesInRange - Свечи инструмента из хранилища в интервале [from, to), если свечей нет, например в выходной день,
+// возвращается пустой слайс
+func (c *CandlesStorage) candlesInRange(id string, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	allCandles, ok := c.candles[id]
+	if !ok {
+		return nil, fmt.Errorf("%v instrument not found, at first LoadCandlesHistory() or use candles_dowloader", id)
 	}
-	if indexes[1] == 0 {
-		return allCandles[indexes[0]:], nil
+	low := sort.Search(len(allCandles), func(i int) bool {
+		return !allCandles[i].GetTime().AsTime().Before(from)
+	})
+	high := sort.Search(len(allCandles), func(i int) bool {
+		return !allCandles[i].GetTime().AsTime().Before(to)
+	})
+	if low >= high {
+		return []*pb.HistoricCandle{}, nil
 	}
-	return allCandles[indexes[0]:indexes[1]], nil
+	return allCandles[low:high], nil
 }
 
 // CandlesAll - Получение всех исторических свечей из хранилища по uid инструмента
@@ -220,74 +173,23 @@ func (c *CandlesStorage) CandlesAll(uid string) ([]*pb.HistoricCandle, error) {
 	if !ok {
 		return nil, fmt.Errorf("%v instrument not found, at first LoadCandlesHistory()", c.ticker(uid))
 	}
-
-	stmt, err := c.db.Preparex(`select * from candles where instrument_uid=? order by time `)
+	candles, err := c.db.CandlesAll(uid, instrument.CandleInterval)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err := stmt.Close()
-		if err != nil {
-			c.logger.Errorf(err.Error())
-		}
-	}()
-
-	rows, err := stmt.Queryx(uid)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err := rows.Close()
-		if err != nil {
-			c.logger.Errorf(err.Error())
-		}
-	}()
-
-	dst := CandleDB{}
-	candles := make([]*pb.HistoricCandle, 0)
-	for rows.Next() {
-		err = rows.StructScan(&dst)
-		if err != nil {
-			return nil, err
-		}
-		if !reflect.DeepEqual(dst, CandleDB{}) {
-			candles = append(candles, &pb.HistoricCandle{
-				Open:       investgo.FloatToQuotation(dst.Open, instrument.PriceStep),
-				High:       investgo.FloatToQuotation(dst.High, instrument.PriceStep),
-				Low:        investgo.FloatToQuotation(dst.Low, instrument.PriceStep),
-				Close:      investgo.FloatToQuotation(dst.Close, instrument.PriceStep),
-				Volume:     int64(dst.Volume),
-				Time:       investgo.TimeToTimestamp(time.Unix(dst.Time, 0)),
-				IsComplete: dst.IsComplete == 1,
-			})
-		}
-	}
 	c.logger.Infof("%v %v candles downloaded from storage", c.ticker(uid), len(candles))
-
 	return candles, nil
 }
 
 // LoadCandlesHistory - Начальная загрузка исторических свечей для нового инструмента (from - now)
 func (c *CandlesStorage) LoadCandlesHistory(id string, interval pb.CandleInterval, inc *pb.Quotation, from time.Time) error {
-	now := time.Now()
-	newCandles, err := c.mds.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
-		Instrument: id,
-		Interval:   interval,
-		From:       from,
-		To:         now,
-		File:       false,
-		FileName:   "",
-	})
-	if err != nil {
-		return err
-	}
 	c.instruments[id] = StorageInstrument{
 		CandleInterval: interval,
 		PriceStep:      inc,
-		LastUpdate:     now,
+		FirstUpdate:    from,
 	}
-	c.candles[id] = newCandles
-	return c.storeCandlesInDB(id, now, newCandles)
+	c.candles[id] = make([]*pb.HistoricCandle, 0)
+	return c.UpdateCandlesHistory(id)
 }
 
 // UpdateCandlesHistory - Загрузить исторические свечи в хранилище от времени последнего обновления до now
@@ -298,189 +200,46 @@ func (c *CandlesStorage) UpdateCandlesHistory(id string) error {
 		return fmt.Errorf("%v not found in candles storage", c.ticker(id))
 	}
 	now := time.Now()
-	newCandles, err := c.mds.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
-		Instrument: id,
-		Interval:   instrument.CandleInterval,
-		From:       instrument.LastUpdate,
-		To:         now,
-		File:       false,
-		FileName:   "",
+	err := c.db.Update(context.Background(), c.mds, storage.UpdateRequest{
+		Instruments: []string{id},
+		Interval:    instrument.CandleInterval,
+		From:        instrument.FirstUpdate,
+		To:          now,
 	})
 	if err != nil {
 		return err
 	}
-	instrument.LastUpdate = now
-	c.instruments[id] = instrument
-	c.candles[id] = append(c.candles[id], newCandles...)
-	return c.storeCandlesInDB(id, now, newCandles)
-}
-
-// lastUpdates - Возвращает первое и последнее обновление для инструментов из бд
-func (c *CandlesStorage) lastUpdates() (map[string]StorageInstrument, error) {
-	c.logger.Infof("update lastUpdate time from storage...")
-	var lastUpdUnix, firstUpdUnix int64
-	var tempId string
-	updatesFromDB := make(map[string]StorageInstrument, len(c.instruments))
-
-	rows, err := c.db.Query(`select * from updates`)
-	if err != nil {
-		return nil, err
-	}
-
-	for rows.Next() {
-		err = rows.Scan(&tempId, &firstUpdUnix, &lastUpdUnix)
-		if err != nil {
-			return nil, err
-		}
-		updatesFromDB[tempId] = StorageInstrument{
-			FirstUpdate: time.Unix(firstUpdUnix, 0),
-			LastUpdate:  time.Unix(lastUpdUnix, 0),
+	if c.adjust {
+		// новое корпоративное действие меняет коэффициенты всех свечей до него, поэтому скорректированная
+		// история перечитывается целиком
+		from := instrument.FirstUpdate
+		if cached := c.candles[id]; len(cached) > 0 {
+			from = cached[0].GetTime().AsTime()
 		}
-	}
-	return updatesFromDB, nil
-}
-
-//// uniqueInstruments - Метод возвращает мапу с уникальными значениями uid инструментов в бд
-//func (c *CandlesStorage) uniqueInstruments() (map[string]struct{}, error) {
-//	instruments := make([]string, 0)
-//	err := c.db.Select(&instruments, `select distinct instrument_id from updates`)
-//	if err != nil {
-//		return nil, err
-//	}
-//	m := make(map[string]struct{})
-//	for _, instrument := range instruments {
-//		m[instrument] = struct{}{}
-//	}
-//	c.logger.Infof("got %v unique instruments from storage", len(m))
-//	return m, nil
-//}
-
-// initDB - Инициализация бд
-func (c *CandlesStorage) initDB(path string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
-	}
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-	if _, err = db.Exec(schema); err != nil {
-		return nil, err
-	}
-	c.logger.Infof("database initialized")
-	return db, nil
-}
-
-// storeCandlesInDB - Сохранение исторических свечей инструмента в бд
-func (c *CandlesStorage) storeCandlesInDB(uid string, update time.Time, hc []*pb.HistoricCandle) error {
-	err := func() error {
-		tx, err := c.db.Begin()
+		candles, err := c.db.AdjustedCandles(c.is, id, instrument.CandleInterval, from, now.Add(time.Minute))
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := tx.Commit(); err != nil {
-				c.logger.Errorf(err.Error())
-			}
-		}()
-		insertCandle, err := tx.Prepare(`insert into candles (instrument_uid, open, close, high, low, volume, time, is_complete) 
-		values (?, ?, ?, ?, ?, ?, ?, ?) `)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err := insertCandle.Close(); err != nil {
-				c.logger.Errorf(err.Error())
-			}
-		}()
-
-		for _, candle := range hc {
-			_, err := insertCandle.Exec(uid,
-				candle.GetOpen().ToFloat(),
-				candle.GetClose().ToFloat(),
-				candle.GetHigh().ToFloat(),
-				candle.GetLow().ToFloat(),
-				candle.GetVolume(),
-				candle.GetTime().AsTime().Unix(),
-				candle.GetIsComplete())
-			if err != nil {
-				if errors.As(err, &sqlite3.Error{}) {
-					continue
-				} else {
-					return err
-				}
-			}
-		}
+		instrument.LastUpdate = now
+		c.instruments[id] = instrument
+		c.candles[id] = candles
+		c.logger.Infof("%v %v adjusted candles reloaded from storage", c.ticker(id), len(candles))
 		return nil
-	}()
-	if err != nil {
-		return err
 	}
-	// записываем в базу время последнего обновления
-	_, err = c.db.Exec(`insert or replace into updates(instrument_id, first_time, last_time) values (?, ?, ?)`,
-		uid, c.instruments[uid].FirstUpdate.Unix(), update.Unix())
+	// перечитываем из бд свечи начиная с последней свечи в памяти, она могла быть незавершенной
+	cached := c.candles[id]
+	from := instrument.FirstUpdate
+	if len(cached) > 0 {
+		from = cached[len(cached)-1].GetTime().AsTime()
+		cached = cached[:len(cached)-1]
+	}
+	newCandles, err := c.db.Candles(id, instrument.CandleInterval, from, now.Add(time.Minute))
 	if err != nil {
 		return err
 	}
-	c.logger.Infof("%v %v candles uploaded in storage", c.ticker(uid), len(hc))
+	instrument.LastUpdate = now
+	c.instruments[id] = instrument
+	c.candles[id] = append(cached, newCandles...)
+	c.logger.Infof("%v %v candles uploaded in storage", c.ticker(id), len(newCandles))
 	return nil
 }
-
-type CandleDB struct {
-	Id            int     `db:"id"`
-	InstrumentUid string  `db:"instrument_uid"`
-	Open          float64 `db:"open"`
-	Close         float64 `db:"close"`
-	High          float64 `db:"high"`
-	Low           float64 `db:"low"`
-	Volume        int     `db:"volume"`
-	Time          int64   `db:"time"`
-	IsComplete    int     `db:"is_complete"`
-}
-
-// loadCandlesFromDB - Загрузка исторических свечей по инструменту из напрямую из бд
-func (c *CandlesStorage) loadCandlesFromDB(uid string, inc *pb.Quotation, from, to time.Time) ([]*pb.HistoricCandle, error) {
-	stmt, err := c.db.Preparex(`select * from candles where instrument_uid=? and time between ? and ? order by time`)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err := stmt.Close()
-		if err != nil {
-			c.logger.Errorf(err.Error())
-		}
-	}()
-
-	rows, err := stmt.Queryx(uid, from.Unix(), to.Unix())
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err := rows.Close()
-		if err != nil {
-			c.logger.Errorf(err.Error())
-		}
-	}()
-
-	dst := CandleDB{}
-	candles := make([]*pb.HistoricCandle, 0)
-	for rows.Next() {
-		err = rows.StructScan(&dst)
-		if err != nil {
-			return nil, err
-		}
-		if !reflect.DeepEqual(dst, CandleDB{}) {
-			candles = append(candles, &pb.HistoricCandle{
-				Open:       investgo.FloatToQuotation(dst.Open, inc),
-				High:       investgo.FloatToQuotation(dst.High, inc),
-				Low:        investgo.FloatToQuotation(dst.Low, inc),
-				Close:      investgo.FloatToQuotation(dst.Close, inc),
-				Volume:     int64(dst.Volume),
-				Time:       investgo.TimeToTimestamp(time.Unix(int64(dst.Time), 0)),
-				IsComplete: dst.IsComplete == 1,
-			})
-		}
-	}
-	c.logger.Infof("%v %v candles downloaded from storage", c.ticker(uid), len(candles))
-	return candles, nil
-}
@@ -0,0 +1,829 @@
+package bot
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/sizing"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Command - Команда интервального бота, от нее зависят флаги и проверка конфигурации
+type Command int
+
+const (
+	// CMD_BOT - Запуск бота, cmd/main.go
+	CMD_BOT Command = iota
+	// CMD_BACKTEST - Проверка на истории, cmd/backtest
+	CMD_BACKTEST
+	// CMD_DOWNLOADER - Загрузка свечей, cmd/candles_downloader
+	CMD_DOWNLOADER
+)
+
+func (c Command) String() string {
+	switch c {
+	case CMD_BOT:
+		return "bot"
+	case CMD_BACKTEST:
+		return "backtest"
+	case CMD_DOWNLOADER:
+		return "candles_downloader"
+	}
+	return fmt.Sprintf("Command(%d)", int(c))
+}
+
+// InstrumentsSelection - Типы инструментов для отбора
+type InstrumentsSelection int
+
+const (
+	// SHARES - Акции
+	SHARES InstrumentsSelection = iota
+	// ETFS - Фонды
+	ETFS
+	// SHARES_AND_ETFS - Акции и фонды
+	SHARES_AND_ETFS
+)
+
+var selectionNames = []string{"SHARES", "ETFS", "SHARES_AND_ETFS"}
+
+func (s InstrumentsSelection) String() string {
+	return enumName(selectionNames, int(s))
+}
+
+// MarshalText - Название типа отбора для yaml и флагов
+func (s InstrumentsSelection) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText - Тип отбора по названию, например SHARES_AND_ETFS
+func (s *InstrumentsSelection) UnmarshalText(text []byte) error {
+	v, err := parseEnum(selectionNames, "instruments selection", string(text))
+	*s = InstrumentsSelection(v)
+	return err
+}
+
+// RunMode - Режим запуска бектеста
+type RunMode int
+
+const (
+	// TEST_WITH_CONFIG - Запуск бектеста на одном конфиге
+	TEST_WITH_CONFIG RunMode = iota
+	// TEST_WITH_MULTIPLE_CONFIGS - Запуск генерации конфигов полным перебором и проверка их всех
+	TEST_WITH_MULTIPLE_CONFIGS
+	// OPTIMIZE - Подбор параметров с проверкой вне выборки на окнах walk-forward
+	OPTIMIZE
+	// PORTFOLIO - Проверка на одном конфиге с общим денежным балансом и переносом позиций между днями
+	PORTFOLIO
+)
+
+var runModeNames = []string{"TEST_WITH_CONFIG", "TEST_WITH_MULTIPLE_CONFIGS", "OPTIMIZE", "PORTFOLIO"}
+
+func (m RunMode) String() string {
+	return enumName(runModeNames, int(m))
+}
+
+// MarshalText - Название режима для yaml и флагов
+func (m RunMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText - Режим по названию, например OPTIMIZE
+func (m *RunMode) UnmarshalText(text []byte) error {
+	v, err := parseEnum(runModeNames, "run mode", string(text))
+	*m = RunMode(v)
+	return err
+}
+
+// TradeSide - Направление торговли интервальной стратегии
+type TradeSide int
+
+const (
+	// LONG - Покупка у нижней границы интервала и продажа у верхней
+	LONG TradeSide = iota
+	// SHORT - Продажа в короткую у верхней границы интервала и откуп у нижней, только инструменты с ShortEnabledFlag
+	SHORT
+	// LONG_AND_SHORT - Вход у ближайшей к цене границы интервала, в короткую только по инструментам с ShortEnabledFlag
+	LONG_AND_SHORT
+)
+
+var sideNames = []string{"LONG", "SHORT", "LONG_AND_SHORT"}
+
+func (s TradeSide) String() string {
+	return enumName(sideNames, int(s))
+}
+
+// MarshalText - Название направления для yaml и флагов
+func (s TradeSide) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText - Направление по названию, например LONG_AND_SHORT
+func (s *TradeSide) UnmarshalText(text []byte) error {
+	v, err := parseEnum(sideNames, "trade side", string(text))
+	*s = TradeSide(v)
+	return err
+}
+
+var analyseNames = []string{"MATH_STAT", "BEST_WIDTH", "SIMPLEST"}
+
+func (a AnalyseType) String() string {
+	return enumName(analyseNames, int(a))
+}
+
+// MarshalText - Название типа анализа для yaml и флагов
+func (a AnalyseType) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText - Тип анализа по названию, например BEST_WIDTH
+func (a *AnalyseType) UnmarshalText(text []byte) error {
+	v, err := parseEnum(analyseNames, "analyse type", string(text))
+	*a = AnalyseType(v)
+	return err
+}
+
+func enumName(names []string, v int) string {
+	if v < 0 || v >= len(names) {
+		return fmt.Sprintf("%d", v)
+	}
+	return names[v]
+}
+
+func parseEnum(names []string, kind, text string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(name, text) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %v %q, expected one of %v", kind, text, strings.Join(names, ", "))
+}
+
+// ParseCandleInterval - Интервал свечей по названию, например CANDLE_INTERVAL_1_MIN или 1_MIN
+func ParseCandleInterval(text string) (pb.CandleInterval, error) {
+	name := strings.ToUpper(text)
+	if !strings.HasPrefix(name, "CANDLE_INTERVAL_") {
+		name = "CANDLE_INTERVAL_" + name
+	}
+	v, ok := pb.CandleInterval_value[name]
+	if !ok || pb.CandleInterval(v) == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		return pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED, fmt.Errorf("unknown candle interval %q", text)
+	}
+	return pb.CandleInterval(v), nil
+}
+
+// MarshalYAML - Конфигурация стратегии с интервалом свечей в виде названия
+func (c IntervalStrategyConfig) MarshalYAML() (any, error) {
+	type plain IntervalStrategyConfig
+	return struct {
+		plain                 `yaml:",inline"`
+		StorageCandleInterval string `yaml:"StorageCandleInterval"`
+	}{plain(c), c.StorageCandleInterval.String()}, nil
+}
+
+// UnmarshalYAML - Чтение конфигурации стратегии поверх текущих значений, интервал свечей задается названием
+func (c *IntervalStrategyConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain IntervalStrategyConfig
+	aux := struct {
+		*plain                `yaml:",inline"`
+		StorageCandleInterval string `yaml:"StorageCandleInterval"`
+	}{(*plain)(c), c.StorageCandleInterval.String()}
+	// value.Decode не проверяет неизвестные поля, поэтому ключи проверяются по тегам структуры
+	known := map[string]bool{"StorageCandleInterval": true}
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("yaml")] = true
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if key := value.Content[i]; !known[key.Value] || key.Value == "-" {
+			return fmt.Errorf("line %v: field %v not found in strategy config", key.Line, key.Value)
+		}
+	}
+	if err := value.Decode(&aux); err != nil {
+		return err
+	}
+	interval, err := ParseCandleInterval(aux.StorageCandleInterval)
+	if err != nil {
+		return err
+	}
+	c.StorageCandleInterval = interval
+	return nil
+}
+
+// Validate - Проверка конфигурации стратегии для запуска бота
+func (c IntervalStrategyConfig) Validate() error {
+	errs := []error{
+		c.validatePositions(),
+		validateAnalyse(c.Analyse, c.AnalyseLowPercentile, c.AnalyseHighPercentile, c.MinProfit, c.StopLossPercent,
+			c.DaysToCalculateInterval),
+	}
+	if c.IntervalUpdateDelay <= 0 {
+		errs = append(errs, errors.New("IntervalUpdateDelay must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// validatePositions - Проверка параметров отбора инструментов и хранилища, общих для бота и бектеста
+func (c IntervalStrategyConfig) validatePositions() error {
+	errs := make([]error, 0)
+	if c.PreferredPositionPrice <= 0 {
+		errs = append(errs, errors.New("PreferredPositionPrice must be positive"))
+	}
+	if c.MaxPositionPrice < c.PreferredPositionPrice {
+		errs = append(errs, fmt.Errorf("MaxPositionPrice = %v is less than PreferredPositionPrice = %v",
+			c.MaxPositionPrice, c.PreferredPositionPrice))
+	}
+	if c.TopInstrumentsQuantity <= 0 {
+		errs = append(errs, errors.New("TopInstrumentsQuantity must be positive"))
+	}
+	if c.Side < LONG || c.Side > LONG_AND_SHORT {
+		errs = append(errs, fmt.Errorf("unknown trade side %v", c.Side))
+	}
+	return errors.Join(append(errs, validateStorage(c.StorageDBPath, c.StorageCandleInterval))...)
+}
+
+// Validate - Проверка конфигурации бектеста
+func (bc BacktestConfig) Validate() error {
+	errs := []error{
+		validateAnalyse(bc.Analyse, bc.LowPercentile, bc.HighPercentile, bc.MinProfit, bc.StopLoss,
+			bc.DaysToCalculateInterval),
+	}
+	if bc.Commission < 0 {
+		errs = append(errs, errors.New("Commission must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func validateAnalyse(analyse AnalyseType, low, high, minProfit, stopLoss float64, days int) error {
+	errs := make([]error, 0)
+	switch analyse {
+	case MATH_STAT:
+		if low < 0 || high > 100 || low >= high {
+			errs = append(errs, fmt.Errorf("percentiles must satisfy 0 <= low < high <= 100, got low = %v, high = %v",
+				low, high))
+		}
+	case BEST_WIDTH, SIMPLEST:
+	default:
+		errs = append(errs, fmt.Errorf("unknown analyse type %v", analyse))
+	}
+	if minProfit <= 0 {
+		errs = append(errs, errors.New("MinProfit must be positive"))
+	}
+	if stopLoss < 0 {
+		errs = append(errs, errors.New("stop loss must not be negative"))
+	}
+	if days <= 0 {
+		errs = append(errs, errors.New("DaysToCalculateInterval must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func validateStorage(path string, interval pb.CandleInterval) error {
+	errs := make([]error, 0)
+	if path == "" {
+		errs = append(errs, errors.New("StorageDBPath is required"))
+	}
+	if interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		errs = append(errs, errors.New("StorageCandleInterval is required"))
+	}
+	return errors.Join(errs...)
+}
+
+// Date - Дата или дата со временем в локальной зоне, в yaml и флагах задается как 2006-01-02 или 2006-01-02 15:04:05
+type Date struct {
+	time.Time
+}
+
+// MarshalText - Дата в формате 2006-01-02, если время не указано
+func (d Date) MarshalText() ([]byte, error) {
+	if d.Equal(time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, d.Location())) {
+		return []byte(d.Format(time.DateOnly)), nil
+	}
+	return []byte(d.Format(time.DateTime)), nil
+}
+
+// UnmarshalText - Чтение даты в локальной зоне
+func (d *Date) UnmarshalText(text []byte) error {
+	for _, layout := range []string{time.DateOnly, time.DateTime} {
+		t, err := time.ParseInLocation(layout, string(text), time.Local)
+		if err == nil {
+			d.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid date %q, expected %v or %v", text, time.DateOnly, time.DateTime)
+}
+
+// InstrumentsConfig - Отбор инструментов для торговли
+type InstrumentsConfig struct {
+	// Uids - Явный список uid инструментов, если он задан, остальные поля не используются
+	Uids []string `yaml:"Uids"`
+	// Selection - Типы инструментов для отбора
+	Selection InstrumentsSelection `yaml:"Selection"`
+	// ShareExchanges, EtfExchanges - Торговые площадки для отбора акций и фондов
+	ShareExchanges []string `yaml:"ShareExchanges"`
+	EtfExchanges   []string `yaml:"EtfExchanges"`
+	// Currency - Валюта инструментов
+	Currency string `yaml:"Currency"`
+	// ExcludeTickers - Тикеры, которые не нужно отбирать
+	ExcludeTickers []string `yaml:"ExcludeTickers"`
+	// ForQualInvestor - Если false, инструменты для квалифицированных инвесторов не отбираются
+	ForQualInvestor bool `yaml:"ForQualInvestor"`
+	// Max - Максимальное кол-во инструментов
+	Max int `yaml:"Max"`
+}
+
+// Validate - Проверка параметров отбора
+func (c InstrumentsConfig) Validate() error {
+	if len(c.Uids) > 0 {
+		return nil
+	}
+	errs := make([]error, 0)
+	if c.Max <= 0 {
+		errs = append(errs, errors.New("Instruments.Max must be positive"))
+	}
+	if c.Currency == "" {
+		errs = append(errs, errors.New("Instruments.Currency is required"))
+	}
+	if c.Selection != ETFS && len(c.ShareExchanges) == 0 {
+		errs = append(errs, errors.New("Instruments.ShareExchanges is required to select shares"))
+	}
+	if c.Selection != SHARES && len(c.EtfExchanges) == 0 {
+		errs = append(errs, errors.New("Instruments.EtfExchanges is required to select etfs"))
+	}
+	if c.Selection < SHARES || c.Selection > SHARES_AND_ETFS {
+		errs = append(errs, fmt.Errorf("unknown instruments selection %v", c.Selection))
+	}
+	return errors.Join(errs...)
+}
+
+// Select - Отбор uid инструментов: явный список Uids или акции и фонды, доступные для торговли через investAPI
+func (c InstrumentsConfig) Select(s *investgo.InstrumentsServiceClient) ([]string, error) {
+	if len(c.Uids) > 0 {
+		return c.Uids, nil
+	}
+	ids := make([]string, 0, c.Max)
+	match := func(exchanges []string, exchange, currency, ticker string, qual bool) bool {
+		if (qual && !c.ForQualInvestor) || !strings.EqualFold(currency, c.Currency) {
+			return false
+		}
+		for _, t := range c.ExcludeTickers {
+			if strings.EqualFold(t, ticker) {
+				return false
+			}
+		}
+		for _, e := range exchanges {
+			if strings.EqualFold(e, exchange) {
+				return true
+			}
+		}
+		return false
+	}
+	if c.Selection == SHARES || c.Selection == SHARES_AND_ETFS {
+		resp, err := s.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range resp.GetInstruments() {
+			if len(ids) >= c.Max {
+				return ids, nil
+			}
+			if match(c.ShareExchanges, share.GetExchange(), share.GetCurrency(), share.GetTicker(), share.GetForQualInvestorFlag()) {
+				ids = append(ids, share.GetUid())
+			}
+		}
+	}
+	if c.Selection == ETFS || c.Selection == SHARES_AND_ETFS {
+		resp, err := s.Etfs(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+		if err != nil {
+			return nil, err
+		}
+		for _, etf := range resp.GetInstruments() {
+			if len(ids) >= c.Max {
+				return ids, nil
+			}
+			if match(c.EtfExchanges, etf.GetExchange(), etf.GetCurrency(), etf.GetTicker(), etf.GetForQualInvestorFlag()) {
+				ids = append(ids, etf.GetUid())
+			}
+		}
+	}
+	return ids, nil
+}
+
+// RunConfig - Параметры запуска бота
+type RunConfig struct {
+	// Exchange - Биржа, по расписанию которой бот запускается и останавливается
+	Exchange string `yaml:"Exchange"`
+	// CancelAhead - За сколько до конца торгов бот получает событие STOP
+	CancelAhead time.Duration `yaml:"CancelAhead"`
+	// Risk - Лимиты риск-менеджера для поручений бота, если секции нет - без проверок
+	Risk *investgo.RiskConfig `yaml:"Risk,omitempty"`
+	// Sizing - Размер позиций по капиталу счета, риску на сделку и волатильности, если секции нет - кол-во лотов
+	// подбирается по PreferredPositionPrice
+	Sizing *sizing.Config `yaml:"Sizing,omitempty"`
+}
+
+// ParamConfig - Оптимизируемое поле BacktestConfig: перечисленные значения Values или диапазон Min-Max с шагом Step
+type ParamConfig struct {
+	Name   string  `yaml:"Name"`
+	Values []any   `yaml:"Values,omitempty"`
+	Min    float64 `yaml:"Min,omitempty"`
+	Max    float64 `yaml:"Max,omitempty"`
+	Step   float64 `yaml:"Step,omitempty"`
+}
+
+// Param - Параметр для оптимизатора
+func (p ParamConfig) Param() backtest.Param {
+	if len(p.Values) > 0 {
+		return backtest.Values(p.Name, p.Values...)
+	}
+	return backtest.FloatRange(p.Name, p.Min, p.Max, p.Step)
+}
+
+// OptimizeConfig - Параметры режима OPTIMIZE
+type OptimizeConfig struct {
+	// Params - Перебираемые поля BacktestConfig, остальные поля берутся из Backtest.Config.
+	// Если перебирается только LowPercentile, HighPercentile симметричен ему
+	Params []ParamConfig `yaml:"Params"`
+	// Search - Способ перебора: grid, random или halving, для random нужно задать Samples
+	Search  backtest.Search `yaml:"Search"`
+	Samples int             `yaml:"Samples"`
+	// Metric - Показатель, по которому выбирается лучший конфиг на периоде обучения
+	Metric backtest.Metric `yaml:"Metric"`
+	// MinTrades - Минимальное кол-во сделок на периоде обучения
+	MinTrades int `yaml:"MinTrades"`
+	// TrainDays, TestDays - Окна walk-forward: подбор на TrainDays днях, проверка на следующих TestDays днях
+	TrainDays int `yaml:"TrainDays"`
+	TestDays  int `yaml:"TestDays"`
+	// Anchored - Если true, обучение всегда начинается с начала периода бектеста
+	Anchored bool `yaml:"Anchored"`
+}
+
+// MultipleConfigsConfig - Границы параметров BacktestConfig, которые перебираются в режиме TEST_WITH_MULTIPLE_CONFIGS.
+// Для каждого параметра перебираются значения в [Min, Max) с фиксированным шагом
+type MultipleConfigsConfig struct {
+	// StopLossMin, StopLossMax - Стоп-лосс в процентах, шаг 0.1
+	StopLossMin float64 `yaml:"StopLossMin"`
+	StopLossMax float64 `yaml:"StopLossMax"`
+	// DaysMin, DaysMax - Кол-во дней для расчета интервала, шаг 1
+	DaysMin int `yaml:"DaysMin"`
+	DaysMax int `yaml:"DaysMax"`
+	// MinProfitMin, MinProfitMax - Минимальный профит в процентах, шаг 0.1
+	MinProfitMin float64 `yaml:"MinProfitMin"`
+	MinProfitMax float64 `yaml:"MinProfitMax"`
+	// PercentileMin, PercentileMax - Нижний перцентиль для MATH_STAT, верхний симметричен ему, шаг 1
+	PercentileMin float64 `yaml:"PercentileMin"`
+	PercentileMax float64 `yaml:"PercentileMax"`
+}
+
+// Validate - Проверка границ параметров режима TEST_WITH_MULTIPLE_CONFIGS
+func (c MultipleConfigsConfig) Validate() error {
+	errs := make([]error, 0)
+	if c.StopLossMin <= 0 || c.StopLossMin >= c.StopLossMax {
+		errs = append(errs, fmt.Errorf("MultipleConfigs.StopLossMin = %v must be positive and less than StopLossMax = %v",
+			c.StopLossMin, c.StopLossMax))
+	}
+	if c.DaysMin <= 0 || c.DaysMin >= c.DaysMax {
+		errs = append(errs, fmt.Errorf("MultipleConfigs.DaysMin = %v must be positive and less than DaysMax = %v",
+			c.DaysMin, c.DaysMax))
+	}
+	if c.MinProfitMin <= 0 || c.MinProfitMin >= c.MinProfitMax {
+		errs = append(errs, fmt.Errorf("MultipleConfigs.MinProfitMin = %v must be positive and less than MinProfitMax = %v",
+			c.MinProfitMin, c.MinProfitMax))
+	}
+	if c.PercentileMin <= 0 || c.PercentileMin >= c.PercentileMax || c.PercentileMax > 50 {
+		errs = append(errs, fmt.Errorf("MultipleConfigs.PercentileMin = %v must be positive and less than PercentileMax = %v, "+
+			"PercentileMax must not be greater than 50", c.PercentileMin, c.PercentileMax))
+	}
+	return errors.Join(errs...)
+}
+
+// BacktestRunConfig - Параметры проверки на истории
+type BacktestRunConfig struct {
+	// From, To - Период проверки
+	From Date `yaml:"From"`
+	To   Date `yaml:"To"`
+	// Mode - Режим запуска
+	Mode RunMode `yaml:"Mode"`
+	// Config - Конфиг бектеста, в бектесте заменяет параметры анализа из Strategy
+	Config BacktestConfig `yaml:"Config"`
+	// ReportDir - Каталог для отчетов: html, json и csv со сделками и кривой капитала
+	ReportDir string `yaml:"ReportDir"`
+	// MultipleConfigs - Границы перебора режима TEST_WITH_MULTIPLE_CONFIGS
+	MultipleConfigs MultipleConfigsConfig `yaml:"MultipleConfigs"`
+	// Optimize - Параметры режима OPTIMIZE
+	Optimize OptimizeConfig `yaml:"Optimize"`
+	// Portfolio - Параметры режима PORTFOLIO
+	Portfolio PortfolioConfig `yaml:"Portfolio"`
+	// MonteCarlo - Анализ Монте-Карло по журналу сделок режимов TEST_WITH_CONFIG и PORTFOLIO, 0 прогонов - без анализа
+	MonteCarlo backtest.MonteCarloConfig `yaml:"MonteCarlo"`
+}
+
+// Validate - Проверка параметров бектеста
+func (c BacktestRunConfig) Validate() error {
+	errs := []error{c.Config.Validate()}
+	if !c.From.Before(c.To.Time) {
+		errs = append(errs, fmt.Errorf("Backtest.From = %v must be before Backtest.To = %v", c.From.Format(time.DateTime),
+			c.To.Format(time.DateTime)))
+	}
+	if c.Mode < TEST_WITH_CONFIG || c.Mode > PORTFOLIO {
+		errs = append(errs, fmt.Errorf("unknown run mode %v", c.Mode))
+	}
+	if c.Mode == TEST_WITH_MULTIPLE_CONFIGS {
+		errs = append(errs, c.MultipleConfigs.Validate())
+	}
+	if c.Mode == OPTIMIZE {
+		o := c.Optimize
+		if len(o.Params) == 0 {
+			errs = append(errs, errors.New("Optimize.Params is required"))
+		}
+		for _, p := range o.Params {
+			values := p.Param().Values
+			if len(values) == 0 {
+				errs = append(errs, fmt.Errorf("optimize param %v has no values", p.Name))
+			}
+			// имя поля и типы значений проверяются записью в пустой конфиг
+			for _, v := range values {
+				if err := (backtest.Params{p.Name: v}).Apply(&BacktestConfig{}); err != nil {
+					errs = append(errs, err)
+					break
+				}
+			}
+		}
+		if o.Search == backtest.SEARCH_RANDOM && o.Samples <= 0 {
+			errs = append(errs, errors.New("Optimize.Samples is required for random search"))
+		}
+		if o.TrainDays <= 0 || o.TestDays <= 0 {
+			errs = append(errs, errors.New("Optimize.TrainDays and Optimize.TestDays must be positive"))
+		}
+	}
+	if c.Mode == PORTFOLIO {
+		errs = append(errs, c.Portfolio.Validate())
+	}
+	if mc := c.MonteCarlo; mc.Runs < 0 || mc.BlockSize < 0 || mc.RuinDrawdown < 0 || mc.Confidence < 0 || mc.Confidence >= 1 {
+		errs = append(errs, errors.New("MonteCarlo.Runs, BlockSize and RuinDrawdown must not be negative, Confidence must be in [0, 1)"))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate - Проверка параметров режима PORTFOLIO
+func (c PortfolioConfig) Validate() error {
+	errs := make([]error, 0)
+	if c.InitialCash <= 0 {
+		errs = append(errs, fmt.Errorf("Portfolio.InitialCash = %v must be positive", c.InitialCash))
+	}
+	if c.Leverage < 1 {
+		errs = append(errs, fmt.Errorf("Portfolio.Leverage = %v must be at least 1", c.Leverage))
+	}
+	if c.MarginRate < 0 || c.MarginCall < 0 || c.MaxPositions < 0 {
+		errs = append(errs, errors.New("Portfolio.MarginRate, Portfolio.MarginCall and Portfolio.MaxPositions must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// DownloadConfig - Параметры загрузки свечей, путь к бд и интервал берутся из Strategy
+type DownloadConfig struct {
+	// From - Начало загружаемой истории
+	From Date `yaml:"From"`
+}
+
+// Config - Конфигурация команд интервального бота. Одни и те же секции используются всеми командами, поэтому
+// один yaml файл стратегии подходит для загрузки свечей, бектеста и запуска бота
+type Config struct {
+	// Instruments - Отбор инструментов
+	Instruments InstrumentsConfig `yaml:"Instruments"`
+	// Strategy - Конфигурация стратегии
+	Strategy IntervalStrategyConfig `yaml:"Strategy"`
+	// Bot - Параметры запуска бота
+	Bot RunConfig `yaml:"Bot"`
+	// Backtest - Параметры проверки на истории
+	Backtest BacktestRunConfig `yaml:"Backtest"`
+	// Download - Параметры загрузки свечей
+	Download DownloadConfig `yaml:"Download"`
+	// DisableInfoLogs - Отключение информационных сообщений, вместо них показывается прогресс
+	DisableInfoLogs bool `yaml:"DisableInfoLogs"`
+}
+
+// Validate - Проверка конфигурации для команды cmd
+func (c Config) Validate(cmd Command) error {
+	errs := []error{c.Instruments.Validate()}
+	switch cmd {
+	case CMD_BOT:
+		errs = append(errs, c.Strategy.Validate())
+		if c.Bot.Exchange == "" {
+			errs = append(errs, errors.New("Bot.Exchange is required"))
+		}
+		if c.Bot.CancelAhead < 0 {
+			errs = append(errs, errors.New("Bot.CancelAhead must not be negative"))
+		}
+		if c.Bot.Risk != nil {
+			errs = append(errs, c.Bot.Risk.Validate())
+		}
+		if c.Bot.Sizing != nil {
+			errs = append(errs, c.Bot.Sizing.Validate())
+		}
+	case CMD_BACKTEST:
+		errs = append(errs, c.Strategy.validatePositions(), c.Backtest.Validate())
+	case CMD_DOWNLOADER:
+		errs = append(errs, validateStorage(c.Strategy.StorageDBPath, c.Strategy.StorageCandleInterval))
+		if !c.Download.From.Before(time.Now()) {
+			errs = append(errs, errors.New("Download.From must be in the past"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteYAML - Запись конфигурации в yaml, например для --print-config
+func (c Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Options - Параметры командной строки, не относящиеся к стратегии
+type Options struct {
+	// ConfigPath - Путь к yaml файлу стратегии, пустой - используются значения по умолчанию
+	ConfigPath string
+	// SDKConfigPath - Путь к yaml файлу конфигурации сдк с токеном
+	SDKConfigPath string
+	// PrintConfig - Вывести итоговую конфигурацию и завершить работу
+	PrintConfig bool
+}
+
+// LoadConfig - Конфигурация команды cmd: значения по умолчанию defaults, поверх них yaml файл стратегии из флага
+// --config, поверх него остальные флаги из args. Итоговая конфигурация проверяется
+func LoadConfig(cmd Command, defaults Config, args []string) (Config, Options, error) {
+	// первый проход нужен только для пути к файлу стратегии, ошибки флагов покажет второй проход
+	var opts Options
+	c := defaults
+	fs := cmd.flagSet(&c, &opts)
+	fs.SetOutput(io.Discard)
+	_ = fs.Parse(args)
+	c = defaults
+	if opts.ConfigPath != "" {
+		if err := loadYAML(opts.ConfigPath, &c); err != nil {
+			return Config{}, Options{}, fmt.Errorf("strategy config %v: %w", opts.ConfigPath, err)
+		}
+	}
+	fs = cmd.flagSet(&c, &opts)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, Options{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, Options{}, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return c, opts, c.Validate(cmd)
+}
+
+// loadYAML - Чтение yaml поверх значений c, неизвестные поля считаются ошибкой
+func loadYAML(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// flagSet - Флаги команды, привязанные к полям c
+func (cmd Command) flagSet(c *Config, opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.String(), flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "config", "", "path to strategy yaml, flags override its values")
+	fs.StringVar(&opts.SDKConfigPath, "sdk-config", "config.yaml", "path to sdk yaml with token")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print resulting config as yaml and exit")
+	fs.BoolVar(&c.DisableInfoLogs, "disable-info-logs", c.DisableInfoLogs, "show only errors and progress")
+
+	i := &c.Instruments
+	fs.Var((*listValue)(&i.Uids), "uids", "comma separated instrument uids, disables selection")
+	fs.TextVar(&i.Selection, "selection", i.Selection, "instruments selection: SHARES, ETFS or SHARES_AND_ETFS")
+	fs.Var((*listValue)(&i.ShareExchanges), "share-exchanges", "comma separated exchanges for shares")
+	fs.Var((*listValue)(&i.EtfExchanges), "etf-exchanges", "comma separated exchanges for etfs")
+	fs.StringVar(&i.Currency, "currency", i.Currency, "instruments currency")
+	fs.IntVar(&i.Max, "instruments-max", i.Max, "max instruments quantity")
+
+	s := &c.Strategy
+	fs.StringVar(&s.StorageDBPath, "db", s.StorageDBPath, "path to candles sqlite db")
+	fs.Var((*candleIntervalValue)(&s.StorageCandleInterval), "interval", "candle interval, for example 1_MIN")
+	if cmd == CMD_DOWNLOADER {
+		fs.TextVar(&c.Download.From, "from", c.Download.From, "history start, 2006-01-02 or 2006-01-02 15:04:05")
+		return fs
+	}
+
+	fs.Float64Var(&s.PreferredPositionPrice, "preferred-price", s.PreferredPositionPrice, "preferred position price")
+	fs.Float64Var(&s.MaxPositionPrice, "max-price", s.MaxPositionPrice, "max position price")
+	fs.IntVar(&s.TopInstrumentsQuantity, "top", s.TopInstrumentsQuantity, "top instruments by volatility")
+	fs.BoolVar(&s.SellOut, "sell-out", s.SellOut, "close positions at the end of trading")
+	fs.TextVar(&s.Side, "side", s.Side, "trade side: LONG, SHORT or LONG_AND_SHORT")
+	// параметры анализа в бектесте задаются конфигом бектеста, в боте - конфигом стратегии
+	analyse, low, high, minProfit, stopLoss, days := &s.Analyse, &s.AnalyseLowPercentile, &s.AnalyseHighPercentile,
+		&s.MinProfit, &s.StopLossPercent, &s.DaysToCalculateInterval
+	if cmd == CMD_BACKTEST {
+		bc := &c.Backtest.Config
+		analyse, low, high, minProfit, stopLoss, days = &bc.Analyse, &bc.LowPercentile, &bc.HighPercentile,
+			&bc.MinProfit, &bc.StopLoss, &bc.DaysToCalculateInterval
+	}
+	fs.TextVar(analyse, "analyse", *analyse, "analyse type: MATH_STAT, BEST_WIDTH or SIMPLEST")
+	fs.Float64Var(low, "low-percentile", *low, "low percentile for MATH_STAT")
+	fs.Float64Var(high, "high-percentile", *high, "high percentile for MATH_STAT")
+	fs.Float64Var(minProfit, "min-profit", *minProfit, "min profit in percent")
+	fs.Float64Var(stopLoss, "stop-loss", *stopLoss, "stop loss in percent")
+	fs.IntVar(days, "days", *days, "days to calculate interval")
+
+	switch cmd {
+	case CMD_BOT:
+		fs.DurationVar(&s.IntervalUpdateDelay, "update-delay", s.IntervalUpdateDelay, "interval recalculation delay")
+		fs.StringVar(&c.Bot.Exchange, "exchange", c.Bot.Exchange, "exchange for trading schedule")
+		fs.DurationVar(&c.Bot.CancelAhead, "cancel-ahead", c.Bot.CancelAhead, "stop bot before the end of trading")
+	case CMD_BACKTEST:
+		b := &c.Backtest
+		fs.TextVar(&b.From, "from", b.From, "backtest start, 2006-01-02 or 2006-01-02 15:04:05")
+		fs.TextVar(&b.To, "to", b.To, "backtest end, 2006-01-02 or 2006-01-02 15:04:05")
+		fs.TextVar(&b.Mode, "mode", b.Mode, "run mode: TEST_WITH_CONFIG, TEST_WITH_MULTIPLE_CONFIGS, OPTIMIZE or PORTFOLIO")
+		fs.Float64Var(&b.Config.Commission, "commission", b.Config.Commission, "commission in percent")
+		fs.StringVar(&b.ReportDir, "report-dir", b.ReportDir, "report directory")
+		m := &b.MultipleConfigs
+		fs.Float64Var(&m.StopLossMin, "stop-loss-min", m.StopLossMin, "min stop loss for TEST_WITH_MULTIPLE_CONFIGS")
+		fs.Float64Var(&m.StopLossMax, "stop-loss-max", m.StopLossMax, "max stop loss for TEST_WITH_MULTIPLE_CONFIGS, exclusive")
+		fs.IntVar(&m.DaysMin, "days-min", m.DaysMin, "min days to calculate interval for TEST_WITH_MULTIPLE_CONFIGS")
+		fs.IntVar(&m.DaysMax, "days-max", m.DaysMax, "max days to calculate interval for TEST_WITH_MULTIPLE_CONFIGS, exclusive")
+		fs.Float64Var(&m.MinProfitMin, "min-profit-min", m.MinProfitMin, "min of min profit for TEST_WITH_MULTIPLE_CONFIGS")
+		fs.Float64Var(&m.MinProfitMax, "min-profit-max", m.MinProfitMax, "max of min profit for TEST_WITH_MULTIPLE_CONFIGS, exclusive")
+		fs.Float64Var(&m.PercentileMin, "percentile-min", m.PercentileMin, "min low percentile for TEST_WITH_MULTIPLE_CONFIGS")
+		fs.Float64Var(&m.PercentileMax, "percentile-max", m.PercentileMax, "max low percentile for TEST_WITH_MULTIPLE_CONFIGS, exclusive")
+		o := &b.Optimize
+		fs.TextVar(&o.Search, "search", o.Search, "optimize search: grid, random or halving")
+		fs.IntVar(&o.Samples, "samples", o.Samples, "random configs quantity for random and halving search")
+		fs.TextVar(&o.Metric, "metric", o.Metric, "optimize metric: net_profit, return, sharpe, sortino, profit_factor, win_rate or return_drawdown")
+		fs.IntVar(&o.MinTrades, "min-trades", o.MinTrades, "min trades on train period")
+		fs.IntVar(&o.TrainDays, "train-days", o.TrainDays, "walk-forward train days")
+		fs.IntVar(&o.TestDays, "test-days", o.TestDays, "walk-forward test days")
+		fs.BoolVar(&o.Anchored, "anchored", o.Anchored, "walk-forward train always starts at backtest start")
+		p := &b.Portfolio
+		fs.Float64Var(&p.InitialCash, "initial-cash", p.InitialCash, "portfolio initial cash")
+		fs.Float64Var(&p.Leverage, "leverage", p.Leverage, "portfolio buying power leverage, 1 - without margin")
+		fs.Float64Var(&p.MarginRate, "margin-rate", p.MarginRate, "annual margin rate in percent")
+		fs.Float64Var(&p.MarginCall, "margin-call", p.MarginCall, "min equity in percent of positions value")
+		fs.IntVar(&p.MaxPositions, "max-positions", p.MaxPositions, "max open positions, 0 - unlimited")
+		mc := &b.MonteCarlo
+		fs.IntVar(&mc.Runs, "mc-runs", mc.Runs, "monte carlo runs, 0 - without monte carlo analysis")
+		fs.TextVar(&mc.Resampling, "mc-resampling", mc.Resampling, "monte carlo resampling: bootstrap, block or shuffle")
+		fs.TextVar(&mc.Slippage.Distribution, "mc-slippage", mc.Slippage.Distribution,
+			"monte carlo slippage distribution: none, fixed, uniform, normal or exponential")
+	}
+	return fs
+}
+
+// listValue - Флаг со списком строк через запятую
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// candleIntervalValue - Флаг с названием интервала свечей
+type candleIntervalValue pb.CandleInterval
+
+func (c *candleIntervalValue) String() string {
+	if c == nil {
+		return ""
+	}
+	return pb.CandleInterval(*c).String()
+}
+
+func (c *candleIntervalValue) Set(s string) error {
+	interval, err := ParseCandleInterval(s)
+	if err != nil {
+		return err
+	}
+	*c = candleIntervalValue(interval)
+	return nil
+}
@@ -9,9 +9,17 @@ import (
 	"time"
 
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/sizing"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 )
 
+// SELL_OUT_TIMEOUT - Время, в течение которого SellOut повторяет попытки закрыть позиции
+const SELL_OUT_TIMEOUT = 2 * time.Minute
+
+// MARGIN_TTL - Время, в течение которого используются запрошенные маржинальные показатели счета,
+// при изменении позиций они запрашиваются заново
+const MARGIN_TTL = time.Minute
+
 type InstrumentState int
 
 const (
@@ -26,6 +34,12 @@ const (
 	TRY_TO_BUY
 	// TRY_TO_SELL - Выставлена лимитная заявка на продажу этого инструмента
 	TRY_TO_SELL
+	// IN_SHORT - Есть открытая короткая позиция по этому инструменту
+	IN_SHORT
+	// TRY_TO_SHORT - Выставлена лимитная заявка на продажу для открытия короткой позиции
+	TRY_TO_SHORT
+	// TRY_TO_COVER - Выставлена лимитная заявка на покупку для закрытия короткой позиции
+	TRY_TO_COVER
 )
 
 // State - Текущее состояние торгового инструмента
@@ -33,7 +47,7 @@ type State struct {
 	// instrumentState - Текущее состояние торгового инструмента
 	instrumentState InstrumentState
 	// orderId - Идентификатор выставленного биржевого поручения. Используется только при
-	// state = TRY_TO_BUY или TRY_TO_SELL
+	// state = TRY_TO_BUY, TRY_TO_SELL, TRY_TO_SHORT или TRY_TO_COVER
 	orderId string
 }
 
@@ -79,6 +93,8 @@ type Instrument struct {
 	EntryPrice float64
 	// stopLossPercent - Процент изменения цены, для стоп-лосс заявки
 	StopLossPercent float64
+	// ShortEnabled - Признак доступности инструмента для операций в короткую, ShortEnabledFlag
+	ShortEnabled bool
 }
 
 type intervals struct {
@@ -105,6 +121,14 @@ func (i *intervals) get(id string) (Interval, bool) {
 	return inter, ok
 }
 
+// orderRouter - Выставление поручений исполнителя, реализуется OrdersServiceClient и RiskManager
+type orderRouter interface {
+	Buy(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error)
+	Sell(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error)
+	CancelOrder(accountId, orderId string) (*investgo.CancelOrderResponse, error)
+	ReplaceOrder(req *investgo.ReplaceOrderRequest) (*investgo.PostOrderResponse, error)
+}
+
 // Executor - Вызывается ботом и исполняет торговые поручения
 type Executor struct {
 	// instruments - Инструменты, которыми торгует исполнитель
@@ -118,17 +142,28 @@ type Executor struct {
 	instrumentsStates *States
 	intervals         *intervals
 	strategyProfit    float64
+	// side - Направление торговли, задается при запуске
+	side TradeSide
 
 	client            *investgo.Client
-	ordersService     *investgo.OrdersServiceClient
+	ordersService     orderRouter
 	operationsService *investgo.OperationsServiceClient
+	usersService      *investgo.UsersServiceClient
+	margin            *Margin
+	// risk - Риск-менеджер, через который идут поручения, nil - без проверок
+	risk *investgo.RiskManager
+	// sizer - Расчет кол-ва лотов при запуске, nil - Quantity инструментов не меняется
+	sizer *sizing.Sizer
 }
 
-func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrument) *Executor {
+// NewExecutor - Создание исполнителя, если risk != nil, поручения проверяются риск-менеджером с этими лимитами,
+// если sizingConfig != nil, кол-во лотов инструментов рассчитывается при запуске по капиталу счета
+func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrument, risk *investgo.RiskConfig,
+	sizingConfig *sizing.Config) *Executor {
 	ctxExecutor, cancel := context.WithCancel(ctx)
 	wg := &sync.WaitGroup{}
 
-	return &Executor{
+	e := &Executor{
 		instruments:       ids,
 		positions:         NewPositions(),
 		instrumentsStates: NewStates(),
@@ -139,15 +174,40 @@ func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrum
 		client:            c,
 		ordersService:     c.NewOrdersServiceClient(),
 		operationsService: c.NewOperationsServiceClient(),
+		usersService:      c.NewUsersServiceClient(),
+		margin:            &Margin{},
+	}
+	if risk != nil {
+		instruments := make([]investgo.EngineInstrument, 0, len(ids))
+		for id, instrument := range ids {
+			instruments = append(instruments, investgo.EngineInstrument{
+				Uid:       id,
+				Ticker:    instrument.Ticker,
+				Lot:       int64(instrument.Lot),
+				Currency:  instrument.Currency,
+				PriceStep: instrument.MinPriceInc,
+			})
+		}
+		e.risk = investgo.NewRiskManager(c.NewOrdersServiceClient(), instruments, *risk, c.Logger)
+		e.ordersService = e.risk
+	}
+	if sizingConfig != nil {
+		e.sizer = sizing.NewSizer(c, *sizingConfig)
 	}
+	return e
 }
 
 // Start - Запуск отслеживания инструментов и непрерывное выставление лимитных заявок по интервалам
-func (e *Executor) Start(i map[string]Interval) error {
+// в направлении side
+func (e *Executor) Start(i map[string]Interval, side TradeSide) error {
+	e.side = side
 	err := e.updatePositionsUnary()
 	if err != nil {
 		return err
 	}
+	if e.risk != nil {
+		e.loadRiskState()
+	}
 	// обновление позиций
 	e.wg.Add(1)
 	go func(ctx context.Context) {
@@ -161,10 +221,20 @@ func (e *Executor) Start(i map[string]Interval) error {
 	// начальные значения интервалов цен
 	e.intervals = newIntervals(i)
 
+	// инструменты, по которым риск на сделку не покрывает даже один лот, не торгуются
+	skip := make(map[string]bool)
+	if e.sizer != nil {
+		skip = e.resize(i)
+	}
+
 	// пытаемся выставить заявки на покупку и далее отслеживаем статусы инструментов и выставляем заявки
 	for id := range e.intervals.i {
+		state := WAIT_ENTRY_PRICE
+		if skip[id] {
+			state = OUT_OF_STOCK
+		}
 		e.instrumentsStates.Update(id, State{
-			instrumentState: WAIT_ENTRY_PRICE,
+			instrumentState: state,
 			orderId:         "",
 		})
 	}
@@ -190,6 +260,43 @@ func (e *Executor) Start(i map[string]Interval) error {
 	return nil
 }
 
+// resize - Расчет кол-ва лотов по капиталу счета, стоп-лоссу и ATR. Цена входа - граница интервала, при торговле
+// в короткую берется верхняя граница, как более дорогая. Возвращает инструменты, для которых получилось 0 лотов,
+// при ошибке расчета кол-во лотов инструмента не меняется
+func (e *Executor) resize(i map[string]Interval) map[string]bool {
+	skip := make(map[string]bool)
+	for id, interval := range i {
+		instrument, ok := e.instruments[id]
+		if !ok {
+			continue
+		}
+		price, stop := interval.low, interval.low*(1-instrument.StopLossPercent/100)
+		if e.side != LONG && instrument.ShortEnabled {
+			price, stop = interval.high, interval.high*(1+instrument.StopLossPercent/100)
+		}
+		size, err := e.sizer.Size(sizing.Request{
+			InstrumentId: id,
+			Price:        price,
+			StopPrice:    stop,
+			Lot:          int64(instrument.Lot),
+			Currency:     instrument.Currency,
+		})
+		if err != nil {
+			e.client.Logger.Errorf("sizing %v: %v, quantity = %v lots", e.ticker(id), err.Error(), instrument.Quantity)
+			continue
+		}
+		e.client.Logger.Infof("sizing %v: %v lots by %v, equity = %.2f, stop distance = %.4f, risk = %.2f of %.2f",
+			e.ticker(id), size.Lots, size.Limit, size.Equity, size.StopDistance, size.Risk, size.RiskBudget)
+		if size.Lots == 0 {
+			skip[id] = true
+			continue
+		}
+		instrument.Quantity = size.Lots
+		e.instruments[id] = instrument
+	}
+	return skip
+}
+
 // Stop - Завершение работы
 func (e *Executor) Stop(sellOut bool) error {
 	// останавливаем обновление позиций и сделок
@@ -308,13 +415,112 @@ func (e *Executor) SellLimit(id string, price float64) error {
 	return nil
 }
 
+// ShortLimit - Выставление лимитного торгового поручения на продажу для открытия короткой позиции по инструменту
+// с uid = id по цене ближайшей к price
+func (e *Executor) ShortLimit(id string, price float64) error {
+	currentInstrument, ok := e.instruments[id]
+	if !ok {
+		return fmt.Errorf("instrument %v not found in executor map", id)
+	}
+	if !e.possibleToShort(id, price) {
+		return nil
+	}
+	resp, err := e.ordersService.Sell(&investgo.PostOrderRequestShort{
+		InstrumentId: id,
+		Quantity:     currentInstrument.Quantity,
+		Price:        investgo.FloatToQuotation(price, currentInstrument.MinPriceInc),
+		AccountId:    e.client.Config.AccountId,
+		OrderType:    pb.OrderType_ORDER_TYPE_LIMIT,
+		OrderId:      investgo.CreateUid(),
+	})
+	if err != nil {
+		e.client.Logger.Errorf(investgo.MessageFromHeader(resp.GetHeader()))
+		return err
+	}
+	e.instrumentsStates.Update(id, State{
+		instrumentState: TRY_TO_SHORT,
+		orderId:         resp.GetOrderId(),
+	})
+	e.client.Logger.Infof("post short limit order with %v price = %v", e.ticker(resp.GetInstrumentUid()),
+		investgo.FloatToQuotation(price, currentInstrument.MinPriceInc).ToFloat())
+	return nil
+}
+
+// possibleToShort - Проверка маржинальных показателей счета для открытия короткой позиции по инструменту c uid = id
+// по цене price: ликвидный портфель сверх начальной маржи должен покрывать стоимость позиции
+func (e *Executor) possibleToShort(id string, price float64) bool {
+	currentInstrument, ok := e.instruments[id]
+	if !ok {
+		e.client.Logger.Infof("instrument %v not found in executor map", id)
+		return false
+	}
+	if !currentInstrument.ShortEnabled {
+		e.client.Logger.Infof("executor: %v is not available for short", e.ticker(id))
+		return false
+	}
+	resp, ok := e.margin.Get()
+	if !ok {
+		marginResp, err := e.usersService.GetMarginAttributes(e.client.Config.AccountId)
+		if err != nil {
+			e.client.Logger.Errorf("executor: margin attributes: %v %v", err.Error(), investgo.MessageFromHeader(marginResp.GetHeader()))
+			return false
+		}
+		resp = marginResp.GetMarginAttributesResponse
+		e.margin.Update(resp)
+	}
+	required := price * float64(currentInstrument.Quantity) * float64(currentInstrument.Lot)
+	free := resp.GetLiquidPortfolio().ToFloat() - resp.GetStartingMargin().ToFloat()
+	if resp.GetAmountOfMissingFunds().ToFloat() > 0 || free < required {
+		e.client.Logger.Infof("executor: not enough margin to short %v, free = %.3f, required = %.3f", e.ticker(id),
+			free, required)
+		return false
+	}
+	return true
+}
+
+// CoverLimit - Выставление лимитного торгового поручения на покупку для закрытия короткой позиции по инструменту
+// с uid = id по цене ближайшей к price
+func (e *Executor) CoverLimit(id string, price float64) error {
+	currentInstrument, ok := e.instruments[id]
+	if !ok {
+		return fmt.Errorf("instrument %v not found in executor map", id)
+	}
+	st, ok := e.instrumentsStates.Get(id)
+	if !ok {
+		e.client.Logger.Infof("%v not found in instrumentStates", e.ticker(id))
+		return nil
+	}
+	if st.instrumentState != IN_SHORT {
+		e.client.Logger.Infof("cover limit fail %v not in short", e.ticker(id))
+		return nil
+	}
+	resp, err := e.ordersService.Buy(&investgo.PostOrderRequestShort{
+		InstrumentId: id,
+		Quantity:     currentInstrument.Quantity,
+		Price:        investgo.FloatToQuotation(price, currentInstrument.MinPriceInc),
+		AccountId:    e.client.Config.AccountId,
+		OrderType:    pb.OrderType_ORDER_TYPE_LIMIT,
+		OrderId:      investgo.CreateUid(),
+	})
+	if err != nil {
+		return err
+	}
+	e.instrumentsStates.Update(id, State{
+		instrumentState: TRY_TO_COVER,
+		orderId:         resp.GetOrderId(),
+	})
+	e.client.Logger.Infof("post cover limit order, with %v price = %v", e.ticker(resp.GetInstrumentUid()),
+		investgo.FloatToQuotation(price, currentInstrument.MinPriceInc).ToFloat())
+	return nil
+}
+
 // CancelLimit - Отмена текущего лимитного поручения, если оно есть, для инструмента с uid = id
 func (e *Executor) CancelLimit(id string) error {
 	state, ok := e.instrumentsStates.Get(id)
 	if !ok {
 		return fmt.Errorf("%v not found in instruments states", id)
 	}
-	if state.instrumentState == IN_STOCK || state.instrumentState == OUT_OF_STOCK {
+	if state.instrumentState == IN_STOCK || state.instrumentState == OUT_OF_STOCK || state.instrumentState == IN_SHORT {
 		return fmt.Errorf("invalid instrument state")
 	}
 	if state.instrumentState == WAIT_ENTRY_PRICE {
@@ -332,8 +538,10 @@ func (e *Executor) CancelLimit(id string) error {
 	switch state.instrumentState {
 	case TRY_TO_SELL:
 		newState = IN_STOCK
-	case TRY_TO_BUY:
+	case TRY_TO_BUY, TRY_TO_SHORT:
 		newState = OUT_OF_STOCK
+	case TRY_TO_COVER:
+		newState = IN_SHORT
 	}
 	e.instrumentsStates.Update(id, State{
 		instrumentState: newState,
@@ -352,7 +560,7 @@ func (e *Executor) ReplaceLimit(id string, price float64) error {
 	if !ok {
 		return fmt.Errorf("%v not found in instruments states", id)
 	}
-	if state.instrumentState == IN_STOCK || state.instrumentState == OUT_OF_STOCK {
+	if state.instrumentState == IN_STOCK || state.instrumentState == OUT_OF_STOCK || state.instrumentState == IN_SHORT {
 		return fmt.Errorf("invalid instrument state")
 	}
 	resp, err := e.ordersService.ReplaceOrder(&investgo.ReplaceOrderRequest{
@@ -401,6 +609,38 @@ func (p *Positions) Get() *pb.PositionData {
 	return p.pd
 }
 
+// Margin - Маржинальные показатели счета, запрошенные не более MARGIN_TTL назад
+type Margin struct {
+	mx      sync.Mutex
+	attrs   *pb.GetMarginAttributesResponse
+	updated time.Time
+}
+
+// Update - Обновление маржинальных показателей
+func (m *Margin) Update(attrs *pb.GetMarginAttributesResponse) {
+	m.mx.Lock()
+	m.attrs = attrs
+	m.updated = time.Now()
+	m.mx.Unlock()
+}
+
+// Reset - Сброс маржинальных показателей, при следующей проверке они будут запрошены заново
+func (m *Margin) Reset() {
+	m.mx.Lock()
+	m.attrs = nil
+	m.mx.Unlock()
+}
+
+// Get - Получение маржинальных показателей, false если их нет или они устарели
+func (m *Margin) Get() (*pb.GetMarginAttributesResponse, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.attrs == nil || time.Since(m.updated) > MARGIN_TTL {
+		return nil, false
+	}
+	return m.attrs, true
+}
+
 // UpdateInterval - Обновление интервала для инструмента и замена заявки, если понадобится
 func (e *Executor) UpdateInterval(id string, i Interval) error {
 	oldInterval, ok := e.intervals.get(id)
@@ -420,9 +660,17 @@ func (e *Executor) UpdateInterval(id string, i Interval) error {
 	}
 	// Если цена в интервале изменилась, заменяем лимитную заявку
 	switch state.instrumentState {
-	case TRY_TO_SELL:
-		// Если уже выставлена заявка на продажу, ее не нужно менять
+	case TRY_TO_SELL, TRY_TO_COVER:
+		// Если уже выставлена заявка на закрытие позиции, ее не нужно менять
 		return nil
+	case TRY_TO_SHORT:
+		if oldInterval.high != i.high {
+			err := e.ReplaceLimit(id, i.high)
+			e.client.Logger.Infof("Произведен перерассчет коридора. До: min = %v; max = %v, после min = %v; max = %v.", oldInterval.low, oldInterval.high, i.low, i.high)
+			if err != nil {
+				return err
+			}
+		}
 	case TRY_TO_BUY:
 		p1 := investgo.FloatToQuotation(i.low, currentInstrument.MinPriceInc)
 		p2 := investgo.FloatToQuotation(oldInterval.low, currentInstrument.MinPriceInc)
@@ -478,6 +726,7 @@ func (e *Executor) listenPositions(ctx context.Context) error {
 				}
 				// e.client.Logger.Infof("update from positions stream %v\n", p.GetMoney())
 				e.positions.Update(p)
+				e.margin.Reset()
 			}
 		}
 	}(ctx)
@@ -488,6 +737,46 @@ func (e *Executor) listenPositions(ctx context.Context) error {
 	return nil
 }
 
+// loadRiskState - Начальные позиции, последние цены и ценовые лимиты инструментов для риск-менеджера
+func (e *Executor) loadRiskState() {
+	ids := make([]string, 0, len(e.instruments))
+	for id := range e.instruments {
+		ids = append(ids, id)
+	}
+	marketDataService := e.client.NewMarketDataServiceClient()
+	prices := make(map[string]float64, len(ids))
+	lastPrices, err := marketDataService.GetLastPrices(ids)
+	if err != nil {
+		e.client.Logger.Errorf("risk last prices: %v", err.Error())
+	} else {
+		for _, lp := range lastPrices.GetLastPrices() {
+			prices[lp.GetInstrumentUid()] = lp.GetPrice().ToFloat()
+			e.risk.Handle(lp)
+		}
+	}
+	// цена открытия позиций, открытых до запуска, неизвестна, поэтому дневной результат по ним считается от последней цены
+	for _, s := range e.positions.Get().GetSecurities() {
+		if instrument, ok := e.instruments[s.GetInstrumentUid()]; ok && instrument.Lot > 0 {
+			e.risk.SetPosition(s.GetInstrumentUid(), s.GetBalance()/int64(instrument.Lot), prices[s.GetInstrumentUid()])
+		}
+	}
+	// поручения, выставленные до запуска, учитываются в лимитах до исполнения или снятия
+	orders, err := e.client.NewOrdersServiceClient().GetOrders(e.client.Config.AccountId)
+	if err != nil {
+		e.client.Logger.Errorf("risk active orders: %v", err.Error())
+	} else {
+		e.risk.SyncOrders(orders.GetOrders())
+	}
+	for _, id := range ids {
+		ob, err := marketDataService.GetOrderBook(id, 1)
+		if err != nil {
+			e.client.Logger.Errorf("risk price limits %v: %v", e.ticker(id), err.Error())
+			continue
+		}
+		e.risk.SetPriceLimits(id, ob.GetLimitUp().ToFloat(), ob.GetLimitDown().ToFloat())
+	}
+}
+
 // updatePositionsUnary - Unary метод обновления позиций
 func (e *Executor) updatePositionsUnary() error {
 	resp, err := e.operationsService.GetPositions(e.client.Config.AccountId)
@@ -571,6 +860,9 @@ func (e *Executor) listenTrades(ctx context.Context) error {
 				if t.GetAccountId() != e.client.Config.AccountId {
 					continue
 				}
+				if e.risk != nil {
+					e.risk.Handle(t)
+				}
 				orderTrades := t.GetTrades()
 				for i, trade := range orderTrades {
 					e.client.Logger.Infof("trade %v = %v", i, trade)
@@ -586,7 +878,24 @@ func (e *Executor) listenTrades(ctx context.Context) error {
 					e.client.Logger.Errorf("%v not found in executor instruments", uid)
 					continue
 				}
+				// сделка в короткой позиции определяется по состоянию инструмента до исполнения
+				state, _ := e.instrumentsStates.Get(uid)
 				switch {
+				case t.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_BUY &&
+					(state.instrumentState == TRY_TO_COVER || state.instrumentState == IN_SHORT):
+					// после откупа короткой позиции снова ждем подходящую цену для входа
+					is = WAIT_ENTRY_PRICE
+					profit := 0.0
+					if currentInstrument.EntryPrice != 0 {
+						profit = (currentInstrument.EntryPrice - orderPrice) * float64(currentInstrument.Lot) * float64(currentInstrument.Quantity)
+					}
+					e.strategyProfit += profit
+					e.client.Logger.Infof("%v cover order is fill, profit = %.9f, Subtotal profit: %.9f", e.ticker(t.GetInstrumentUid()), profit, e.strategyProfit)
+				case t.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_SELL && state.instrumentState == TRY_TO_SHORT:
+					is = IN_SHORT
+					currentInstrument.EntryPrice = orderPrice
+					e.instruments[uid] = currentInstrument
+					e.client.Logger.Infof("%v short order is fill, price = %v", e.ticker(t.GetInstrumentUid()), orderPrice)
 				case t.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_BUY:
 					is = IN_STOCK
 					currentInstrument.EntryPrice = orderPrice
@@ -608,8 +917,8 @@ func (e *Executor) listenTrades(ctx context.Context) error {
 
 				// обновляем состояние инструмента
 				e.instrumentsStates.Update(uid, State{instrumentState: is})
-				// если только что купили выставляем заявку на продажу
-				if is != IN_STOCK {
+				// если только что купили выставляем заявку на продажу, если открыли короткую позицию - на откуп
+				if is != IN_STOCK && is != IN_SHORT {
 					continue
 				}
 				price, ok := e.intervals.get(uid)
@@ -617,7 +926,11 @@ func (e *Executor) listenTrades(ctx context.Context) error {
 					e.client.Logger.Errorf("%v not found in intervals", uid)
 					return
 				}
-				err = e.SellLimit(uid, price.high)
+				if is == IN_STOCK {
+					err = e.SellLimit(uid, price.high)
+				} else {
+					err = e.CoverLimit(uid, price.low)
+				}
 				if err != nil {
 					e.client.Logger.Errorf(err.Error())
 				}
@@ -669,6 +982,9 @@ func (e *Executor) listenLastPrices(ctx context.Context) error {
 				if !ok {
 					return
 				}
+				if e.risk != nil {
+					e.risk.Handle(lp)
+				}
 				uid := lp.GetInstrumentUid()
 				price := lp.GetPrice().ToFloat()
 				// получаем состояние инструмента
@@ -684,13 +1000,37 @@ func (e *Executor) listenLastPrices(ctx context.Context) error {
 						e.client.Logger.Errorf("not found interval for %v", uid)
 					}
 
-					// если достигаем нижней цены интервала, выставляем заявку на покупку
-					if price >= interval.low {
-						err := e.BuyLimit(uid, interval.low)
-						if err != nil {
-							e.client.Logger.Errorf(err.Error())
+					// если цена выше нижней границы интервала, выставляем заявку на покупку по ней,
+					// если ниже верхней - заявку на открытие короткой позиции по верхней
+					long := e.side != SHORT && price >= interval.low
+					short := e.side != LONG && e.instruments[uid].ShortEnabled && price <= interval.high
+					// в режиме LONG_AND_SHORT заявка выставляется у ближайшей к цене границы, если короткую
+					// позицию открыть нельзя - заявка на покупку
+					if long && short && !e.possibleToShort(uid, interval.high) {
+						short = false
+					}
+					fallback := long
+					if long && short {
+						if interval.high-price < price-interval.low {
+							long = false
+						} else {
+							short = false
+						}
+					}
+					var err error
+					switch {
+					case long:
+						err = e.BuyLimit(uid, interval.low)
+					case short:
+						err = e.ShortLimit(uid, interval.high)
+						if err != nil && fallback {
+							e.client.Logger.Errorf("short %v rejected: %v, post buy limit order", e.ticker(uid), err.Error())
+							err = e.BuyLimit(uid, interval.low)
 						}
 					}
+					if err != nil {
+						e.client.Logger.Errorf(err.Error())
+					}
 				case TRY_TO_SELL:
 					// Если выставлена заявка на продажу, но цена упала - продаем по рынку
 					interval, ok := e.intervals.get(uid)
@@ -720,6 +1060,39 @@ func (e *Executor) listenLastPrices(ctx context.Context) error {
 							e.client.Logger.Errorf(err.Error())
 						}
 					}
+				case TRY_TO_COVER:
+					// Если выставлена заявка на откуп, но цена выросла выше входа - откупаем по рынку
+					interval, ok := e.intervals.get(uid)
+					if !ok {
+						e.client.Logger.Errorf("not found interval for %v", uid)
+					}
+					instrument, ok := e.instruments[uid]
+					if !ok {
+						e.client.Logger.Errorf("%v not found in executor map", uid)
+					}
+					entry := instrument.EntryPrice
+					if entry == 0 {
+						entry = interval.high
+					}
+					if price >= investgo.FloatToQuotation(entry*(1+instrument.StopLossPercent/100), instrument.MinPriceInc).ToFloat() {
+						e.client.Logger.Infof("short stop loss with %v", e.ticker(uid))
+						// Отменяем заявку на откуп
+						err = e.CancelLimit(uid)
+						if err != nil {
+							e.client.Logger.Errorf(err.Error())
+						}
+						_, err := e.ordersService.Buy(&investgo.PostOrderRequestShort{
+							InstrumentId: uid,
+							Quantity:     instrument.Quantity,
+							Price:        nil,
+							AccountId:    e.client.Config.AccountId,
+							OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+							OrderId:      investgo.CreateUid(),
+						})
+						if err != nil {
+							e.client.Logger.Errorf(err.Error())
+						}
+					}
 				}
 			}
 		}
@@ -731,72 +1104,37 @@ func (e *Executor) listenLastPrices(ctx context.Context) error {
 	return nil
 }
 
-// SellOut - Метод выхода из всех текущих позиций
+// SellOut - Метод выхода из всех позиций бота: длинных и коротких, по бумагам, фьючерсам и опционам.
+// Попытки закрыть позиции повторяются, пока они не закроются или не истечет SELL_OUT_TIMEOUT
 func (e *Executor) SellOut() (float64, error) {
-	// TODO for futures and options
 	// отменяем все лимитные поручения
 	for id, state := range e.instrumentsStates.s {
-		if state.instrumentState == TRY_TO_SELL || state.instrumentState == TRY_TO_BUY {
+		switch state.instrumentState {
+		case TRY_TO_SELL, TRY_TO_BUY, TRY_TO_SHORT, TRY_TO_COVER:
 			err := e.CancelLimit(id)
 			if err != nil {
 				return 0, err
 			}
 		}
 	}
-	// продаем бумаги, которые в наличии
-	resp, err := e.operationsService.GetPositions(e.client.Config.AccountId)
-	if err != nil {
-		return 0, err
+	ids := make([]string, 0, len(e.instruments))
+	for id := range e.instruments {
+		ids = append(ids, id)
 	}
+	// если бот не открывал позицию, он не будет ее закрывать
+	closed, err := investgo.NewFlattener(e.client, investgo.FlattenConfig{
+		Instruments: ids,
+		Timeout:     SELL_OUT_TIMEOUT,
+	}).Flatten(context.Background())
 
 	var sellOutProfit float64
-	securities := resp.GetSecurities()
-	for _, security := range securities {
-		// если бумага заблокирована, пропускаем ее
-		if security.GetBalance() == 0 {
-			continue
-		}
-		var lot int64
-		instrument, ok := e.instruments[security.GetInstrumentUid()]
-		if !ok {
-			// если бот не открывал эту позицию, он не будет ее закрывать
-			e.client.Logger.Infof("%v not found in executor instruments map", security.GetInstrumentUid())
+	for _, p := range closed {
+		instrument, ok := e.instruments[p.InstrumentUid]
+		if !ok || p.ClosedLots == 0 {
 			continue
-		} else {
-			lot = int64(instrument.Lot)
-		}
-		balanceInLots := security.GetBalance() / lot
-		if balanceInLots < 0 {
-			resp, err := e.ordersService.Buy(&investgo.PostOrderRequestShort{
-				InstrumentId: security.GetInstrumentUid(),
-				Quantity:     -balanceInLots,
-				Price:        nil,
-				AccountId:    e.client.Config.AccountId,
-				OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
-				OrderId:      investgo.CreateUid(),
-			})
-			if err != nil {
-				e.client.Logger.Errorf(investgo.MessageFromHeader(resp.GetHeader()))
-				return 0, err
-			}
-		} else {
-			resp, err := e.ordersService.Sell(&investgo.PostOrderRequestShort{
-				InstrumentId: security.GetInstrumentUid(),
-				Quantity:     balanceInLots,
-				Price:        nil,
-				AccountId:    e.client.Config.AccountId,
-				OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
-				OrderId:      investgo.CreateUid(),
-			})
-			if err != nil {
-				e.client.Logger.Errorf(investgo.MessageFromHeader(resp.GetHeader()))
-				return 0, err
-			}
-			if resp.GetExecutionReportStatus() == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL {
-				// разница в цене инструмента * лотность * кол-во лотов
-				sellOutProfit += (resp.GetExecutedOrderPrice().ToFloat() - instrument.EntryPrice) * float64(instrument.Lot) * float64(instrument.Quantity)
-			}
 		}
+		// разница в цене инструмента * лотность * кол-во лотов, для короткой позиции ClosedLots < 0
+		sellOutProfit += (p.ExecutedPrice - instrument.EntryPrice) * float64(instrument.Lot) * float64(p.ClosedLots)
 	}
-	return sellOutProfit, nil
+	return sellOutProfit, err
 }
@@ -0,0 +1,371 @@
+package bot
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// PortfolioConfig - Параметры проверки стратегии на истории с общим денежным балансом
+type PortfolioConfig struct {
+	// InitialCash - Начальный баланс денежных средств
+	InitialCash float64 `yaml:"InitialCash"`
+	// Leverage - Плечо: покупательная способность равна капиталу * Leverage, 1 - без заемных средств
+	Leverage float64 `yaml:"Leverage"`
+	// MarginRate - Годовая ставка в процентах за пользование заемными средствами и бумагами, начисляется за каждый
+	// календарный день, в том числе выходной, на отрицательный денежный баланс и стоимость коротких позиций
+	MarginRate float64 `yaml:"MarginRate"`
+	// MarginCall - Минимальный капитал в процентах от стоимости позиций, если капитал меньше, все позиции
+	// закрываются по рынку. 0 - без ограничения
+	MarginCall float64 `yaml:"MarginCall"`
+	// MaxPositions - Максимальное кол-во одновременно открытых позиций, 0 - без ограничения
+	MaxPositions int `yaml:"MaxPositions"`
+}
+
+// PortfolioResult - Результат проверки стратегии с общим денежным балансом
+type PortfolioResult struct {
+	// Report - Показатели и сделки, кривая капитала переоценивается по ценам закрытия каждого дня
+	Report *backtest.Report
+	// Cash - Денежный баланс в конце проверки
+	Cash float64
+	// Rejected - Входы в позицию, отклоненные из-за нехватки покупательной способности или лимита позиций
+	Rejected int
+	// MarginCalls - Кол-во принудительных закрытий позиций из-за нехватки капитала
+	MarginCalls int
+	// MarginInterest - Сумма процентов за пользование заемными средствами
+	MarginInterest float64
+	// MaxOpenPositions - Максимальное кол-во одновременно открытых позиций
+	MaxOpenPositions int
+	// MaxExposure - Максимальная стоимость открытых позиций, длинных и коротких
+	MaxExposure float64
+	// OpenPositions - Позиции, которые остались открытыми в конце проверки
+	OpenPositions int
+}
+
+// portfolioPosition - Открытая позиция портфеля
+type portfolioPosition struct {
+	trade backtest.Trade
+	// interval - Интервал на день открытия позиции, по нему выставляются цены выхода и стоп-лосса
+	interval Interval
+	// lastPrice - Последняя цена закрытия, по ней переоценивается позиция
+	lastPrice float64
+}
+
+func (p *portfolioPosition) short() bool {
+	return p.trade.Direction == pb.OrderDirection_ORDER_DIRECTION_SELL
+}
+
+// marketValue - Стоимость позиции по последней цене, для короткой позиции отрицательная
+func (p *portfolioPosition) marketValue() float64 {
+	value := p.lastPrice * float64(p.trade.Quantity)
+	if p.short() {
+		return -value
+	}
+	return value
+}
+
+// candleEvent - Свеча инструмента за торговый день
+type candleEvent struct {
+	id     string
+	candle *pb.HistoricCandle
+	// last - Последняя свеча инструмента за день
+	last bool
+}
+
+// portfolio - Состояние счета при проверке на истории
+type portfolio struct {
+	b         *Bot
+	bc        BacktestConfig
+	pc        PortfolioConfig
+	cash      float64
+	positions map[string]*portfolioPosition
+	trades    []backtest.Trade
+	equity    []backtest.EquityPoint
+	result    PortfolioResult
+}
+
+// PortfolioBackTest - Проверка стратегии на истории за [from, to) с одним денежным балансом на все инструменты.
+// Каждый день инструменты заново отбираются по волатильности, позиция открывается на кол-во лотов, при котором
+// ее стоимость ближе всего к PreferredPositionPrice, и только если хватает покупательной способности счета.
+// Направление позиций задается Side, как в обычном бектесте. Свечи всех инструментов обрабатываются в порядке времени.
+// Если SellOut = false, позиции переносятся на следующий день с ценами выхода и стоп-лосса по интервалу дня открытия.
+func (b *Bot) PortfolioBackTest(from, to time.Time, bc BacktestConfig, pc PortfolioConfig) (PortfolioResult, error) {
+	if pc.InitialCash <= 0 {
+		return PortfolioResult{}, fmt.Errorf("InitialCash must be positive, got %v", pc.InitialCash)
+	}
+	if pc.Leverage < 1 {
+		pc.Leverage = 1
+	}
+	b.applyBacktestConfig(bc)
+	p := &portfolio{
+		b:         b,
+		bc:        bc,
+		pc:        pc,
+		cash:      pc.InitialCash,
+		positions: make(map[string]*portfolioPosition),
+		trades:    make([]backtest.Trade, 0),
+		equity:    []backtest.EquityPoint{{Time: from, Equity: pc.InitialCash}},
+	}
+	for day := from; day.Before(to); day = day.Add(investgo.DAY) {
+		if err := p.tradeDay(day); err != nil {
+			return PortfolioResult{}, err
+		}
+	}
+	p.result.Report = backtest.AnalyzeEquity(p.trades, p.equity, pc.InitialCash)
+	p.result.Cash = p.cash
+	p.result.OpenPositions = len(p.positions)
+	return p.result, nil
+}
+
+// tradeDay - Отбор инструментов и торговля за день
+func (p *portfolio) tradeDay(day time.Time) error {
+	ranked, err := p.b.rankInstruments(day)
+	if err != nil {
+		return err
+	}
+	tradable := make([]*analyseResponse, 0, len(ranked))
+	for _, r := range ranked {
+		if p.b.tradable(r.id) {
+			tradable = append(tradable, r)
+		}
+	}
+	top := p.b.StrategyConfig.TopInstrumentsQuantity
+	if top > len(tradable) {
+		return fmt.Errorf("TopInstrumentsQuantity = %v, but max value = %v", top, len(tradable))
+	}
+	intervals := make(map[string]Interval, top)
+	ids := make([]string, 0, top+len(p.positions))
+	for _, r := range tradable[:top] {
+		intervals[r.id] = r.interval
+		ids = append(ids, r.id)
+	}
+	// открытые позиции сопровождаются, даже если инструмент не попал в топ
+	for id := range p.positions {
+		if _, ok := intervals[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	events := make([]candleEvent, 0)
+	for _, id := range ids {
+		candles, err := p.b.storage.candlesInRange(id, day, day.Add(investgo.DAY))
+		if err != nil {
+			return err
+		}
+		for i, c := range candles {
+			events = append(events, candleEvent{id: id, candle: c, last: i == len(candles)-1})
+		}
+	}
+	// в выходные и праздники свечей нет, но проценты за заемные средства начисляются
+	if len(events) == 0 {
+		p.accrueInterest()
+		return nil
+	}
+	// при одинаковом времени первыми обрабатываются более волатильные инструменты
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].candle.GetTime().AsTime().Before(events[j].candle.GetTime().AsTime())
+	})
+
+	var end time.Time
+	for _, ev := range events {
+		p.onCandle(ev, intervals)
+		end = ev.candle.GetTime().AsTime()
+	}
+	if p.b.StrategyConfig.SellOut {
+		for id, position := range p.positions {
+			p.close(id, end, position.lastPrice)
+		}
+	}
+	p.accrueInterest()
+	p.equity = append(p.equity, backtest.EquityPoint{Time: end, Equity: p.value()})
+	return nil
+}
+
+// accrueInterest - Начисление процентов за календарный день на отрицательный денежный баланс и стоимость
+// коротких позиций
+func (p *portfolio) accrueInterest() {
+	if p.pc.MarginRate <= 0 {
+		return
+	}
+	borrowed := math.Max(0, -p.cash)
+	for _, position := range p.positions {
+		if position.short() {
+			borrowed -= position.marketValue()
+		}
+	}
+	interest := borrowed * p.pc.MarginRate / 100 / 365
+	p.cash -= interest
+	p.result.MarginInterest += interest
+}
+
+// onCandle - Обработка свечи: выход по интервалу или стоп-лоссу для открытой позиции, иначе вход у границы
+// интервала по направлению Side
+func (p *portfolio) onCandle(ev candleEvent, intervals map[string]Interval) {
+	c := ev.candle
+	t := c.GetTime().AsTime()
+	open, high, low := c.GetOpen().ToFloat(), c.GetHigh().ToFloat(), c.GetLow().ToFloat()
+	if position, ok := p.positions[ev.id]; ok {
+		instrument := p.b.executor.instruments[ev.id]
+		if position.short() {
+			loss := position.interval.high * (p.b.StrategyConfig.StopLossPercent / 100)
+			lossPrice := investgo.FloatToQuotation(position.interval.high+loss, instrument.MinPriceInc).ToFloat()
+			switch {
+			case low <= position.interval.low:
+				// если цена открылась ниже заявки, откупаем по цене открытия
+				p.close(ev.id, t, math.Min(open, position.interval.low))
+			case high >= lossPrice:
+				p.close(ev.id, t, math.Max(open, lossPrice))
+			default:
+				position.lastPrice = c.GetClose().ToFloat()
+				p.marginCall(t)
+			}
+			return
+		}
+		loss := position.interval.low * (p.b.StrategyConfig.StopLossPercent / 100)
+		lossPrice := investgo.FloatToQuotation(position.interval.low-loss, instrument.MinPriceInc).ToFloat()
+		switch {
+		case position.interval.high <= high:
+			// если цена открылась выше заявки, продаем по цене открытия
+			p.close(ev.id, t, math.Max(open, position.interval.high))
+		case low <= lossPrice:
+			p.close(ev.id, t, math.Min(open, lossPrice))
+		default:
+			position.lastPrice = c.GetClose().ToFloat()
+			p.marginCall(t)
+		}
+		return
+	}
+	interval, ok := intervals[ev.id]
+	// в последнюю свечу дня не входим
+	if !ok || ev.last || interval.low <= 0 {
+		return
+	}
+	buy := p.b.StrategyConfig.Side != SHORT && interval.low <= high && interval.low >= low
+	short := p.b.StrategyConfig.Side != LONG && p.b.executor.instruments[ev.id].ShortEnabled &&
+		interval.high <= high && interval.high >= low
+	// если свеча пересекает обе границы, как и исполнитель, входим у ближайшей к цене открытия
+	if buy && short {
+		if interval.high-open < open-interval.low {
+			buy = false
+		} else {
+			short = false
+		}
+	}
+	switch {
+	case buy:
+		p.open(ev.id, t, pb.OrderDirection_ORDER_DIRECTION_BUY, math.Min(open, interval.low), interval, c.GetClose().ToFloat())
+	case short:
+		p.open(ev.id, t, pb.OrderDirection_ORDER_DIRECTION_SELL, math.Max(open, interval.high), interval, c.GetClose().ToFloat())
+	}
+}
+
+// open - Покупка или продажа в короткую, если хватает покупательной способности и не превышен лимит позиций
+func (p *portfolio) open(id string, t time.Time, direction pb.OrderDirection, price float64, interval Interval, last float64) {
+	instrument, ok := p.b.executor.instruments[id]
+	if !ok {
+		return
+	}
+	lots := p.lots(price, float64(instrument.Lot))
+	if lots == 0 {
+		return
+	}
+	quantity := lots * int64(instrument.Lot)
+	value := price * float64(quantity)
+	commission := value * p.bc.Commission / 100
+	if p.pc.MaxPositions > 0 && len(p.positions) >= p.pc.MaxPositions ||
+		p.value()*p.pc.Leverage-p.exposure() < value+commission {
+		p.result.Rejected++
+		return
+	}
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		p.cash += value - commission
+	} else {
+		p.cash -= value + commission
+	}
+	p.positions[id] = &portfolioPosition{
+		trade: backtest.Trade{
+			InstrumentUid: id,
+			Direction:     direction,
+			Quantity:      quantity,
+			EntryTime:     t,
+			EntryPrice:    price,
+			Commission:    commission,
+		},
+		interval:  interval,
+		lastPrice: last,
+	}
+	if n := len(p.positions); n > p.result.MaxOpenPositions {
+		p.result.MaxOpenPositions = n
+	}
+	p.result.MaxExposure = math.Max(p.result.MaxExposure, p.exposure())
+}
+
+// lots - Кол-во лотов, при котором стоимость позиции ближе всего к PreferredPositionPrice, но не больше
+// MaxPositionPrice. 0 - если один лот дороже MaxPositionPrice
+func (p *portfolio) lots(price, lot float64) int64 {
+	lotPrice := price * lot
+	if lotPrice <= 0 || lotPrice > p.b.StrategyConfig.MaxPositionPrice {
+		return 0
+	}
+	if lotPrice < p.b.StrategyConfig.PreferredPositionPrice {
+		return int64(math.Floor(p.b.StrategyConfig.PreferredPositionPrice / lotPrice))
+	}
+	return 1
+}
+
+// close - Продажа длинной или откуп короткой позиции по цене price
+func (p *portfolio) close(id string, t time.Time, price float64) {
+	position, ok := p.positions[id]
+	if !ok {
+		return
+	}
+	trade := position.trade
+	value := price * float64(trade.Quantity)
+	commission := value * p.bc.Commission / 100
+	trade.ExitTime = t
+	trade.ExitPrice = price
+	trade.PnL = (price - trade.EntryPrice) * float64(trade.Quantity)
+	if position.short() {
+		p.cash -= value + commission
+		trade.PnL = -trade.PnL
+	} else {
+		p.cash += value - commission
+	}
+	trade.Commission += commission
+	p.trades = append(p.trades, trade)
+	delete(p.positions, id)
+}
+
+// marginCall - Закрытие всех позиций по последним ценам, если капитал меньше MarginCall процентов от их стоимости
+func (p *portfolio) marginCall(t time.Time) {
+	exposure := p.exposure()
+	if p.pc.MarginCall <= 0 || exposure == 0 || p.value()/exposure*100 >= p.pc.MarginCall {
+		return
+	}
+	p.result.MarginCalls++
+	for id, position := range p.positions {
+		p.close(id, t, position.lastPrice)
+	}
+}
+
+// exposure - Стоимость открытых длинных и коротких позиций по последним ценам
+func (p *portfolio) exposure() float64 {
+	var sum float64
+	for _, position := range p.positions {
+		sum += math.Abs(position.marketValue())
+	}
+	return sum
+}
+
+// value - Капитал: денежный баланс и стоимость позиций по последним ценам, короткие позиции уменьшают капитал
+func (p *portfolio) value() float64 {
+	value := p.cash
+	for _, position := range p.positions {
+		value += position.marketValue()
+	}
+	return value
+}
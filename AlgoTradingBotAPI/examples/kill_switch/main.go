@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const usage = `usage: kill_switch <command> [flags]
+
+commands:
+  now    cancel all orders and stop orders and close all positions on the account immediately
+  watch  wait for a trigger: SIGUSR1, appearance of -file or POST http://<-addr>/kill
+
+run kill_switch <command> -h for command flags
+`
+
+func main() {
+	os.Exit(run())
+}
+
+// run - Выполнение команды, код выхода 1, если выключатель сработал с ошибками и позиции могут быть не закрыты
+func run() int {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	sdkConfig := fs.String("sdk-config", "config.yaml", "path to sdk yaml with token")
+	account := fs.String("account", "", "account id, by default AccountId from sdk config")
+	out := fs.String("out", "", "path to write json report")
+
+	var ksConfig investgo.KillSwitchConfig
+	var keepRunning bool
+	switch cmd {
+	case "now":
+	case "watch":
+		fs.StringVar(&ksConfig.File, "file", "", "flag file, kill switch is triggered when it appears")
+		fs.DurationVar(&ksConfig.PollInterval, "poll", time.Second, "flag file poll interval")
+		fs.StringVar(&ksConfig.Addr, "addr", "", "http listen address, for example 127.0.0.1:8090")
+		fs.StringVar(&ksConfig.Token, "token", "", "bearer token required for http requests")
+		fs.BoolVar(&keepRunning, "keep-running", false, "keep watching after the kill switch is triggered")
+		ksConfig.Signals = []os.Signal{syscall.SIGUSR1}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf(err.Error())
+	}
+	if cmd == "watch" && ksConfig.Addr != "" && ksConfig.Token == "" {
+		log.Printf("warning: http kill switch without -token, anyone who can reach %v can close positions", ksConfig.Addr)
+	}
+
+	config, err := investgo.LoadConfig(*sdkConfig)
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+	// SIGINT и SIGTERM только завершают работу, выключатель в режиме watch срабатывает по SIGUSR1
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	ksConfig.AccountId = *account
+	// failed - Срабатывание с ошибками, OnKill в режиме watch вызывается из горутины выключателя
+	var failed atomic.Bool
+	ksConfig.OnKill = func(report *investgo.KillSwitchReport) {
+		fmt.Print(report.String())
+		if err := report.Err(); err != nil {
+			failed.Store(true)
+			logger.Errorf("kill switch failed: %v", err.Error())
+		}
+		if *out != "" {
+			if err := writeReport(*out, report); err != nil {
+				logger.Errorf("write report: %v", err.Error())
+			}
+		}
+		if !keepRunning {
+			cancel()
+		}
+	}
+	ks := investgo.NewKillSwitch(client, ksConfig)
+
+	if cmd == "now" {
+		if ks.Kill("command line").Err() != nil {
+			return 1
+		}
+		return 0
+	}
+	if ksConfig.AccountId == "" {
+		ksConfig.AccountId = client.Config.AccountId
+	}
+	logger.Infof("kill switch armed for account %v, pid %v", ksConfig.AccountId, os.Getpid())
+	if err := ks.Run(ctx); err != nil {
+		logger.Errorf(err.Error())
+		return 1
+	}
+	if failed.Load() {
+		return 1
+	}
+	return 0
+}
+
+// writeReport - Запись отчета в json файл path
+func writeReport(path string, report *investgo.KillSwitchReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteJSON(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
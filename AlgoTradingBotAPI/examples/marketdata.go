@@ -160,4 +160,29 @@ func main() {
 		logger.Errorf(err.Error())
 	}
 
+	// параллельная загрузка минутных свечей по нескольким инструментам за последние 30 дней,
+	// при повторном запуске загрузка продолжится с сохраненного в candles_progress.json места
+	checkpoint, err := investgo.NewFileCheckpoint("candles_progress.json")
+	if err != nil {
+		logger.Errorf(err.Error())
+	} else {
+		err = MarketDataService.DownloadCandles(ctx, &investgo.DownloadCandlesRequest{
+			Instruments: instruments,
+			Interval:    pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			From:        time.Now().Add(-30 * 24 * time.Hour),
+			To:          time.Now(),
+			Workers:     4,
+			Sink: investgo.CandlesSinkFunc(func(id string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error {
+				fmt.Printf("%v got %v candles, last = %v\n", id, len(candles), candles[len(candles)-1].GetTime().AsTime())
+				return nil
+			}),
+			Checkpoint: checkpoint,
+			OnProgress: func(p investgo.DownloadProgress) {
+				fmt.Printf("downloaded %v/%v windows\n", p.AllDone, p.AllTotal)
+			},
+		})
+		if err != nil {
+			logger.Errorf(err.Error())
+		}
+	}
 }
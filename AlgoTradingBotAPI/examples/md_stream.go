@@ -65,6 +65,19 @@ func main() {
 	if err != nil {
 		logger.Errorf(err.Error())
 	}
+	// все сообщения стрима можно записывать в файл, чтобы потом воспроизвести их через
+	// investgo.NewMarketDataReplayer, он реализует тот же интерфейс investgo.MarketDataSource, что и стрим
+	recorder, err := investgo.NewMarketDataRecorder("md_record.bin")
+	if err != nil {
+		logger.Errorf(err.Error())
+	} else {
+		firstMDStream.Record(recorder)
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				logger.Errorf(err.Error())
+			}
+		}()
+	}
 	// результат подписки на инструменты это канал с определенным типом информации, при повторном вызове функции
 	// подписки(например на свечи), возвращаемый канал можно игнорировать, так как при первом вызове он уже был получен
 	firstInstrumetsGroup := []string{"BBG004730N88", "BBG00475KKY8", "BBG004RVFCY3"}
@@ -93,6 +106,9 @@ func main() {
 	// для дальнейшей обработки, поступившей из канала, информации хорошо подойдет механизм,
 	// основанный на паттерне pipeline https://go.dev/blog/pipelines
 
+	// из потока сделок можно строить свечи произвольной длительности, например 30-секундные
+	builders := make(map[string]*investgo.CandleBuilder)
+
 	wg.Add(1)
 	go func(ctx context.Context) {
 		defer wg.Done()
@@ -113,6 +129,22 @@ func main() {
 				}
 				// клиентская логика обработки...
 				fmt.Println("trade price = ", trade.GetPrice().ToFloat())
+				builder, ok := builders[trade.GetFigi()]
+				if !ok {
+					newBuilder, err := investgo.NewCandleBuilder(investgo.CandleBuilderConfig{
+						Type:     investgo.BAR_TIME,
+						Duration: 30 * time.Second,
+					})
+					if err != nil {
+						logger.Errorf(err.Error())
+						return
+					}
+					builder = newBuilder
+					builders[trade.GetFigi()] = builder
+				}
+				for _, bar := range builder.Add(trade) {
+					fmt.Printf("30s bar %v close = %v, volume = %v\n", bar.GetTime().AsTime(), bar.GetClose().ToFloat(), bar.GetVolume())
+				}
 			}
 		}
 	}(ctx)
@@ -165,5 +197,44 @@ func main() {
 		}
 	}(ctx)
 
+	// ряд свечей: история за последние сутки из api, далее свечи из стрима, включая незавершенные
+	thirdMDStream, err := MDClient.MarketDataStream()
+	if err != nil {
+		logger.Errorf(err.Error())
+	}
+	seriesId := "BBG004730N88"
+	series, err := investgo.NewCandleSeries(&investgo.CandleSeriesRequest{
+		InstrumentId:      seriesId,
+		Interval:          pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+		From:              time.Now().Add(-investgo.DAY),
+		WaitingClose:      false,
+		MaxLen:            1000,
+		MarketDataService: client.NewMarketDataServiceClient(),
+		OnComplete: func(candle *pb.HistoricCandle) {
+			fmt.Printf("%v candle %v completed, close = %v\n", seriesId, candle.GetTime().AsTime(), candle.GetClose().ToFloat())
+		},
+	})
+	if err != nil {
+		logger.Errorf(err.Error())
+	} else {
+		seriesChan, err := thirdMDStream.SubscribeCandle([]string{seriesId}, pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE, false)
+		if err != nil {
+			logger.Errorf(err.Error())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := thirdMDStream.Listen()
+			if err != nil {
+				logger.Errorf(err.Error())
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			investgo.ListenCandleSeries(ctx, seriesChan, map[string]*investgo.CandleSeries{seriesId: series}, logger)
+		}()
+	}
+
 	wg.Wait()
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/examples/ob_bot/internal/bot"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// STORE_DIR - Директория хранилища стаканов, в которую пишет order_book_download
+	STORE_DIR = "../order_book_download/data"
+	// LEGACY_DB_PATH - Файл sqlite, записанный предыдущей версией order_book_download, используется если
+	// STORE_DIR не существует
+	LEGACY_DB_PATH = "../order_book_download/order_books.db"
+	// REPORT_DIR - Каталог для отчета лучшей конфигурации
+	REPORT_DIR = "backtest_report"
+	// TOP_RESULTS - Кол-во лучших конфигураций в выводе
+	TOP_RESULTS = 10
+)
+
+var (
+	// проверка на стаканах за последние 5 дней
+	initDate = time.Now().Add(-5 * 24 * time.Hour)
+	stopDate = time.Now()
+
+	// instruments - uid инструментов для проверки, для хранилища STORE_DIR пустой слайс - все записанные инструменты,
+	// для LEGACY_DB_PATH инструменты нужно перечислить
+	instruments = []string{"e6123145-9665-43e0-8413-cd61b8aa9b13"}
+
+	// baseConfig - Конфигурация стратегии, в которой перебираются BuyRatio, SellRatio и Depth
+	baseConfig = bot.OrderBookStrategyConfig{
+		Instruments: instruments,
+		Currency:    "RUB",
+		MinProfit:   0.5,
+		SellOut:     true,
+	}
+
+	backtestConfig = bot.BacktestConfig{
+		InitialCash: 200000,
+		Commission:  0.05,
+	}
+
+	// перебираемые значения параметров стратегии
+	buyRatios  = []float64{1.5, 2, 2.5, 3}
+	sellRatios = []float64{1.5, 2, 2.5, 3}
+	depths     = []int32{10, 20, 50}
+)
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	config, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	// клиент нужен только для получения лотности инструментов
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	books, err := orderBooks()
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+
+	instrumentsService := client.NewInstrumentsServiceClient()
+	instrument := func(id string) (bot.BacktestInstrument, error) {
+		resp, err := instrumentsService.InstrumentByUid(id)
+		if err != nil {
+			return bot.BacktestInstrument{}, err
+		}
+		return bot.BacktestInstrument{Lot: int64(resp.GetInstrument().GetLot())}, nil
+	}
+
+	// все конфигурации проверяются за один проход по записи
+	configs := make([]bot.OrderBookStrategyConfig, 0, len(buyRatios)*len(sellRatios)*len(depths))
+	for _, buy := range buyRatios {
+		for _, sell := range sellRatios {
+			for _, depth := range depths {
+				c := baseConfig
+				c.BuyRatio, c.SellRatio, c.Depth = buy, sell, depth
+				configs = append(configs, c)
+			}
+		}
+	}
+	logger.Infof("start backtest of %v configs from %v to %v", len(configs), initDate.Format(time.DateTime),
+		stopDate.Format(time.DateTime))
+
+	results, err := bot.BackTest(ctx, books, instrument, backtestConfig, configs)
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Report.Metrics.NetProfit > results[j].Report.Metrics.NetProfit
+	})
+
+	for i, r := range results {
+		if i == TOP_RESULTS {
+			break
+		}
+		m := r.Report.Metrics
+		s := r.Signals
+		fmt.Printf("result %v:\nbuy ratio = %v, sell ratio = %v, depth = %v\nnet profit = %.3f\nreturn = %.3f%%\n"+
+			"trades = %v\nwin rate = %.2f%%\nmax drawdown = %.2f%%\ncommission = %.3f\naverage slippage = %.2f bp\n"+
+			"slippage cost = %.3f\nsignals: books = %v, buy = %v, sell = %v, bought = %v, sold = %v\n"+
+			"skipped: in stock = %v, no position = %v, no money = %v, not profitable = %v, no liquidity = %v\n"+
+			"open positions = %v\n\n",
+			i+1, r.Config.BuyRatio, r.Config.SellRatio, r.Config.Depth, m.NetProfit, m.ReturnPercent,
+			m.Trades, m.WinRate, m.MaxDrawdownPercent, m.Commission, r.Slippage,
+			r.SlippageCost, s.Books, s.Buy, s.Sell, s.Bought, s.Sold,
+			s.InStock, s.NoPosition, s.NoMoney, s.NotProfitable, s.NoLiquidity,
+			r.OpenPositions)
+	}
+
+	if len(results) > 0 {
+		best := results[0]
+		title := fmt.Sprintf("Order book bot, buy ratio = %v, sell ratio = %v, depth = %v",
+			best.Config.BuyRatio, best.Config.SellRatio, best.Config.Depth)
+		if err := best.Report.Save(REPORT_DIR, title); err != nil {
+			logger.Errorf(err.Error())
+		} else {
+			fmt.Printf("best config report saved to %v\n", REPORT_DIR)
+		}
+	}
+}
+
+// orderBooks - Источник записанных стаканов: хранилище STORE_DIR или, если его нет, sqlite файл LEGACY_DB_PATH
+func orderBooks() (func(fn func(ob *orderbook.OrderBook) error) error, error) {
+	if _, err := os.Stat(STORE_DIR); !errors.Is(err, os.ErrNotExist) {
+		return backtest.OrderBooksFromStore(STORE_DIR, orderbook.QueryRequest{
+			Instruments: instruments,
+			From:        initDate,
+			To:          stopDate,
+		}), nil
+	}
+	if len(instruments) == 0 {
+		return nil, fmt.Errorf("%v not found, instruments are required to load %v", STORE_DIR, LEGACY_DB_PATH)
+	}
+	books := make([]*orderbook.OrderBook, 0)
+	for _, id := range instruments {
+		obs, err := orderbook.LoadOrderBooks(LEGACY_DB_PATH, orderbook.LoadRequest{
+			InstrumentId: id,
+			From:         initDate,
+			To:           stopDate,
+		})
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, obs...)
+	}
+	// стаканы разных инструментов идут по возрастанию времени
+	sort.SliceStable(books, func(i, j int) bool {
+		return books[i].Time.Before(books[j].Time)
+	})
+	return backtest.OrderBooks(books), nil
+}
@@ -107,6 +107,13 @@ func main() {
 		SellRatio:            2,
 		MinProfit:            0.5,
 		SellOut:              true,
+		// риск-менеджер отклоняет поручения сверх лимитов, поручения на закрытие позиций проходят всегда
+		Risk: &investgo.RiskConfig{
+			MaxOrderValue:         20000,
+			MaxTotalPositionValue: 100000,
+			MaxDailyLoss:          5000,
+			MaxOrdersPerMinute:    20,
+		},
 	}
 
 	// создание бота на стакане
@@ -0,0 +1,362 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Signal - Сигнал стратегии по стакану
+type Signal int
+
+const (
+	// SIGNAL_NONE - Нет сигнала
+	SIGNAL_NONE Signal = iota
+	// SIGNAL_BUY - Сигнал на покупку
+	SIGNAL_BUY
+	// SIGNAL_SELL - Сигнал на продажу
+	SIGNAL_SELL
+)
+
+// Ratio - Отношение объема заявок на покупку к объему заявок на продажу по первым depth уровням стакана.
+// Если depth <= 0 или больше глубины стакана, учитываются все уровни
+func Ratio(ob *orderbook.OrderBook, depth int32) float64 {
+	bids := ob.CumulativeDepth(orderbook.BID, int(depth))
+	asks := ob.CumulativeDepth(orderbook.ASK, int(depth))
+	var buy, sell int64
+	if len(bids) > 0 {
+		buy = bids[len(bids)-1]
+	}
+	if len(asks) > 0 {
+		sell = asks[len(asks)-1]
+	}
+	return float64(buy) / float64(sell)
+}
+
+// Signal - Решение стратегии по стакану: покупка, если бид/аск больше BuyRatio, продажа, если аск/бид больше SellRatio
+func (c OrderBookStrategyConfig) Signal(ob *orderbook.OrderBook) Signal {
+	ratio := Ratio(ob, c.Depth)
+	switch {
+	case math.IsNaN(ratio):
+		return SIGNAL_NONE
+	case ratio > c.BuyRatio:
+		return SIGNAL_BUY
+	case 1/ratio > c.SellRatio:
+		return SIGNAL_SELL
+	}
+	return SIGNAL_NONE
+}
+
+// BacktestInstrument - Данные инструмента, нужные для расчета сделок на истории
+type BacktestInstrument struct {
+	// Lot - Лотность инструмента
+	Lot int64
+}
+
+// InstrumentFunc - Получение данных инструмента по uid, вызывается один раз для каждого инструмента из записи
+type InstrumentFunc func(id string) (BacktestInstrument, error)
+
+// BacktestConfig - Параметры проверки стратегии на записанных стаканах
+type BacktestConfig struct {
+	// InitialCash - Начальный баланс денежных средств
+	InitialCash float64
+	// Commission - Комиссия за 1 сделку в процентах
+	Commission float64
+}
+
+// SignalStats - Статистика сигналов стратегии
+type SignalStats struct {
+	// Books - Кол-во обработанных стаканов, Inconsistent - пропущенных неконсистентных стаканов
+	Books        int `json:"books"`
+	Inconsistent int `json:"inconsistent"`
+	// Buy, Sell - Кол-во сигналов на покупку и продажу
+	Buy  int `json:"buy"`
+	Sell int `json:"sell"`
+	// Bought, Sold - Кол-во исполненных сигналов
+	Bought int `json:"bought"`
+	Sold   int `json:"sold"`
+	// InStock - Сигналы на покупку при уже открытой позиции
+	InStock int `json:"in_stock"`
+	// NoPosition - Сигналы на продажу без открытой позиции
+	NoPosition int `json:"no_position"`
+	// NoMoney - Сигналы на покупку, для которых не хватило денежных средств
+	NoMoney int `json:"no_money"`
+	// NotProfitable - Сигналы на продажу, при которых выгода меньше MinProfit
+	NotProfitable int `json:"not_profitable"`
+	// NoLiquidity - Сигналы, для которых в стакане не хватило объема
+	NoLiquidity int `json:"no_liquidity"`
+}
+
+// BacktestResult - Результат проверки одной конфигурации стратегии на записанных стаканах
+type BacktestResult struct {
+	// Config - Проверенная конфигурация стратегии
+	Config OrderBookStrategyConfig
+	// Report - Показатели, сделки и кривая капитала по закрытым сделкам
+	Report *backtest.Report
+	// Signals - Статистика сигналов
+	Signals SignalStats
+	// Slippage - Среднее отклонение цены исполнения от середины спреда в б.п.
+	Slippage float64
+	// SlippageCost - Потери на проскальзывании относительно лучшей цены стакана в валюте
+	SlippageCost float64
+	// OpenPositions - Позиции, которые остались открытыми в конце записи (если SellOut = false)
+	OpenPositions int
+}
+
+// simPosition - Открытая позиция симулятора
+type simPosition struct {
+	trade backtest.Trade
+	lot   int64
+}
+
+// Simulator - Воспроизведение стаканов через логику бота на стакане. Рыночные заявки исполняются
+// по уровням записанного стакана, сигналы и проверки те же, что у исполнителя: позиция по инструменту одна,
+// покупка только при достаточном балансе, продажа только с выгодой больше MinProfit.
+// Если SellOut = true, позиции закрываются по последнему стакану каждого торгового дня.
+type Simulator struct {
+	config OrderBookStrategyConfig
+	bc     BacktestConfig
+
+	// instruments - Инструменты стратегии, если пусто - все инструменты записи
+	instruments map[string]struct{}
+	cash        float64
+	positions   map[string]*simPosition
+	// last - Последние стаканы по инструментам, по ним закрываются позиции в конце дня
+	last map[string]*orderbook.OrderBook
+	day  string
+
+	trades       []backtest.Trade
+	stats        SignalStats
+	slippage     float64
+	fills        int
+	slippageCost float64
+}
+
+// NewSimulator - Создание симулятора для конфигурации стратегии config
+func NewSimulator(config OrderBookStrategyConfig, bc BacktestConfig) *Simulator {
+	instruments := make(map[string]struct{}, len(config.Instruments))
+	for _, id := range config.Instruments {
+		instruments[id] = struct{}{}
+	}
+	return &Simulator{
+		config:      config,
+		bc:          bc,
+		instruments: instruments,
+		cash:        bc.InitialCash,
+		positions:   make(map[string]*simPosition),
+		last:        make(map[string]*orderbook.OrderBook),
+		trades:      make([]backtest.Trade, 0),
+	}
+}
+
+// OnOrderBook - Обработка очередного стакана, стаканы должны идти по возрастанию времени
+func (s *Simulator) OnOrderBook(ob *orderbook.OrderBook, instrument BacktestInstrument) {
+	id := ob.InstrumentUid
+	if len(s.instruments) > 0 {
+		if _, ok := s.instruments[id]; !ok {
+			return
+		}
+	}
+	// новый торговый день, закрываем позиции по последним стаканам предыдущего
+	if day := ob.Time.In(orderbook.MSK).Format(time.DateOnly); day != s.day {
+		if s.day != "" && s.config.SellOut {
+			s.sellOut()
+		}
+		s.day = day
+	}
+	s.stats.Books++
+	if !ob.IsConsistent {
+		s.stats.Inconsistent++
+		return
+	}
+	s.last[id] = ob
+
+	switch s.config.Signal(ob) {
+	case SIGNAL_BUY:
+		s.stats.Buy++
+		s.buy(ob, instrument)
+	case SIGNAL_SELL:
+		s.stats.Sell++
+		s.sell(ob)
+	}
+}
+
+// buy - Покупка QUANTITY лотов по уровням asks
+func (s *Simulator) buy(ob *orderbook.OrderBook, instrument BacktestInstrument) {
+	if _, ok := s.positions[ob.InstrumentUid]; ok {
+		s.stats.InStock++
+		return
+	}
+	price, impact, ok := s.walk(ob, orderbook.BID, false)
+	if !ok {
+		return
+	}
+	quantity := instrument.Lot * QUANTITY
+	value := price * float64(quantity)
+	commission := value * s.bc.Commission / 100
+	if s.cash < value+commission {
+		s.stats.NoMoney++
+		return
+	}
+	s.commit(ob, orderbook.BID, impact, instrument.Lot)
+	s.cash -= value + commission
+	s.positions[ob.InstrumentUid] = &simPosition{lot: instrument.Lot, trade: backtest.Trade{
+		InstrumentUid: ob.InstrumentUid,
+		Direction:     pb.OrderDirection_ORDER_DIRECTION_BUY,
+		Quantity:      quantity,
+		EntryTime:     ob.Time,
+		EntryPrice:    price,
+		Commission:    commission,
+	}}
+	s.stats.Bought++
+}
+
+// sell - Продажа открытой позиции по уровням bids, если выгода больше MinProfit
+func (s *Simulator) sell(ob *orderbook.OrderBook) {
+	position, ok := s.positions[ob.InstrumentUid]
+	if !ok {
+		s.stats.NoPosition++
+		return
+	}
+	price, impact, ok := s.walk(ob, orderbook.ASK, false)
+	if !ok {
+		return
+	}
+	entry := position.trade.EntryPrice
+	if (price-entry)/entry*100 <= s.config.MinProfit {
+		s.stats.NotProfitable++
+		return
+	}
+	s.commit(ob, orderbook.ASK, impact, position.lot)
+	s.close(position, ob.Time, price)
+	s.stats.Sold++
+}
+
+// sellOut - Закрытие всех позиций по последним стаканам инструментов, без проверки выгоды
+func (s *Simulator) sellOut() {
+	for id, position := range s.positions {
+		ob, ok := s.last[id]
+		if !ok {
+			continue
+		}
+		price, impact, ok := s.walk(ob, orderbook.ASK, true)
+		if !ok {
+			continue
+		}
+		s.commit(ob, orderbook.ASK, impact, position.lot)
+		s.close(position, ob.Time, price)
+	}
+}
+
+// close - Закрытие позиции по цене price
+func (s *Simulator) close(position *simPosition, t time.Time, price float64) {
+	trade := position.trade
+	value := price * float64(trade.Quantity)
+	commission := value * s.bc.Commission / 100
+	s.cash += value - commission
+	trade.ExitTime = t
+	trade.ExitPrice = price
+	trade.PnL = (price - trade.EntryPrice) * float64(trade.Quantity)
+	trade.Commission += commission
+	s.trades = append(s.trades, trade)
+	delete(s.positions, trade.InstrumentUid)
+}
+
+// walk - Средняя цена рыночной заявки на QUANTITY лотов по уровням стакана: BID - покупка, ASK - продажа.
+// Если объема стакана не хватает и force = false, заявка не исполняется, иначе остаток исполняется по худшей цене
+func (s *Simulator) walk(ob *orderbook.OrderBook, side orderbook.Side, force bool) (float64, orderbook.Impact, bool) {
+	impact, err := ob.PriceImpact(side, QUANTITY)
+	if err != nil || impact.Filled == 0 {
+		s.stats.NoLiquidity++
+		return 0, impact, false
+	}
+	if impact.Filled < QUANTITY {
+		if !force {
+			s.stats.NoLiquidity++
+			return 0, impact, false
+		}
+		rest := float64(QUANTITY - impact.Filled)
+		return (impact.AvgPrice*float64(impact.Filled) + impact.WorstPrice*rest) / QUANTITY, impact, true
+	}
+	return impact.AvgPrice, impact, true
+}
+
+// commit - Учет проскальзывания исполненной заявки
+func (s *Simulator) commit(ob *orderbook.OrderBook, side orderbook.Side, impact orderbook.Impact, lot int64) {
+	best, err := ob.BestAsk()
+	if side == orderbook.ASK {
+		best, err = ob.BestBid()
+	}
+	if err != nil {
+		return
+	}
+	s.slippage += impact.Slippage * 10000
+	s.fills++
+	s.slippageCost += math.Abs(impact.AvgPrice-best.Price.ToFloat()) * float64(impact.Filled*lot)
+}
+
+// Result - Результат проверки, если SellOut = true, открытые позиции закрываются по последним стаканам
+func (s *Simulator) Result() BacktestResult {
+	if s.config.SellOut {
+		s.sellOut()
+	}
+	result := BacktestResult{
+		Config:        s.config,
+		Report:        backtest.AnalyzeTrades(s.trades, s.bc.InitialCash),
+		Signals:       s.stats,
+		SlippageCost:  s.slippageCost,
+		OpenPositions: len(s.positions),
+	}
+	if s.fills > 0 {
+		result.Slippage = s.slippage / float64(s.fills)
+	}
+	return result
+}
+
+// BackTest - Проверка конфигураций стратегии configs за один проход по источнику стаканов books,
+// например backtest.OrderBooksFromStore. instrument вызывается один раз для каждого инструмента записи
+func BackTest(ctx context.Context, books func(fn func(ob *orderbook.OrderBook) error) error, instrument InstrumentFunc,
+	bc BacktestConfig, configs []OrderBookStrategyConfig) ([]BacktestResult, error) {
+	if bc.InitialCash <= 0 {
+		return nil, fmt.Errorf("InitialCash must be positive, got %v", bc.InitialCash)
+	}
+	simulators := make([]*Simulator, 0, len(configs))
+	for _, c := range configs {
+		simulators = append(simulators, NewSimulator(c, bc))
+	}
+	instruments := make(map[string]BacktestInstrument)
+	err := books(func(ob *orderbook.OrderBook) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		i, ok := instruments[ob.InstrumentUid]
+		if !ok {
+			var err error
+			i, err = instrument(ob.InstrumentUid)
+			if err != nil {
+				return err
+			}
+			if i.Lot <= 0 {
+				return fmt.Errorf("invalid lot %v for %v", i.Lot, ob.InstrumentUid)
+			}
+			instruments[ob.InstrumentUid] = i
+		}
+		for _, s := range simulators {
+			s.OnOrderBook(ob, i)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]BacktestResult, 0, len(simulators))
+	for _, s := range simulators {
+		results = append(results, s.Result())
+	}
+	return results, nil
+}
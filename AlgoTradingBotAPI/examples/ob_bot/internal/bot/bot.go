@@ -8,7 +8,7 @@ import (
 	"sync"
 
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
-	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
 )
 
 // QUANTITY - Кол-во лотов инструментов, которыми торгует бот
@@ -33,6 +33,8 @@ type OrderBookStrategyConfig struct {
 	MinProfit float64
 	// SellOut - Если true, то по достижению дедлайна бот выходит из всех активных позиций
 	SellOut bool
+	// Risk - Лимиты риск-менеджера для поручений бота, nil - без проверок
+	Risk *investgo.RiskConfig
 }
 
 type Bot struct {
@@ -66,6 +68,7 @@ func NewBot(ctx context.Context, c *investgo.Client, config OrderBookStrategyCon
 			entryPrice: 0,
 			lot:        resp.GetInstrument().GetLot(),
 			currency:   resp.GetInstrument().GetCurrency(),
+			priceStep:  resp.GetInstrument().GetMinPriceIncrement(),
 		}
 	}
 	return &Bot{
@@ -73,7 +76,7 @@ func NewBot(ctx context.Context, c *investgo.Client, config OrderBookStrategyCon
 		StrategyConfig: config,
 		ctx:            botCtx,
 		cancelBot:      cancelBot,
-		executor:       NewExecutor(ctx, c, instruments, config.MinProfit),
+		executor:       NewExecutor(ctx, c, instruments, config.MinProfit, config.Risk),
 	}, nil
 }
 
@@ -106,7 +109,7 @@ func (b *Bot) Run() error {
 		}
 	}()
 
-	orderBooks := make(chan OrderBook)
+	orderBooks := make(chan *orderbook.OrderBook)
 	defer close(orderBooks)
 
 	// чтение из стрима
@@ -121,7 +124,11 @@ func (b *Bot) Run() error {
 				if !ok {
 					return
 				}
-				orderBooks <- transformOrderBook(ob)
+				// риск-менеджер берет из стакана LimitUp/LimitDown
+				if b.executor.risk != nil {
+					b.executor.risk.Handle(ob)
+				}
+				orderBooks <- orderbook.NewOrderBook(ob, b.executor.instruments[ob.GetInstrumentUid()].priceStep)
 			}
 		}
 	}(b.ctx)
@@ -171,7 +178,7 @@ func (b *Bot) Stop() {
 }
 
 // // HandleOrderBooks - нужно вызвать асинхронно, будет писать в канал id инструментов, которые нужно купить или продать
-// func (b *Bot) HandleOrderBooks(ctx context.Context, orderBooks chan OrderBook) (float64, error) {
+// func (b *Bot) HandleOrderBooks(ctx context.Context, orderBooks chan *orderbook.OrderBook) (float64, error) {
 // 	var totalProfit float64
 // 	for {
 // 		select {
@@ -201,20 +208,9 @@ func (b *Bot) Stop() {
 // 	}
 // }
 
-// checkRate - возвращает значения коэффициента count(ask) / count(bid)
-func (b *Bot) checkRatio(ob OrderBook) float64 {
-	sell := ordersCount(ob.Asks)
-	buy := ordersCount(ob.Bids)
-	return float64(buy) / float64(sell)
-}
-
-// ordersCount - возвращает кол-во заявок из слайса ордеров
-func ordersCount(o []Order) int64 {
-	var count int64
-	for _, order := range o {
-		count += order.Quantity
-	}
-	return count
+// checkRatio - возвращает значения коэффициента count(bid) / count(ask), та же функция используется в BackTest
+func (b *Bot) checkRatio(ob *orderbook.OrderBook) float64 {
+	return Ratio(ob, b.StrategyConfig.Depth)
 }
 
 // checkMoneyBalance - проверка доступного баланса денежных средств
@@ -259,33 +255,3 @@ func (b *Bot) checkMoneyBalance(currency string, required float64) error {
 
 	return nil
 }
-
-// transformOrderBook - Преобразование стакана в нужный формат
-func transformOrderBook(input *pb.OrderBook) OrderBook {
-	depth := input.GetDepth()
-	bids := make([]Order, 0, depth)
-	asks := make([]Order, 0, depth)
-	for _, o := range input.GetBids() {
-		bids = append(bids, Order{
-			Price:    o.GetPrice().ToFloat(),
-			Quantity: o.GetQuantity(),
-		})
-	}
-	for _, o := range input.GetAsks() {
-		asks = append(asks, Order{
-			Price:    o.GetPrice().ToFloat(),
-			Quantity: o.GetQuantity(),
-		})
-	}
-	return OrderBook{
-		Figi:          input.GetFigi(),
-		InstrumentUid: input.GetInstrumentUid(),
-		Depth:         depth,
-		IsConsistent:  input.GetIsConsistent(),
-		TimeUnix:      input.GetTime().AsTime().Unix(),
-		LimitUp:       input.GetLimitUp().ToFloat(),
-		LimitDown:     input.GetLimitDown().ToFloat(),
-		Bids:          bids,
-		Asks:          asks,
-	}
-}
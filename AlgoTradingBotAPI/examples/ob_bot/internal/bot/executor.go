@@ -11,6 +11,9 @@ import (
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 )
 
+// SELL_OUT_TIMEOUT - Время, в течение которого SellOut повторяет попытки закрыть позиции
+const SELL_OUT_TIMEOUT = 2 * time.Minute
+
 type Instrument struct {
 	// quantity - Количество лотов, которое покупает/продает исполнитель за 1 поручение
 	quantity int64
@@ -22,6 +25,8 @@ type Instrument struct {
 	inStock bool
 	// entryPrice - После открытия позиции, сохраняется цена этой сделки
 	entryPrice float64
+	// priceStep - Шаг цены инструмента
+	priceStep *pb.Quotation
 }
 
 // LastPrices - Последние цены инструментов
@@ -130,6 +135,12 @@ func (s *States) Get(id string) (State, bool) {
 	return state, ok
 }
 
+// orderRouter - Выставление поручений исполнителя, реализуется OrdersServiceClient и RiskManager
+type orderRouter interface {
+	Buy(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error)
+	Sell(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error)
+}
+
 // Executor - Вызывается ботом и исполняет торговые поручения
 type Executor struct {
 	// instruments - Инструменты, которыми торгует исполнитель
@@ -148,12 +159,15 @@ type Executor struct {
 	cancel context.CancelFunc
 
 	client            *investgo.Client
-	ordersService     *investgo.OrdersServiceClient
+	ordersService     orderRouter
 	operationsService *investgo.OperationsServiceClient
+	// risk - Риск-менеджер, через который идут поручения, nil - без проверок
+	risk *investgo.RiskManager
 }
 
-// NewExecutor - Создание экземпляра исполнителя
-func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrument, minProfit float64) *Executor {
+// NewExecutor - Создание экземпляра исполнителя, если risk != nil, поручения проверяются риск-менеджером с этими лимитами
+func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrument, minProfit float64,
+	risk *investgo.RiskConfig) *Executor {
 	ctxExecutor, cancel := context.WithCancel(ctx)
 	wg := &sync.WaitGroup{}
 
@@ -168,6 +182,19 @@ func NewExecutor(ctx context.Context, c *investgo.Client, ids map[string]Instrum
 		ordersService:     c.NewOrdersServiceClient(),
 		operationsService: c.NewOperationsServiceClient(),
 	}
+	if risk != nil {
+		instruments := make([]investgo.EngineInstrument, 0, len(ids))
+		for id, instrument := range ids {
+			instruments = append(instruments, investgo.EngineInstrument{
+				Uid:       id,
+				Lot:       int64(instrument.lot),
+				Currency:  instrument.currency,
+				PriceStep: instrument.priceStep,
+			})
+		}
+		e.risk = investgo.NewRiskManager(c.NewOrdersServiceClient(), instruments, *risk, c.Logger)
+		e.ordersService = e.risk
+	}
 	// Сразу запускаем исполнителя из его же конструктора
 	e.start(ctxExecutor)
 	return e
@@ -368,6 +395,7 @@ func (e *Executor) Buy(id string) error {
 	if err != nil {
 		return err
 	}
+	e.riskFill(resp, pb.OrderDirection_ORDER_DIRECTION_BUY)
 	if resp.GetExecutionReportStatus() == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL {
 		currentInstrument.inStock = true
 		currentInstrument.entryPrice = resp.GetExecutedOrderPrice().ToFloat()
@@ -402,6 +430,7 @@ func (e *Executor) Sell(id string) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
+	e.riskFill(resp, pb.OrderDirection_ORDER_DIRECTION_SELL)
 	var profit float64
 	if resp.GetExecutionReportStatus() == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL {
 		currentInstrument.inStock = false
@@ -413,6 +442,25 @@ func (e *Executor) Sell(id string) (float64, error) {
 	return profit, nil
 }
 
+// riskFill - Передача исполнения рыночного поручения риск-менеджеру. Стрима сделок у исполнителя нет,
+// поэтому позиция и результат риск-менеджера обновляются по ответу на поручение
+func (e *Executor) riskFill(resp *investgo.PostOrderResponse, direction pb.OrderDirection) {
+	if e.risk == nil || resp.GetLotsExecuted() == 0 {
+		return
+	}
+	uid := resp.GetInstrumentUid()
+	instrument := e.instruments[uid]
+	e.risk.Handle(&pb.OrderTrades{
+		OrderId:       resp.GetOrderId(),
+		Direction:     direction,
+		InstrumentUid: uid,
+		Trades: []*pb.OrderTrade{{
+			Price:    investgo.FloatToQuotation(resp.GetExecutedOrderPrice().ToFloat(), instrument.priceStep),
+			Quantity: resp.GetLotsExecuted() * int64(instrument.lot),
+		}},
+	})
+}
+
 // isProfitable - Верно если процент выгоды возможной сделки, рассчитанный по цене последней сделки, больше чем minProfit
 func (e *Executor) isProfitable(id string) bool {
 	lp, ok := e.lastPrices.Get(id)
@@ -452,62 +500,35 @@ func (e *Executor) possibleToBuy(id string) bool {
 	return moneyInFloat > required
 }
 
-// SellOut - Метод выхода из всех ценно-бумажных позиций
+// SellOut - Метод выхода из всех позиций бота: длинных и коротких, по бумагам, фьючерсам и опционам.
+// Попытки закрыть позиции повторяются, пока они не закроются или не истечет SELL_OUT_TIMEOUT
 func (e *Executor) SellOut() (float64, error) {
-	// TODO for futures and options
-	resp, err := e.operationsService.GetPositions(e.client.Config.AccountId)
-	if err != nil {
-		return 0, err
+	ids := make([]string, 0, len(e.instruments))
+	for id := range e.instruments {
+		ids = append(ids, id)
 	}
+	// если бот не открывал позицию, он не будет ее закрывать
+	closed, err := investgo.NewFlattener(e.client, investgo.FlattenConfig{
+		Instruments: ids,
+		Timeout:     SELL_OUT_TIMEOUT,
+	}).Flatten(context.Background())
 
 	var sellOutProfit float64
-	securities := resp.GetSecurities()
-	for _, security := range securities {
-		var lot int64
-		instrument, ok := e.instruments[security.GetInstrumentUid()]
+	for _, p := range closed {
+		instrument, ok := e.instruments[p.InstrumentUid]
 		if !ok {
-			// если бот не открывал эту позицию, он не будет ее закрывать
-			e.client.Logger.Infof("%v not found in executor instruments map", security.GetInstrumentUid())
 			continue
-		} else {
-			lot = int64(instrument.lot)
 		}
-		balanceInLots := security.GetBalance() / lot
-		if balanceInLots < 0 {
-			resp, err := e.ordersService.Buy(&investgo.PostOrderRequestShort{
-				InstrumentId: security.GetInstrumentUid(),
-				Quantity:     -balanceInLots,
-				Price:        nil,
-				AccountId:    e.client.Config.AccountId,
-				OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
-				OrderId:      investgo.CreateUid(),
-			})
-			if err != nil {
-				e.client.Logger.Errorf(investgo.MessageFromHeader(resp.GetHeader()))
-				return 0, err
-			}
-		} else {
-			resp, err := e.ordersService.Sell(&investgo.PostOrderRequestShort{
-				InstrumentId: security.GetInstrumentUid(),
-				Quantity:     balanceInLots,
-				Price:        nil,
-				AccountId:    e.client.Config.AccountId,
-				OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
-				OrderId:      investgo.CreateUid(),
-			})
-			if err != nil {
-				e.client.Logger.Errorf(investgo.MessageFromHeader(resp.GetHeader()))
-				return 0, err
-			}
-			if resp.GetExecutionReportStatus() == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL {
-				instrument.inStock = false
-				// разница в цене инструмента * лотность * кол-во лотов
-				sellOutProfit += (resp.GetExecutedOrderPrice().ToFloat() - instrument.entryPrice) * float64(instrument.lot) * float64(instrument.quantity)
-			}
-			e.instruments[security.GetInstrumentUid()] = instrument
+		if p.ClosedLots != 0 && instrument.entryPrice != 0 {
+			// разница в цене инструмента * лотность * кол-во лотов, для короткой позиции ClosedLots < 0
+			sellOutProfit += (p.ExecutedPrice - instrument.entryPrice) * float64(instrument.lot) * float64(p.ClosedLots)
+		}
+		if p.Flat() {
+			instrument.inStock = false
+			e.instruments[p.InstrumentUid] = instrument
 		}
 	}
-	return sellOutProfit, nil
+	return sellOutProfit, err
 }
 
 // listenLastPrices - Метод слушает стрим последних цен и обновляет их
@@ -548,6 +569,9 @@ func (e *Executor) listenLastPrices(ctx context.Context) error {
 				if !ok {
 					return
 				}
+				if e.risk != nil {
+					e.risk.Handle(lp)
+				}
 				uid := lp.GetInstrumentUid()
 				price := lp.GetPrice().ToFloat()
 				// получаем состояние инструмента
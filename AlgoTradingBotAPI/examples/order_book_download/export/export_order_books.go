@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+)
+
+const (
+	// STORE_DIR - Директория хранилища стаканов, в которую пишет order_book_download
+	STORE_DIR = "order_book_download/data"
+	// LEGACY_DB_PATH - Файл sqlite, записанный предыдущей версией order_book_download, используется если
+	// STORE_DIR не существует
+	LEGACY_DB_PATH = "order_book_download/order_books.db"
+	// OUTPUT_PATH - Файл выгрузки
+	OUTPUT_PATH = "order_book_download/order_books.csv"
+	// INSTRUMENT - uid или figi инструмента, пустая строка - все инструменты (только для STORE_DIR)
+	INSTRUMENT = "e6123145-9665-43e0-8413-cd61b8aa9b13"
+	// LEVELS - Кол-во выгружаемых уровней каждой стороны стакана, 0 - все
+	LEVELS = 10
+)
+
+func main() {
+	// выгружаем стаканы за последние сутки
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+
+	file, err := os.Create(OUTPUT_PATH)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	w, err := orderbook.NewCSVWriter(file, LEVELS)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	var count int
+	if _, err = os.Stat(STORE_DIR); errors.Is(err, os.ErrNotExist) {
+		books, err := orderbook.LoadOrderBooks(LEGACY_DB_PATH, orderbook.LoadRequest{
+			InstrumentId: INSTRUMENT,
+			From:         from,
+			To:           to,
+		})
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		for _, ob := range books {
+			if err = w.Write(ob); err != nil {
+				log.Fatalf(err.Error())
+			}
+		}
+		count = len(books)
+	} else {
+		req := orderbook.QueryRequest{
+			From: from,
+			To:   to,
+		}
+		if INSTRUMENT != "" {
+			req.Instruments = []string{INSTRUMENT}
+		}
+		err = orderbook.Query(STORE_DIR, req, func(ob *orderbook.OrderBook) error {
+			count++
+			return w.Write(ob)
+		})
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+	}
+	if err = w.Flush(); err != nil {
+		log.Fatalf(err.Error())
+	}
+	log.Printf("%v order books exported to %v", count, OUTPUT_PATH)
+}
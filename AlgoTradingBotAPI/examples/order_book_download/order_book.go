@@ -2,84 +2,64 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	BATCH_SIZE    = 300
-	DEPTH         = 20
-	STORE_IN_JSON = false // if false store in sqlite
+	// CONFIG_PATH - Путь к конфигурации записи стаканов
+	CONFIG_PATH = "order_book_download/order_books.yaml"
+	// STREAM_LIMIT - Максимальное кол-во подписок на стаканы в одном стриме по умолчанию
+	STREAM_LIMIT = 300
+	// FLUSH_PERIOD - Период сброса записанных стаканов на диск
+	FLUSH_PERIOD = 10 * time.Second
 )
 
-type Order struct {
-	Price    float64 `json:"Price"`
-	Quantity int64   `json:"Quantity"`
+// InstrumentGroup - Группа инструментов с одной глубиной стакана
+type InstrumentGroup struct {
+	// Depth - Глубина стакана
+	Depth int32 `yaml:"Depth"`
+	// Instruments - uid инструментов
+	Instruments []string `yaml:"Instruments"`
+	// Shares - Кол-во акций из списка InstrumentStatus_INSTRUMENT_STATUS_BASE, которые добавляются в группу
+	Shares int `yaml:"Shares"`
 }
 
-type OrderBook struct {
-	Figi          string  `json:"Figi"`
-	InstrumentUid string  `json:"InstrumentUid"`
-	Depth         int32   `json:"Depth"`
-	IsConsistent  bool    `json:"IsConsistent"`
-	TimeUnix      int64   `json:"TimeUnix"`
-	LimitUp       float64 `json:"LimitUp"`
-	LimitDown     float64 `json:"LimitDown"`
-	Bids          []Order `json:"Bids"`
-	Asks          []Order `json:"Asks"`
+// Config - Конфигурация записи стаканов
+type Config struct {
+	// Dir - Директория хранилища стаканов, файлы ротируются по торговым дням
+	Dir string `yaml:"Dir"`
+	// StreamLimit - Максимальное кол-во подписок в одном стриме, инструменты распределяются по нескольким стримам
+	StreamLimit int `yaml:"StreamLimit"`
+	// Groups - Группы инструментов
+	Groups []InstrumentGroup `yaml:"Groups"`
 }
 
-var schema = `
-create table if not exists orderbooks (
-    id integer primary key autoincrement,
-    figi text,
-    instrument_uid text,
-    depth integer,
-    is_consistent integer,
-    time_unix integer,
-    limit_up real,
-    limit_down real
-);
-
-create table if not exists bids (
-    orderbook_id integer,
-    price real,
-    quantity integer,
-    foreign key (orderbook_id) references orderbooks (id) on delete cascade 
-);
-
-create table if not exists asks (
-    orderbook_id integer,
-    price real,
-    quantity integer,
-    foreign key (orderbook_id) references orderbooks (id) on delete cascade 
-);
-`
+// subscription - Подписка на стакан инструмента
+type subscription struct {
+	id    string
+	depth int32
+}
 
 func main() {
-	// создаем базу данных sqlite
-	db, err := initDB("order_book_download/order_books.db")
+	// загружаем конфигурацию записи стаканов
+	obConfig, err := loadConfig(CONFIG_PATH)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatalf("order books config loading error %v", err.Error())
 	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			log.Printf(err.Error())
-		}
-	}()
 	// загружаем конфигурацию для сдк из .yaml файла
 	config, err := investgo.LoadConfig("config.yaml")
 	if err != nil {
@@ -118,323 +98,171 @@ func main() {
 		}
 	}()
 
-	// для синхронизации всех горутин
-	wg := &sync.WaitGroup{}
-	// создаем сервис инструментов, и у него вызываем нужные методы
-	insrtumentsService := client.NewInstrumentsServiceClient()
-
-	// получаем список акций доступных для торговли через investAPI
-	instrumentsResp, err := insrtumentsService.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// слайс идентификаторов торговых инструментов
-	instrumentIds := make([]string, 0, 900)
-
-	// берем первые 900 элементов
-	instruments := instrumentsResp.GetInstruments()
-	for i, instrument := range instruments {
-		if i > 899 {
-			break
-		}
-		instrumentIds = append(instrumentIds, instrument.GetUid())
-	}
-	fmt.Printf("got %v instruments\n", len(instrumentIds))
-	// создаем клиента сервиса стримов маркетдаты, и с его помощью создаем стримы
-	MarketDataStreamService := client.NewMarketDataStreamClient()
-	// создаем стримы
-	stream1, err := MarketDataStreamService.MarketDataStream()
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-
-	stream2, err := MarketDataStreamService.MarketDataStream()
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-
-	stream3, err := MarketDataStreamService.MarketDataStream()
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// в рамках каждого стрима подписываемся на стаканы для 300 инструментов
-	orderBooks1, err := stream1.SubscribeOrderBook(instrumentIds[:299], DEPTH)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-
-	orderBooks2, err := stream2.SubscribeOrderBook(instrumentIds[300:599], DEPTH)
+	subs, err := subscriptions(client, obConfig)
 	if err != nil {
-		logger.Errorf(err.Error())
+		logger.Fatalf(err.Error())
 	}
+	logger.Infof("got %v instruments", len(subs))
 
-	orderBooks3, err := stream3.SubscribeOrderBook(instrumentIds[600:899], DEPTH)
+	// хранилище стаканов, по одному сжатому файлу на торговый день
+	store, err := orderbook.NewStore(obConfig.Dir, orderbook.MSK, logger)
 	if err != nil {
-		logger.Errorf(err.Error())
+		logger.Fatalf(err.Error())
 	}
-	// процесс сохранения стакана в хранилище:
-	// чтение из стрима -> преобразование -> сохранение в слайс -> запись в хранилище
-	// разбиваем процесс на три горутины:
-	// 1. Читаем из стрима и преобразуем -> orderBookStorage
-	// 2. Собираем batch и отправляем во внешнее хранилище -> externalStorage
-	// 3. Записываем batch в хранилище
-
-	// канал для связи горутны 1 и 2
-	orderBookStorage := make(chan *OrderBook)
-	defer close(orderBookStorage)
-
-	// запускаем чтение стримов
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer wg.Done()
-		err := stream1.Listen()
-		if err != nil {
+	defer func() {
+		if err := store.Close(); err != nil {
 			logger.Errorf(err.Error())
 		}
-	}(ctx)
+	}()
 
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer wg.Done()
-		err := stream2.Listen()
+	// для синхронизации всех горутин
+	wg := &sync.WaitGroup{}
+	// создаем клиента сервиса стримов маркетдаты, и с его помощью создаем стримы,
+	// в каждом стриме не больше StreamLimit подписок
+	MarketDataStreamService := client.NewMarketDataStreamClient()
+	streams := make([]*investgo.MarketDataStream, 0)
+	for start := 0; start < len(subs); start += obConfig.StreamLimit {
+		end := start + obConfig.StreamLimit
+		if end > len(subs) {
+			end = len(subs)
+		}
+		stream, err := MarketDataStreamService.MarketDataStream()
 		if err != nil {
-			logger.Errorf(err.Error())
+			logger.Fatalf(err.Error())
 		}
-	}(ctx)
-
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer wg.Done()
-		err := stream3.Listen()
+		streams = append(streams, stream)
+		orderBooks, err := subscribeShard(stream, subs[start:end])
 		if err != nil {
-			logger.Errorf(err.Error())
+			logger.Fatalf(err.Error())
 		}
-	}(ctx)
-
-	// читаем стаканы из каналов и преобразуем стакан в нужную структуру
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer func() {
-			// если мы слушаем в одной рутине несколько стримов, то
-			// при завершении (из-за закрытия одного из каналов) нужно остановить все стримы
-			stream1.Stop()
-			stream2.Stop()
-			stream3.Stop()
-			wg.Done()
-		}()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case input, ok := <-orderBooks1:
-				if !ok {
-					return
-				}
-				orderBookStorage <- transformOrderBook(input)
-			case input, ok := <-orderBooks2:
-				if !ok {
-					return
-				}
-				orderBookStorage <- transformOrderBook(input)
-			case input, ok := <-orderBooks3:
-				if !ok {
-					return
-				}
-				orderBookStorage <- transformOrderBook(input)
+		logger.Infof("stream %v: %v order book subscriptions", len(streams), end-start)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stream.Listen()
+			if err != nil {
+				logger.Errorf(err.Error())
 			}
-		}
-	}(ctx)
+		}()
 
-	// канал для связи горутины 2 и 3
-	externalStorage := make(chan []*OrderBook)
-	defer close(externalStorage)
-	// сохраняем в хранилище
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer wg.Done()
-		batch := make([]*OrderBook, BATCH_SIZE)
-		count := 0
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case ob, ok := <-orderBookStorage:
-				if !ok {
+		// читаем стаканы из стрима и записываем в хранилище
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
 					return
-				}
-				if count < BATCH_SIZE-1 {
-					batch[count] = ob
-					count++
-				} else {
-					client.Logger.Infof("batch overflow")
-					batch[count] = ob
-					count = 0
-					externalStorage <- batch
+				case input, ok := <-orderBooks:
+					if !ok {
+						// если один из стримов завершился, то завершаем запись
+						cancel()
+						return
+					}
+					if err := store.Write(orderbook.NewOrderBook(input, nil)); err != nil {
+						logger.Errorf(err.Error())
+					}
 				}
 			}
-		}
-	}(ctx)
+		}(ctx)
+	}
 
-	// записываем стаканы в бд или json
+	// периодически сбрасываем данные на диск, чтобы при аварийном завершении потерять не больше FLUSH_PERIOD
 	wg.Add(1)
 	go func(ctx context.Context) {
 		defer wg.Done()
+		ticker := time.NewTicker(FLUSH_PERIOD)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case data, ok := <-externalStorage:
-				if !ok {
-					return
-				}
-				if STORE_IN_JSON {
-					err = storeOrderBooksInFile(data)
-				} else {
-					err = storeOrderBooksInDB(db, data)
-				}
-				if err != nil {
+			case <-ticker.C:
+				if err := store.Flush(); err != nil {
 					logger.Errorf(err.Error())
 				}
 			}
 		}
 	}(ctx)
 
-	wg.Wait()
-}
-
-// transformOrderBook - Преобразование стакана в нужный формат
-func transformOrderBook(input *pb.OrderBook) *OrderBook {
-	depth := input.GetDepth()
-	bids := make([]Order, 0, depth)
-	asks := make([]Order, 0, depth)
-	for _, o := range input.GetBids() {
-		bids = append(bids, Order{
-			Price:    o.GetPrice().ToFloat(),
-			Quantity: o.GetQuantity(),
-		})
-	}
-	for _, o := range input.GetAsks() {
-		asks = append(asks, Order{
-			Price:    o.GetPrice().ToFloat(),
-			Quantity: o.GetQuantity(),
-		})
-	}
-	return &OrderBook{
-		Figi:          input.GetFigi(),
-		InstrumentUid: input.GetInstrumentUid(),
-		Depth:         depth,
-		IsConsistent:  input.GetIsConsistent(),
-		TimeUnix:      input.GetTime().AsTime().Unix(),
-		LimitUp:       input.GetLimitUp().ToFloat(),
-		LimitDown:     input.GetLimitDown().ToFloat(),
-		Bids:          bids,
-		Asks:          asks,
+	<-ctx.Done()
+	logger.Infof("stop order books recording...")
+	// стримы работают на контексте клиента, завершать их нужно явно
+	for _, stream := range streams {
+		stream.Stop()
 	}
+	wg.Wait()
 }
 
-// storeOrderBooksInFile - Сохранение стаканов в json
-func storeOrderBooksInFile(orderBooks []*OrderBook) error {
-	file, err := os.Create("order_books.json")
+// loadConfig - Загрузка конфигурации записи стаканов из .yaml файла
+func loadConfig(path string) (Config, error) {
+	var c Config
+	input, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return c, err
 	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Printf(err.Error())
-		}
-	}()
-	data, err := json.MarshalIndent(orderBooks, "", " ")
-	if err != nil {
-		return err
+	if err = yaml.Unmarshal(input, &c); err != nil {
+		return c, err
 	}
-	_, err = file.Write(data)
-	return err
-}
-
-// initDB - Инициализация бд
-func initDB(path string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
+	if c.Dir == "" {
+		return c, fmt.Errorf("%v: Dir is required", path)
 	}
-
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	if _, err = db.Exec(schema); err != nil {
-		return nil, err
+	if c.StreamLimit <= 0 {
+		c.StreamLimit = STREAM_LIMIT
 	}
-	return db, nil
+	return c, nil
 }
 
-// storeOrderBooksInDB - Сохранение партии стаканов в бд
-func storeOrderBooksInDB(db *sqlx.DB, obooks []*OrderBook) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := tx.Commit(); err != nil {
-			log.Printf(err.Error())
+// subscriptions - Список подписок по группам конфига, если инструмент есть в нескольких группах,
+// берется наибольшая глубина
+func subscriptions(client *investgo.Client, c Config) ([]subscription, error) {
+	depths := make(map[string]int32)
+	var shares []*pb.Share
+	for _, g := range c.Groups {
+		ids := g.Instruments
+		if g.Shares > 0 {
+			if shares == nil {
+				resp, err := client.NewInstrumentsServiceClient().Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
+				if err != nil {
+					return nil, err
+				}
+				shares = resp.GetInstruments()
+			}
+			for i := 0; i < g.Shares && i < len(shares); i++ {
+				ids = append(ids, shares[i].GetUid())
+			}
 		}
-	}()
-
-	insertOB, err := tx.Prepare(`insert into orderbooks (figi, instrument_uid, depth, is_consistent, time_unix, limit_up, limit_down) 
-		values (?, ?, ?, ?, ?, ?, ?) `)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := insertOB.Close(); err != nil {
-			log.Printf(err.Error())
+		for _, id := range ids {
+			if g.Depth > depths[id] {
+				depths[id] = g.Depth
+			}
 		}
-	}()
-
-	insertBid, err := tx.Prepare(`insert into bids (orderbook_id, price, quantity) values (?, ?, ?)`)
-	if err != nil {
-		return err
 	}
-	defer func() {
-		if err := insertBid.Close(); err != nil {
-			log.Printf(err.Error())
-		}
-	}()
-
-	insertAsk, err := tx.Prepare(`insert into asks (orderbook_id, price, quantity) values (?, ?, ?)`)
-	if err != nil {
-		return err
+	subs := make([]subscription, 0, len(depths))
+	for id, depth := range depths {
+		subs = append(subs, subscription{id: id, depth: depth})
 	}
-	defer func() {
-		if err := insertAsk.Close(); err != nil {
-			log.Printf(err.Error())
-		}
-	}()
-
-	for _, ob := range obooks {
-		result, err := insertOB.Exec(ob.Figi, ob.InstrumentUid, ob.Depth, ob.IsConsistent, ob.TimeUnix, ob.LimitUp, ob.LimitDown)
-		if err != nil {
-			return err
-		}
+	// порядок нужен для одинакового распределения по стримам между запусками
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].id < subs[j].id
+	})
+	return subs, nil
+}
 
-		lastId, err := result.LastInsertId()
+// subscribeShard - Подписка стрима на стаканы инструментов, по одному запросу на каждую глубину
+func subscribeShard(stream *investgo.MarketDataStream, subs []subscription) (<-chan *pb.OrderBook, error) {
+	byDepth := make(map[int32][]string)
+	for _, s := range subs {
+		byDepth[s.depth] = append(byDepth[s.depth], s.id)
+	}
+	var orderBooks <-chan *pb.OrderBook
+	for depth, ids := range byDepth {
+		ch, err := stream.SubscribeOrderBook(ids, depth)
 		if err != nil {
-			return err
-		}
-
-		for _, bid := range ob.Bids {
-			if _, err := insertBid.Exec(lastId, bid.Price, bid.Quantity); err != nil {
-				return err
-			}
-		}
-
-		for _, ask := range ob.Asks {
-			if _, err := insertAsk.Exec(lastId, ask.Price, ask.Quantity); err != nil {
-				return err
-			}
+			return nil, err
 		}
+		orderBooks = ch
 	}
-
-	return nil
+	return orderBooks, nil
 }
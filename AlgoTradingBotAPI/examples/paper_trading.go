@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/backtest"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// REPLAY_PATH - Запись биржевой информации MarketDataRecorder. Если путь задан, бот торгует на воспроизведении
+// записи, иначе - на живом стриме
+const REPLAY_PATH = ""
+
+// SpreadStrategy - Стратегия на стакане: покупка лимитным поручением по лучшей цене покупки, когда спред
+// больше порога, и продажа по лучшей цене продажи
+type SpreadStrategy struct {
+	investgo.BaseStrategy
+	engine *investgo.Engine
+
+	// Spread - Минимальный спред в шагах цены
+	Spread float64
+	// Lots - Кол-во лотов в одном поручении
+	Lots int64
+}
+
+func (s *SpreadStrategy) Init(e *investgo.Engine) error {
+	s.engine = e
+	return nil
+}
+
+func (s *SpreadStrategy) OnOrderBook(input *pb.OrderBook) error {
+	id := input.GetInstrumentUid()
+	instrument, ok := s.engine.Instrument(id)
+	if !ok {
+		return nil
+	}
+	for _, o := range s.engine.ActiveOrders() {
+		if o.InstrumentUid == id {
+			return nil
+		}
+	}
+	ob := orderbook.NewOrderBook(input, instrument.PriceStep)
+	bid, err := ob.BestBid()
+	if err != nil {
+		return nil
+	}
+	ask, err := ob.BestAsk()
+	if err != nil {
+		return nil
+	}
+	step := instrument.PriceStep.ToFloat()
+	position := s.engine.Position(id)
+	switch {
+	case position.Lots == 0 && ask.Price.ToFloat()-bid.Price.ToFloat() >= s.Spread*step:
+		_, err = s.engine.Buy(id, s.Lots, bid.Price)
+	case position.Lots > 0:
+		_, err = s.engine.Sell(id, position.Lots, ask.Price)
+	}
+	return err
+}
+
+func (s *SpreadStrategy) OnOrderUpdate(trades *pb.OrderTrades) error {
+	p := s.engine.Position(trades.GetInstrumentUid())
+	s.engine.Logger().Infof("paper fill %v position = %v lots, realized pnl = %.2f", trades.GetInstrumentUid(), p.Lots, p.RealizedPnL)
+	return nil
+}
+
+func main() {
+	// загружаем конфигурацию для сдк из .yaml файла
+	config, err := investgo.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// сдк использует для внутреннего логирования investgo.Logger
+	// для примера передадим uber.zap
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	// клиент нужен для информации об инструментах и стрима биржевой информации, поручения на счет не выставляются
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		logger.Infof("closing client connection")
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	ids := []string{"e6123145-9665-43e0-8413-cd61b8aa9b13"}
+	instrumentsService := client.NewInstrumentsServiceClient()
+	instruments := make([]investgo.EngineInstrument, 0, len(ids))
+	for _, id := range ids {
+		resp, err := instrumentsService.InstrumentByUid(id)
+		if err != nil {
+			logger.Fatalf(err.Error())
+		}
+		instrument := resp.GetInstrument()
+		instruments = append(instruments, investgo.EngineInstrument{
+			Uid:       instrument.GetUid(),
+			Figi:      instrument.GetFigi(),
+			Ticker:    instrument.GetTicker(),
+			Lot:       int64(instrument.GetLot()),
+			Currency:  instrument.GetCurrency(),
+			PriceStep: instrument.GetMinPriceIncrement(),
+		})
+	}
+
+	// лимитные поручения исполняются, когда встречные заявки или обезличенные сделки проходят их цену,
+	// а уменьшение объема уровня в стакане считается исполнением заявок, стоящих в очереди перед поручением
+	paper := backtest.NewPaperBroker(backtest.PaperConfig{
+		Instruments: instruments,
+		InitialCash: 100000,
+		Currency:    "RUB",
+		Fill:        backtest.FILL_QUEUE,
+		Slippage:    backtest.Slippage{Ticks: 1},
+		Commission:  backtest.TariffTrader,
+		Trades:      true,
+		Logger:      logger,
+	})
+
+	marketData := func() (investgo.MarketDataSource, error) {
+		if REPLAY_PATH != "" {
+			return investgo.NewMarketDataReplayer(ctx, REPLAY_PATH, investgo.REPLAY_AS_FAST_AS_POSSIBLE, logger), nil
+		}
+		return client.NewMarketDataStreamClient().MarketDataStream()
+	}
+	// поручения, позиции и исполнения движка идут через бумажного брокера
+	engine, err := investgo.NewEngine(ctx, client, &SpreadStrategy{Spread: 3, Lots: 1}, paper.EngineConfig(investgo.EngineConfig{
+		Instruments:    ids,
+		OrderBookDepth: 20,
+		SellOut:        true,
+		Currency:       "RUB",
+		// поручения стратегии проверяются риск-менеджером до отправки бумажному брокеру
+		Risk: &investgo.RiskConfig{
+			MaxOrderValue:      10000,
+			MaxPositionValue:   20000,
+			MaxOrdersPerMinute: 30,
+			PriceCollar:        2,
+		},
+	}, marketData))
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	if err = engine.Run(); err != nil {
+		logger.Errorf(err.Error())
+	}
+
+	portfolio, err := paper.GetPortfolio(paper.AccountId(), pb.PortfolioRequest_RUB)
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	fills := paper.Fills()
+	logger.Infof("paper trading finished: fills = %v, cash = %.2f, portfolio = %.2f, rejected by risk = %v", len(fills),
+		paper.Cash(), portfolio.GetTotalAmountPortfolio().ToFloat(), engine.Risk().Rejected())
+	report := backtest.AnalyzeTrades(backtest.TradesFromFills(fills), 100000)
+	logger.Infof("net profit = %.2f, win rate = %.2f%%", report.Metrics.NetProfit, report.Metrics.WinRate)
+}
@@ -80,17 +80,13 @@ func main() {
 			client.Config.AccountId = newAccId
 		}
 	}
-	// пополняем счет песочницы на 100 000 рублей
-	payInResp, err := sandboxService.SandboxPayIn(&investgo.SandboxPayInRequest{
-		AccountId: newAccId,
-		Currency:  "RUB",
-		Unit:      100000,
-		Nano:      0,
+	// пополняем счет песочницы на 100 000 рублей, чтобы начать с чистого счета, можно вызвать
+	// sandboxService.ResetSandboxAccount - он закроет счет и откроет новый с нужными балансами и позициями
+	err = sandboxService.SeedSandboxAccount(newAccId, investgo.SandboxAccountState{
+		Money: []investgo.SandboxMoney{{Currency: "RUB", Amount: 100000}},
 	})
 	if err != nil {
 		logger.Errorf(err.Error())
-	} else {
-		fmt.Printf("sandbox accouunt %v balance = %v\n", newAccId, payInResp.GetBalance().ToFloat())
 	}
 	// далее вызываем нужные нам сервисы, используя счет, токен, и эндпоинт песочницы
 	// создаем клиента для сервиса песочницы
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const usage = `usage: sandbox_tool <command> [flags]
+
+commands:
+  reset     close account, open a new one, fund it and seed positions from state yaml
+  accounts  list sandbox accounts
+  close     close stale accounts opened before -older-than
+  snapshot  save account portfolio snapshot to json
+  compare   compare two snapshots, or a snapshot with the current portfolio
+
+run sandbox_tool <command> -h for command flags
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	sdkConfig := fs.String("sdk-config", "config.yaml", "path to sdk yaml with sandbox token and endpoint")
+	account := fs.String("account", "", "sandbox account id, by default AccountId from sdk config")
+
+	var run func(s *investgo.SandboxServiceClient, accountId string) error
+	switch cmd {
+	case "reset":
+		state := fs.String("state", "sandbox.yaml", "path to account state yaml")
+		write := fs.Bool("write-config", false, "write new account id to sdk config")
+		run = func(s *investgo.SandboxServiceClient, accountId string) error {
+			st, err := investgo.LoadSandboxAccountState(*state)
+			if err != nil {
+				return err
+			}
+			newId, err := s.ResetSandboxAccount(accountId, st)
+			if newId != "" {
+				fmt.Printf("sandbox account = %v\n", newId)
+			}
+			if err != nil {
+				return err
+			}
+			if *write {
+				return writeAccountId(*sdkConfig, newId)
+			}
+			return nil
+		}
+	case "accounts":
+		run = func(s *investgo.SandboxServiceClient, _ string) error {
+			resp, err := s.GetSandboxAccounts()
+			if err != nil {
+				return err
+			}
+			for _, a := range resp.GetAccounts() {
+				fmt.Printf("%v\t%v\topened %v\n", a.GetId(), a.GetStatus().String(),
+					a.GetOpenedDate().AsTime().Format(time.DateTime))
+			}
+			return nil
+		}
+	case "close":
+		olderThan := fs.Duration("older-than", 7*24*time.Hour, "close accounts opened earlier than this duration ago")
+		keep := fs.String("keep", "", "comma separated account ids to keep, AccountId from sdk config is always kept")
+		dryRun := fs.Bool("dry-run", false, "only list accounts to close")
+		run = func(s *investgo.SandboxServiceClient, accountId string) error {
+			keepIds := []string{accountId}
+			if *keep != "" {
+				keepIds = append(keepIds, strings.Split(*keep, ",")...)
+			}
+			stale, err := s.StaleSandboxAccounts(time.Now().Add(-*olderThan), keepIds...)
+			if err != nil {
+				return err
+			}
+			ids := make([]string, 0, len(stale))
+			for _, a := range stale {
+				ids = append(ids, a.GetId())
+				fmt.Printf("stale account %v opened %v\n", a.GetId(), a.GetOpenedDate().AsTime().Format(time.DateTime))
+			}
+			if *dryRun || len(ids) == 0 {
+				return nil
+			}
+			closed, err := s.CloseSandboxAccounts(ids)
+			fmt.Printf("closed %v of %v accounts\n", len(closed), len(ids))
+			return err
+		}
+	case "snapshot":
+		out := fs.String("out", "", "snapshot json path, by default snapshot_<account>_<time>.json")
+		run = func(s *investgo.SandboxServiceClient, accountId string) error {
+			snapshot, err := s.SnapshotSandboxAccount(accountId)
+			if err != nil {
+				return err
+			}
+			path := *out
+			if path == "" {
+				path = fmt.Sprintf("snapshot_%v_%v.json", accountId, snapshot.Time.Format("20060102_150405"))
+			}
+			if err := snapshot.Save(path); err != nil {
+				return err
+			}
+			fmt.Printf("snapshot saved to %v, total = %.2f\n", path, snapshot.Total)
+			return nil
+		}
+	case "compare":
+		from := fs.String("from", "", "first snapshot json")
+		to := fs.String("to", "", "second snapshot json, by default current account portfolio")
+		run = func(s *investgo.SandboxServiceClient, accountId string) error {
+			before, err := investgo.LoadSandboxSnapshot(*from)
+			if err != nil {
+				return err
+			}
+			var after *investgo.SandboxSnapshot
+			if *to != "" {
+				after, err = investgo.LoadSandboxSnapshot(*to)
+			} else {
+				if *account == "" {
+					accountId = before.AccountId
+				}
+				after, err = s.SnapshotSandboxAccount(accountId)
+			}
+			if err != nil {
+				return err
+			}
+			printDiff(investgo.CompareSandboxSnapshots(before, after))
+			return nil
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	config, err := investgo.LoadConfig(*sdkConfig)
+	if err != nil {
+		log.Fatalf("config loading error %v", err.Error())
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	zapConfig := zap.NewDevelopmentConfig()
+	zapConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.DateTime)
+	zapConfig.EncoderConfig.TimeKey = "time"
+	l, err := zapConfig.Build()
+	if err != nil {
+		log.Fatalf("logger creating error %v", err)
+	}
+	logger := l.Sugar()
+	defer func() {
+		err := logger.Sync()
+		if err != nil {
+			log.Printf(err.Error())
+		}
+	}()
+	client, err := investgo.NewClient(ctx, config, logger)
+	if err != nil {
+		logger.Fatalf("client creating error %v", err.Error())
+	}
+	defer func() {
+		err := client.Stop()
+		if err != nil {
+			logger.Errorf("client shutdown error %v", err.Error())
+		}
+	}()
+
+	// если AccountId в конфиге пустой, клиент берет первый открытый счет песочницы или открывает новый
+	accountId := *account
+	if accountId == "" {
+		accountId = client.Config.AccountId
+	}
+	if err := run(client.NewSandboxServiceClient(), accountId); err != nil {
+		logger.Errorf(err.Error())
+	}
+}
+
+// printDiff - Вывод изменений между снимками
+func printDiff(d investgo.SandboxSnapshotDiff) {
+	if d.Empty() {
+		fmt.Printf("no changes, total change = %.2f\n", d.Total)
+		return
+	}
+	for currency, change := range d.Money {
+		fmt.Printf("money %v: %+.2f\n", currency, change)
+	}
+	for _, p := range d.Positions {
+		fmt.Printf("position %v (%v): %v -> %v\n", p.InstrumentUid, p.Figi, p.Before, p.After)
+	}
+	fmt.Printf("total change = %+.2f\n", d.Total)
+}
+
+// writeAccountId - Запись идентификатора счета в AccountId конфига сдк, остальные поля не меняются
+func writeAccountId(path, accountId string) error {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(input), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "AccountId:") {
+			lines[i] = fmt.Sprintf("AccountId: %q", accountId)
+			found = true
+		}
+	}
+	if !found {
+		lines = append([]string{fmt.Sprintf("AccountId: %q", accountId)}, lines...)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+}
@@ -0,0 +1,408 @@
+package backtest
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// TRADING_DAYS - Кол-во торговых дней в году для годовых Sharpe и Sortino
+const TRADING_DAYS = 252
+
+// Trade - Сделка от открытия до закрытия позиции. Закрытие частями дает несколько сделок,
+// открытия и закрытия сопоставляются по FIFO
+type Trade struct {
+	InstrumentUid string `json:"instrument_uid"`
+	// Direction - Направление открытия: BUY - длинная позиция, SELL - короткая
+	Direction pb.OrderDirection `json:"direction"`
+	// Quantity - Кол-во инструментов
+	Quantity   int64     `json:"quantity"`
+	EntryTime  time.Time `json:"entry_time"`
+	ExitTime   time.Time `json:"exit_time"`
+	EntryPrice float64   `json:"entry_price"`
+	ExitPrice  float64   `json:"exit_price"`
+	// PnL - Результат без комиссий
+	PnL float64 `json:"pnl"`
+	// Commission - Комиссии за открытие и закрытие, приходящиеся на сделку
+	Commission float64 `json:"commission"`
+}
+
+// NetPnL - Результат с учетом комиссий
+func (t Trade) NetPnL() float64 {
+	return t.PnL - t.Commission
+}
+
+// Holding - Время удержания позиции
+func (t Trade) Holding() time.Duration {
+	return t.ExitTime.Sub(t.EntryTime)
+}
+
+// ReturnPercent - Результат с учетом комиссий в процентах от стоимости открытия
+func (t Trade) ReturnPercent() float64 {
+	value := t.EntryPrice * float64(t.Quantity)
+	if value == 0 {
+		return 0
+	}
+	return t.NetPnL() / value * 100
+}
+
+// DrawdownPoint - Точка кривой просадки
+type DrawdownPoint struct {
+	Time time.Time `json:"time"`
+	// Drawdown - Просадка от максимума капитала в валюте, неположительная
+	Drawdown float64 `json:"drawdown"`
+	// Percent - Просадка в процентах от максимума капитала
+	Percent float64 `json:"percent"`
+}
+
+// Metrics - Показатели результата тестирования
+type Metrics struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	InitialEquity float64   `json:"initial_equity"`
+	FinalEquity   float64   `json:"final_equity"`
+	NetProfit     float64   `json:"net_profit"`
+	ReturnPercent float64   `json:"return_percent"`
+	// MaxDrawdown, MaxDrawdownPercent - Максимальная просадка в валюте и в процентах
+	MaxDrawdown        float64 `json:"max_drawdown"`
+	MaxDrawdownPercent float64 `json:"max_drawdown_percent"`
+	// MaxDrawdownDuration - Самый долгий период от максимума капитала до его обновления
+	MaxDrawdownDuration time.Duration `json:"max_drawdown_duration"`
+	// Sharpe, Sortino - Годовые коэффициенты по дневным доходностям капитала без безрисковой ставки
+	Sharpe  float64 `json:"sharpe"`
+	Sortino float64 `json:"sortino"`
+	// ProfitFactor - Отношение суммы прибыльных сделок к сумме убыточных, 0 - если убыточных сделок нет
+	ProfitFactor float64 `json:"profit_factor"`
+	// WinRate - Доля прибыльных сделок в процентах
+	WinRate      float64 `json:"win_rate"`
+	Trades       int     `json:"trades"`
+	Wins         int     `json:"wins"`
+	Losses       int     `json:"losses"`
+	AverageTrade float64 `json:"average_trade"`
+	AverageWin   float64 `json:"average_win"`
+	AverageLoss  float64 `json:"average_loss"`
+	// AverageHolding - Среднее время удержания позиции
+	AverageHolding time.Duration `json:"average_holding"`
+	// Exposure - Доля времени тестирования, когда была открыта хотя бы одна позиция, в процентах
+	Exposure float64 `json:"exposure"`
+	// Turnover - Суммарный объем сделок, TurnoverRatio - оборот, деленный на средний капитал
+	Turnover      float64 `json:"turnover"`
+	TurnoverRatio float64 `json:"turnover_ratio"`
+	Commission    float64 `json:"commission"`
+}
+
+// Report - Аналитика результата тестирования: сделки, кривые капитала и просадки, показатели
+type Report struct {
+	Metrics  Metrics         `json:"metrics"`
+	Trades   []Trade         `json:"trades"`
+	Equity   []EquityPoint   `json:"equity"`
+	Drawdown []DrawdownPoint `json:"drawdown"`
+}
+
+// Analyze - Аналитика по результату Run
+func Analyze(r *Result) *Report {
+	var turnover float64
+	for _, f := range r.Fills {
+		turnover += f.Price * float64(f.Quantity)
+	}
+	return analyze(TradesFromFills(r.Fills), r.Equity, r.InitialCash, turnover, r.Commission)
+}
+
+// AnalyzeTrades - Аналитика по готовому списку сделок, например из упрощенного тестирования без Broker.
+// Кривая капитала строится по закрытым сделкам от начального капитала initial, в рабочие дни без закрытых сделок
+// капитал переносится с предыдущего дня
+func AnalyzeTrades(trades []Trade, initial float64) *Report {
+	trades = append([]Trade(nil), trades...)
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].ExitTime.Before(trades[j].ExitTime)
+	})
+	var turnover, commission float64
+	equity := make([]EquityPoint, 0, len(trades)+1)
+	if len(trades) > 0 {
+		start := trades[0].EntryTime
+		for _, t := range trades {
+			if t.EntryTime.Before(start) {
+				start = t.EntryTime
+			}
+		}
+		equity = append(equity, EquityPoint{Time: start, Equity: initial})
+	}
+	value := initial
+	for _, t := range trades {
+		value += t.NetPnL()
+		turnover += (t.EntryPrice + t.ExitPrice) * float64(t.Quantity)
+		commission += t.Commission
+		equity = append(equity, EquityPoint{Time: t.ExitTime, Equity: value})
+	}
+	return analyze(trades, carryForward(equity), initial, turnover, commission)
+}
+
+// carryForward - Кривая капитала с точкой на каждый рабочий день по московскому времени. Без этих точек дни без
+// сделок выпадают из дневных доходностей, и Sharpe и Sortino завышаются
+func carryForward(equity []EquityPoint) []EquityPoint {
+	filled := make([]EquityPoint, 0, len(equity))
+	for i, p := range equity {
+		if i > 0 {
+			prev := equity[i-1]
+			for day := startOfDay(prev.Time).AddDate(0, 0, 1); day.Before(startOfDay(p.Time)); day = day.AddDate(0, 0, 1) {
+				if wd := day.Weekday(); wd != time.Saturday && wd != time.Sunday {
+					filled = append(filled, EquityPoint{Time: day, Equity: prev.Equity})
+				}
+			}
+		}
+		filled = append(filled, p)
+	}
+	return filled
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.In(orderbook.MSK).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, orderbook.MSK)
+}
+
+// AnalyzeEquity - Аналитика по сделкам и готовой кривой капитала equity, например переоцененной по рыночным ценам
+// в конце каждого дня. Кривая должна начинаться с начального капитала initial
+func AnalyzeEquity(trades []Trade, equity []EquityPoint, initial float64) *Report {
+	trades = append([]Trade(nil), trades...)
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].ExitTime.Before(trades[j].ExitTime)
+	})
+	var turnover, commission float64
+	for _, t := range trades {
+		turnover += (t.EntryPrice + t.ExitPrice) * float64(t.Quantity)
+		commission += t.Commission
+	}
+	return analyze(trades, equity, initial, turnover, commission)
+}
+
+// openLot - Открытая часть позиции для сопоставления по FIFO
+type openLot struct {
+	time      time.Time
+	direction pb.OrderDirection
+	quantity  int64
+	price     float64
+	// commission - Комиссия открытия на 1 инструмент
+	commission float64
+}
+
+// TradesFromFills - Сделки от открытия до закрытия по сделкам Broker, открытые позиции не учитываются
+func TradesFromFills(fills []Fill) []Trade {
+	open := make(map[string][]openLot)
+	trades := make([]Trade, 0)
+	for _, f := range fills {
+		if f.Quantity <= 0 {
+			continue
+		}
+		lots := open[f.InstrumentUid]
+		rest := f.Quantity
+		exitCommission := f.Commission / float64(f.Quantity)
+		for rest > 0 && len(lots) > 0 && lots[0].direction != f.Direction {
+			l := &lots[0]
+			q := l.quantity
+			if q > rest {
+				q = rest
+			}
+			sign := 1.0
+			if l.direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+				sign = -1
+			}
+			trades = append(trades, Trade{
+				InstrumentUid: f.InstrumentUid,
+				Direction:     l.direction,
+				Quantity:      q,
+				EntryTime:     l.time,
+				ExitTime:      f.Time,
+				EntryPrice:    l.price,
+				ExitPrice:     f.Price,
+				PnL:           sign * (f.Price - l.price) * float64(q),
+				Commission:    (l.commission + exitCommission) * float64(q),
+			})
+			l.quantity -= q
+			rest -= q
+			if l.quantity == 0 {
+				lots = lots[1:]
+			}
+		}
+		if rest > 0 {
+			lots = append(lots, openLot{
+				time:       f.Time,
+				direction:  f.Direction,
+				quantity:   rest,
+				price:      f.Price,
+				commission: f.Commission / float64(f.Quantity),
+			})
+		}
+		open[f.InstrumentUid] = lots
+	}
+	return trades
+}
+
+// analyze - Расчет показателей по сделкам и кривой капитала
+func analyze(trades []Trade, equity []EquityPoint, initial, turnover, commission float64) *Report {
+	m := Metrics{
+		InitialEquity: initial,
+		FinalEquity:   initial,
+		Trades:        len(trades),
+		Turnover:      turnover,
+		Commission:    commission,
+	}
+	if len(equity) > 0 {
+		m.Start = equity[0].Time
+		m.End = equity[len(equity)-1].Time
+		m.FinalEquity = equity[len(equity)-1].Equity
+	}
+	m.NetProfit = m.FinalEquity - m.InitialEquity
+	if initial != 0 {
+		m.ReturnPercent = m.NetProfit / initial * 100
+	}
+
+	drawdown := drawdowns(equity, initial, &m)
+	m.Sharpe, m.Sortino = ratios(equity, initial)
+
+	var grossProfit, grossLoss, holding float64
+	for _, t := range trades {
+		pnl := t.NetPnL()
+		switch {
+		case pnl > 0:
+			m.Wins++
+			grossProfit += pnl
+		case pnl < 0:
+			m.Losses++
+			grossLoss -= pnl
+		}
+		holding += float64(t.Holding())
+	}
+	if len(trades) > 0 {
+		m.WinRate = float64(m.Wins) / float64(len(trades)) * 100
+		m.AverageTrade = (grossProfit - grossLoss) / float64(len(trades))
+		m.AverageHolding = time.Duration(holding / float64(len(trades)))
+	}
+	if m.Wins > 0 {
+		m.AverageWin = grossProfit / float64(m.Wins)
+	}
+	if m.Losses > 0 {
+		m.AverageLoss = -grossLoss / float64(m.Losses)
+	}
+	if grossLoss > 0 {
+		m.ProfitFactor = grossProfit / grossLoss
+	}
+	m.Exposure = exposure(trades, m.Start, m.End)
+
+	var sum float64
+	for _, p := range equity {
+		sum += p.Equity
+	}
+	if len(equity) > 0 && sum != 0 {
+		m.TurnoverRatio = turnover / (sum / float64(len(equity)))
+	}
+	return &Report{Metrics: m, Trades: trades, Equity: equity, Drawdown: drawdown}
+}
+
+// drawdowns - Кривая просадки, максимальная просадка и ее длительность
+func drawdowns(equity []EquityPoint, initial float64, m *Metrics) []DrawdownPoint {
+	points := make([]DrawdownPoint, 0, len(equity))
+	peak := initial
+	var peakTime time.Time
+	if len(equity) > 0 {
+		peakTime = equity[0].Time
+	}
+	for _, p := range equity {
+		if p.Equity >= peak {
+			peak = p.Equity
+			peakTime = p.Time
+		}
+		dd := DrawdownPoint{Time: p.Time, Drawdown: p.Equity - peak}
+		if peak > 0 {
+			dd.Percent = dd.Drawdown / peak * 100
+		}
+		if dd.Drawdown < m.MaxDrawdown {
+			m.MaxDrawdown = dd.Drawdown
+		}
+		if dd.Percent < m.MaxDrawdownPercent {
+			m.MaxDrawdownPercent = dd.Percent
+		}
+		if d := p.Time.Sub(peakTime); dd.Drawdown < 0 && d > m.MaxDrawdownDuration {
+			m.MaxDrawdownDuration = d
+		}
+		points = append(points, dd)
+	}
+	return points
+}
+
+// ratios - Годовые Sharpe и Sortino по дневным доходностям, день - по московскому времени
+func ratios(equity []EquityPoint, initial float64) (float64, float64) {
+	closes := make([]float64, 0)
+	var day string
+	for _, p := range equity {
+		d := p.Time.In(orderbook.MSK).Format(time.DateOnly)
+		if d != day {
+			closes = append(closes, p.Equity)
+			day = d
+			continue
+		}
+		closes[len(closes)-1] = p.Equity
+	}
+	returns := make([]float64, 0, len(closes))
+	prev := initial
+	for _, c := range closes {
+		if prev != 0 {
+			returns = append(returns, c/prev-1)
+		}
+		prev = c
+	}
+	if len(returns) < 2 {
+		return 0, 0
+	}
+	var mean, variance, downside float64
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+		if r < 0 {
+			downside += r * r
+		}
+	}
+	variance /= float64(len(returns) - 1)
+	downside /= float64(len(returns))
+	annual := math.Sqrt(TRADING_DAYS)
+	var sharpe, sortino float64
+	if variance > 0 {
+		sharpe = mean / math.Sqrt(variance) * annual
+	}
+	if downside > 0 {
+		sortino = mean / math.Sqrt(downside) * annual
+	}
+	return sharpe, sortino
+}
+
+// exposure - Доля времени start-end в процентах, когда была открыта хотя бы одна сделка
+func exposure(trades []Trade, start, end time.Time) float64 {
+	total := end.Sub(start)
+	if total <= 0 || len(trades) == 0 {
+		return 0
+	}
+	intervals := make([]Trade, len(trades))
+	copy(intervals, trades)
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].EntryTime.Before(intervals[j].EntryTime)
+	})
+	var covered time.Duration
+	from, to := intervals[0].EntryTime, intervals[0].ExitTime
+	for _, t := range intervals[1:] {
+		if t.EntryTime.After(to) {
+			covered += to.Sub(from)
+			from, to = t.EntryTime, t.ExitTime
+			continue
+		}
+		if t.ExitTime.After(to) {
+			to = t.ExitTime
+		}
+	}
+	covered += to.Sub(from)
+	return math.Min(float64(covered)/float64(total)*100, 100)
+}
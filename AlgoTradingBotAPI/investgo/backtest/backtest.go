@@ -0,0 +1,289 @@
+// Package backtest - Событийное тестирование стратегий investgo.Engine на истории. Исторические свечи и записанные
+// стаканы передаются стратегии через тот же движок, что и в реальной торговле, а поручения и стоп-заявки исполняет
+// симулятор Broker с выбранной моделью исполнения лимитных поручений, проскальзыванием, частичным исполнением
+// и комиссией по тарифу.
+package backtest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// EQUITY_INTERVAL - Период записи кривой капитала по умолчанию
+const EQUITY_INTERVAL = time.Minute
+
+// Config - Конфигурация тестирования на истории
+type Config struct {
+	// Instruments - Инструменты стратегии, лотность и шаг цены нужны для расчета сделок
+	Instruments []investgo.EngineInstrument
+	// Candles - Исторические свечи по uid инструментов
+	Candles map[string][]*pb.HistoricCandle
+	// CandleInterval - Интервал свечей Candles, свеча передается стратегии после ее завершения
+	CandleInterval pb.CandleInterval
+	// OrderBooks - Источник записанных стаканов по возрастанию времени, например OrderBooksFromStore
+	OrderBooks func(fn func(ob *orderbook.OrderBook) error) error
+	// InitialCash, Currency - Начальный денежный баланс счета
+	InitialCash float64
+	Currency    string
+	// Fill - Модель исполнения лимитных поручений
+	Fill FillModel
+	// Slippage - Проскальзывание рыночных поручений
+	Slippage Slippage
+	// Commission - Комиссия по тарифу, например TariffTrader
+	Commission Commission
+	// Participation - Доля объема свечи, которую могут забрать поручения по инструменту, 0 - без ограничений.
+	// Остаток поручения исполняется на следующих свечах
+	Participation float64
+	// SellOut - Закрыть позиции в конце тестирования
+	SellOut bool
+	// EquityInterval - Период записи кривой капитала, по умолчанию EQUITY_INTERVAL
+	EquityInterval time.Duration
+	// Logger - Логгер движка и стратегии, по умолчанию логи не пишутся
+	Logger investgo.Logger
+}
+
+// EquityPoint - Точка кривой капитала
+type EquityPoint struct {
+	Time   time.Time `json:"time"`
+	Equity float64   `json:"equity"`
+}
+
+// Result - Результат тестирования на истории
+type Result struct {
+	InitialCash float64
+	// Cash - Денежный баланс в конце тестирования
+	Cash float64
+	// FinalEquity - Стоимость счета в конце тестирования по последним ценам
+	FinalEquity float64
+	// Commission - Сумма комиссий
+	Commission float64
+	// Orders, Rejected - Кол-во принятых и отклоненных поручений
+	Orders   int
+	Rejected int
+	// Fills - Сделки по времени
+	Fills []Fill
+	// Equity - Кривая капитала с периодом EquityInterval
+	Equity []EquityPoint
+	// Positions - Позиции движка в конце тестирования
+	Positions map[string]investgo.Position
+}
+
+// candleEvent - Свеча инструмента и время ее завершения
+type candleEvent struct {
+	uid    string
+	candle *pb.HistoricCandle
+	close  time.Time
+}
+
+// runner - Передача событий симулятору и движку в порядке времени
+type runner struct {
+	config Config
+	engine *investgo.Engine
+	broker *Broker
+	result *Result
+}
+
+// Run - Тестирование стратегии s на истории. Для каждого события симулятор сначала исполняет ранее выставленные
+// поручения, затем событие передается стратегии, поэтому поручения исполняются не раньше следующего события
+func Run(ctx context.Context, s investgo.Strategy, config Config) (*Result, error) {
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	if config.EquityInterval <= 0 {
+		config.EquityInterval = EQUITY_INTERVAL
+	}
+	if len(config.Candles) > 0 && investgo.CandleIntervalDuration(config.CandleInterval) == 0 {
+		return nil, errors.New("candle interval is required for candles backtest")
+	}
+	broker := NewBroker(config)
+	ids := make([]string, 0, len(config.Instruments))
+	for _, i := range config.Instruments {
+		ids = append(ids, i.Uid)
+	}
+	engine, err := investgo.NewEngine(ctx, nil, s, investgo.EngineConfig{
+		AccountId:       ACCOUNT_ID,
+		Instruments:     ids,
+		SellOut:         config.SellOut,
+		Currency:        config.Currency,
+		Orders:          broker,
+		StopOrders:      broker,
+		Positions:       broker,
+		InstrumentsInfo: config.Instruments,
+		Logger:          config.Logger,
+		Clock:           broker.Now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer engine.Stop()
+
+	r := &runner{
+		config: config,
+		engine: engine,
+		broker: broker,
+		result: &Result{InitialCash: config.InitialCash},
+	}
+	if err := engine.Begin(); err != nil {
+		return nil, err
+	}
+	err = r.replay(ctx)
+	err = errors.Join(err, engine.End())
+	broker.closeOut()
+	r.deliver()
+	r.record()
+
+	broker.mx.Lock()
+	r.result.Cash = broker.cash
+	r.result.FinalEquity = broker.equity()
+	r.result.Commission = broker.commission
+	r.result.Orders = broker.posted
+	r.result.Rejected = broker.rejected
+	broker.mx.Unlock()
+	r.result.Fills = broker.Fills()
+	r.result.Positions = engine.Positions()
+	return r.result, err
+}
+
+// replay - Объединение свечей и стаканов по времени
+func (r *runner) replay(ctx context.Context) error {
+	candles := r.candleEvents()
+	i := 0
+	flush := func(t time.Time) error {
+		for ; i < len(candles) && !candles[i].close.After(t); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			r.onCandle(candles[i])
+		}
+		return nil
+	}
+	if r.config.OrderBooks != nil {
+		err := r.config.OrderBooks(func(ob *orderbook.OrderBook) error {
+			if err := flush(ob.Time); err != nil {
+				return err
+			}
+			return r.onOrderBook(ob)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(candles) == 0 {
+		return nil
+	}
+	return flush(candles[len(candles)-1].close)
+}
+
+// candleEvents - Свечи всех инструментов по времени завершения
+func (r *runner) candleEvents() []candleEvent {
+	d := investgo.CandleIntervalDuration(r.config.CandleInterval)
+	events := make([]candleEvent, 0)
+	for _, i := range r.config.Instruments {
+		for _, c := range r.config.Candles[i.Uid] {
+			events = append(events, candleEvent{uid: i.Uid, candle: c, close: c.GetTime().AsTime().Add(d)})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].close.Before(events[j].close)
+	})
+	return events
+}
+
+func (r *runner) onCandle(ev candleEvent) {
+	r.broker.OnCandle(ev.uid, ev.candle, ev.close)
+	r.deliver()
+	c := ev.candle
+	r.handle(&pb.Candle{
+		Figi:          r.broker.instruments[ev.uid].Figi,
+		Interval:      investgo.SubscriptionIntervalByCandleInterval(r.config.CandleInterval),
+		Open:          c.GetOpen(),
+		High:          c.GetHigh(),
+		Low:           c.GetLow(),
+		Close:         c.GetClose(),
+		Volume:        c.GetVolume(),
+		Time:          c.GetTime(),
+		LastTradeTs:   timestamppb.New(ev.close),
+		InstrumentUid: ev.uid,
+	})
+	r.record()
+}
+
+func (r *runner) onOrderBook(ob *orderbook.OrderBook) error {
+	if _, ok := r.broker.uid(ob.InstrumentUid); !ok {
+		// в записи могут быть стаканы инструментов, которые стратегия не торгует
+		return nil
+	}
+	r.broker.OnOrderBook(ob)
+	r.deliver()
+	r.handle(ob.ToProto())
+	r.record()
+	return nil
+}
+
+// handle - Передача события стратегии и исполнений, которые появились в колбеке
+func (r *runner) handle(msg any) {
+	if err := r.engine.Handle(msg); err != nil {
+		r.config.Logger.Errorf(err.Error())
+	}
+	r.deliver()
+}
+
+// deliver - Передача исполнений движку, пока симулятор их возвращает
+func (r *runner) deliver() {
+	for {
+		pending := r.broker.drain()
+		if len(pending) == 0 {
+			return
+		}
+		for _, ot := range pending {
+			if err := r.engine.Handle(ot); err != nil {
+				r.config.Logger.Errorf(err.Error())
+			}
+		}
+	}
+}
+
+// record - Запись кривой капитала, в пределах периода сохраняется последнее значение
+func (r *runner) record() {
+	point := EquityPoint{Time: r.broker.Now(), Equity: r.broker.Equity()}
+	equity := r.result.Equity
+	if n := len(equity); n > 0 &&
+		point.Time.Truncate(r.config.EquityInterval).Equal(equity[n-1].Time.Truncate(r.config.EquityInterval)) {
+		equity[n-1] = point
+		return
+	}
+	r.result.Equity = append(equity, point)
+}
+
+// OrderBooksFromStore - Источник стаканов из хранилища orderbook.Store
+func OrderBooksFromStore(dir string, req orderbook.QueryRequest) func(fn func(ob *orderbook.OrderBook) error) error {
+	return func(fn func(ob *orderbook.OrderBook) error) error {
+		return orderbook.Query(dir, req, fn)
+	}
+}
+
+// OrderBooks - Источник стаканов из среза, например загруженного orderbook.LoadOrderBooks
+func OrderBooks(obs []*orderbook.OrderBook) func(fn func(ob *orderbook.OrderBook) error) error {
+	return func(fn func(ob *orderbook.OrderBook) error) error {
+		for _, ob := range obs {
+			if err := fn(ob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// nopLogger - Логгер, который ничего не пишет
+type nopLogger struct{}
+
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
+func (nopLogger) Fatalf(string, ...any) {}
@@ -0,0 +1,1092 @@
+package backtest
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ACCOUNT_ID - Идентификатор счета симулятора
+const ACCOUNT_ID = "backtest"
+
+// Fill - Сделка симулятора
+type Fill struct {
+	Time          time.Time
+	OrderId       string
+	InstrumentUid string
+	Direction     pb.OrderDirection
+	Lots          int64
+	// Quantity - Кол-во инструментов, лоты * лотность
+	Quantity int64
+	// Price - Цена за 1 инструмент
+	Price float64
+	// Commission - Комиссия за сделку
+	Commission float64
+	// TradeId - Идентификатор сделки в исполнении OrderTrades и в операциях
+	TradeId string
+}
+
+// order - Активное поручение симулятора
+type order struct {
+	id        string
+	uid       string
+	direction pb.OrderDirection
+	orderType pb.OrderType
+	limit     bool
+	price     float64
+	lots      int64
+	filled    int64
+	created   time.Time
+	cancelled bool
+	// value, commission - Стоимость исполненной части поручения и комиссия по ней
+	value      float64
+	commission float64
+	// trigger - Цена срабатывания стоп-заявки, по ней исполняется рыночное поручение на свече
+	trigger float64
+	// queued - Поручение стоит в стакане, ahead - лотов перед ним на его ценовом уровне,
+	// level - объем уровня в последнем стакане
+	queued bool
+	ahead  int64
+	level  int64
+}
+
+// total - Стоимость исполненной части поручения с учетом комиссии
+func (o *order) total() float64 {
+	if o.buy() {
+		return o.value + o.commission
+	}
+	return o.value - o.commission
+}
+
+func (o *order) buy() bool {
+	return o.direction == pb.OrderDirection_ORDER_DIRECTION_BUY
+}
+
+func (o *order) rest() int64 {
+	return o.lots - o.filled
+}
+
+func (o *order) status() pb.OrderExecutionReportStatus {
+	switch {
+	case o.filled == o.lots:
+		return pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL
+	case o.cancelled:
+		return pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+	case o.filled > 0:
+		return pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL
+	}
+	return pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW
+}
+
+// stopOrder - Активная стоп-заявка симулятора
+type stopOrder struct {
+	id        string
+	uid       string
+	direction pb.StopOrderDirection
+	orderType pb.StopOrderType
+	lots      int64
+	stopPrice float64
+	price     float64
+}
+
+// triggered - Сработала ли стоп-заявка при ценах в диапазоне low-high
+func (s *stopOrder) triggered(low, high float64) bool {
+	buy := s.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_BUY
+	takeProfit := s.orderType == pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT
+	if buy != takeProfit {
+		// stop-loss и stop-limit на покупку, take-profit на продажу - при росте цены до stopPrice
+		return high >= s.stopPrice
+	}
+	return low <= s.stopPrice
+}
+
+// triggerPrice - Цена срабатывания с учетом гэпа: если цена открытия уже за stopPrice, срабатывание по ней
+func (s *stopOrder) triggerPrice(open float64) float64 {
+	buy := s.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_BUY
+	takeProfit := s.orderType == pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT
+	if buy != takeProfit {
+		return math.Max(open, s.stopPrice)
+	}
+	return math.Min(open, s.stopPrice)
+}
+
+// Broker - Симулятор брокера и биржи для тестирования на истории. Исполняет поручения по свечам, стаканам
+// и обезличенным сделкам, которые передаются в OnCandle, OnOrderBook и OnTrade, ведет денежный баланс и позиции.
+// Реализует investgo.OrderRouter, investgo.StopOrderRouter и investgo.PositionsSource, а также методы
+// OrdersServiceClient и OperationsServiceClient для поручений, портфеля и операций.
+type Broker struct {
+	mx        sync.Mutex
+	config    Config
+	accountId string
+
+	instruments map[string]investgo.EngineInstrument
+	figiToUid   map[string]string
+
+	now        time.Time
+	day        string
+	turnover   float64
+	cash       float64
+	commission float64
+	positions  map[string]int64
+	avgPrices  map[string]float64
+	lastPrices map[string]float64
+	books      map[string]*orderbook.OrderBook
+
+	orders []*order
+	// history - Все поручения по биржевому идентификатору, в том числе исполненные и отмененные,
+	// clients - те же поручения по идентификатору запроса для идемпотентности выставления
+	history  map[string]*order
+	clients  map[string]*order
+	stops    []*stopOrder
+	pending  []*pb.OrderTrades
+	fills    []Fill
+	posted   int
+	rejected int
+}
+
+// NewBroker - Создание симулятора, используются инструменты, баланс и модели исполнения из конфигурации
+func NewBroker(config Config) *Broker {
+	b := &Broker{
+		config:      config,
+		accountId:   ACCOUNT_ID,
+		instruments: make(map[string]investgo.EngineInstrument, len(config.Instruments)),
+		figiToUid:   make(map[string]string, len(config.Instruments)),
+		cash:        config.InitialCash,
+		positions:   make(map[string]int64),
+		avgPrices:   make(map[string]float64),
+		lastPrices:  make(map[string]float64),
+		books:       make(map[string]*orderbook.OrderBook),
+		history:     make(map[string]*order),
+		clients:     make(map[string]*order),
+	}
+	for _, i := range config.Instruments {
+		b.instruments[i.Uid] = i
+		b.figiToUid[i.Figi] = i.Uid
+	}
+	return b
+}
+
+// Now - Время последнего события симулятора
+func (b *Broker) Now() time.Time {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.now
+}
+
+// Cash - Денежный баланс
+func (b *Broker) Cash() float64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.cash
+}
+
+// Equity - Стоимость счета: денежный баланс и позиции по последним ценам
+func (b *Broker) Equity() float64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.equity()
+}
+
+func (b *Broker) equity() float64 {
+	equity := b.cash
+	for uid, lots := range b.positions {
+		equity += float64(lots*b.lot(uid)) * b.lastPrices[uid]
+	}
+	return equity
+}
+
+// Fills - Копия всех сделок симулятора
+func (b *Broker) Fills() []Fill {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	fills := make([]Fill, len(b.fills))
+	copy(fills, b.fills)
+	return fills
+}
+
+// PostOrder - Выставление поручения. Если по инструменту есть стакан, рыночное поручение и пересекающая
+// стакан часть лимитного исполняются сразу, иначе - на следующей свече, стакане или сделке.
+// Повторное поручение с тем же OrderId не выставляется, возвращается состояние первого. Как и на бирже,
+// в ответе возвращается биржевой идентификатор поручения, по нему поручение снимается и изменяется
+func (b *Broker) PostOrder(req *investgo.PostOrderRequest) (*investgo.PostOrderResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.post(req)
+}
+
+// Buy - Выставление поручения на покупку
+func (b *Broker) Buy(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error) {
+	return b.PostOrder(shortRequest(req, pb.OrderDirection_ORDER_DIRECTION_BUY))
+}
+
+// Sell - Выставление поручения на продажу
+func (b *Broker) Sell(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error) {
+	return b.PostOrder(shortRequest(req, pb.OrderDirection_ORDER_DIRECTION_SELL))
+}
+
+func shortRequest(req *investgo.PostOrderRequestShort, direction pb.OrderDirection) *investgo.PostOrderRequest {
+	return &investgo.PostOrderRequest{
+		InstrumentId: req.InstrumentId,
+		Quantity:     req.Quantity,
+		Price:        req.Price,
+		Direction:    direction,
+		AccountId:    req.AccountId,
+		OrderType:    req.OrderType,
+		OrderId:      req.OrderId,
+	}
+}
+
+func (b *Broker) post(req *investgo.PostOrderRequest) (*investgo.PostOrderResponse, error) {
+	if o, ok := b.clients[req.OrderId]; ok && req.OrderId != "" {
+		return b.postOrderResponse(o), nil
+	}
+	uid, ok := b.uid(req.InstrumentId)
+	if !ok {
+		return b.reject("instrument not found")
+	}
+	if req.Quantity <= 0 {
+		return b.reject("invalid order quantity")
+	}
+	limit := req.OrderType == pb.OrderType_ORDER_TYPE_LIMIT
+	if limit && req.Price == nil {
+		return b.reject("limit order price is required")
+	}
+	o := &order{
+		id:        investgo.CreateUid(),
+		uid:       uid,
+		direction: req.Direction,
+		orderType: req.OrderType,
+		limit:     limit,
+		price:     req.Price.ToFloat(),
+		lots:      req.Quantity,
+		created:   b.now,
+	}
+	if o.buy() {
+		price := o.price
+		if !limit {
+			price = b.marketPrice(uid, true)
+		}
+		if b.cost(uid, o.lots, price) > b.cash {
+			return b.reject("not enough money on balance")
+		}
+	}
+	b.posted++
+	b.orders = append(b.orders, o)
+	b.history[o.id] = o
+	if req.OrderId != "" {
+		b.clients[req.OrderId] = o
+	}
+	if book, ok := b.books[uid]; ok {
+		b.take(o, book)
+		if limit {
+			b.enqueue(o, book)
+		}
+	}
+	b.cleanup()
+	return b.postOrderResponse(o), nil
+}
+
+func (b *Broker) postOrderResponse(o *order) *investgo.PostOrderResponse {
+	return &investgo.PostOrderResponse{
+		PostOrderResponse: &pb.PostOrderResponse{
+			OrderId:               o.id,
+			ExecutionReportStatus: o.status(),
+			LotsRequested:         o.lots,
+			LotsExecuted:          o.filled,
+			ExecutedOrderPrice:    b.moneyPrice(o.uid, b.avgPrice(o)),
+			TotalOrderAmount:      b.money(o.uid, o.total()),
+			ExecutedCommission:    b.money(o.uid, o.commission),
+			Figi:                  b.instruments[o.uid].Figi,
+			Direction:             o.direction,
+			OrderType:             o.orderType,
+			InstrumentUid:         o.uid,
+		},
+	}
+}
+
+func (b *Broker) reject(msg string) (*investgo.PostOrderResponse, error) {
+	b.rejected++
+	return &investgo.PostOrderResponse{Header: metadata.Pairs("message", msg)}, errors.New(msg)
+}
+
+// CancelOrder - Отмена поручения
+func (b *Broker) CancelOrder(accountId, orderId string) (*investgo.CancelOrderResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if _, ok := b.cancel(orderId); !ok {
+		return &investgo.CancelOrderResponse{Header: metadata.Pairs("message", "order not found")},
+			errors.New("order not found")
+	}
+	return &investgo.CancelOrderResponse{
+		CancelOrderResponse: &pb.CancelOrderResponse{Time: timestamppb.New(b.now)},
+	}, nil
+}
+
+// cancel - Снятие активного поручения, false если поручение не найдено или уже исполнено
+func (b *Broker) cancel(orderId string) (*order, bool) {
+	for i, o := range b.orders {
+		if o.id == orderId {
+			o.cancelled = true
+			b.orders = append(b.orders[:i], b.orders[i+1:]...)
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+// ReplaceOrder - Изменение поручения: активное поручение снимается и выставляется новое с тем же инструментом,
+// направлением и типом, но с новыми кол-вом лотов и ценой
+func (b *Broker) ReplaceOrder(req *investgo.ReplaceOrderRequest) (*investgo.PostOrderResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	o, ok := b.cancel(req.OrderId)
+	if !ok {
+		return b.reject("order not found")
+	}
+	return b.post(&investgo.PostOrderRequest{
+		InstrumentId: o.uid,
+		Quantity:     req.Quantity,
+		Price:        req.Price,
+		Direction:    o.direction,
+		AccountId:    req.AccountId,
+		OrderType:    o.orderType,
+		OrderId:      req.NewOrderId,
+	})
+}
+
+// GetOrderState - Состояние поручения, в том числе исполненного или отмененного
+func (b *Broker) GetOrderState(accountId, orderId string) (*investgo.GetOrderStateResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	o, ok := b.history[orderId]
+	if !ok {
+		return &investgo.GetOrderStateResponse{Header: metadata.Pairs("message", "order not found")},
+			errors.New("order not found")
+	}
+	return &investgo.GetOrderStateResponse{OrderState: b.orderState(o)}, nil
+}
+
+// GetOrders - Активные поручения
+func (b *Broker) GetOrders(accountId string) (*investgo.GetOrdersResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	orders := make([]*pb.OrderState, 0, len(b.orders))
+	for _, o := range b.orders {
+		orders = append(orders, b.orderState(o))
+	}
+	return &investgo.GetOrdersResponse{GetOrdersResponse: &pb.GetOrdersResponse{Orders: orders}}, nil
+}
+
+// avgPrice - Средняя цена исполнения поручения за 1 инструмент
+func (b *Broker) avgPrice(o *order) float64 {
+	if o.filled == 0 {
+		return 0
+	}
+	return o.value / float64(o.filled*b.lot(o.uid))
+}
+
+func (b *Broker) orderState(o *order) *pb.OrderState {
+	quantity := float64(o.lots * b.lot(o.uid))
+	return &pb.OrderState{
+		OrderId:               o.id,
+		ExecutionReportStatus: o.status(),
+		LotsRequested:         o.lots,
+		LotsExecuted:          o.filled,
+		InitialOrderPrice:     b.money(o.uid, o.price*quantity),
+		ExecutedOrderPrice:    b.money(o.uid, o.value),
+		TotalOrderAmount:      b.money(o.uid, o.total()),
+		AveragePositionPrice:  b.moneyPrice(o.uid, b.avgPrice(o)),
+		ExecutedCommission:    b.money(o.uid, o.commission),
+		Figi:                  b.instruments[o.uid].Figi,
+		Direction:             o.direction,
+		InitialSecurityPrice:  b.moneyPrice(o.uid, o.price),
+		Currency:              b.currency(o.uid),
+		OrderType:             o.orderType,
+		OrderDate:             timestamppb.New(o.created),
+		InstrumentUid:         o.uid,
+	}
+}
+
+// PostStopOrder - Выставление стоп-заявки, срабатывание проверяется по следующим свечам или стаканам
+func (b *Broker) PostStopOrder(req *investgo.PostStopOrderRequest) (*investgo.PostStopOrderResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	uid, ok := b.uid(req.InstrumentId)
+	if !ok || req.Quantity <= 0 || req.StopPrice == nil {
+		return &investgo.PostStopOrderResponse{Header: metadata.Pairs("message", "invalid stop order")},
+			errors.New("invalid stop order")
+	}
+	s := &stopOrder{
+		id:        investgo.CreateUid(),
+		uid:       uid,
+		direction: req.Direction,
+		orderType: req.StopOrderType,
+		lots:      req.Quantity,
+		stopPrice: req.StopPrice.ToFloat(),
+		price:     req.Price.ToFloat(),
+	}
+	b.stops = append(b.stops, s)
+	return &investgo.PostStopOrderResponse{
+		PostStopOrderResponse: &pb.PostStopOrderResponse{StopOrderId: s.id},
+	}, nil
+}
+
+// CancelStopOrder - Отмена стоп-заявки
+func (b *Broker) CancelStopOrder(accountId, stopOrderId string) (*investgo.CancelStopOrderResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for i, s := range b.stops {
+		if s.id == stopOrderId {
+			b.stops = append(b.stops[:i], b.stops[i+1:]...)
+			return &investgo.CancelStopOrderResponse{
+				CancelStopOrderResponse: &pb.CancelStopOrderResponse{Time: timestamppb.New(b.now)},
+			}, nil
+		}
+	}
+	return &investgo.CancelStopOrderResponse{Header: metadata.Pairs("message", "stop order not found")},
+		errors.New("stop order not found")
+}
+
+// GetPositions - Денежный баланс и позиции симулятора
+func (b *Broker) GetPositions(accountId string) (*investgo.PositionsResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	resp := &pb.PositionsResponse{
+		Money: []*pb.MoneyValue{b.money("", b.cash)},
+	}
+	for uid, lots := range b.positions {
+		if lots == 0 {
+			continue
+		}
+		resp.Securities = append(resp.Securities, &pb.PositionsSecurities{
+			Figi:          b.instruments[uid].Figi,
+			InstrumentUid: uid,
+			Balance:       lots * b.lot(uid),
+		})
+	}
+	return &investgo.PositionsResponse{PositionsResponse: resp}, nil
+}
+
+// GetPortfolio - Портфель симулятора: позиции со средней ценой, оценкой по последним ценам и доходностью.
+// Все суммы в валюте счета, параметр currency не используется
+func (b *Broker) GetPortfolio(accountId string, currency pb.PortfolioRequest_CurrencyRequest) (*investgo.PortfolioResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	resp := &pb.PortfolioResponse{
+		TotalAmountCurrencies: b.money("", b.cash),
+		TotalAmountPortfolio:  b.money("", b.equity()),
+		AccountId:             b.accountId,
+	}
+	if b.config.InitialCash > 0 {
+		resp.ExpectedYield = investgo.FloatToQuotation((b.equity()/b.config.InitialCash-1)*100, &pb.Quotation{Nano: 1e7})
+	}
+	for uid, lots := range b.positions {
+		if lots == 0 {
+			continue
+		}
+		quantity := float64(lots * b.lot(uid))
+		avg, last := b.avgPrices[uid], b.lastPrices[uid]
+		resp.Positions = append(resp.Positions, &pb.PortfolioPosition{
+			Figi:                 b.instruments[uid].Figi,
+			Quantity:             investgo.FloatToQuotation(quantity, &pb.Quotation{Units: 1}),
+			AveragePositionPrice: b.moneyPrice(uid, avg),
+			ExpectedYield:        investgo.FloatToQuotation((last-avg)*quantity, &pb.Quotation{Nano: 1e7}),
+			CurrentPrice:         b.moneyPrice(uid, last),
+			QuantityLots:         investgo.FloatToQuotation(float64(lots), &pb.Quotation{Units: 1}),
+			InstrumentUid:        uid,
+		})
+	}
+	return &investgo.PortfolioResponse{PortfolioResponse: resp}, nil
+}
+
+// GetOperations - Исполненные сделки симулятора и комиссии по ним в виде операций за период [From, To].
+// Figi может быть figi или uid инструмента, нулевые From и To - без ограничения
+func (b *Broker) GetOperations(req *investgo.GetOperationsRequest) (*investgo.OperationsResponse, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	resp := &pb.OperationsResponse{}
+	if req.State != pb.OperationState_OPERATION_STATE_UNSPECIFIED && req.State != pb.OperationState_OPERATION_STATE_EXECUTED {
+		return &investgo.OperationsResponse{OperationsResponse: resp}, nil
+	}
+	uid, _ := b.uid(req.Figi)
+	for _, f := range b.fills {
+		if req.Figi != "" && f.InstrumentUid != uid ||
+			!req.From.IsZero() && f.Time.Before(req.From) || !req.To.IsZero() && f.Time.After(req.To) {
+			continue
+		}
+		value := f.Price * float64(f.Quantity)
+		operationType, name := pb.OperationType_OPERATION_TYPE_BUY, "Покупка ценных бумаг"
+		if f.Direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+			operationType, name = pb.OperationType_OPERATION_TYPE_SELL, "Продажа ценных бумаг"
+		} else {
+			value = -value
+		}
+		operation := &pb.Operation{
+			Id:            f.TradeId,
+			Currency:      b.currency(f.InstrumentUid),
+			Payment:       b.money(f.InstrumentUid, value),
+			Price:         b.moneyPrice(f.InstrumentUid, f.Price),
+			State:         pb.OperationState_OPERATION_STATE_EXECUTED,
+			Quantity:      f.Quantity,
+			Figi:          b.instruments[f.InstrumentUid].Figi,
+			Date:          timestamppb.New(f.Time),
+			Type:          name,
+			OperationType: operationType,
+			InstrumentUid: f.InstrumentUid,
+			Trades: []*pb.OperationTrade{{
+				TradeId:  f.TradeId,
+				DateTime: timestamppb.New(f.Time),
+				Quantity: f.Quantity,
+				Price:    b.moneyPrice(f.InstrumentUid, f.Price),
+			}},
+		}
+		resp.Operations = append(resp.Operations, operation)
+		if f.Commission > 0 {
+			resp.Operations = append(resp.Operations, &pb.Operation{
+				Id:                operation.Id + "_fee",
+				ParentOperationId: operation.Id,
+				Currency:          operation.Currency,
+				Payment:           b.money(f.InstrumentUid, -f.Commission),
+				State:             pb.OperationState_OPERATION_STATE_EXECUTED,
+				Figi:              operation.Figi,
+				Date:              operation.Date,
+				Type:              "Удержание комиссии за операцию",
+				OperationType:     pb.OperationType_OPERATION_TYPE_BROKER_FEE,
+				InstrumentUid:     f.InstrumentUid,
+			})
+		}
+	}
+	return &investgo.OperationsResponse{OperationsResponse: resp}, nil
+}
+
+// OnCandle - Исполнение поручений по свече инструмента uid. Сделки датируются временем открытия свечи,
+// после исполнения время симулятора - closeTime, время завершения свечи
+func (b *Broker) OnCandle(uid string, c *pb.HistoricCandle, closeTime time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.setTime(c.GetTime().AsTime())
+	open, high, low := c.GetOpen().ToFloat(), c.GetHigh().ToFloat(), c.GetLow().ToFloat()
+	step := b.step(uid)
+	// на свечах очередь не видна, поэтому FILL_QUEUE работает как FILL_TRADE_THROUGH
+	through := b.config.Fill != FILL_TOUCH
+
+	// сработавшие лимитные стоп-заявки встают в очередь после исполнения на этой свече
+	var limits []*order
+	for _, o := range b.triggerStops(uid, low, high, open) {
+		if o.limit {
+			limits = append(limits, o)
+		} else {
+			b.orders = append(b.orders, o)
+		}
+	}
+	available := int64(math.MaxInt64)
+	if b.config.Participation > 0 {
+		available = int64(float64(c.GetVolume()) * b.config.Participation)
+	}
+	for _, o := range b.orders {
+		if o.uid != uid || available <= 0 {
+			continue
+		}
+		var price float64
+		switch {
+		case !o.limit:
+			price = open
+			if o.trigger > 0 {
+				price = o.trigger
+			}
+			price = b.config.Slippage.apply(price, step, o.buy())
+		case o.buy() && reaches(low, o.price, step, true, through):
+			price = math.Min(o.price, open)
+		case !o.buy() && reaches(high, o.price, step, false, through):
+			price = math.Max(o.price, open)
+		default:
+			continue
+		}
+		q := o.rest()
+		if q > available {
+			q = available
+		}
+		available -= q
+		b.fill(o, q, price)
+	}
+	b.orders = append(b.orders, limits...)
+	b.cleanup()
+	b.lastPrices[uid] = c.GetClose().ToFloat()
+	b.setTime(closeTime)
+}
+
+// reaches - Достигла ли цена p цены поручения price, при through - прошла ли ее хотя бы на шаг цены
+func reaches(p, price, step float64, buy, through bool) bool {
+	eps := step / 2
+	if through {
+		eps -= step
+	}
+	if buy {
+		return p <= price+eps
+	}
+	return p >= price-eps
+}
+
+// OnOrderBook - Исполнение поручений по стакану. Стакан сохраняется как текущий для инструмента,
+// по нему сразу исполняются новые рыночные поручения
+func (b *Broker) OnOrderBook(ob *orderbook.OrderBook) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	uid, ok := b.uid(ob.InstrumentUid)
+	if !ok {
+		uid, ok = b.uid(ob.Figi)
+	}
+	if !ok {
+		return
+	}
+	b.setTime(ob.Time)
+	// копия уровней, объем которых уменьшается при исполнении поручений до следующего стакана
+	book := *ob
+	book.Bids = append([]orderbook.Level(nil), ob.Bids...)
+	book.Asks = append([]orderbook.Level(nil), ob.Asks...)
+	b.books[uid] = &book
+	bid, bidErr := book.BestBid()
+	ask, askErr := book.BestAsk()
+	if mid, err := book.Mid(); err == nil {
+		b.lastPrices[uid] = mid
+	}
+
+	if bidErr == nil && askErr == nil {
+		b.orders = append(b.orders, b.triggerStopsByBook(uid, bid.Price.ToFloat(), ask.Price.ToFloat())...)
+	}
+	for _, o := range b.orders {
+		if o.uid != uid {
+			continue
+		}
+		switch {
+		case !o.limit:
+			b.take(o, &book)
+		case !o.queued:
+			b.take(o, &book)
+			b.enqueue(o, &book)
+		default:
+			b.matchResting(o, &book)
+		}
+	}
+	b.cleanup()
+}
+
+// OnTrade - Исполнение поручений по обезличенной сделке в пределах ее объема. Рыночные поручения, которые не
+// исполнились по стакану, исполняются по цене сделки с проскальзыванием, лимитные - по своей цене, если сделка
+// прошла ее хотя бы на шаг цены, для FILL_TOUCH - если достигла. Сделка по цене поручения для FILL_QUEUE
+// поручение не исполняет, очередь учитывается по стаканам
+func (b *Broker) OnTrade(t *pb.Trade) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	uid, ok := b.uid(t.GetInstrumentUid())
+	if !ok {
+		uid, ok = b.uid(t.GetFigi())
+	}
+	if !ok {
+		return
+	}
+	b.setTime(t.GetTime().AsTime())
+	b.onPrice(uid, t.GetPrice().ToFloat(), t.GetQuantity(), true)
+}
+
+// OnLastPrice - Обновление последней цены инструмента, срабатывание стоп-заявок и исполнение рыночных поручений,
+// для которых нет стакана. Объем по последней цене неизвестен, поэтому лимитные поручения по ней не исполняются
+func (b *Broker) OnLastPrice(lp *pb.LastPrice) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	uid, ok := b.uid(lp.GetInstrumentUid())
+	if !ok {
+		uid, ok = b.uid(lp.GetFigi())
+	}
+	if !ok {
+		return
+	}
+	b.setTime(lp.GetTime().AsTime())
+	b.onPrice(uid, lp.GetPrice().ToFloat(), math.MaxInt64, false)
+}
+
+// onPrice - Исполнение поручений инструмента по цене price в пределах available лотов, при limits = false -
+// только рыночных
+func (b *Broker) onPrice(uid string, price float64, available int64, limits bool) {
+	if price <= 0 {
+		return
+	}
+	b.lastPrices[uid] = price
+	b.orders = append(b.orders, b.triggerStopsByBook(uid, price, price)...)
+	step := b.step(uid)
+	through := b.config.Fill != FILL_TOUCH
+	for _, o := range b.orders {
+		if o.uid != uid || available <= 0 {
+			continue
+		}
+		p := o.price
+		switch {
+		case !o.limit:
+			p = b.config.Slippage.apply(price, step, o.buy())
+		case !limits || !reaches(price, o.price, step, o.buy(), through):
+			continue
+		}
+		q := o.rest()
+		if q > available {
+			q = available
+		}
+		available -= q
+		b.fill(o, q, p)
+	}
+	b.cleanup()
+}
+
+// triggerStopsByBook - Срабатывание стоп-заявок: на покупку по лучшей цене продажи, на продажу - по лучшей цене покупки
+func (b *Broker) triggerStopsByBook(uid string, bid, ask float64) []*order {
+	var orders []*order
+	stops := b.stops[:0]
+	for _, s := range b.stops {
+		price := bid
+		if s.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_BUY {
+			price = ask
+		}
+		if s.uid == uid && s.triggered(price, price) {
+			orders = append(orders, b.stopToOrder(s, 0))
+			continue
+		}
+		stops = append(stops, s)
+	}
+	b.stops = stops
+	return orders
+}
+
+// triggerStops - Срабатывание стоп-заявок инструмента по диапазону цен свечи
+func (b *Broker) triggerStops(uid string, low, high, open float64) []*order {
+	var orders []*order
+	stops := b.stops[:0]
+	for _, s := range b.stops {
+		if s.uid == uid && s.triggered(low, high) {
+			orders = append(orders, b.stopToOrder(s, s.triggerPrice(open)))
+			continue
+		}
+		stops = append(stops, s)
+	}
+	b.stops = stops
+	return orders
+}
+
+// stopToOrder - Поручение по сработавшей стоп-заявке: для STOP_LIMIT лимитное, иначе рыночное
+func (b *Broker) stopToOrder(s *stopOrder, trigger float64) *order {
+	o := &order{
+		id:        investgo.CreateUid(),
+		uid:       s.uid,
+		direction: pb.OrderDirection_ORDER_DIRECTION_BUY,
+		lots:      s.lots,
+		trigger:   trigger,
+		orderType: pb.OrderType_ORDER_TYPE_MARKET,
+		created:   b.now,
+	}
+	if s.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL {
+		o.direction = pb.OrderDirection_ORDER_DIRECTION_SELL
+	}
+	if s.orderType == pb.StopOrderType_STOP_ORDER_TYPE_STOP_LIMIT {
+		o.limit = true
+		o.price = s.price
+		o.orderType = pb.OrderType_ORDER_TYPE_LIMIT
+	}
+	b.history[o.id] = o
+	return o
+}
+
+// take - Исполнение поручения по встречным заявкам стакана по их ценам, для лимитного - только до его цены
+func (b *Broker) take(o *order, book *orderbook.OrderBook) {
+	levels := book.Asks
+	if !o.buy() {
+		levels = book.Bids
+	}
+	step := b.step(o.uid)
+	for i := range levels {
+		if o.rest() == 0 {
+			break
+		}
+		l := &levels[i]
+		p := l.Price.ToFloat()
+		if o.limit && ((o.buy() && p > o.price+step/2) || (!o.buy() && p < o.price-step/2)) {
+			break
+		}
+		q := l.Quantity
+		if q > o.rest() {
+			q = o.rest()
+		}
+		if q <= 0 {
+			continue
+		}
+		l.Quantity -= q
+		if !o.limit {
+			p = b.config.Slippage.apply(p, step, o.buy())
+		}
+		b.fill(o, q, p)
+	}
+}
+
+// enqueue - Постановка остатка лимитного поручения в очередь за объемом его ценового уровня
+func (b *Broker) enqueue(o *order, book *orderbook.OrderBook) {
+	o.queued = true
+	o.level, _ = b.levelQuantity(o, book)
+	o.ahead = o.level
+}
+
+// matchResting - Исполнение поручения, стоящего в стакане. Если встречные заявки достигли его цены, оно
+// исполняется по своей цене в пределах их объема. Для FILL_QUEUE уменьшение объема его ценового уровня
+// считается исполнением заявок перед поручением, после них исполняется само поручение
+func (b *Broker) matchResting(o *order, book *orderbook.OrderBook) {
+	levels := book.Asks
+	if !o.buy() {
+		levels = book.Bids
+	}
+	step := b.step(o.uid)
+	for i := range levels {
+		if o.rest() == 0 {
+			return
+		}
+		l := &levels[i]
+		if !reaches(l.Price.ToFloat(), o.price, step, o.buy(), b.config.Fill == FILL_TRADE_THROUGH) {
+			break
+		}
+		q := l.Quantity
+		if q > o.rest() {
+			q = o.rest()
+		}
+		if q <= 0 {
+			continue
+		}
+		l.Quantity -= q
+		b.fill(o, q, o.price)
+	}
+	if b.config.Fill != FILL_QUEUE || o.rest() == 0 {
+		return
+	}
+	level, visible := b.levelQuantity(o, book)
+	if !visible {
+		return
+	}
+	decrease := o.level - level
+	o.level = level
+	if decrease <= 0 {
+		return
+	}
+	if decrease <= o.ahead {
+		o.ahead -= decrease
+		return
+	}
+	q := decrease - o.ahead
+	o.ahead = 0
+	if q > o.rest() {
+		q = o.rest()
+	}
+	b.fill(o, q, o.price)
+}
+
+// levelQuantity - Объем уровня стакана с ценой поручения на его стороне. visible = false, если цена
+// за пределами глубины стакана и объем уровня неизвестен
+func (b *Broker) levelQuantity(o *order, book *orderbook.OrderBook) (int64, bool) {
+	levels := book.Bids
+	if !o.buy() {
+		levels = book.Asks
+	}
+	if len(levels) == 0 {
+		return 0, false
+	}
+	eps := b.step(o.uid) / 2
+	for _, l := range levels {
+		if math.Abs(l.Price.ToFloat()-o.price) < eps {
+			return l.Quantity, true
+		}
+	}
+	worst := levels[len(levels)-1].Price.ToFloat()
+	if o.buy() {
+		return 0, o.price > worst
+	}
+	return 0, o.price < worst
+}
+
+// fill - Сделка по поручению: обновление баланса, позиции, комиссии и очередь исполнения для движка
+func (b *Broker) fill(o *order, lots int64, price float64) {
+	instrument := b.instruments[o.uid]
+	lot := b.lot(o.uid)
+	quotation := investgo.FloatToQuotation(price, b.stepQuotation(o.uid))
+	price = quotation.ToFloat()
+	value := price * float64(lots*lot)
+	commission := b.config.Commission.calc(value, b.turnover)
+	b.turnover += value
+	b.commission += commission
+	delta := lots
+	if o.buy() {
+		b.cash -= value + commission
+	} else {
+		b.cash += value - commission
+		delta = -lots
+	}
+	b.updateAvgPrice(o.uid, delta, price)
+	b.positions[o.uid] += delta
+	o.filled += lots
+	o.value += value
+	o.commission += commission
+	tradeId := investgo.CreateUid()
+	b.fills = append(b.fills, Fill{
+		Time:          b.now,
+		OrderId:       o.id,
+		InstrumentUid: o.uid,
+		Direction:     o.direction,
+		Lots:          lots,
+		Quantity:      lots * lot,
+		Price:         price,
+		Commission:    commission,
+		TradeId:       tradeId,
+	})
+	b.pending = append(b.pending, &pb.OrderTrades{
+		OrderId:   o.id,
+		CreatedAt: timestamppb.New(b.now),
+		Direction: o.direction,
+		Figi:      instrument.Figi,
+		Trades: []*pb.OrderTrade{{
+			DateTime: timestamppb.New(b.now),
+			Price:    quotation,
+			Quantity: lots * lot,
+			TradeId:  tradeId,
+		}},
+		AccountId:     b.accountId,
+		InstrumentUid: o.uid,
+	})
+}
+
+// updateAvgPrice - Средняя цена позиции после изменения на delta лотов по цене price. При сокращении позиции
+// средняя цена не меняется, при развороте - равна цене сделки
+func (b *Broker) updateAvgPrice(uid string, delta int64, price float64) {
+	current := b.positions[uid]
+	next := current + delta
+	switch {
+	case next == 0:
+		delete(b.avgPrices, uid)
+	case current == 0 || (current > 0) != (next > 0):
+		b.avgPrices[uid] = price
+	case (current > 0) == (delta > 0):
+		b.avgPrices[uid] = (b.avgPrices[uid]*float64(current) + price*float64(delta)) / float64(next)
+	}
+}
+
+// closeOut - Исполнение оставшихся рыночных поручений по последним ценам, когда данных больше нет
+func (b *Broker) closeOut() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for _, o := range b.orders {
+		price, ok := b.lastPrices[o.uid]
+		if o.limit || !ok {
+			continue
+		}
+		b.fill(o, o.rest(), b.config.Slippage.apply(price, b.step(o.uid), o.buy()))
+	}
+	b.cleanup()
+}
+
+// drain - Исполнения, которые еще не переданы движку
+func (b *Broker) drain() []*pb.OrderTrades {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	pending := b.pending
+	b.pending = nil
+	return pending
+}
+
+// cleanup - Удаление исполненных поручений
+func (b *Broker) cleanup() {
+	orders := b.orders[:0]
+	for _, o := range b.orders {
+		if o.rest() > 0 {
+			orders = append(orders, o)
+		}
+	}
+	b.orders = orders
+}
+
+// setTime - Время симулятора, дневной оборот для комиссии считается по московскому времени
+func (b *Broker) setTime(t time.Time) {
+	b.now = t
+	if day := t.In(orderbook.MSK).Format(time.DateOnly); day != b.day {
+		b.day = day
+		b.turnover = 0
+	}
+}
+
+// marketPrice - Оценка цены рыночного поручения: лучшая встречная цена стакана или последняя цена
+func (b *Broker) marketPrice(uid string, buy bool) float64 {
+	if book, ok := b.books[uid]; ok {
+		level, err := book.BestAsk()
+		if !buy {
+			level, err = book.BestBid()
+		}
+		if err == nil {
+			return level.Price.ToFloat()
+		}
+	}
+	return b.lastPrices[uid]
+}
+
+// cost - Сумма, нужная для покупки lots лотов по цене price, без учета закрытия короткой позиции
+func (b *Broker) cost(uid string, lots int64, price float64) float64 {
+	if short := -b.positions[uid]; short > 0 {
+		if short >= lots {
+			return 0
+		}
+		lots -= short
+	}
+	value := price * float64(lots*b.lot(uid))
+	return value + b.config.Commission.calc(value, b.turnover)
+}
+
+// money - Сумма в валюте инструмента uid, если она не задана - в валюте счета
+func (b *Broker) money(uid string, value float64) *pb.MoneyValue {
+	q := investgo.FloatToQuotation(value, &pb.Quotation{Nano: 1e7})
+	return &pb.MoneyValue{Currency: b.currency(uid), Units: q.GetUnits(), Nano: q.GetNano()}
+}
+
+// moneyPrice - Цена за 1 инструмент в валюте инструмента, без округления до копеек
+func (b *Broker) moneyPrice(uid string, price float64) *pb.MoneyValue {
+	q := investgo.FloatToQuotation(price, &pb.Quotation{Nano: 1})
+	return &pb.MoneyValue{Currency: b.currency(uid), Units: q.GetUnits(), Nano: q.GetNano()}
+}
+
+func (b *Broker) currency(uid string) string {
+	if currency := b.instruments[uid].Currency; currency != "" {
+		return currency
+	}
+	return b.config.Currency
+}
+
+func (b *Broker) uid(id string) (string, bool) {
+	if _, ok := b.instruments[id]; ok {
+		return id, true
+	}
+	uid, ok := b.figiToUid[id]
+	return uid, ok
+}
+
+func (b *Broker) lot(uid string) int64 {
+	if lot := b.instruments[uid].Lot; lot > 0 {
+		return lot
+	}
+	return 1
+}
+
+func (b *Broker) stepQuotation(uid string) *pb.Quotation {
+	if step := b.instruments[uid].PriceStep; step.ToFloat() > 0 {
+		return step
+	}
+	return &pb.Quotation{Nano: 1}
+}
+
+func (b *Broker) step(uid string) float64 {
+	return b.stepQuotation(uid).ToFloat()
+}
@@ -0,0 +1,81 @@
+package backtest
+
+// FillModel - Модель исполнения лимитных поручений
+type FillModel int
+
+const (
+	// FILL_TOUCH - Поручение исполняется, как только цена достигает цены поручения
+	FILL_TOUCH FillModel = iota
+	// FILL_TRADE_THROUGH - Поручение исполняется, только если цена прошла цену поручения хотя бы на шаг цены
+	FILL_TRADE_THROUGH
+	// FILL_QUEUE - Учет позиции в очереди на ценовом уровне по стаканам: поручение исполняется после того,
+	// как исполнен или снят объем, стоявший перед ним. На свечах работает как FILL_TRADE_THROUGH
+	FILL_QUEUE
+)
+
+func (f FillModel) String() string {
+	switch f {
+	case FILL_TOUCH:
+		return "touch"
+	case FILL_TRADE_THROUGH:
+		return "trade-through"
+	case FILL_QUEUE:
+		return "queue"
+	}
+	return "unknown"
+}
+
+// Slippage - Проскальзывание рыночных поручений и сработавших стоп-заявок, цена ухудшается
+// на Ticks шагов цены и на Percent процентов
+type Slippage struct {
+	Ticks   int64
+	Percent float64
+}
+
+// apply - Цена исполнения с учетом проскальзывания
+func (s Slippage) apply(price, step float64, buy bool) float64 {
+	d := float64(s.Ticks)*step + price*s.Percent/100
+	if buy {
+		return price + d
+	}
+	return price - d
+}
+
+// CommissionTier - Ставка комиссии, действующая, когда дневной оборот достиг Turnover
+type CommissionTier struct {
+	Turnover float64
+	Rate     float64
+}
+
+// Commission - Комиссия брокера по тарифу: ставка Rate в процентах от объема сделки, но не меньше Min.
+// Если дневной оборот до сделки достиг порога одной из ступеней Tiers, действует ее ставка.
+type Commission struct {
+	Rate  float64
+	Min   float64
+	Tiers []CommissionTier
+}
+
+// Тарифы на сделки с акциями на момент написания, актуальные ставки сверяйте с условиями брокера
+var (
+	// TariffInvestor - Тариф Инвестор, 0.3%
+	TariffInvestor = Commission{Rate: 0.3}
+	// TariffTrader - Тариф Трейдер, 0.05%, при дневном обороте от 200 000 - 0.025%
+	TariffTrader = Commission{Rate: 0.05, Tiers: []CommissionTier{{Turnover: 200000, Rate: 0.025}}}
+	// TariffPremium - Тариф Премиум, 0.025%
+	TariffPremium = Commission{Rate: 0.025}
+)
+
+// calc - Комиссия за сделку объемом value при дневном обороте turnover до нее
+func (c Commission) calc(value, turnover float64) float64 {
+	rate := c.Rate
+	for _, t := range c.Tiers {
+		if turnover >= t.Turnover {
+			rate = t.Rate
+		}
+	}
+	commission := value * rate / 100
+	if commission < c.Min {
+		commission = c.Min
+	}
+	return commission
+}
@@ -0,0 +1,381 @@
+package backtest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MONTE_CARLO_RUNS - Кол-во прогонов Монте-Карло по умолчанию
+	MONTE_CARLO_RUNS = 1000
+	// MONTE_CARLO_CONFIDENCE - Уровень доверительных интервалов по умолчанию
+	MONTE_CARLO_CONFIDENCE = 0.95
+)
+
+// Resampling - Способ построения последовательности сделок для одного прогона
+type Resampling int
+
+const (
+	// RESAMPLE_BOOTSTRAP - Выборка сделок с возвращением, каждая сделка выбирается независимо
+	RESAMPLE_BOOTSTRAP Resampling = iota
+	// RESAMPLE_BLOCK - Выборка с возвращением блоками по BlockSize подряд идущих сделок, сохраняет серии
+	// прибыльных и убыточных сделок. Блок, дошедший до конца журнала, продолжается с его начала
+	RESAMPLE_BLOCK
+	// RESAMPLE_SHUFFLE - Перестановка сделок без возвращения: итоговый результат тот же, меняется только путь
+	// капитала и просадка
+	RESAMPLE_SHUFFLE
+)
+
+var resamplingNames = []string{"bootstrap", "block", "shuffle"}
+
+func (r Resampling) String() string {
+	if r < 0 || int(r) >= len(resamplingNames) {
+		return fmt.Sprintf("Resampling(%d)", int(r))
+	}
+	return resamplingNames[r]
+}
+
+// MarshalText - Название способа, например для yaml
+func (r Resampling) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText - Способ по названию: bootstrap, block или shuffle
+func (r *Resampling) UnmarshalText(text []byte) error {
+	for i, name := range resamplingNames {
+		if strings.EqualFold(name, string(text)) {
+			*r = Resampling(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resampling %q", text)
+}
+
+// Distribution - Распределение проскальзывания
+type Distribution int
+
+const (
+	// DIST_NONE - Без проскальзывания
+	DIST_NONE Distribution = iota
+	// DIST_FIXED - Постоянное проскальзывание Mean
+	DIST_FIXED
+	// DIST_UNIFORM - Равномерное распределение на [Mean-Spread, Mean+Spread]
+	DIST_UNIFORM
+	// DIST_NORMAL - Нормальное распределение со средним Mean и стандартным отклонением Spread
+	DIST_NORMAL
+	// DIST_EXPONENTIAL - Экспоненциальное распределение со средним Mean, редкие большие проскальзывания
+	DIST_EXPONENTIAL
+)
+
+var distributionNames = []string{"none", "fixed", "uniform", "normal", "exponential"}
+
+func (d Distribution) String() string {
+	if d < 0 || int(d) >= len(distributionNames) {
+		return fmt.Sprintf("Distribution(%d)", int(d))
+	}
+	return distributionNames[d]
+}
+
+// MarshalText - Название распределения, например для yaml
+func (d Distribution) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText - Распределение по названию: none, fixed, uniform, normal или exponential
+func (d *Distribution) UnmarshalText(text []byte) error {
+	for i, name := range distributionNames {
+		if strings.EqualFold(name, string(text)) {
+			*d = Distribution(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown distribution %q", text)
+}
+
+// SlippageModel - Случайное проскальзывание цен входа и выхода в процентах от цены. Положительное значение
+// ухудшает цену сделки в любом направлении, отрицательное - улучшает
+type SlippageModel struct {
+	Distribution Distribution `yaml:"Distribution"`
+	Mean         float64      `yaml:"Mean"`
+	Spread       float64      `yaml:"Spread"`
+}
+
+// sample - Случайное проскальзывание в долях цены
+func (s SlippageModel) sample(rnd *rand.Rand) float64 {
+	var v float64
+	switch s.Distribution {
+	case DIST_FIXED:
+		v = s.Mean
+	case DIST_UNIFORM:
+		v = s.Mean + (2*rnd.Float64()-1)*s.Spread
+	case DIST_NORMAL:
+		v = s.Mean + rnd.NormFloat64()*s.Spread
+	case DIST_EXPONENTIAL:
+		v = rnd.ExpFloat64() * s.Mean
+	}
+	return v / 100
+}
+
+// MonteCarloConfig - Параметры анализа Монте-Карло
+type MonteCarloConfig struct {
+	// Runs - Кол-во прогонов, по умолчанию MONTE_CARLO_RUNS
+	Runs int `yaml:"Runs"`
+	// Resampling - Способ построения последовательности сделок
+	Resampling Resampling `yaml:"Resampling"`
+	// BlockSize - Размер блока для RESAMPLE_BLOCK, по умолчанию корень из кол-ва сделок
+	BlockSize int `yaml:"BlockSize"`
+	// Slippage - Проскальзывание цен входа и выхода каждой сделки
+	Slippage SlippageModel `yaml:"Slippage"`
+	// Confidence - Уровень доверительных интервалов, по умолчанию MONTE_CARLO_CONFIDENCE
+	Confidence float64 `yaml:"Confidence"`
+	// RuinDrawdown - Просадка в процентах, которая считается разорением
+	RuinDrawdown float64 `yaml:"RuinDrawdown"`
+	// Seed - Начальное значение генератора случайных чисел, 0 - от текущего времени
+	Seed int64 `yaml:"Seed"`
+}
+
+// Estimate - Распределение показателя по прогонам
+type Estimate struct {
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+	Median float64 `json:"median"`
+	// Low, High - Границы доверительного интервала уровня Confidence
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+	// Worst - Худшее значение
+	Worst float64 `json:"worst"`
+}
+
+// MonteCarloRun - Результат одного прогона
+type MonteCarloRun struct {
+	NetProfit     float64 `json:"net_profit"`
+	ReturnPercent float64 `json:"return_percent"`
+	// MaxDrawdownPercent - Максимальная просадка в процентах, отрицательная
+	MaxDrawdownPercent float64 `json:"max_drawdown_percent"`
+}
+
+// MonteCarloResult - Результат анализа Монте-Карло
+type MonteCarloResult struct {
+	Runs       int      `json:"runs"`
+	Trades     int      `json:"trades"`
+	Resampling string   `json:"resampling"`
+	Confidence float64  `json:"confidence"`
+	NetProfit  Estimate `json:"net_profit"`
+	Return     Estimate `json:"return_percent"`
+	Drawdown   Estimate `json:"max_drawdown_percent"`
+	// ProbabilityOfLoss - Доля прогонов с отрицательным результатом в процентах
+	ProbabilityOfLoss float64 `json:"probability_of_loss"`
+	// ProbabilityOfRuin - Доля прогонов, в которых просадка достигла RuinDrawdown, в процентах
+	ProbabilityOfRuin float64 `json:"probability_of_ruin"`
+	// Paths - Результаты всех прогонов
+	Paths []MonteCarloRun `json:"-"`
+}
+
+// MonteCarlo - Анализ устойчивости результата по журналу сделок trades: сделки многократно перевыбираются
+// способом Resampling, цены входа и выхода смещаются на случайное проскальзывание, для каждого прогона
+// считается результат и максимальная просадка от начального капитала initial
+func MonteCarlo(trades []Trade, initial float64, config MonteCarloConfig) (*MonteCarloResult, error) {
+	if len(trades) == 0 {
+		return nil, errors.New("monte carlo: trades are required")
+	}
+	if initial <= 0 {
+		return nil, fmt.Errorf("monte carlo: initial equity must be positive, got %v", initial)
+	}
+	if config.Runs <= 0 {
+		config.Runs = MONTE_CARLO_RUNS
+	}
+	if config.Confidence <= 0 || config.Confidence >= 1 {
+		config.Confidence = MONTE_CARLO_CONFIDENCE
+	}
+	if config.BlockSize <= 0 {
+		config.BlockSize = int(math.Max(1, math.Round(math.Sqrt(float64(len(trades))))))
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	// блоки и перестановки строятся по журналу в порядке закрытия сделок
+	trades = append([]Trade(nil), trades...)
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].ExitTime.Before(trades[j].ExitTime)
+	})
+	rnd := rand.New(rand.NewSource(config.Seed))
+
+	result := &MonteCarloResult{
+		Runs:       config.Runs,
+		Trades:     len(trades),
+		Resampling: config.Resampling.String(),
+		Confidence: config.Confidence,
+		Paths:      make([]MonteCarloRun, 0, config.Runs),
+	}
+	order := make([]int, len(trades))
+	var losses, ruins int
+	for run := 0; run < config.Runs; run++ {
+		resample(order, config, rnd)
+		equity, peak, maxDrawdown := initial, initial, 0.0
+		for _, i := range order {
+			t := trades[i]
+			slippage := (config.Slippage.sample(rnd)*t.EntryPrice + config.Slippage.sample(rnd)*t.ExitPrice) *
+				float64(t.Quantity)
+			equity += t.NetPnL() - slippage
+			peak = math.Max(peak, equity)
+			if peak > 0 {
+				maxDrawdown = math.Min(maxDrawdown, (equity-peak)/peak*100)
+			}
+		}
+		path := MonteCarloRun{
+			NetProfit:          equity - initial,
+			ReturnPercent:      (equity - initial) / initial * 100,
+			MaxDrawdownPercent: maxDrawdown,
+		}
+		if path.NetProfit < 0 {
+			losses++
+		}
+		if config.RuinDrawdown > 0 && -maxDrawdown >= config.RuinDrawdown || equity <= 0 {
+			ruins++
+		}
+		result.Paths = append(result.Paths, path)
+	}
+	result.ProbabilityOfLoss = float64(losses) / float64(config.Runs) * 100
+	result.ProbabilityOfRuin = float64(ruins) / float64(config.Runs) * 100
+
+	values := make([]float64, config.Runs)
+	estimate := func(value func(r MonteCarloRun) float64) Estimate {
+		for i, p := range result.Paths {
+			values[i] = value(p)
+		}
+		return newEstimate(values, config.Confidence)
+	}
+	result.NetProfit = estimate(func(r MonteCarloRun) float64 { return r.NetProfit })
+	result.Return = estimate(func(r MonteCarloRun) float64 { return r.ReturnPercent })
+	result.Drawdown = estimate(func(r MonteCarloRun) float64 { return r.MaxDrawdownPercent })
+	return result, nil
+}
+
+// resample - Индексы сделок для очередного прогона
+func resample(order []int, config MonteCarloConfig, rnd *rand.Rand) {
+	n := len(order)
+	switch config.Resampling {
+	case RESAMPLE_BLOCK:
+		for i := 0; i < n; {
+			start := rnd.Intn(n)
+			for j := 0; j < config.BlockSize && i < n; j++ {
+				order[i] = (start + j) % n
+				i++
+			}
+		}
+	case RESAMPLE_SHUFFLE:
+		for i := range order {
+			order[i] = i
+		}
+		rnd.Shuffle(n, func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	default:
+		for i := range order {
+			order[i] = rnd.Intn(n)
+		}
+	}
+}
+
+// newEstimate - Среднее, медиана, доверительный интервал и худшее значение, values сортируется.
+// Для всех показателей худшее значение - минимальное
+func newEstimate(values []float64, confidence float64) Estimate {
+	sort.Float64s(values)
+	var sum, sq float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	tail := (1 - confidence) / 2
+	return Estimate{
+		Mean:   mean,
+		StdDev: math.Sqrt(sq / float64(len(values))),
+		Median: percentile(values, 0.5),
+		Low:    percentile(values, tail),
+		High:   percentile(values, 1-tail),
+		Worst:  values[0],
+	}
+}
+
+// percentile - Квантиль q отсортированного слайса с линейной интерполяцией
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(pos-float64(i))
+}
+
+// WriteJSON - Сводка анализа в json
+func (m *MonteCarloResult) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// WritePathsCSV - Результаты всех прогонов в csv
+func (m *MonteCarloResult) WritePathsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"run", "net_profit", "return_percent", "max_drawdown_percent"}); err != nil {
+		return err
+	}
+	for i, p := range m.Paths {
+		err := cw.Write([]string{
+			strconv.Itoa(i + 1),
+			formatFloat(p.NetProfit),
+			formatFloat(p.ReturnPercent),
+			formatFloat(p.MaxDrawdownPercent),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Save - Сохранение анализа в каталог dir: montecarlo.json и montecarlo.csv
+func (m *MonteCarloResult) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files := []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"montecarlo.json", m.WriteJSON},
+		{"montecarlo.csv", m.WritePathsCSV},
+	}
+	for _, f := range files {
+		file, err := os.Create(filepath.Join(dir, f.name))
+		if err != nil {
+			return err
+		}
+		err = f.write(file)
+		if closeErr := file.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,660 @@
+package backtest
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+)
+
+// HALVING_ETA - Коэффициент сокращения кандидатов для SEARCH_HALVING по умолчанию
+const HALVING_ETA = 3
+
+// Search - Способ перебора параметров
+type Search int
+
+const (
+	// SEARCH_GRID - Полный перебор всех сочетаний значений параметров
+	SEARCH_GRID Search = iota
+	// SEARCH_RANDOM - Проверка Samples случайных сочетаний значений параметров
+	SEARCH_RANDOM
+	// SEARCH_HALVING - Successive halving: кандидаты (вся сетка или Samples случайных сочетаний) сначала проверяются
+	// на последней части периода обучения, после каждого этапа остается 1/Eta лучших, а период растет в Eta раз
+	// до полного
+	SEARCH_HALVING
+)
+
+func (s Search) String() string {
+	switch s {
+	case SEARCH_GRID:
+		return "grid"
+	case SEARCH_RANDOM:
+		return "random"
+	case SEARCH_HALVING:
+		return "halving"
+	}
+	return fmt.Sprintf("Search(%d)", int(s))
+}
+
+// MarshalText - Название способа перебора, например для yaml
+func (s Search) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText - Способ перебора по названию: grid, random или halving
+func (s *Search) UnmarshalText(text []byte) error {
+	for _, v := range []Search{SEARCH_GRID, SEARCH_RANDOM, SEARCH_HALVING} {
+		if strings.EqualFold(v.String(), string(text)) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown search %q", text)
+}
+
+// Metric - Показатель, по которому ранжируются варианты параметров, больше - лучше
+type Metric int
+
+const (
+	// METRIC_NET_PROFIT - Результат в валюте
+	METRIC_NET_PROFIT Metric = iota
+	// METRIC_RETURN - Доходность в процентах
+	METRIC_RETURN
+	// METRIC_SHARPE - Коэффициент Шарпа
+	METRIC_SHARPE
+	// METRIC_SORTINO - Коэффициент Сортино
+	METRIC_SORTINO
+	// METRIC_PROFIT_FACTOR - Profit factor, без убыточных сделок варианты с прибылью оказываются первыми
+	METRIC_PROFIT_FACTOR
+	// METRIC_WIN_RATE - Доля прибыльных сделок
+	METRIC_WIN_RATE
+	// METRIC_RETURN_DRAWDOWN - Доходность, деленная на максимальную просадку в процентах
+	METRIC_RETURN_DRAWDOWN
+)
+
+func (m Metric) String() string {
+	switch m {
+	case METRIC_NET_PROFIT:
+		return "net_profit"
+	case METRIC_RETURN:
+		return "return"
+	case METRIC_SHARPE:
+		return "sharpe"
+	case METRIC_SORTINO:
+		return "sortino"
+	case METRIC_PROFIT_FACTOR:
+		return "profit_factor"
+	case METRIC_WIN_RATE:
+		return "win_rate"
+	case METRIC_RETURN_DRAWDOWN:
+		return "return_drawdown"
+	}
+	return fmt.Sprintf("Metric(%d)", int(m))
+}
+
+// MarshalText - Название показателя, например для yaml
+func (m Metric) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText - Показатель по названию, например sharpe
+func (m *Metric) UnmarshalText(text []byte) error {
+	for v := METRIC_NET_PROFIT; v <= METRIC_RETURN_DRAWDOWN; v++ {
+		if strings.EqualFold(v.String(), string(text)) {
+			*m = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown metric %q", text)
+}
+
+// Value - Значение показателя по метрикам тестирования
+func (m Metric) Value(metrics Metrics) float64 {
+	switch m {
+	case METRIC_RETURN:
+		return metrics.ReturnPercent
+	case METRIC_SHARPE:
+		return metrics.Sharpe
+	case METRIC_SORTINO:
+		return metrics.Sortino
+	case METRIC_PROFIT_FACTOR:
+		if metrics.Losses == 0 && metrics.Wins > 0 {
+			return math.MaxFloat64
+		}
+		return metrics.ProfitFactor
+	case METRIC_WIN_RATE:
+		return metrics.WinRate
+	case METRIC_RETURN_DRAWDOWN:
+		if metrics.MaxDrawdownPercent == 0 {
+			return metrics.ReturnPercent
+		}
+		return metrics.ReturnPercent / -metrics.MaxDrawdownPercent
+	}
+	return metrics.NetProfit
+}
+
+// Param - Оптимизируемый параметр: имя поля конфигурации и значения для перебора
+type Param struct {
+	Name   string
+	Values []any
+}
+
+// Values - Параметр с перечисленными значениями
+func Values[T any](name string, values ...T) Param {
+	p := Param{Name: name, Values: make([]any, 0, len(values))}
+	for _, v := range values {
+		p.Values = append(p.Values, v)
+	}
+	return p
+}
+
+// FloatRange - Параметр со значениями от min до max включительно с шагом step
+func FloatRange(name string, min, max, step float64) Param {
+	p := Param{Name: name}
+	if step <= 0 {
+		return p
+	}
+	for i := 0; ; i++ {
+		// округление убирает накопленную ошибку, чтобы 0.1 + 0.2 было 0.3 и в ключе кеша
+		v := math.Round((min+float64(i)*step)*1e9) / 1e9
+		if v > max+step*1e-9 {
+			return p
+		}
+		p.Values = append(p.Values, v)
+	}
+}
+
+// IntRange - Параметр с целыми значениями от min до max включительно с шагом step
+func IntRange(name string, min, max, step int) Param {
+	p := Param{Name: name}
+	if step <= 0 {
+		return p
+	}
+	for v := min; v <= max; v += step {
+		p.Values = append(p.Values, v)
+	}
+	return p
+}
+
+// Params - Значения параметров одного варианта по именам полей конфигурации
+type Params map[string]any
+
+// Key - Строковое представление, одинаковое для одинаковых значений параметров
+func (p Params) Key() string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%v=%v", name, p[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p Params) String() string {
+	return p.Key()
+}
+
+// Apply - Запись значений параметров в поля структуры, config - указатель на структуру конфигурации.
+// Значения приводятся к типу поля, например int к float64 или к именованному типу. Строки записываются через
+// encoding.TextUnmarshaler, если поле его реализует, например название типа анализа из yaml
+func (p Params) Apply(config any) error {
+	v := reflect.ValueOf(config)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to struct, got %T", config)
+	}
+	v = v.Elem()
+	for name, value := range p {
+		field := v.FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			return fmt.Errorf("field %v not found in %v", name, v.Type())
+		}
+		if text, ok := value.(string); ok {
+			if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+				if err := u.UnmarshalText([]byte(text)); err != nil {
+					return fmt.Errorf("field %v: %w", name, err)
+				}
+				continue
+			}
+		}
+		val := reflect.ValueOf(value)
+		if !val.IsValid() || !val.Type().ConvertibleTo(field.Type()) {
+			return fmt.Errorf("value %v of type %T can not be assigned to %v.%v of type %v", value, value,
+				v.Type(), name, field.Type())
+		}
+		field.Set(val.Convert(field.Type()))
+	}
+	return nil
+}
+
+// Split - Окно walk-forward: период подбора параметров и следующий за ним период проверки вне выборки
+type Split struct {
+	TrainStart time.Time `json:"train_start"`
+	TrainEnd   time.Time `json:"train_end"`
+	TestStart  time.Time `json:"test_start"`
+	TestEnd    time.Time `json:"test_end"`
+}
+
+// WalkForward - Разбиение периода from-to на окна: обучение длиной train, затем проверка длиной test, окна
+// сдвигаются на test. При anchored обучение всегда начинается с from. Последний период проверки может быть короче
+func WalkForward(from, to time.Time, train, test time.Duration, anchored bool) []Split {
+	splits := make([]Split, 0)
+	if train <= 0 || test <= 0 {
+		return splits
+	}
+	for start := from; ; start = start.Add(test) {
+		trainEnd := start.Add(train)
+		if !trainEnd.Before(to) {
+			return splits
+		}
+		s := Split{TrainStart: start, TrainEnd: trainEnd, TestStart: trainEnd, TestEnd: trainEnd.Add(test)}
+		if anchored {
+			s.TrainStart = from
+		}
+		if s.TestEnd.After(to) {
+			s.TestEnd = to
+		}
+		splits = append(splits, s)
+	}
+}
+
+// EvaluateFunc - Тестирование варианта параметров на периоде from-to
+type EvaluateFunc func(ctx context.Context, p Params, from, to time.Time) (*Report, error)
+
+// OptimizerConfig - Конфигурация оптимизатора
+type OptimizerConfig struct {
+	// Params - Оптимизируемые параметры
+	Params []Param
+	// Search - Способ перебора
+	Search Search
+	// Samples - Кол-во случайных вариантов для SEARCH_RANDOM и SEARCH_HALVING, для SEARCH_HALVING 0 - вся сетка
+	Samples int
+	// Eta - Коэффициент сокращения кандидатов и роста периода для SEARCH_HALVING, по умолчанию HALVING_ETA
+	Eta int
+	// Metric - Показатель для ранжирования вариантов
+	Metric Metric
+	// MinTrades - Минимальное кол-во сделок на обучении, варианты с меньшим кол-вом сделок ранжируются последними
+	MinTrades int
+	// Splits - Окна walk-forward, например WalkForward
+	Splits []Split
+	// Chunk - Если > 0, период проверки делится на части длиной Chunk от его начала, части проверяются и кешируются
+	// отдельно, а результаты объединяются по сделкам через AnalyzeTrades. Подходит для стратегий, которые закрывают
+	// позиции внутри части, например для проверки по дням с Chunk = investgo.DAY. Тогда пересекающиеся окна и этапы
+	// SEARCH_HALVING не проверяют одни и те же дни повторно
+	Chunk time.Duration
+	// Parallel - Кол-во одновременных проверок, по умолчанию runtime.NumCPU()
+	Parallel int
+	// Seed - Начальное значение генератора случайных вариантов, 0 - случайное
+	Seed int64
+	// Progress - Вызывается после каждой проверки варианта на периоде, в том числе из кеша
+	Progress func()
+	// Logger - Логгер, по умолчанию логи не пишутся
+	Logger investgo.Logger
+}
+
+// Trial - Результат варианта параметров на периоде обучения
+type Trial struct {
+	Params  Params  `json:"params"`
+	Metrics Metrics `json:"metrics"`
+	Score   float64 `json:"score"`
+}
+
+// SplitResult - Результат окна walk-forward
+type SplitResult struct {
+	Split Split `json:"split"`
+	// Best - Лучший вариант на обучении
+	Best Trial `json:"best"`
+	// Test - Результат лучшего варианта на периоде проверки
+	Test *Report `json:"test"`
+	// TestScore - Значение Metric на периоде проверки
+	TestScore float64 `json:"test_score"`
+	// Trials - Варианты, проверенные на всем периоде обучения, по убыванию Score
+	Trials []Trial `json:"trials"`
+}
+
+// Optimization - Результат оптимизации
+type Optimization struct {
+	Splits []SplitResult `json:"splits"`
+	// OutOfSample - Объединенный результат всех периодов проверки
+	OutOfSample *Report `json:"out_of_sample"`
+	// Efficiency - Отношение средней дневной доходности на проверке к средней дневной доходности на обучении,
+	// 0 - если на обучении доходность неположительная
+	Efficiency float64 `json:"efficiency"`
+	// Evaluations, CacheHits - Кол-во проверок и сколько из них взято из кеша
+	Evaluations int `json:"evaluations"`
+	CacheHits   int `json:"cache_hits"`
+}
+
+// cacheEntry - Результат проверки, done закрывается после ее завершения
+type cacheEntry struct {
+	done   chan struct{}
+	report *Report
+	err    error
+}
+
+// Optimizer - Подбор параметров стратегии с проверкой вне выборки. Результаты проверок кешируются по значениям
+// параметров и периоду, кеш сохраняется между вызовами Run
+type Optimizer struct {
+	config   OptimizerConfig
+	evaluate EvaluateFunc
+
+	mx          sync.Mutex
+	cache       map[string]*cacheEntry
+	evaluations int
+	hits        int
+}
+
+// NewOptimizer - Создание оптимизатора, evaluate проверяет вариант параметров на периоде
+func NewOptimizer(config OptimizerConfig, evaluate EvaluateFunc) (*Optimizer, error) {
+	if evaluate == nil {
+		return nil, errors.New("evaluate function is required")
+	}
+	if len(config.Params) == 0 {
+		return nil, errors.New("at least one param is required")
+	}
+	if len(config.Splits) == 0 {
+		return nil, errors.New("at least one split is required")
+	}
+	names := make(map[string]struct{}, len(config.Params))
+	for _, p := range config.Params {
+		if len(p.Values) == 0 {
+			return nil, fmt.Errorf("param %v has no values", p.Name)
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("param %v is duplicated", p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
+	for i, s := range config.Splits {
+		if !s.TrainStart.Before(s.TrainEnd) || !s.TestStart.Before(s.TestEnd) {
+			return nil, fmt.Errorf("split %v has empty train or test period", i)
+		}
+	}
+	if config.Search == SEARCH_RANDOM && config.Samples <= 0 {
+		return nil, errors.New("samples is required for random search")
+	}
+	if config.Eta < 2 {
+		config.Eta = HALVING_ETA
+	}
+	if config.Parallel <= 0 {
+		config.Parallel = runtime.NumCPU()
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	return &Optimizer{
+		config:   config,
+		evaluate: evaluate,
+		cache:    make(map[string]*cacheEntry),
+	}, nil
+}
+
+// Run - Подбор параметров на каждом окне обучения и проверка лучшего варианта на следующем за ним периоде
+func (o *Optimizer) Run(ctx context.Context) (*Optimization, error) {
+	o.mx.Lock()
+	evaluations, hits := o.evaluations, o.hits
+	o.mx.Unlock()
+
+	candidates := o.candidates()
+	o.config.Logger.Infof("optimization: %v search, %v candidates, %v splits", o.config.Search, len(candidates),
+		len(o.config.Splits))
+	result := &Optimization{Splits: make([]SplitResult, 0, len(o.config.Splits))}
+	testTrades := make([]Trade, 0)
+	var initial, trainReturn, testReturn, trainDays, testDays float64
+	for i, split := range o.config.Splits {
+		trials, err := o.train(ctx, candidates, split)
+		if err != nil {
+			return nil, err
+		}
+		best := trials[0]
+		test, err := o.run(ctx, best.Params, split.TestStart, split.TestEnd)
+		if err != nil {
+			return nil, err
+		}
+		sr := SplitResult{
+			Split:     split,
+			Best:      best,
+			Test:      test,
+			TestScore: o.config.Metric.Value(test.Metrics),
+			Trials:    trials,
+		}
+		o.config.Logger.Infof("split %v: best %v, train %v = %.3f, test %v = %.3f", i, best.Params, o.config.Metric,
+			best.Score, o.config.Metric, sr.TestScore)
+		result.Splits = append(result.Splits, sr)
+
+		testTrades = append(testTrades, test.Trades...)
+		initial = math.Max(initial, test.Metrics.InitialEquity)
+		trainReturn += best.Metrics.ReturnPercent
+		testReturn += test.Metrics.ReturnPercent
+		trainDays += split.TrainEnd.Sub(split.TrainStart).Hours() / 24
+		testDays += split.TestEnd.Sub(split.TestStart).Hours() / 24
+	}
+	result.OutOfSample = AnalyzeTrades(testTrades, initial)
+	if trainReturn > 0 {
+		result.Efficiency = (testReturn / testDays) / (trainReturn / trainDays)
+	}
+
+	o.mx.Lock()
+	result.Evaluations = o.evaluations - evaluations
+	result.CacheHits = o.hits - hits
+	o.mx.Unlock()
+	return result, nil
+}
+
+// candidates - Варианты параметров для проверки
+func (o *Optimizer) candidates() []Params {
+	switch {
+	case o.config.Search == SEARCH_RANDOM, o.config.Search == SEARCH_HALVING && o.config.Samples > 0:
+		return o.random(o.config.Samples)
+	}
+	return o.grid()
+}
+
+// grid - Все сочетания значений параметров
+func (o *Optimizer) grid() []Params {
+	result := []Params{{}}
+	for _, p := range o.config.Params {
+		next := make([]Params, 0, len(result)*len(p.Values))
+		for _, prev := range result {
+			for _, v := range p.Values {
+				params := make(Params, len(prev)+1)
+				for name, value := range prev {
+					params[name] = value
+				}
+				params[p.Name] = v
+				next = append(next, params)
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// random - n различных случайных сочетаний, но не больше размера сетки
+func (o *Optimizer) random(n int) []Params {
+	size := 1
+	for _, p := range o.config.Params {
+		size *= len(p.Values)
+		if size >= n {
+			size = n
+			break
+		}
+	}
+	r := rand.New(rand.NewSource(o.config.Seed))
+	seen := make(map[string]struct{}, size)
+	result := make([]Params, 0, size)
+	for len(result) < size {
+		params := make(Params, len(o.config.Params))
+		for _, p := range o.config.Params {
+			params[p.Name] = p.Values[r.Intn(len(p.Values))]
+		}
+		if _, ok := seen[params.Key()]; ok {
+			continue
+		}
+		seen[params.Key()] = struct{}{}
+		result = append(result, params)
+	}
+	return result
+}
+
+// train - Проверка кандидатов на периоде обучения, результат по убыванию Score
+func (o *Optimizer) train(ctx context.Context, candidates []Params, split Split) ([]Trial, error) {
+	if o.config.Search != SEARCH_HALVING {
+		return o.trials(ctx, candidates, split.TrainStart, split.TrainEnd)
+	}
+	// кол-во этапов, чтобы на последнем осталось не больше Eta кандидатов
+	rungs := 0
+	for n := len(candidates); n > o.config.Eta; n = (n + o.config.Eta - 1) / o.config.Eta {
+		rungs++
+	}
+	period := split.TrainEnd.Sub(split.TrainStart)
+	for rung := 0; rung < rungs; rung++ {
+		// на каждом этапе берется последняя часть периода обучения, как самая близкая к периоду проверки
+		d := time.Duration(float64(period) / math.Pow(float64(o.config.Eta), float64(rungs-rung)))
+		if o.config.Chunk > 0 {
+			d = time.Duration(math.Ceil(float64(d)/float64(o.config.Chunk))) * o.config.Chunk
+		}
+		from := split.TrainEnd.Add(-d)
+		if from.Before(split.TrainStart) {
+			from = split.TrainStart
+		}
+		trials, err := o.trials(ctx, candidates, from, split.TrainEnd)
+		if err != nil {
+			return nil, err
+		}
+		keep := (len(trials) + o.config.Eta - 1) / o.config.Eta
+		candidates = make([]Params, 0, keep)
+		for _, t := range trials[:keep] {
+			candidates = append(candidates, t.Params)
+		}
+	}
+	return o.trials(ctx, candidates, split.TrainStart, split.TrainEnd)
+}
+
+// trials - Параллельная проверка кандидатов на периоде from-to, результат по убыванию Score. Варианты с кол-вом
+// сделок меньше MinTrades идут последними
+func (o *Optimizer) trials(ctx context.Context, candidates []Params, from, to time.Time) ([]Trial, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	trials := make([]Trial, len(candidates))
+	errs := make([]error, len(candidates))
+	sem := make(chan struct{}, o.config.Parallel)
+	wg := &sync.WaitGroup{}
+	for i, params := range candidates {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			break
+		}
+		i, params := i, params
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			report, err := o.run(ctx, params, from, to)
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+			trials[i] = Trial{Params: params, Metrics: report.Metrics, Score: o.config.Metric.Value(report.Metrics)}
+		}()
+	}
+	wg.Wait()
+	// после первой ошибки остальные проверки отменяются, возвращается исходная ошибка
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(trials, func(i, j int) bool {
+		ei, ej := trials[i].Metrics.Trades >= o.config.MinTrades, trials[j].Metrics.Trades >= o.config.MinTrades
+		if ei != ej {
+			return ei
+		}
+		return trials[i].Score > trials[j].Score
+	})
+	return trials, nil
+}
+
+// run - Проверка варианта на периоде from-to частями по Chunk
+func (o *Optimizer) run(ctx context.Context, params Params, from, to time.Time) (*Report, error) {
+	if o.config.Chunk <= 0 {
+		return o.cached(ctx, params, from, to)
+	}
+	trades := make([]Trade, 0)
+	var initial float64
+	for start := from; start.Before(to); start = start.Add(o.config.Chunk) {
+		end := start.Add(o.config.Chunk)
+		if end.After(to) {
+			end = to
+		}
+		report, err := o.cached(ctx, params, start, end)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, report.Trades...)
+		initial = math.Max(initial, report.Metrics.InitialEquity)
+	}
+	return AnalyzeTrades(trades, initial), nil
+}
+
+// cached - Проверка варианта на периоде from-to с кешированием, одновременные запросы одной проверки ждут
+// первый из них
+func (o *Optimizer) cached(ctx context.Context, params Params, from, to time.Time) (*Report, error) {
+	key := fmt.Sprintf("%v|%v|%v", params.Key(), from.UnixNano(), to.UnixNano())
+	o.mx.Lock()
+	o.evaluations++
+	entry, ok := o.cache[key]
+	if ok {
+		o.hits++
+	} else {
+		entry = &cacheEntry{done: make(chan struct{})}
+		o.cache[key] = entry
+	}
+	o.mx.Unlock()
+	if o.config.Progress != nil {
+		defer o.config.Progress()
+	}
+
+	if ok {
+		select {
+		case <-entry.done:
+			return entry.report, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	entry.report, entry.err = o.evaluate(ctx, params, from, to)
+	if entry.err == nil && entry.report == nil {
+		entry.err = fmt.Errorf("evaluate returned no report for %v", params)
+	}
+	if entry.err != nil {
+		// ошибки не кешируются, например из-за отмены контекста
+		o.mx.Lock()
+		delete(o.cache, key)
+		o.mx.Unlock()
+	}
+	close(entry.done)
+	return entry.report, entry.err
+}
@@ -0,0 +1,450 @@
+package backtest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/orderbook"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// PAPER_ACCOUNT_ID - Идентификатор счета бумажного брокера по умолчанию
+const PAPER_ACCOUNT_ID = "paper"
+
+// PaperConfig - Конфигурация бумажного брокера
+type PaperConfig struct {
+	// AccountId - Идентификатор счета в ответах и исполнениях, по умолчанию PAPER_ACCOUNT_ID
+	AccountId string
+	// Instruments - Торгуемые инструменты, лотность и шаг цены нужны для расчета сделок
+	Instruments []investgo.EngineInstrument
+	// InitialCash, Currency - Начальный денежный баланс счета
+	InitialCash float64
+	Currency    string
+	// Fill - Модель исполнения лимитных поручений
+	Fill FillModel
+	// Slippage - Проскальзывание рыночных поручений
+	Slippage Slippage
+	// Commission - Комиссия по тарифу, например TariffTrader
+	Commission Commission
+	// OrderBookDepth - Глубина стаканов, на которые PaperMarketData подписывается для исполнения поручений,
+	// если потребитель не подписался на них сам. 0 - без дополнительной подписки
+	OrderBookDepth int32
+	// Trades - Подписка PaperMarketData на обезличенные сделки для исполнения поручений
+	Trades bool
+	// Logger - Логгер, по умолчанию логи не пишутся
+	Logger investgo.Logger
+}
+
+// PaperBroker - Бумажный брокер для пробного запуска ботов без реального счета и песочницы. Поручения исполняются
+// локально симулятором Broker по стаканам, обезличенным сделкам и последним ценам из живого стрима
+// или воспроизведения записи, которые проходят через PaperMarketData. Исполнения отправляются в стримы
+// PaperTradesStream в формате TradesStream.
+type PaperBroker struct {
+	*Broker
+	config PaperConfig
+	logger investgo.Logger
+
+	mx      sync.Mutex
+	streams map[*PaperTradesStream]struct{}
+}
+
+// NewPaperBroker - Создание бумажного брокера
+func NewPaperBroker(config PaperConfig) *PaperBroker {
+	if config.AccountId == "" {
+		config.AccountId = PAPER_ACCOUNT_ID
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	b := NewBroker(Config{
+		Instruments: config.Instruments,
+		InitialCash: config.InitialCash,
+		Currency:    config.Currency,
+		Fill:        config.Fill,
+		Slippage:    config.Slippage,
+		Commission:  config.Commission,
+	})
+	b.accountId = config.AccountId
+	return &PaperBroker{
+		Broker:  b,
+		config:  config,
+		logger:  config.Logger,
+		streams: make(map[*PaperTradesStream]struct{}),
+	}
+}
+
+// AccountId - Идентификатор счета бумажного брокера
+func (p *PaperBroker) AccountId() string {
+	return p.config.AccountId
+}
+
+// EngineConfig - Конфигурация движка для торговли через бумажного брокера: поручения, стоп-заявки, позиции
+// и исполнения идут через брокера, а биржевая информация из md проходит через PaperMarketData
+func (p *PaperBroker) EngineConfig(config investgo.EngineConfig, md func() (investgo.MarketDataSource, error)) investgo.EngineConfig {
+	config.AccountId = p.config.AccountId
+	config.Orders = p
+	config.StopOrders = p
+	config.Positions = p
+	config.InstrumentsInfo = p.config.Instruments
+	config.MarketData = func() (investgo.MarketDataSource, error) {
+		source, err := md()
+		if err != nil {
+			return nil, err
+		}
+		return p.MarketData(source), nil
+	}
+	config.OrderTrades = func() (investgo.OrderTradesSource, error) {
+		return p.TradesStream(), nil
+	}
+	if config.Logger == nil {
+		config.Logger = p.logger
+	}
+	return config
+}
+
+// PostOrder - Выставление поручения, исполнения сразу отправляются в стримы
+func (p *PaperBroker) PostOrder(req *investgo.PostOrderRequest) (*investgo.PostOrderResponse, error) {
+	defer p.deliver()
+	return p.Broker.PostOrder(req)
+}
+
+// Buy - Выставление поручения на покупку
+func (p *PaperBroker) Buy(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error) {
+	return p.PostOrder(shortRequest(req, pb.OrderDirection_ORDER_DIRECTION_BUY))
+}
+
+// Sell - Выставление поручения на продажу
+func (p *PaperBroker) Sell(req *investgo.PostOrderRequestShort) (*investgo.PostOrderResponse, error) {
+	return p.PostOrder(shortRequest(req, pb.OrderDirection_ORDER_DIRECTION_SELL))
+}
+
+// ReplaceOrder - Изменение поручения, исполнения нового поручения сразу отправляются в стримы
+func (p *PaperBroker) ReplaceOrder(req *investgo.ReplaceOrderRequest) (*investgo.PostOrderResponse, error) {
+	defer p.deliver()
+	return p.Broker.ReplaceOrder(req)
+}
+
+// OnOrderBook - Исполнение поручений по стакану
+func (p *PaperBroker) OnOrderBook(ob *orderbook.OrderBook) {
+	p.Broker.OnOrderBook(ob)
+	p.deliver()
+}
+
+// OnTrade - Исполнение поручений по обезличенной сделке
+func (p *PaperBroker) OnTrade(t *pb.Trade) {
+	p.Broker.OnTrade(t)
+	p.deliver()
+}
+
+// OnLastPrice - Обновление последней цены, срабатывание стоп-заявок и исполнение рыночных поручений
+func (p *PaperBroker) OnLastPrice(lp *pb.LastPrice) {
+	p.Broker.OnLastPrice(lp)
+	p.deliver()
+}
+
+// Handle - Обработка сообщения стрима биржевой информации: *pb.OrderBook, *pb.Trade или *pb.LastPrice,
+// остальные сообщения игнорируются
+func (p *PaperBroker) Handle(msg any) {
+	switch m := msg.(type) {
+	case *pb.OrderBook:
+		uid, ok := p.uid(m.GetInstrumentUid())
+		if !ok {
+			uid, ok = p.uid(m.GetFigi())
+		}
+		if ok {
+			p.OnOrderBook(orderbook.NewOrderBook(m, p.instruments[uid].PriceStep))
+		}
+	case *pb.Trade:
+		p.OnTrade(m)
+	case *pb.LastPrice:
+		p.OnLastPrice(m)
+	}
+}
+
+// deliver - Отправка новых исполнений во все открытые стримы
+func (p *PaperBroker) deliver() {
+	pending := p.drain()
+	if len(pending) == 0 {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for s := range p.streams {
+		s.push(pending)
+	}
+}
+
+// TradesStream - Стрим исполнений бумажного брокера с интерфейсом TradesStream, реализует investgo.OrderTradesSource.
+// Исполнения, которые произошли до создания стрима, в него не попадают
+func (p *PaperBroker) TradesStream() *PaperTradesStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &PaperTradesStream{
+		broker: p,
+		ctx:    ctx,
+		cancel: cancel,
+		notify: make(chan struct{}, 1),
+		trades: make(chan *pb.OrderTrades),
+	}
+	p.mx.Lock()
+	p.streams[s] = struct{}{}
+	p.mx.Unlock()
+	return s
+}
+
+// PaperTradesStream - Стрим исполнений бумажного брокера. Исполнения копятся в очереди, поэтому выставление
+// поручения из обработчика исполнений не блокируется
+type PaperTradesStream struct {
+	broker *PaperBroker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx     sync.Mutex
+	queue  []*pb.OrderTrades
+	notify chan struct{}
+	trades chan *pb.OrderTrades
+}
+
+// Trades - Канал исполнений
+func (s *PaperTradesStream) Trades() <-chan *pb.OrderTrades {
+	return s.trades
+}
+
+// Listen - Отправка исполнений в канал до вызова Stop, после чего канал закрывается
+func (s *PaperTradesStream) Listen() error {
+	defer s.shutdown()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-s.notify:
+		}
+		s.mx.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mx.Unlock()
+		for _, ot := range queue {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			case s.trades <- ot:
+			}
+		}
+	}
+}
+
+// push - Добавление исполнений в очередь стрима
+func (s *PaperTradesStream) push(trades []*pb.OrderTrades) {
+	s.mx.Lock()
+	s.queue = append(s.queue, trades...)
+	s.mx.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *PaperTradesStream) shutdown() {
+	s.broker.mx.Lock()
+	delete(s.broker.streams, s)
+	s.broker.mx.Unlock()
+	s.broker.logger.Infof("close paper trades stream")
+	close(s.trades)
+}
+
+// Stop - Завершение работы стрима
+func (s *PaperTradesStream) Stop() {
+	s.cancel()
+}
+
+// PaperMarketData - Источник биржевой информации, который передает стаканы, обезличенные сделки и последние цены
+// бумажному брокеру, а затем потребителю. Поручения исполняются до того, как стратегия получит событие.
+// Реализует investgo.MarketDataSource, поэтому может заменить MarketDataStream или MarketDataReplayer
+type PaperMarketData struct {
+	source investgo.MarketDataSource
+	broker *PaperBroker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx         sync.Mutex
+	wg         sync.WaitGroup
+	listening  bool
+	orderBooks paperFeed[*pb.OrderBook]
+	trades     paperFeed[*pb.Trade]
+	lastPrices paperFeed[*pb.LastPrice]
+}
+
+// instrumentMessage - Сообщение стрима биржевой информации по инструменту
+type instrumentMessage interface {
+	GetFigi() string
+	GetInstrumentUid() string
+}
+
+// paperFeed - Подписка одного типа: канал источника, канал потребителя и инструменты, на которые подписался потребитель
+type paperFeed[T instrumentMessage] struct {
+	in      <-chan T
+	out     chan T
+	ids     map[string]struct{}
+	started bool
+}
+
+// MarketData - Источник биржевой информации source, события которого сначала обрабатывает бумажный брокер
+func (p *PaperBroker) MarketData(source investgo.MarketDataSource) *PaperMarketData {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PaperMarketData{
+		source:     source,
+		broker:     p,
+		ctx:        ctx,
+		cancel:     cancel,
+		orderBooks: paperFeed[*pb.OrderBook]{out: make(chan *pb.OrderBook, 1), ids: make(map[string]struct{})},
+		trades:     paperFeed[*pb.Trade]{out: make(chan *pb.Trade, 1), ids: make(map[string]struct{})},
+		lastPrices: paperFeed[*pb.LastPrice]{out: make(chan *pb.LastPrice, 1), ids: make(map[string]struct{})},
+	}
+}
+
+// SubscribeCandle - Подписка на свечи, свечи передаются потребителю без обработки брокером
+func (m *PaperMarketData) SubscribeCandle(ids []string, interval pb.SubscriptionInterval, waitingClose bool) (<-chan *pb.Candle, error) {
+	return m.source.SubscribeCandle(ids, interval, waitingClose)
+}
+
+// SubscribeOrderBook - Подписка на стаканы
+func (m *PaperMarketData) SubscribeOrderBook(ids []string, depth int32) (<-chan *pb.OrderBook, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	in, err := m.source.SubscribeOrderBook(ids, depth)
+	if err != nil {
+		return nil, err
+	}
+	subscribe(m, &m.orderBooks, in, ids)
+	return m.orderBooks.out, nil
+}
+
+// SubscribeTrade - Подписка на обезличенные сделки
+func (m *PaperMarketData) SubscribeTrade(ids []string) (<-chan *pb.Trade, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	in, err := m.source.SubscribeTrade(ids)
+	if err != nil {
+		return nil, err
+	}
+	subscribe(m, &m.trades, in, ids)
+	return m.trades.out, nil
+}
+
+// SubscribeInfo - Подписка на торговые статусы, статусы передаются потребителю без обработки брокером
+func (m *PaperMarketData) SubscribeInfo(ids []string) (<-chan *pb.TradingStatus, error) {
+	return m.source.SubscribeInfo(ids)
+}
+
+// SubscribeLastPrice - Подписка на последние цены
+func (m *PaperMarketData) SubscribeLastPrice(ids []string) (<-chan *pb.LastPrice, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	in, err := m.source.SubscribeLastPrice(ids)
+	if err != nil {
+		return nil, err
+	}
+	subscribe(m, &m.lastPrices, in, ids)
+	return m.lastPrices.out, nil
+}
+
+// Listen - Подписка на стаканы и сделки инструментов брокера, на которые не подписался потребитель, и чтение
+// источника. Блокируется до завершения источника, после чего каналы потребителя закрываются
+func (m *PaperMarketData) Listen() error {
+	config := m.broker.config
+	m.mx.Lock()
+	if rest := m.orderBooks.missing(config.Instruments); config.OrderBookDepth > 0 && len(rest) > 0 {
+		in, err := m.source.SubscribeOrderBook(rest, config.OrderBookDepth)
+		if err != nil {
+			m.mx.Unlock()
+			m.shutdown()
+			return err
+		}
+		m.orderBooks.in = in
+	}
+	if rest := m.trades.missing(config.Instruments); config.Trades && len(rest) > 0 {
+		in, err := m.source.SubscribeTrade(rest)
+		if err != nil {
+			m.mx.Unlock()
+			m.shutdown()
+			return err
+		}
+		m.trades.in = in
+	}
+	m.listening = true
+	start(m, &m.orderBooks)
+	start(m, &m.trades)
+	start(m, &m.lastPrices)
+	m.mx.Unlock()
+
+	err := m.source.Listen()
+	m.shutdown()
+	return err
+}
+
+// shutdown - Ожидание завершения передачи и закрытие каналов потребителя
+func (m *PaperMarketData) shutdown() {
+	m.wg.Wait()
+	close(m.orderBooks.out)
+	close(m.trades.out)
+	close(m.lastPrices.out)
+}
+
+// Stop - Завершение работы источника
+func (m *PaperMarketData) Stop() {
+	m.cancel()
+	m.source.Stop()
+}
+
+// subscribe - Запоминание подписки потребителя, если источник уже слушается - запуск передачи
+func subscribe[T instrumentMessage](m *PaperMarketData, f *paperFeed[T], in <-chan T, ids []string) {
+	f.in = in
+	for _, id := range ids {
+		f.ids[id] = struct{}{}
+	}
+	if m.listening {
+		start(m, f)
+	}
+}
+
+// start - Запуск передачи сообщений из канала источника брокеру и потребителю. Потребитель получает только
+// сообщения по своим инструментам, сообщения после Stop брокер обрабатывает, но потребителю они не передаются
+func start[T instrumentMessage](m *PaperMarketData, f *paperFeed[T]) {
+	if f.in == nil || f.started {
+		return
+	}
+	f.started = true
+	m.wg.Add(1)
+	go func(in <-chan T) {
+		defer m.wg.Done()
+		for msg := range in {
+			m.broker.Handle(msg)
+			m.mx.Lock()
+			_, byFigi := f.ids[msg.GetFigi()]
+			_, byUid := f.ids[msg.GetInstrumentUid()]
+			m.mx.Unlock()
+			if !byFigi && !byUid {
+				continue
+			}
+			select {
+			case <-m.ctx.Done():
+			case f.out <- msg:
+			}
+		}
+	}(f.in)
+}
+
+// missing - Uid инструментов, на которые потребитель не подписался ни по uid, ни по figi
+func (f *paperFeed[T]) missing(instruments []investgo.EngineInstrument) []string {
+	rest := make([]string, 0, len(instruments))
+	for _, i := range instruments {
+		_, byFigi := f.ids[i.Figi]
+		_, byUid := f.ids[i.Uid]
+		if !byFigi && !byUid {
+			rest = append(rest, i.Uid)
+		}
+	}
+	return rest
+}
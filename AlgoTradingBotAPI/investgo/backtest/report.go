@@ -0,0 +1,258 @@
+package backtest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CHART_WIDTH, CHART_HEIGHT - Размер графиков HTML отчета
+	CHART_WIDTH  = 960
+	CHART_HEIGHT = 260
+	// CHART_POINTS - Максимальное кол-во точек на графике, длинные кривые прореживаются
+	CHART_POINTS = 2000
+)
+
+// WriteTradesCSV - Журнал сделок в csv
+func (r *Report) WriteTradesCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"instrument_uid", "direction", "quantity", "entry_time", "exit_time", "entry_price",
+		"exit_price", "pnl", "commission", "net_pnl", "return_percent", "holding_sec"})
+	if err != nil {
+		return err
+	}
+	for _, t := range r.Trades {
+		err = cw.Write([]string{
+			t.InstrumentUid,
+			t.Direction.String(),
+			strconv.FormatInt(t.Quantity, 10),
+			t.EntryTime.Format(time.RFC3339),
+			t.ExitTime.Format(time.RFC3339),
+			formatFloat(t.EntryPrice),
+			formatFloat(t.ExitPrice),
+			formatFloat(t.PnL),
+			formatFloat(t.Commission),
+			formatFloat(t.NetPnL()),
+			formatFloat(t.ReturnPercent()),
+			formatFloat(t.Holding().Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteEquityCSV - Кривые капитала и просадки в csv
+func (r *Report) WriteEquityCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"time", "equity", "drawdown", "drawdown_percent"}); err != nil {
+		return err
+	}
+	for i, p := range r.Equity {
+		dd := r.Drawdown[i]
+		err := cw.Write([]string{p.Time.Format(time.RFC3339), formatFloat(p.Equity), formatFloat(dd.Drawdown),
+			formatFloat(dd.Percent)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON - Отчет целиком в json, длительности в наносекундах
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteHTML - Самодостаточный HTML отчет: показатели, графики капитала и просадки в SVG, журнал сделок
+func (r *Report) WriteHTML(w io.Writer, title string) error {
+	equity := make([]float64, 0, len(r.Equity))
+	for _, p := range r.Equity {
+		equity = append(equity, p.Equity)
+	}
+	drawdown := make([]float64, 0, len(r.Drawdown))
+	for _, p := range r.Drawdown {
+		drawdown = append(drawdown, p.Percent)
+	}
+	return reportTemplate.Execute(w, struct {
+		Title    string
+		Report   *Report
+		Metrics  [][2]string
+		Equity   template.HTML
+		Drawdown template.HTML
+	}{
+		Title:    title,
+		Report:   r,
+		Metrics:  r.metricsTable(),
+		Equity:   svgChart(equity, "#1f77b4", false),
+		Drawdown: svgChart(drawdown, "#d62728", true),
+	})
+}
+
+// Save - Сохранение отчета в каталог dir: report.html, report.json, trades.csv и equity.csv
+func (r *Report) Save(dir, title string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	files := []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"report.html", func(w io.Writer) error { return r.WriteHTML(w, title) }},
+		{"report.json", r.WriteJSON},
+		{"trades.csv", r.WriteTradesCSV},
+		{"equity.csv", r.WriteEquityCSV},
+	}
+	for _, f := range files {
+		file, err := os.Create(filepath.Join(dir, f.name))
+		if err != nil {
+			return err
+		}
+		err = f.write(file)
+		if closeErr := file.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsTable - Показатели для HTML отчета
+func (r *Report) metricsTable() [][2]string {
+	m := r.Metrics
+	return [][2]string{
+		{"Период", fmt.Sprintf("%v - %v", m.Start.Format(time.DateTime), m.End.Format(time.DateTime))},
+		{"Начальный капитал", fmt.Sprintf("%.2f", m.InitialEquity)},
+		{"Конечный капитал", fmt.Sprintf("%.2f", m.FinalEquity)},
+		{"Результат", fmt.Sprintf("%.2f (%.2f%%)", m.NetProfit, m.ReturnPercent)},
+		{"Максимальная просадка", fmt.Sprintf("%.2f (%.2f%%)", m.MaxDrawdown, m.MaxDrawdownPercent)},
+		{"Длительность просадки", m.MaxDrawdownDuration.Round(time.Minute).String()},
+		{"Sharpe", fmt.Sprintf("%.2f", m.Sharpe)},
+		{"Sortino", fmt.Sprintf("%.2f", m.Sortino)},
+		{"Profit factor", fmt.Sprintf("%.2f", m.ProfitFactor)},
+		{"Сделок / прибыльных / убыточных", fmt.Sprintf("%v / %v / %v", m.Trades, m.Wins, m.Losses)},
+		{"Доля прибыльных", fmt.Sprintf("%.2f%%", m.WinRate)},
+		{"Средняя сделка / прибыль / убыток", fmt.Sprintf("%.2f / %.2f / %.2f", m.AverageTrade, m.AverageWin, m.AverageLoss)},
+		{"Среднее удержание", m.AverageHolding.Round(time.Second).String()},
+		{"Время в позиции", fmt.Sprintf("%.2f%%", m.Exposure)},
+		{"Оборот", fmt.Sprintf("%.2f (x%.2f)", m.Turnover, m.TurnoverRatio)},
+		{"Комиссии", fmt.Sprintf("%.2f", m.Commission)},
+	}
+}
+
+// svgChart - Линейный график значений в SVG, при fill область под линией до нуля закрашивается
+func svgChart(values []float64, color string, fill bool) template.HTML {
+	if len(values) > CHART_POINTS {
+		// прореживание с сохранением последней точки
+		step := float64(len(values)-1) / float64(CHART_POINTS-1)
+		sampled := make([]float64, 0, CHART_POINTS)
+		for i := 0; i < CHART_POINTS; i++ {
+			sampled = append(sampled, values[int(float64(i)*step)])
+		}
+		sampled[len(sampled)-1] = values[len(values)-1]
+		values = sampled
+	}
+	const pad = 40.0
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		CHART_WIDTH, CHART_HEIGHT, CHART_WIDTH, CHART_HEIGHT)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff" stroke="#ddd"/>`)
+	if len(values) == 0 {
+		b.WriteString(`</svg>`)
+		return template.HTML(b.String())
+	}
+	low, high := values[0], values[0]
+	for _, v := range values {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+	if fill {
+		high = math.Max(high, 0)
+		low = math.Min(low, 0)
+	}
+	if high == low {
+		high, low = high+1, low-1
+	}
+	width, height := float64(CHART_WIDTH)-2*pad, float64(CHART_HEIGHT)-2*pad
+	x := func(i int) float64 {
+		if len(values) == 1 {
+			return pad
+		}
+		return pad + width*float64(i)/float64(len(values)-1)
+	}
+	y := func(v float64) float64 {
+		return pad + height*(high-v)/(high-low)
+	}
+	// шкала: максимум и минимум
+	for _, v := range []float64{high, low} {
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#eee"/>`, pad, y(v), pad+width, y(v))
+		fmt.Fprintf(&b, `<text x="2" y="%.1f" font-size="11" fill="#666">%.2f</text>`, y(v)+4, v)
+	}
+	points := make([]string, 0, len(values)+2)
+	for i, v := range values {
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(i), y(v)))
+	}
+	if fill {
+		area := append([]string{fmt.Sprintf("%.1f,%.1f", x(0), y(0))}, points...)
+		area = append(area, fmt.Sprintf("%.1f,%.1f", x(len(values)-1), y(0)))
+		fmt.Fprintf(&b, `<polygon points="%s" fill="%s" fill-opacity="0.2" stroke="none"/>`, strings.Join(area, " "), color)
+	}
+	fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.Join(points, " "), color)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"datetime": func(t time.Time) string { return t.Format(time.DateTime) },
+	"money":    func(f float64) string { return fmt.Sprintf("%.2f", f) },
+}).Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 24px; }
+td, th { border: 1px solid #ddd; padding: 4px 8px; font-size: 13px; text-align: right; }
+td:first-child, th:first-child { text-align: left; }
+.loss { color: #d62728; }
+.profit { color: #2ca02c; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Metrics}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+<h2>Капитал</h2>
+{{.Equity}}
+<h2>Просадка, %</h2>
+{{.Drawdown}}
+<h2>Сделки</h2>
+<table>
+<tr><th>Инструмент</th><th>Направление</th><th>Кол-во</th><th>Открытие</th><th>Закрытие</th><th>Цена открытия</th><th>Цена закрытия</th><th>Результат</th><th>Комиссия</th></tr>
+{{range .Report.Trades}}<tr><td>{{.InstrumentUid}}</td><td>{{.Direction}}</td><td>{{.Quantity}}</td><td>{{datetime .EntryTime}}</td><td>{{datetime .ExitTime}}</td><td>{{.EntryPrice}}</td><td>{{.ExitPrice}}</td><td class="{{if lt .NetPnL 0.0}}loss{{else}}profit{{end}}">{{money .NetPnL}}</td><td>{{money .Commission}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,213 @@
+package investgo
+
+import (
+	"errors"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// BarType - Способ разбиения сделок на свечи
+type BarType int
+
+const (
+	// BAR_TIME - Свечи фиксированной длительности
+	BAR_TIME BarType = iota
+	// BAR_VOLUME - Свеча закрывается, когда объем сделок в лотах достигает заданного значения
+	BAR_VOLUME
+	// BAR_TICK - Свеча закрывается после заданного кол-ва сделок
+	BAR_TICK
+)
+
+// BarAlignment - Выравнивание свечей по времени. Каждые сутки свечи начинаются заново от якоря - времени Offset
+// от начала суток в Location, и свеча не может пересечь якорь следующих суток. Например, для 7-минутных
+// свечей основной сессии MOEX: Location = Europe/Moscow, Offset = 10 часов. Нулевое значение - полночь UTC,
+// что совпадает с разбиением свечей в api для интервалов, на которые делятся сутки.
+type BarAlignment struct {
+	Location *time.Location
+	Offset   time.Duration
+}
+
+// anchor - Якорь суток, которому принадлежит время t
+func (a BarAlignment) anchor(t time.Time) time.Time {
+	loc := a.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	anchor := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).Add(a.Offset)
+	if t.Before(anchor) {
+		anchor = anchor.AddDate(0, 0, -1)
+	}
+	return anchor
+}
+
+// Bounds - Границы [start, end) свечи длительностью d, в которую попадает время t
+func (a BarAlignment) Bounds(t time.Time, d time.Duration) (time.Time, time.Time) {
+	anchor := a.anchor(t)
+	next := anchor.AddDate(0, 0, 1)
+	if d <= 0 || d >= next.Sub(anchor) {
+		return anchor, next
+	}
+	start := anchor.Add(t.Sub(anchor) / d * d)
+	end := start.Add(d)
+	if end.After(next) {
+		end = next
+	}
+	return start, end
+}
+
+// CandleBuilderConfig - Параметры построения свечей из сделок
+type CandleBuilderConfig struct {
+	// Type - Тип свечей
+	Type BarType
+	// Duration - Длительность свечи для BAR_TIME, например 30 * time.Second или 7 * time.Minute
+	Duration time.Duration
+	// Volume - Объем свечи в лотах для BAR_VOLUME
+	Volume int64
+	// Ticks - Кол-во сделок в свече для BAR_TICK
+	Ticks int
+	// Alignment - Выравнивание свечей для BAR_TIME
+	Alignment BarAlignment
+}
+
+// CandleBuilder - Построение свечей произвольной длительности, объема или кол-ва сделок из потока сделок
+// pb.Trade. Builder не потокобезопасный, сделки одного инструмента нужно передавать из одной горутины.
+type CandleBuilder struct {
+	config  CandleBuilderConfig
+	current *pb.HistoricCandle
+	end     time.Time
+	ticks   int
+}
+
+// NewCandleBuilder - Создание построителя свечей
+func NewCandleBuilder(config CandleBuilderConfig) (*CandleBuilder, error) {
+	switch {
+	case config.Type == BAR_TIME && config.Duration <= 0:
+		return nil, errors.New("bar duration must be positive")
+	case config.Type == BAR_VOLUME && config.Volume <= 0:
+		return nil, errors.New("bar volume must be positive")
+	case config.Type == BAR_TICK && config.Ticks <= 0:
+		return nil, errors.New("bar ticks must be positive")
+	}
+	return &CandleBuilder{config: config}, nil
+}
+
+// Add - Добавление сделки, возвращает свечи, которые завершились после этой сделки. Для свечей по времени
+// сделка, время которой раньше начала текущей свечи, отбрасывается.
+func (b *CandleBuilder) Add(trade *pb.Trade) []*pb.HistoricCandle {
+	completed := make([]*pb.HistoricCandle, 0, 1)
+	t := trade.GetTime().AsTime()
+	if b.config.Type == BAR_TIME {
+		if b.current != nil && t.Before(b.current.GetTime().AsTime()) {
+			return completed
+		}
+		if c := b.Advance(t); c != nil {
+			completed = append(completed, c)
+		}
+	}
+	if b.current == nil {
+		start := t
+		if b.config.Type == BAR_TIME {
+			start, b.end = b.config.Alignment.Bounds(t, b.config.Duration)
+		}
+		b.current = &pb.HistoricCandle{
+			Open:  trade.GetPrice(),
+			High:  trade.GetPrice(),
+			Low:   trade.GetPrice(),
+			Close: trade.GetPrice(),
+			Time:  TimeToTimestamp(start),
+		}
+		b.ticks = 0
+	}
+	updateCandle(b.current, trade.GetPrice(), trade.GetPrice(), trade.GetPrice(), trade.GetQuantity())
+	b.ticks++
+
+	switch {
+	case b.config.Type == BAR_VOLUME && b.current.GetVolume() >= b.config.Volume,
+		b.config.Type == BAR_TICK && b.ticks >= b.config.Ticks:
+		completed = append(completed, b.Flush())
+	}
+	return completed
+}
+
+// Advance - Закрытие свечи по времени: если now не раньше конца текущей свечи, свеча завершается и
+// возвращается, иначе nil. Позволяет закрывать свечи, когда после их окончания не было сделок.
+func (b *CandleBuilder) Advance(now time.Time) *pb.HistoricCandle {
+	if b.config.Type != BAR_TIME || b.current == nil || now.Before(b.end) {
+		return nil
+	}
+	return b.Flush()
+}
+
+// Current - Текущая незавершенная свеча, nil если сделок в ней еще не было
+func (b *CandleBuilder) Current() *pb.HistoricCandle {
+	return b.current
+}
+
+// Flush - Принудительное завершение текущей свечи, например по окончании торгов
+func (b *CandleBuilder) Flush() *pb.HistoricCandle {
+	c := b.current
+	if c == nil {
+		return nil
+	}
+	c.IsComplete = true
+	b.current = nil
+	b.ticks = 0
+	return c
+}
+
+// ResampleCandles - Пересчет свечей в свечи большей длительности d с выравниванием alignment, например
+// минутных свечей в 7-минутные от начала сессии. Свечи должны идти по возрастанию времени. Результирующая
+// свеча завершена, только если завершены все исходные свечи в ней.
+func ResampleCandles(candles []*pb.HistoricCandle, d time.Duration, alignment BarAlignment) []*pb.HistoricCandle {
+	resampled := make([]*pb.HistoricCandle, 0)
+	var current *pb.HistoricCandle
+	var end time.Time
+	for _, candle := range candles {
+		t := candle.GetTime().AsTime()
+		if current == nil || !t.Before(end) {
+			var start time.Time
+			start, end = alignment.Bounds(t, d)
+			current = &pb.HistoricCandle{
+				Open:       candle.GetOpen(),
+				High:       candle.GetHigh(),
+				Low:        candle.GetLow(),
+				Close:      candle.GetClose(),
+				Time:       TimeToTimestamp(start),
+				IsComplete: true,
+			}
+			resampled = append(resampled, current)
+		}
+		updateCandle(current, candle.GetHigh(), candle.GetLow(), candle.GetClose(), candle.GetVolume())
+		current.IsComplete = current.GetIsComplete() && candle.GetIsComplete()
+	}
+	return resampled
+}
+
+// updateCandle - Обновление максимума, минимума, цены закрытия и объема свечи
+func updateCandle(c *pb.HistoricCandle, high, low, closePrice *pb.Quotation, volume int64) {
+	if compareQuotation(high, c.GetHigh()) > 0 {
+		c.High = high
+	}
+	if compareQuotation(low, c.GetLow()) < 0 {
+		c.Low = low
+	}
+	c.Close = closePrice
+	c.Volume += volume
+}
+
+// compareQuotation - Сравнение двух Quotation, возвращает -1, 0 или 1
+func compareQuotation(a, b *pb.Quotation) int {
+	switch {
+	case a.GetUnits() < b.GetUnits():
+		return -1
+	case a.GetUnits() > b.GetUnits():
+		return 1
+	case a.GetNano() < b.GetNano():
+		return -1
+	case a.GetNano() > b.GetNano():
+		return 1
+	}
+	return 0
+}
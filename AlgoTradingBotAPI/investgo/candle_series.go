@@ -0,0 +1,325 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// CandleSeries - Непрерывный ряд свечей инструмента: начальная история из хранилища или api, далее свечи
+// из стрима SubscribeCandle. Незавершенная последняя свеча обновляется на месте, пропуски между историей и
+// стримом, например после переподключения, догружаются через GetCandles. Методы потокобезопасны.
+type CandleSeries struct {
+	mx           sync.RWMutex
+	instrumentId string
+	interval     pb.CandleInterval
+	duration     time.Duration
+	waitingClose bool
+	maxLen       int
+	candles      []*pb.HistoricCandle
+	onComplete   func(candle *pb.HistoricCandle)
+
+	mds    *MarketDataServiceClient
+	logger Logger
+}
+
+// NewCandleSeries - Создание ряда свечей. Если req.History пустая, история загружается через api
+// с req.From, иначе догружаются свечи от последней свечи истории до текущего момента.
+func NewCandleSeries(req *CandleSeriesRequest) (*CandleSeries, error) {
+	duration := CandleIntervalDuration(req.Interval)
+	if duration == 0 {
+		return nil, errors.New("candle series interval must be shorter than week")
+	}
+	if req.MarketDataService == nil {
+		return nil, errors.New("market data service is nil")
+	}
+	s := &CandleSeries{
+		instrumentId: req.InstrumentId,
+		interval:     req.Interval,
+		duration:     duration,
+		waitingClose: req.WaitingClose,
+		maxLen:       req.MaxLen,
+		candles:      make([]*pb.HistoricCandle, 0, len(req.History)),
+		onComplete:   req.OnComplete,
+		mds:          req.MarketDataService,
+		logger:       req.MarketDataService.logger,
+	}
+	s.candles = append(s.candles, req.History...)
+
+	from := req.From
+	if len(s.candles) > 0 {
+		// последняя свеча истории могла быть незавершенной, поэтому запрашиваем ее заново
+		from = s.candles[len(s.candles)-1].GetTime().AsTime()
+	}
+	if _, err := s.backfill(from, time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// InstrumentId - Идентификатор инструмента ряда
+func (s *CandleSeries) InstrumentId() string {
+	return s.instrumentId
+}
+
+// Interval - Интервал свечей ряда
+func (s *CandleSeries) Interval() pb.CandleInterval {
+	return s.interval
+}
+
+// Len - Кол-во свечей в ряду
+func (s *CandleSeries) Len() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.candles)
+}
+
+// Candles - Копия всех свечей ряда
+func (s *CandleSeries) Candles() []*pb.HistoricCandle {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return append(make([]*pb.HistoricCandle, 0, len(s.candles)), s.candles...)
+}
+
+// Last - Последние n свечей ряда, включая незавершенную
+func (s *CandleSeries) Last(n int) []*pb.HistoricCandle {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	switch {
+	case n > len(s.candles):
+		n = len(s.candles)
+	case n < 0:
+		n = 0
+	}
+	return append(make([]*pb.HistoricCandle, 0, n), s.candles[len(s.candles)-n:]...)
+}
+
+// Range - Свечи ряда, время которых лежит в [from, to)
+func (s *CandleSeries) Range(from, to time.Time) []*pb.HistoricCandle {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	low, high := s.index(from), s.index(to)
+	return append(make([]*pb.HistoricCandle, 0, high-low), s.candles[low:high]...)
+}
+
+// index - Индекс первой свечи, время которой не раньше t
+func (s *CandleSeries) index(t time.Time) int {
+	return sort.Search(len(s.candles), func(i int) bool {
+		return !s.candles[i].GetTime().AsTime().Before(t)
+	})
+}
+
+// Update - Добавление свечи из стрима. Свеча с временем последней свечи заменяет ее, более новая свеча
+// завершает предыдущую, а если между ними есть пропуск, он догружается через api.
+func (s *CandleSeries) Update(candle *pb.Candle) error {
+	hc := &pb.HistoricCandle{
+		Open:   candle.GetOpen(),
+		High:   candle.GetHigh(),
+		Low:    candle.GetLow(),
+		Close:  candle.GetClose(),
+		Volume: candle.GetVolume(),
+		Time:   candle.GetTime(),
+		// при waitingClose = true стрим присылает только завершенные свечи
+		IsComplete: s.waitingClose,
+	}
+	t := hc.GetTime().AsTime()
+
+	s.mx.Lock()
+	var last time.Time
+	if len(s.candles) > 0 {
+		last = s.candles[len(s.candles)-1].GetTime().AsTime()
+	}
+	switch {
+	case len(s.candles) == 0 || t.After(last):
+		gap := len(s.candles) > 0 && t.Sub(last) > s.duration
+		s.mx.Unlock()
+		if gap {
+			// первая свеча после пропуска, догружаем недостающие свечи с последней известной
+			if _, err := s.backfill(last, t); err != nil {
+				return err
+			}
+		}
+		s.mx.Lock()
+		var completed *pb.HistoricCandle
+		if n := len(s.candles); n > 0 && s.candles[n-1].GetTime().AsTime().Equal(t) {
+			// свеча уже пришла вместе с пропуском
+			s.candles[n-1] = hc
+		} else {
+			completed = s.completeLast()
+			s.append(hc)
+		}
+		s.mx.Unlock()
+		s.notify(completed)
+		if hc.GetIsComplete() {
+			s.notify(hc)
+		}
+		return nil
+	case t.Equal(last):
+		// обновление текущей свечи
+		prev := s.candles[len(s.candles)-1]
+		s.candles[len(s.candles)-1] = hc
+		s.mx.Unlock()
+		if hc.GetIsComplete() && !prev.GetIsComplete() {
+			s.notify(hc)
+		}
+		return nil
+	default:
+		// запоздавшая свеча заменяет свечу с тем же временем, если она есть
+		if i := s.index(t); i < len(s.candles) && s.candles[i].GetTime().AsTime().Equal(t) {
+			s.candles[i] = hc
+		}
+		s.mx.Unlock()
+		return nil
+	}
+}
+
+// backfill - Загрузка свечей с from до to через api и слияние с рядом, возвращает кол-во загруженных свечей
+func (s *CandleSeries) backfill(from, to time.Time) (int, error) {
+	if !from.Before(to) {
+		return 0, nil
+	}
+	candles, err := s.mds.GetHistoricCandles(&GetHistoricCandlesRequest{
+		Instrument: s.instrumentId,
+		Interval:   s.interval,
+		From:       from,
+		To:         to,
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mx.Lock()
+	completed := make([]*pb.HistoricCandle, 0, len(candles))
+	for _, candle := range candles {
+		t := candle.GetTime().AsTime()
+		i := s.index(t)
+		switch {
+		case i < len(s.candles) && s.candles[i].GetTime().AsTime().Equal(t):
+			if candle.GetIsComplete() && !s.candles[i].GetIsComplete() {
+				completed = append(completed, candle)
+			}
+			s.candles[i] = candle
+		case i == len(s.candles):
+			s.append(candle)
+			if candle.GetIsComplete() {
+				completed = append(completed, candle)
+			}
+		}
+	}
+	s.mx.Unlock()
+	if len(candles) > 0 {
+		s.logger.Infof("%v %v candles backfilled from %v", s.instrumentId, len(candles), from)
+	}
+	for _, candle := range completed {
+		s.notify(candle)
+	}
+	return len(candles), nil
+}
+
+// completeLast - Завершение последней свечи ряда при появлении следующей, возвращает ее или nil,
+// если она уже была завершена
+func (s *CandleSeries) completeLast() *pb.HistoricCandle {
+	if len(s.candles) == 0 {
+		return nil
+	}
+	last := s.candles[len(s.candles)-1]
+	if last.GetIsComplete() {
+		return nil
+	}
+	last.IsComplete = true
+	return last
+}
+
+// append - Добавление свечи в конец ряда с учетом максимальной длины
+func (s *CandleSeries) append(candle *pb.HistoricCandle) {
+	s.candles = append(s.candles, candle)
+	if s.maxLen > 0 && len(s.candles) > s.maxLen {
+		s.candles = append(s.candles[:0], s.candles[len(s.candles)-s.maxLen:]...)
+	}
+}
+
+func (s *CandleSeries) notify(candle *pb.HistoricCandle) {
+	if candle != nil && s.onComplete != nil {
+		s.onComplete(candle)
+	}
+}
+
+// ListenCandleSeries - Передача свечей из канала SubscribeCandle в ряды, series - ряды по идентификатору
+// инструмента (uid или figi, который указан при подписке). Завершается при закрытии канала или отмене ctx.
+func ListenCandleSeries(ctx context.Context, candles <-chan *pb.Candle, series map[string]*CandleSeries, l Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case candle, ok := <-candles:
+			if !ok {
+				return
+			}
+			s, ok := series[candle.GetInstrumentUid()]
+			if !ok {
+				s, ok = series[candle.GetFigi()]
+			}
+			if !ok {
+				continue
+			}
+			if err := s.Update(candle); err != nil {
+				l.Errorf(err.Error())
+			}
+		}
+	}
+}
+
+// CandleIntervalDuration - Длительность свечи интервала interval, для недельных и месячных свечей 0
+func CandleIntervalDuration(interval pb.CandleInterval) time.Duration {
+	switch interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_1_MIN:
+		return time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_2_MIN:
+		return 2 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_3_MIN:
+		return 3 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_5_MIN:
+		return 5 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_10_MIN:
+		return 10 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_15_MIN:
+		return 15 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_30_MIN:
+		return 30 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_HOUR:
+		return time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_2_HOUR:
+		return 2 * time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_4_HOUR:
+		return 4 * time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		return DAY
+	}
+	return 0
+}
+
+// SubscriptionIntervalDuration - Длительность свечи интервала подписки interval, для неизвестного интервала 0
+func SubscriptionIntervalDuration(interval pb.SubscriptionInterval) time.Duration {
+	switch interval {
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE:
+		return time.Minute
+	case pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_FIVE_MINUTES:
+		return 5 * time.Minute
+	}
+	return 0
+}
+
+// SubscriptionIntervalByCandleInterval - Интервал подписки на свечи, соответствующий интервалу свечей,
+// если в стриме такого интервала нет, то SUBSCRIPTION_INTERVAL_UNSPECIFIED
+func SubscriptionIntervalByCandleInterval(interval pb.CandleInterval) pb.SubscriptionInterval {
+	switch interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_1_MIN:
+		return pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_ONE_MINUTE
+	case pb.CandleInterval_CANDLE_INTERVAL_5_MIN:
+		return pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_FIVE_MINUTES
+	}
+	return pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_UNSPECIFIED
+}
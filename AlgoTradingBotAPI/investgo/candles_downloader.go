@@ -0,0 +1,337 @@
+package investgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// CANDLES_REQUESTS_PER_MINUTE - Лимит запросов GetCandles в минуту по умолчанию
+	CANDLES_REQUESTS_PER_MINUTE = 299
+	// CANDLES_DOWNLOAD_WORKERS - Кол-во параллельных запросов при загрузке свечей по умолчанию
+	CANDLES_DOWNLOAD_WORKERS = 4
+)
+
+// CandlesSink - Приемник свечей для DownloadCandles. Свечи одного инструмента передаются в порядке возрастания
+// времени, вызовы WriteCandles никогда не выполняются параллельно.
+type CandlesSink interface {
+	WriteCandles(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error
+}
+
+// CandlesSinkFunc - Адаптер, позволяющий использовать обычную функцию как CandlesSink
+type CandlesSinkFunc func(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error
+
+// WriteCandles - Вызов f(instrumentId, interval, candles)
+func (f CandlesSinkFunc) WriteCandles(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error {
+	return f(instrumentId, interval, candles)
+}
+
+// CandlesCheckpoint - Хранилище прогресса загрузки свечей. Save вызывается после того, как все свечи
+// инструмента до времени t переданы в приемник, Load возвращает это время при повторном запуске загрузки.
+type CandlesCheckpoint interface {
+	Load(instrumentId string, interval pb.CandleInterval) (time.Time, bool, error)
+	Save(instrumentId string, interval pb.CandleInterval, t time.Time) error
+}
+
+// DownloadProgress - Прогресс загрузки свечей, передается в DownloadCandlesRequest.OnProgress
+type DownloadProgress struct {
+	// InstrumentId - Инструмент, по которому загружено очередное окно
+	InstrumentId string
+	// Interval - Интервал свечей
+	Interval pb.CandleInterval
+	// Done, Total - Кол-во загруженных и общее кол-во временных окон по инструменту
+	Done, Total int
+	// Candles - Кол-во свечей, переданных в приемник по инструменту
+	Candles int
+	// AllDone, AllTotal - Кол-во загруженных и общее кол-во временных окон по всем инструментам
+	AllDone, AllTotal int
+}
+
+// candlesWindow - Временное окно [from, to) для одного запроса GetCandles
+type candlesWindow struct {
+	id       string
+	index    int
+	from, to time.Time
+}
+
+// instrumentDownload - Состояние загрузки одного инструмента
+type instrumentDownload struct {
+	windows []candlesWindow
+	// next - индекс следующего окна, которое нужно передать в приемник
+	next int
+	// ready - загруженные окна, которые ждут передачи в приемник, пока не будут готовы все предыдущие
+	ready   map[int][]*pb.HistoricCandle
+	candles int
+}
+
+// DownloadCandles - Метод параллельной загрузки исторических свечей по нескольким инструментам.
+// Временной интервал каждого инструмента делится на окна допустимой для GetCandles длины, окна запрашиваются
+// параллельно в Workers потоков с ограничением RequestsPerMinute запросов в минуту. Свечи передаются в req.Sink
+// по мере загрузки в порядке возрастания времени, без дублей на границах окон. Если указан req.Checkpoint, после
+// каждого окна сохраняется прогресс, и повторный вызов продолжит загрузку с места остановки.
+func (md *MarketDataServiceClient) DownloadCandles(ctx context.Context, req *DownloadCandlesRequest) error {
+	if req.Sink == nil {
+		return errors.New("candles sink is nil")
+	}
+	if req.Interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		req.Interval = pb.CandleInterval_CANDLE_INTERVAL_HOUR
+	}
+	if req.Workers < 1 {
+		req.Workers = CANDLES_DOWNLOAD_WORKERS
+	}
+	if req.RequestsPerMinute < 1 {
+		req.RequestsPerMinute = CANDLES_REQUESTS_PER_MINUTE
+	}
+
+	duration := selectDuration(req.Interval)
+	downloads := make(map[string]*instrumentDownload, len(req.Instruments))
+	queue := make([]candlesWindow, 0)
+	for _, id := range req.Instruments {
+		from := req.From
+		if req.Checkpoint != nil {
+			t, ok, err := req.Checkpoint.Load(id, req.Interval)
+			if err != nil {
+				return err
+			}
+			if ok && t.After(from) {
+				from = t
+			}
+		}
+		bounds := splitInterval(from, req.To, duration)
+		windows := make([]candlesWindow, 0, len(bounds))
+		for i, b := range bounds {
+			windows = append(windows, candlesWindow{id: id, index: i, from: b[0], to: b[1]})
+		}
+		downloads[id] = &instrumentDownload{
+			windows: windows,
+			ready:   make(map[int][]*pb.HistoricCandle),
+		}
+		queue = append(queue, windows...)
+	}
+
+	ctxDownload, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var downloadErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			downloadErr = err
+			cancel()
+		})
+	}
+
+	// mx - защищает состояние загрузок, вызовы приемника, чекпоинта и колбека прогресса
+	var mx sync.Mutex
+	allDone := 0
+	complete := func(w candlesWindow, candles []*pb.HistoricCandle) error {
+		mx.Lock()
+		defer mx.Unlock()
+		d := downloads[w.id]
+		d.ready[w.index] = candles
+		for {
+			ready, ok := d.ready[d.next]
+			if !ok {
+				return nil
+			}
+			delete(d.ready, d.next)
+			if len(ready) > 0 {
+				if err := req.Sink.WriteCandles(w.id, req.Interval, ready); err != nil {
+					return err
+				}
+			}
+			if req.Checkpoint != nil {
+				if err := req.Checkpoint.Save(w.id, req.Interval, d.windows[d.next].to); err != nil {
+					return err
+				}
+			}
+			d.next++
+			d.candles += len(ready)
+			allDone++
+			if req.OnProgress != nil {
+				req.OnProgress(DownloadProgress{
+					InstrumentId: w.id,
+					Interval:     req.Interval,
+					Done:         d.next,
+					Total:        len(d.windows),
+					Candles:      d.candles,
+					AllDone:      allDone,
+					AllTotal:     len(queue),
+				})
+			}
+		}
+	}
+
+	limiter := newRateLimiter(req.RequestsPerMinute)
+	jobs := make(chan candlesWindow)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < req.Workers; i++ {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			for w := range jobs {
+				if err := limiter.wait(ctx); err != nil {
+					return
+				}
+				candles, err := md.windowCandles(w.id, req.Interval, w.from, w.to)
+				if err != nil {
+					fail(fmt.Errorf("%v candles from %v to %v: %w", w.id, w.from, w.to, err))
+					return
+				}
+				if err := complete(w, candles); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(ctxDownload)
+	}
+
+feed:
+	for _, w := range queue {
+		select {
+		case <-ctxDownload.Done():
+			break feed
+		case jobs <- w:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if downloadErr != nil {
+		return downloadErr
+	}
+	return ctx.Err()
+}
+
+// windowCandles - Запрос свечей за окно [from, to). Свечи вне окна отбрасываются, поэтому соседние окна
+// не пересекаются и не теряют свечи на границах.
+func (md *MarketDataServiceClient) windowCandles(id string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	resp, err := md.GetCandles(id, interval, from, to)
+	if err != nil {
+		if msg := MessageFromHeader(resp.GetHeader()); msg != "" {
+			md.logger.Errorf(msg)
+		}
+		return nil, err
+	}
+	candles := make([]*pb.HistoricCandle, 0, len(resp.GetCandles()))
+	for _, candle := range resp.GetCandles() {
+		t := candle.GetTime().AsTime()
+		if t.Before(from) || !t.Before(to) {
+			continue
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+// splitInterval - Разбиение интервала [from, to) на последовательные окна длиной не больше duration
+func splitInterval(from, to time.Time, duration time.Duration) [][2]time.Time {
+	windows := make([][2]time.Time, 0)
+	for low := from; low.Before(to); low = low.Add(duration) {
+		high := low.Add(duration)
+		if high.After(to) {
+			high = to
+		}
+		windows = append(windows, [2]time.Time{low, high})
+	}
+	return windows
+}
+
+// rateLimiter - Ограничитель частоты запросов, равномерно распределяет запросы внутри минуты
+type rateLimiter struct {
+	mx    sync.Mutex
+	every time.Duration
+	next  time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		every: time.Minute / time.Duration(perMinute),
+	}
+}
+
+// wait - Ожидание своей очереди на запрос, с возможностью отмены по контексту
+func (r *rateLimiter) wait(ctx context.Context) error {
+	r.mx.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	slot := r.next
+	r.next = r.next.Add(r.every)
+	r.mx.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// FileCheckpoint - Хранилище прогресса загрузки свечей в json файле
+type FileCheckpoint struct {
+	mx       sync.Mutex
+	path     string
+	progress map[string]int64
+}
+
+// NewFileCheckpoint - Создание чекпоинта в файле path, если файл уже существует, прогресс загружается из него
+func NewFileCheckpoint(path string) (*FileCheckpoint, error) {
+	fc := &FileCheckpoint{
+		path:     path,
+		progress: make(map[string]int64),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fc, nil
+	case err != nil:
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &fc.progress); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Load - Время, до которого свечи по инструменту уже загружены
+func (f *FileCheckpoint) Load(instrumentId string, interval pb.CandleInterval) (time.Time, bool, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	t, ok := f.progress[checkpointKey(instrumentId, interval)]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(t, 0), true, nil
+}
+
+// Save - Сохранение прогресса загрузки на диск
+func (f *FileCheckpoint) Save(instrumentId string, interval pb.CandleInterval, t time.Time) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.progress[checkpointKey(instrumentId, interval)] = t.Unix()
+	data, err := json.Marshal(f.progress)
+	if err != nil {
+		return err
+	}
+	// пишем во временный файл и переименовываем, чтобы прерывание не оставило поврежденный чекпоинт
+	tmp := f.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func checkpointKey(instrumentId string, interval pb.CandleInterval) string {
+	return fmt.Sprintf("%v:%v", instrumentId, interval.String())
+}
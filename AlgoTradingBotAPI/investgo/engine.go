@@ -0,0 +1,880 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Strategy - Торговая стратегия для Engine. Все колбеки вызываются движком последовательно из одной горутины,
+// поэтому стратегии не нужна синхронизация своего состояния. Ошибки колбеков логируются, работа продолжается.
+// Чтобы реализовать только нужные колбеки, встройте в стратегию BaseStrategy.
+type Strategy interface {
+	// Init - Вызывается один раз при запуске движка, стратегия сохраняет движок для выставления поручений
+	Init(e *Engine) error
+	// OnSessionStart - Начало торговой сессии, подписки уже оформлены
+	OnSessionStart() error
+	// OnCandle - Свеча из стрима
+	OnCandle(candle *pb.Candle) error
+	// OnOrderBook - Стакан из стрима
+	OnOrderBook(ob *pb.OrderBook) error
+	// OnTrade - Обезличенная сделка из стрима
+	OnTrade(trade *pb.Trade) error
+	// OnLastPrice - Последняя цена из стрима
+	OnLastPrice(lp *pb.LastPrice) error
+	// OnOrderUpdate - Исполнение поручения, позиции движка уже обновлены
+	OnOrderUpdate(trades *pb.OrderTrades) error
+	// OnSessionEnd - Конец торговой сессии, вызывается до закрытия позиций при SellOut
+	OnSessionEnd() error
+}
+
+// BaseStrategy - Пустая реализация Strategy
+type BaseStrategy struct{}
+
+func (BaseStrategy) Init(*Engine) error                  { return nil }
+func (BaseStrategy) OnSessionStart() error               { return nil }
+func (BaseStrategy) OnCandle(*pb.Candle) error           { return nil }
+func (BaseStrategy) OnOrderBook(*pb.OrderBook) error     { return nil }
+func (BaseStrategy) OnTrade(*pb.Trade) error             { return nil }
+func (BaseStrategy) OnLastPrice(*pb.LastPrice) error     { return nil }
+func (BaseStrategy) OnOrderUpdate(*pb.OrderTrades) error { return nil }
+func (BaseStrategy) OnSessionEnd() error                 { return nil }
+
+// OrderRouter - Исполнение торговых поручений, реализуется OrdersServiceClient
+type OrderRouter interface {
+	PostOrder(req *PostOrderRequest) (*PostOrderResponse, error)
+	CancelOrder(accountId, orderId string) (*CancelOrderResponse, error)
+}
+
+// StopOrderRouter - Исполнение стоп-заявок, реализуется StopOrdersServiceClient
+type StopOrderRouter interface {
+	PostStopOrder(req *PostStopOrderRequest) (*PostStopOrderResponse, error)
+	CancelStopOrder(accountId, stopOrderId string) (*CancelStopOrderResponse, error)
+}
+
+// PositionsSource - Позиции счета, реализуется OperationsServiceClient
+type PositionsSource interface {
+	GetPositions(accountId string) (*PositionsResponse, error)
+}
+
+// OrderTradesSource - Источник исполнений поручений, реализуется TradesStream
+type OrderTradesSource interface {
+	Trades() <-chan *pb.OrderTrades
+	Listen() error
+	Stop()
+}
+
+// EngineInstrument - Информация об инструменте стратегии
+type EngineInstrument struct {
+	Uid       string
+	Figi      string
+	Ticker    string
+	Lot       int64
+	Currency  string
+	PriceStep *pb.Quotation
+}
+
+// Position - Позиция по инструменту, которую ведет движок по исполнениям поручений
+type Position struct {
+	// Lots - Кол-во лотов, отрицательное для короткой позиции
+	Lots int64
+	// AvgPrice - Средняя цена открытия позиции за 1 инструмент
+	AvgPrice float64
+	// RealizedPnL - Зафиксированный результат по инструменту с запуска движка, без комиссий
+	RealizedPnL float64
+}
+
+// ActiveOrder - Выставленное движком поручение, которое еще не исполнено полностью
+type ActiveOrder struct {
+	OrderId       string
+	InstrumentUid string
+	Direction     pb.OrderDirection
+	Lots          int64
+	FilledLots    int64
+}
+
+// Engine - Движок исполнения стратегий: оформляет подписки, передает рыночные данные в колбеки стратегии,
+// выставляет поручения, ведет позиции и управляет жизненным циклом торговой сессии по расписанию биржи
+type Engine struct {
+	client   *Client
+	strategy Strategy
+	config   EngineConfig
+	logger   Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx          sync.RWMutex
+	instruments map[string]EngineInstrument
+	figiToUid   map[string]string
+	positions   map[string]Position
+	orders      map[string]ActiveOrder
+	// unmatched - Исполнения по биржевым id поручений, на которые еще не получен ответ PostOrder,
+	// inflight - кол-во таких поручений. Исполнения запоминаются, только пока inflight > 0
+	unmatched  map[string]int64
+	inflight   int
+	lastPrices map[string]float64
+	risk       *RiskManager
+}
+
+// NewEngine - Создание движка для стратегии s, информация об инструментах загружается сразу.
+// Клиент c может быть nil, если в конфигурации заданы Orders, Positions, Logger и InstrumentsInfo для всех инструментов.
+func NewEngine(ctx context.Context, c *Client, s Strategy, config EngineConfig) (*Engine, error) {
+	if c != nil {
+		config = engineDefaults(c, config)
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	if config.Orders == nil || config.Positions == nil || config.Logger == nil {
+		return nil, errors.New("client is required for engine without orders, positions or logger in config")
+	}
+	engineCtx, cancel := context.WithCancel(ctx)
+	e := &Engine{
+		client:      c,
+		strategy:    s,
+		config:      config,
+		logger:      config.Logger,
+		ctx:         engineCtx,
+		cancel:      cancel,
+		instruments: make(map[string]EngineInstrument, len(config.Instruments)),
+		figiToUid:   make(map[string]string, len(config.Instruments)),
+		positions:   make(map[string]Position),
+		orders:      make(map[string]ActiveOrder),
+		unmatched:   make(map[string]int64),
+		lastPrices:  make(map[string]float64),
+	}
+	for _, instrument := range config.InstrumentsInfo {
+		e.instruments[instrument.Uid] = instrument
+		e.figiToUid[instrument.Figi] = instrument.Uid
+	}
+	for _, id := range config.Instruments {
+		if _, ok := e.instruments[id]; ok {
+			continue
+		}
+		if c == nil {
+			cancel()
+			return nil, fmt.Errorf("instrument %v info not found", id)
+		}
+		resp, err := c.NewInstrumentsServiceClient().InstrumentByUid(id)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		instrument := resp.GetInstrument()
+		e.instruments[id] = EngineInstrument{
+			Uid:       instrument.GetUid(),
+			Figi:      instrument.GetFigi(),
+			Ticker:    instrument.GetTicker(),
+			Lot:       int64(instrument.GetLot()),
+			Currency:  instrument.GetCurrency(),
+			PriceStep: instrument.GetMinPriceIncrement(),
+		}
+		e.figiToUid[instrument.GetFigi()] = id
+	}
+	if config.Risk != nil {
+		risk := *config.Risk
+		if risk.Clock == nil {
+			risk.Clock = config.Clock
+		}
+		instruments := make([]EngineInstrument, 0, len(e.instruments))
+		for _, instrument := range e.instruments {
+			instruments = append(instruments, instrument)
+		}
+		e.risk = NewRiskManager(config.Orders, instruments, risk, config.Logger)
+		e.config.Orders = e.risk
+	}
+	return e, nil
+}
+
+// engineDefaults - Заполнение незаданных полей конфигурации сервисами клиента
+func engineDefaults(c *Client, config EngineConfig) EngineConfig {
+	if config.AccountId == "" {
+		config.AccountId = c.Config.AccountId
+	}
+	if config.Orders == nil {
+		config.Orders = c.NewOrdersServiceClient()
+	}
+	if config.StopOrders == nil {
+		config.StopOrders = c.NewStopOrdersServiceClient()
+	}
+	if config.Positions == nil {
+		config.Positions = c.NewOperationsServiceClient()
+	}
+	if config.MarketData == nil {
+		config.MarketData = func() (MarketDataSource, error) {
+			return c.NewMarketDataStreamClient().MarketDataStream()
+		}
+	}
+	if config.OrderTrades == nil {
+		config.OrderTrades = func() (OrderTradesSource, error) {
+			return c.NewOrdersStreamClient().TradesStream([]string{config.AccountId})
+		}
+	}
+	if config.Logger == nil {
+		config.Logger = c.Logger
+	}
+	return config
+}
+
+// Run - Запуск движка, блокируется до вызова Stop или отмены контекста. Если в конфигурации указана биржа,
+// торговые сессии запускаются и завершаются по ее расписанию, иначе сессия начинается сразу.
+func (e *Engine) Run() error {
+	if err := e.strategy.Init(e); err != nil {
+		return err
+	}
+	if e.config.Exchange == "" {
+		return e.session(e.ctx)
+	}
+	if e.client == nil {
+		return errors.New("client is required for trading by exchange schedule")
+	}
+
+	wg := &sync.WaitGroup{}
+	timer := NewTimer(e.client, e.config.Exchange, e.config.CancelAhead)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := timer.Start(e.ctx); err != nil {
+			e.logger.Errorf(err.Error())
+		}
+	}()
+
+	// stopSession закрывается для завершения сессии, sessionDone - после ее завершения
+	var stopSession chan struct{}
+	sessionDone := make(chan struct{})
+	close(sessionDone)
+	endSession := func() {
+		if stopSession != nil {
+			close(stopSession)
+			<-sessionDone
+			stopSession = nil
+		}
+	}
+	defer func() {
+		endSession()
+		// таймер завершается по контексту движка
+		e.cancel()
+		wg.Wait()
+	}()
+
+	events := timer.Events()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			switch ev {
+			case START:
+				select {
+				case <-sessionDone:
+				default:
+					// сессия еще идет
+					continue
+				}
+				endSession()
+				stopSession = make(chan struct{})
+				sessionDone = make(chan struct{})
+				go func(stop, done chan struct{}) {
+					defer close(done)
+					ctx, cancel := context.WithCancel(e.ctx)
+					defer cancel()
+					go func() {
+						select {
+						case <-stop:
+							cancel()
+						case <-ctx.Done():
+						}
+					}()
+					if err := e.session(ctx); err != nil {
+						e.logger.Errorf(err.Error())
+					}
+				}(stopSession, sessionDone)
+			case STOP:
+				endSession()
+			}
+		}
+	}
+}
+
+// Stop - Остановка движка, текущая сессия завершается с закрытием позиций, если SellOut = true
+func (e *Engine) Stop() {
+	e.cancel()
+}
+
+// session - Торговая сессия: подписки, передача данных стратегии до отмены ctx, завершение
+func (e *Engine) session(ctx context.Context) error {
+	if err := e.checkMoneyBalance(); err != nil {
+		return err
+	}
+	if err := e.loadPositions(); err != nil {
+		return err
+	}
+	if e.config.MarketData == nil || e.config.OrderTrades == nil {
+		return errors.New("market data and order trades sources are required for trading session")
+	}
+	md, err := e.config.MarketData()
+	if err != nil {
+		return err
+	}
+	var (
+		candles    <-chan *pb.Candle
+		orderBooks <-chan *pb.OrderBook
+		trades     <-chan *pb.Trade
+		lastPrices <-chan *pb.LastPrice
+	)
+	ids := e.config.Instruments
+	if e.config.CandleInterval != pb.SubscriptionInterval_SUBSCRIPTION_INTERVAL_UNSPECIFIED {
+		if candles, err = md.SubscribeCandle(ids, e.config.CandleInterval, e.config.WaitingClose); err != nil {
+			return err
+		}
+	}
+	if e.config.OrderBookDepth > 0 {
+		if orderBooks, err = md.SubscribeOrderBook(ids, e.config.OrderBookDepth); err != nil {
+			return err
+		}
+	}
+	if e.config.Trades {
+		if trades, err = md.SubscribeTrade(ids); err != nil {
+			return err
+		}
+	}
+	if e.config.LastPrices {
+		if lastPrices, err = md.SubscribeLastPrice(ids); err != nil {
+			return err
+		}
+	}
+	orderTrades, err := e.config.OrderTrades()
+	if err != nil {
+		return err
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := md.Listen(); err != nil {
+			e.logger.Errorf(err.Error())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := orderTrades.Listen(); err != nil {
+			e.logger.Errorf(err.Error())
+		}
+	}()
+
+	e.logger.Infof("trading session started")
+	e.callback("OnSessionStart", e.strategy.OnSessionStart())
+	err = e.dispatch(ctx, candles, orderBooks, trades, lastPrices, orderTrades.Trades())
+
+	// стримы работают на контексте клиента, завершать их нужно явно
+	md.Stop()
+	orderTrades.Stop()
+	wg.Wait()
+	e.callback("OnSessionEnd", e.strategy.OnSessionEnd())
+	if e.config.SellOut {
+		e.logger.Infof("start positions sell out...")
+		err = errors.Join(err, e.SellOut())
+	}
+	e.logger.Infof("trading session finished")
+	return err
+}
+
+// dispatch - Передача данных стримов в колбеки стратегии до отмены ctx или закрытия одного из стримов
+func (e *Engine) dispatch(ctx context.Context, candles <-chan *pb.Candle, orderBooks <-chan *pb.OrderBook,
+	trades <-chan *pb.Trade, lastPrices <-chan *pb.LastPrice, orderTrades <-chan *pb.OrderTrades) error {
+	closed := errors.New("stream is closed")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case c, ok := <-candles:
+			if !ok {
+				return closed
+			}
+			e.handle(c)
+		case ob, ok := <-orderBooks:
+			if !ok {
+				return closed
+			}
+			e.handle(ob)
+		case t, ok := <-trades:
+			if !ok {
+				return closed
+			}
+			e.handle(t)
+		case lp, ok := <-lastPrices:
+			if !ok {
+				return closed
+			}
+			e.handle(lp)
+		case ot, ok := <-orderTrades:
+			if !ok {
+				return closed
+			}
+			e.handle(ot)
+		}
+	}
+}
+
+// handle - Передача одного сообщения в колбек стратегии
+func (e *Engine) handle(msg any) error {
+	if e.risk != nil {
+		e.risk.Handle(msg)
+	}
+	switch m := msg.(type) {
+	case *pb.Candle:
+		e.setLastPrice(m.GetInstrumentUid(), m.GetClose().ToFloat())
+		e.callback("OnCandle", e.strategy.OnCandle(m))
+	case *pb.OrderBook:
+		e.callback("OnOrderBook", e.strategy.OnOrderBook(m))
+	case *pb.Trade:
+		e.setLastPrice(m.GetInstrumentUid(), m.GetPrice().ToFloat())
+		e.callback("OnTrade", e.strategy.OnTrade(m))
+	case *pb.LastPrice:
+		e.setLastPrice(m.GetInstrumentUid(), m.GetPrice().ToFloat())
+		e.callback("OnLastPrice", e.strategy.OnLastPrice(m))
+	case *pb.OrderTrades:
+		e.applyOrderTrades(m)
+		e.callback("OnOrderUpdate", e.strategy.OnOrderUpdate(m))
+	default:
+		return fmt.Errorf("unsupported message type %T", msg)
+	}
+	return nil
+}
+
+// Begin - Начало сессии без стримов: инициализация стратегии, загрузка позиций и OnSessionStart.
+// Вместе с Handle и End заменяет Run, когда сообщения передает вызывающий код, например при тестировании на истории.
+func (e *Engine) Begin() error {
+	if err := e.strategy.Init(e); err != nil {
+		return err
+	}
+	if err := e.loadPositions(); err != nil {
+		return err
+	}
+	e.callback("OnSessionStart", e.strategy.OnSessionStart())
+	return nil
+}
+
+// Handle - Синхронная передача сообщения стратегии: *pb.Candle, *pb.OrderBook, *pb.Trade, *pb.LastPrice
+// или *pb.OrderTrades. Возвращает управление после завершения колбека.
+func (e *Engine) Handle(msg any) error {
+	return e.handle(msg)
+}
+
+// End - Завершение сессии, начатой Begin: OnSessionEnd и закрытие позиций, если SellOut = true
+func (e *Engine) End() error {
+	e.callback("OnSessionEnd", e.strategy.OnSessionEnd())
+	if e.config.SellOut {
+		return e.SellOut()
+	}
+	return nil
+}
+
+func (e *Engine) callback(name string, err error) {
+	if err != nil {
+		e.logger.Errorf("strategy %v: %v", name, err.Error())
+	}
+}
+
+// Risk - Риск-менеджер движка, nil если в конфигурации не заданы лимиты
+func (e *Engine) Risk() *RiskManager {
+	return e.risk
+}
+
+// Logger - Логгер движка
+func (e *Engine) Logger() Logger {
+	return e.logger
+}
+
+// AccountId - Счет, на котором торгует движок
+func (e *Engine) AccountId() string {
+	return e.config.AccountId
+}
+
+// Context - Контекст движка, отменяется при остановке
+func (e *Engine) Context() context.Context {
+	return e.ctx
+}
+
+// Now - Текущее время движка, при тестировании на истории - время последнего события
+func (e *Engine) Now() time.Time {
+	return e.config.Clock()
+}
+
+// Instrument - Информация об инструменте стратегии по uid
+func (e *Engine) Instrument(id string) (EngineInstrument, bool) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	i, ok := e.instruments[id]
+	return i, ok
+}
+
+// Position - Позиция по инструменту
+func (e *Engine) Position(id string) Position {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	return e.positions[id]
+}
+
+// Positions - Копия всех ненулевых позиций
+func (e *Engine) Positions() map[string]Position {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	positions := make(map[string]Position, len(e.positions))
+	for id, p := range e.positions {
+		if p.Lots != 0 {
+			positions[id] = p
+		}
+	}
+	return positions
+}
+
+// ActiveOrders - Поручения движка, которые еще не исполнены полностью
+func (e *Engine) ActiveOrders() []ActiveOrder {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	orders := make([]ActiveOrder, 0, len(e.orders))
+	for _, o := range e.orders {
+		orders = append(orders, o)
+	}
+	return orders
+}
+
+// LastPrice - Последняя известная цена инструмента из свечей, сделок или последних цен
+func (e *Engine) LastPrice(id string) (float64, bool) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	p, ok := e.lastPrices[id]
+	return p, ok
+}
+
+func (e *Engine) setLastPrice(id string, price float64) {
+	e.mx.Lock()
+	e.lastPrices[id] = price
+	e.mx.Unlock()
+}
+
+// Buy - Поручение на покупку lots лотов, если price = nil - рыночное, иначе лимитное
+func (e *Engine) Buy(id string, lots int64, price *pb.Quotation) (*PostOrderResponse, error) {
+	return e.post(id, lots, price, pb.OrderDirection_ORDER_DIRECTION_BUY)
+}
+
+// Sell - Поручение на продажу lots лотов, если price = nil - рыночное, иначе лимитное
+func (e *Engine) Sell(id string, lots int64, price *pb.Quotation) (*PostOrderResponse, error) {
+	return e.post(id, lots, price, pb.OrderDirection_ORDER_DIRECTION_SELL)
+}
+
+func (e *Engine) post(id string, lots int64, price *pb.Quotation, direction pb.OrderDirection) (*PostOrderResponse, error) {
+	if lots <= 0 {
+		return nil, fmt.Errorf("invalid order quantity %v", lots)
+	}
+	orderType := pb.OrderType_ORDER_TYPE_MARKET
+	if price != nil {
+		orderType = pb.OrderType_ORDER_TYPE_LIMIT
+	}
+	orderId := CreateUid()
+	// поручение регистрируем до отправки, исполнение может прийти раньше ответа
+	e.mx.Lock()
+	e.orders[orderId] = ActiveOrder{
+		OrderId:       orderId,
+		InstrumentUid: id,
+		Direction:     direction,
+		Lots:          lots,
+	}
+	e.inflight++
+	e.mx.Unlock()
+	resp, err := e.config.Orders.PostOrder(&PostOrderRequest{
+		InstrumentId: id,
+		Quantity:     lots,
+		Price:        price,
+		Direction:    direction,
+		AccountId:    e.config.AccountId,
+		OrderType:    orderType,
+		OrderId:      orderId,
+	})
+	e.mx.Lock()
+	e.inflight--
+	if err == nil {
+		e.rekey(orderId, resp.GetOrderId())
+	} else {
+		delete(e.orders, orderId)
+	}
+	if e.inflight == 0 {
+		e.unmatched = make(map[string]int64)
+	}
+	e.mx.Unlock()
+	if err != nil {
+		e.logger.Errorf("post order %v: %v", id, MessageFromHeader(resp.GetHeader()))
+		return resp, err
+	}
+	e.logger.Infof("%v %v %v lots, status %v", direction, e.ticker(id), lots, resp.GetExecutionReportStatus())
+	return resp, nil
+}
+
+// rekey - Перенос поручения с ключа клиента на биржевой id с учетом исполнений, пришедших до ответа.
+// Отмена поручения и его исполнения приходят с биржевым id
+func (e *Engine) rekey(orderId, exchangeId string) {
+	o, ok := e.orders[orderId]
+	if !ok || exchangeId == "" || exchangeId == orderId {
+		return
+	}
+	delete(e.orders, orderId)
+	o.OrderId = exchangeId
+	o.FilledLots += e.unmatched[exchangeId]
+	delete(e.unmatched, exchangeId)
+	if o.FilledLots < o.Lots {
+		e.orders[exchangeId] = o
+	}
+}
+
+// Cancel - Отмена поручения по биржевому id из ответа на Buy или Sell
+func (e *Engine) Cancel(orderId string) error {
+	_, err := e.config.Orders.CancelOrder(e.config.AccountId, orderId)
+	if err != nil {
+		return err
+	}
+	e.mx.Lock()
+	delete(e.orders, orderId)
+	e.mx.Unlock()
+	return nil
+}
+
+// StopOrder - Стоп-заявка до отмены на lots лотов. При достижении ценой stopPrice для STOP_LOSS и TAKE_PROFIT
+// выставляется рыночное поручение, для STOP_LIMIT - лимитное по цене price
+func (e *Engine) StopOrder(id string, lots int64, direction pb.StopOrderDirection, orderType pb.StopOrderType,
+	stopPrice, price *pb.Quotation) (string, error) {
+	if e.config.StopOrders == nil {
+		return "", errors.New("stop orders are not supported")
+	}
+	if lots <= 0 {
+		return "", fmt.Errorf("invalid stop order quantity %v", lots)
+	}
+	if price == nil {
+		price = stopPrice
+	}
+	resp, err := e.config.StopOrders.PostStopOrder(&PostStopOrderRequest{
+		InstrumentId:   id,
+		Quantity:       lots,
+		Price:          price,
+		StopPrice:      stopPrice,
+		Direction:      direction,
+		AccountId:      e.config.AccountId,
+		ExpirationType: pb.StopOrderExpirationType_STOP_ORDER_EXPIRATION_TYPE_GOOD_TILL_CANCEL,
+		StopOrderType:  orderType,
+	})
+	if err != nil {
+		e.logger.Errorf("post stop order %v: %v", id, MessageFromHeader(resp.GetHeader()))
+		return "", err
+	}
+	e.logger.Infof("%v %v %v %v lots, stop price %v", orderType, direction, e.ticker(id), lots, stopPrice.ToFloat())
+	return resp.GetStopOrderId(), nil
+}
+
+// CancelStopOrder - Отмена стоп-заявки
+func (e *Engine) CancelStopOrder(stopOrderId string) error {
+	if e.config.StopOrders == nil {
+		return errors.New("stop orders are not supported")
+	}
+	_, err := e.config.StopOrders.CancelStopOrder(e.config.AccountId, stopOrderId)
+	return err
+}
+
+// CancelAll - Отмена всех активных поручений движка
+func (e *Engine) CancelAll() error {
+	var err error
+	for _, o := range e.ActiveOrders() {
+		err = errors.Join(err, e.Cancel(o.OrderId))
+	}
+	return err
+}
+
+// SellOut - Отмена активных поручений и закрытие позиций по инструментам стратегии рыночными поручениями
+func (e *Engine) SellOut() error {
+	err := e.CancelAll()
+	for id, p := range e.Positions() {
+		if _, ok := e.Instrument(id); !ok {
+			// если бот не открывал эту позицию, он не будет ее закрывать
+			continue
+		}
+		switch {
+		case p.Lots > 0:
+			_, sellErr := e.Sell(id, p.Lots, nil)
+			err = errors.Join(err, sellErr)
+		case p.Lots < 0:
+			_, buyErr := e.Buy(id, -p.Lots, nil)
+			err = errors.Join(err, buyErr)
+		}
+	}
+	return err
+}
+
+// applyOrderTrades - Обновление позиций и активных поручений по исполнению
+func (e *Engine) applyOrderTrades(ot *pb.OrderTrades) {
+	id := ot.GetInstrumentUid()
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if id == "" {
+		id = e.figiToUid[ot.GetFigi()]
+	}
+	lot := e.instruments[id].Lot
+	if lot <= 0 {
+		lot = 1
+	}
+	sign := int64(1)
+	if ot.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		sign = -1
+	}
+	var filled int64
+	p := e.positions[id]
+	for _, t := range ot.GetTrades() {
+		lots := t.GetQuantity() / lot
+		filled += lots
+		p = p.apply(sign*lots, t.GetPrice().ToFloat(), lot)
+	}
+	e.positions[id] = p
+	if o, ok := e.orders[ot.GetOrderId()]; ok {
+		o.FilledLots += filled
+		if o.FilledLots >= o.Lots {
+			delete(e.orders, o.OrderId)
+		} else {
+			e.orders[o.OrderId] = o
+		}
+	} else if e.inflight > 0 {
+		// ответ на PostOrder еще не получен
+		e.unmatched[ot.GetOrderId()] += filled
+	}
+}
+
+// apply - Изменение позиции на lots лотов по цене price, при сокращении позиции фиксируется результат
+func (p Position) apply(lots int64, price float64, lot int64) Position {
+	switch {
+	case p.Lots == 0 || (p.Lots > 0) == (lots > 0):
+		// открытие или увеличение позиции
+		total := p.Lots + lots
+		p.AvgPrice = (p.AvgPrice*math.Abs(float64(p.Lots)) + price*math.Abs(float64(lots))) / math.Abs(float64(total))
+		p.Lots = total
+	default:
+		// сокращение, закрытие или разворот позиции
+		closed := lots
+		if abs(lots) > abs(p.Lots) {
+			closed = -p.Lots
+		}
+		direction := float64(1)
+		if p.Lots < 0 {
+			direction = -1
+		}
+		p.RealizedPnL += direction * (price - p.AvgPrice) * float64(abs(closed)*lot)
+		p.Lots += lots
+		if p.Lots == 0 {
+			p.AvgPrice = 0
+		} else if abs(lots) > abs(closed) {
+			p.AvgPrice = price
+		}
+	}
+	return p
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// loadPositions - Загрузка позиций по инструментам стратегии со счета. Если кол-во лотов отличается от известного
+// движку, например позиция изменилась вне движка, средней ценой считается последняя цена. Позиции по инструментам,
+// которых нет в ответе, считаются закрытыми
+func (e *Engine) loadPositions() error {
+	resp, err := e.config.Positions.GetPositions(e.config.AccountId)
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]int64)
+	for _, s := range resp.GetSecurities() {
+		balances[s.GetInstrumentUid()] += s.GetBalance()
+	}
+	for _, f := range resp.GetFutures() {
+		balances[f.GetInstrumentUid()] += f.GetBalance()
+	}
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for uid, instrument := range e.instruments {
+		if instrument.Lot == 0 {
+			continue
+		}
+		p, known := e.positions[uid]
+		balance, reported := balances[uid]
+		if !known && !reported {
+			continue
+		}
+		if lots := balance / instrument.Lot; lots != p.Lots {
+			p.Lots = lots
+			p.AvgPrice = 0
+			if lots != 0 {
+				p.AvgPrice = e.lastPrices[uid]
+			}
+		}
+		e.positions[uid] = p
+		if e.risk != nil {
+			e.risk.SetPosition(uid, p.Lots, p.AvgPrice)
+		}
+	}
+	return nil
+}
+
+// checkMoneyBalance - Проверка доступного баланса денежных средств, в песочнице недостающая сумма пополняется
+func (e *Engine) checkMoneyBalance() error {
+	if e.config.RequiredMoneyBalance <= 0 {
+		return nil
+	}
+	resp, err := e.config.Positions.GetPositions(e.config.AccountId)
+	if err != nil {
+		return err
+	}
+	var balance float64
+	for _, m := range resp.GetMoney() {
+		if strings.EqualFold(m.GetCurrency(), e.config.Currency) {
+			balance = m.ToFloat()
+		}
+	}
+	e.logger.Infof("money balance = %v %v", balance, e.config.Currency)
+	diff := e.config.RequiredMoneyBalance - balance
+	if diff <= 0 {
+		return nil
+	}
+	if e.client == nil || !strings.HasPrefix(e.client.Config.EndPoint, "sandbox") {
+		return errors.New("not enough money on balance")
+	}
+	units, nano := math.Modf(diff)
+	payIn, err := e.client.NewSandboxServiceClient().SandboxPayIn(&SandboxPayInRequest{
+		AccountId: e.config.AccountId,
+		Currency:  e.config.Currency,
+		Unit:      int64(units),
+		Nano:      int32(nano * float64(BILLION)),
+	})
+	if err != nil {
+		return err
+	}
+	e.logger.Infof("sandbox auto pay in, balance = %v", payIn.GetBalance().ToFloat())
+	return nil
+}
+
+func (e *Engine) ticker(id string) string {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	if i, ok := e.instruments[id]; ok {
+		return i.Ticker
+	}
+	return id
+}
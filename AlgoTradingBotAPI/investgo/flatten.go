@@ -0,0 +1,327 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// FlattenConfig - Конфигурация закрытия позиций
+type FlattenConfig struct {
+	// AccountId - Счет, по умолчанию AccountId из конфигурации клиента
+	AccountId string
+	// Instruments - uid инструментов, позиции по которым нужно закрыть. Пусто - все позиции счета
+	Instruments []string
+	// Timeout - Время, в течение которого повторяются попытки закрыть позиции, по умолчанию 1 минута
+	Timeout time.Duration
+	// RetryInterval - Пауза между попытками, по умолчанию 2 секунды
+	RetryInterval time.Duration
+}
+
+// Flattener - Закрытие длинных и коротких позиций по бумагам, фьючерсам и опционам рыночными поручениями.
+// Закрывается только незаблокированный остаток в целых лотах, попытки повторяются, пока позиции не закроются
+// или не истечет Timeout
+type Flattener struct {
+	config FlattenConfig
+	logger Logger
+
+	ordersService      *OrdersServiceClient
+	operationsService  *OperationsServiceClient
+	instrumentsService *InstrumentsServiceClient
+
+	// lots - Лотность инструментов по uid
+	lots map[string]int64
+}
+
+// NewFlattener - Создание закрытия позиций для счета из конфигурации
+func NewFlattener(c *Client, config FlattenConfig) *Flattener {
+	if config.AccountId == "" {
+		config.AccountId = c.Config.AccountId
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Minute
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 2 * time.Second
+	}
+	return &Flattener{
+		config:             config,
+		logger:             c.Logger,
+		ordersService:      c.NewOrdersServiceClient(),
+		operationsService:  c.NewOperationsServiceClient(),
+		instrumentsService: c.NewInstrumentsServiceClient(),
+		lots:               make(map[string]int64),
+	}
+}
+
+// ClosedPosition - Результат закрытия позиции по инструменту
+type ClosedPosition struct {
+	InstrumentUid  string `json:"instrument_uid"`
+	Figi           string `json:"figi,omitempty"`
+	InstrumentType string `json:"instrument_type"`
+	// Lots - Позиция в лотах до закрытия, отрицательная для короткой позиции
+	Lots int64 `json:"lots"`
+	// ClosedLots - Исполнено лотов закрывающими поручениями, знак как у Lots
+	ClosedLots int64 `json:"closed_lots"`
+	// ExecutedPrice - Средняя цена исполнения за 1 инструмент
+	ExecutedPrice float64  `json:"executed_price,omitempty"`
+	Orders        []string `json:"orders,omitempty"`
+	// Error - Последняя ошибка по инструменту или причина, по которой позиция не закрыта
+	Error string `json:"error,omitempty"`
+}
+
+// Flat - Позиция закрыта полностью
+func (p ClosedPosition) Flat() bool {
+	return p.ClosedLots == p.Lots && p.Error == ""
+}
+
+// record - Учет исполнения закрывающего поручения
+func (p *ClosedPosition) record(state *pb.OrderState) {
+	lots := state.GetLotsExecuted()
+	if lots == 0 {
+		return
+	}
+	if p.Lots < 0 {
+		lots = -lots
+	}
+	price := state.GetAveragePositionPrice().ToFloat()
+	total := p.ClosedLots + lots
+	p.ExecutedPrice = (p.ExecutedPrice*float64(abs(p.ClosedLots)) + price*float64(abs(lots))) / float64(abs(total))
+	p.ClosedLots = total
+}
+
+// accountPosition - Позиция счета по инструменту любого типа
+type accountPosition struct {
+	uid            string
+	figi           string
+	instrumentType string
+	balance        int64
+	blocked        int64
+}
+
+// closeOrder - Закрывающее поручение, отправленное на предыдущей попытке
+type closeOrder struct {
+	orderId string
+	// total - Позиция в инструментах вместе с заблокированными до отправки поручения
+	total int64
+	// final - Поручение исполнено или отклонено, executed - по нему были исполнения
+	final    bool
+	executed bool
+}
+
+// Flatten - Закрытие позиций. Возвращает результаты по каждому инструменту с ненулевой позицией и ошибку,
+// если к концу Timeout остались незакрытые позиции
+func (f *Flattener) Flatten(ctx context.Context) ([]ClosedPosition, error) {
+	accountId := f.config.AccountId
+	deadline := time.Now().Add(f.config.Timeout)
+	filter := make(map[string]struct{}, len(f.config.Instruments))
+	for _, id := range f.config.Instruments {
+		filter[id] = struct{}{}
+	}
+	results := make(map[string]*ClosedPosition)
+	order := make([]string, 0)
+	result := func(p accountPosition, lot int64) *ClosedPosition {
+		if r, ok := results[p.uid]; ok {
+			return r
+		}
+		r := &ClosedPosition{
+			InstrumentUid:  p.uid,
+			Figi:           p.figi,
+			InstrumentType: p.instrumentType,
+			Lots:           (p.balance + p.blocked) / lot,
+		}
+		results[p.uid] = r
+		order = append(order, p.uid)
+		return r
+	}
+	pending := make(map[string]*closeOrder)
+
+	for attempt := 1; ; attempt++ {
+		var lastErr error
+		remaining := 0
+		// сначала проверяем поручения прошлой попытки, пока они активны, по инструменту ничего не выставляется
+		for uid, o := range pending {
+			if o.final {
+				continue
+			}
+			resp, err := f.ordersService.GetOrderState(accountId, o.orderId)
+			if err != nil {
+				lastErr = fmt.Errorf("order %v state: %w", o.orderId, err)
+				continue
+			}
+			switch resp.GetExecutionReportStatus() {
+			case pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW,
+				pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL:
+				continue
+			}
+			results[uid].record(resp.OrderState)
+			o.final, o.executed = true, resp.GetLotsExecuted() > 0
+		}
+
+		positions, err := f.positions(accountId)
+		if err != nil {
+			lastErr = err
+		}
+		seen := make(map[string]struct{}, len(positions))
+		for _, p := range positions {
+			seen[p.uid] = struct{}{}
+			if _, ok := filter[p.uid]; len(filter) > 0 && !ok {
+				continue
+			}
+			if o, ok := pending[p.uid]; ok {
+				// позиция по исполненному поручению может обновиться не сразу, повторное поручение в этот момент
+				// открыло бы позицию в обратную сторону
+				if !o.final || (o.executed && p.balance+p.blocked == o.total) {
+					remaining++
+					continue
+				}
+				delete(pending, p.uid)
+			}
+			if p.balance == 0 && p.blocked == 0 {
+				continue
+			}
+			lot, err := f.lot(p.uid)
+			if err != nil {
+				lastErr = fmt.Errorf("%v %v instrument info: %w", p.instrumentType, p.uid, err)
+				remaining++
+				continue
+			}
+			r := result(p, lot)
+			if p.blocked != 0 {
+				// заблокированный остаток освободится после отмены или исполнения поручений
+				r.Error = fmt.Sprintf("%v blocked by active orders", p.blocked)
+				remaining++
+			}
+			lots := p.balance / lot
+			if lots == 0 {
+				if rest := p.balance % lot; rest != 0 && p.blocked == 0 {
+					r.Error = fmt.Sprintf("%v instruments less than a lot can not be closed on exchange", rest)
+				}
+				continue
+			}
+			remaining++
+			orderId, err := f.post(accountId, p.uid, lots)
+			if err != nil {
+				r.Error = err.Error()
+				lastErr = fmt.Errorf("close %v %v %v lots: %w", p.instrumentType, p.uid, lots, err)
+				continue
+			}
+			r.Error = ""
+			r.Orders = append(r.Orders, orderId)
+			pending[p.uid] = &closeOrder{orderId: orderId, total: p.balance + p.blocked}
+			f.logger.Infof("flatten attempt %v: close %v %v %v lots, order %v", attempt, p.instrumentType, p.uid,
+				lots, orderId)
+		}
+		// позиция, которой больше нет в ответе, закрыта
+		for uid, o := range pending {
+			if _, ok := seen[uid]; ok || err != nil {
+				continue
+			}
+			if o.final {
+				delete(pending, uid)
+			} else {
+				remaining++
+			}
+		}
+
+		if remaining == 0 && lastErr == nil {
+			break
+		}
+		if lastErr != nil {
+			f.logger.Errorf("flatten attempt %v: %v", attempt, lastErr.Error())
+		}
+		if time.Now().Add(f.config.RetryInterval).After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			closed, err := f.collect(results, order)
+			return closed, errors.Join(ctx.Err(), err)
+		case <-time.After(f.config.RetryInterval):
+		}
+	}
+	return f.collect(results, order)
+}
+
+// collect - Результаты в порядке появления инструментов и ошибка по незакрытым позициям
+func (f *Flattener) collect(results map[string]*ClosedPosition, order []string) ([]ClosedPosition, error) {
+	closed := make([]ClosedPosition, 0, len(order))
+	var errs []error
+	for _, uid := range order {
+		r := *results[uid]
+		if r.ClosedLots != r.Lots && r.Error == "" {
+			r.Error = fmt.Sprintf("%v of %v lots closed", r.ClosedLots, r.Lots)
+		}
+		if r.Error != "" {
+			errs = append(errs, fmt.Errorf("%v %v: %v", r.InstrumentType, r.InstrumentUid, r.Error))
+		}
+		closed = append(closed, r)
+	}
+	return closed, errors.Join(errs...)
+}
+
+// positions - Позиции счета по бумагам, кроме валют, фьючерсам и опционам
+func (f *Flattener) positions(accountId string) ([]accountPosition, error) {
+	resp, err := f.operationsService.GetPositions(accountId)
+	if err != nil {
+		return nil, fmt.Errorf("get positions: %w, %v", err, MessageFromHeader(resp.GetHeader()))
+	}
+	positions := make([]accountPosition, 0, len(resp.GetSecurities())+len(resp.GetFutures())+len(resp.GetOptions()))
+	for _, s := range resp.GetSecurities() {
+		// валюта - это денежная позиция, ее не нужно закрывать
+		if s.GetInstrumentType() == "currency" {
+			continue
+		}
+		positions = append(positions, accountPosition{uid: s.GetInstrumentUid(), figi: s.GetFigi(),
+			instrumentType: s.GetInstrumentType(), balance: s.GetBalance(), blocked: s.GetBlocked()})
+	}
+	for _, p := range resp.GetFutures() {
+		positions = append(positions, accountPosition{uid: p.GetInstrumentUid(), figi: p.GetFigi(),
+			instrumentType: "futures", balance: p.GetBalance(), blocked: p.GetBlocked()})
+	}
+	for _, p := range resp.GetOptions() {
+		positions = append(positions, accountPosition{uid: p.GetInstrumentUid(), instrumentType: "option",
+			balance: p.GetBalance(), blocked: p.GetBlocked()})
+	}
+	return positions, nil
+}
+
+// post - Рыночное поручение на закрытие lots лотов, для короткой позиции lots < 0
+func (f *Flattener) post(accountId, uid string, lots int64) (string, error) {
+	direction, quantity := pb.OrderDirection_ORDER_DIRECTION_SELL, lots
+	if lots < 0 {
+		direction, quantity = pb.OrderDirection_ORDER_DIRECTION_BUY, -lots
+	}
+	resp, err := f.ordersService.PostOrder(&PostOrderRequest{
+		InstrumentId: uid,
+		Quantity:     quantity,
+		Direction:    direction,
+		AccountId:    accountId,
+		OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+		OrderId:      CreateUid(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w, %v", err, MessageFromHeader(resp.GetHeader()))
+	}
+	return resp.GetOrderId(), nil
+}
+
+// lot - Лотность инструмента, запрашивается один раз
+func (f *Flattener) lot(uid string) (int64, error) {
+	if lot, ok := f.lots[uid]; ok {
+		return lot, nil
+	}
+	resp, err := f.instrumentsService.InstrumentByUid(uid)
+	if err != nil {
+		return 0, err
+	}
+	lot := int64(resp.GetInstrument().GetLot())
+	if lot <= 0 {
+		lot = 1
+	}
+	f.lots[uid] = lot
+	return lot, nil
+}
@@ -0,0 +1,235 @@
+package indicators
+
+// SMA - Простая скользящая средняя цены закрытия
+type SMA struct {
+	bars
+	window window
+	value  float64
+}
+
+// NewSMA - Создание SMA с периодом period
+func NewSMA(period int) *SMA {
+	return &SMA{window: newWindow(validPeriod(period))}
+}
+
+// Update - Обновление баром
+func (s *SMA) Update(bar Bar) {
+	prev, commit, ok := s.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		s.window.commit(prev.Close)
+	}
+	s.value = s.window.mean(bar.Close)
+}
+
+// Ready - true, если баров не меньше периода
+func (s *SMA) Ready() bool {
+	return s.has && s.window.ready()
+}
+
+// Value - Значение SMA
+func (s *SMA) Value() float64 {
+	return s.value
+}
+
+// EMA - Экспоненциальная скользящая средняя цены закрытия, начальное значение - SMA за первые period баров
+type EMA struct {
+	bars
+	ema   smoother
+	value float64
+}
+
+// NewEMA - Создание EMA с периодом period
+func NewEMA(period int) *EMA {
+	return &EMA{ema: newEMA(validPeriod(period))}
+}
+
+// Update - Обновление баром
+func (e *EMA) Update(bar Bar) {
+	prev, commit, ok := e.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		e.ema.commit(prev.Close)
+	}
+	e.value = e.ema.peek(bar.Close)
+}
+
+// Ready - true, если баров не меньше периода
+func (e *EMA) Ready() bool {
+	return e.has && e.ema.ready()
+}
+
+// Value - Значение EMA
+func (e *EMA) Value() float64 {
+	return e.value
+}
+
+// WMA - Линейно взвешенная скользящая средняя цены закрытия, последний бар имеет вес period
+type WMA struct {
+	bars
+	ring ring
+	// sum - Сумма завершенных значений окна, weighted - сумма значений с весами 1..k
+	sum      float64
+	weighted float64
+	value    float64
+}
+
+// NewWMA - Создание WMA с периодом period
+func NewWMA(period int) *WMA {
+	period = validPeriod(period)
+	return &WMA{ring: newRing(period - 1)}
+}
+
+// Update - Обновление баром
+func (w *WMA) Update(bar Bar) {
+	prev, commit, ok := w.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		w.commit(prev.Close)
+	}
+	k := float64(w.ring.size + 1)
+	w.value = (w.weighted + k*bar.Close) / (k * (k + 1) / 2)
+}
+
+func (w *WMA) commit(x float64) {
+	if w.ring.full() {
+		// веса всех значений уменьшаются на 1, самое старое значение выходит из окна
+		old, _ := w.ring.push(x)
+		w.weighted += float64(w.ring.size)*x - w.sum
+		w.sum += x - old
+		return
+	}
+	w.ring.push(x)
+	w.weighted += float64(w.ring.size) * x
+	w.sum += x
+}
+
+// Ready - true, если баров не меньше периода
+func (w *WMA) Ready() bool {
+	return w.has && w.ring.full()
+}
+
+// Value - Значение WMA
+func (w *WMA) Value() float64 {
+	return w.value
+}
+
+// MACD - Схождение/расхождение скользящих средних: разница быстрой и медленной EMA, сигнальная линия - EMA от MACD
+type MACD struct {
+	bars
+	fast, slow, signal  smoother
+	macd, signalValue   float64
+	macdReady, sigReady bool
+}
+
+// NewMACD - Создание MACD, стандартные параметры 12, 26, 9
+func NewMACD(fast, slow, signal int) *MACD {
+	return &MACD{
+		fast:   newEMA(validPeriod(fast)),
+		slow:   newEMA(validPeriod(slow)),
+		signal: newEMA(validPeriod(signal)),
+	}
+}
+
+// Update - Обновление баром
+func (m *MACD) Update(bar Bar) {
+	prev, commit, ok := m.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		// сигнальная линия считается только по значениям MACD, когда обе EMA готовы
+		ready := m.fast.ready() && m.slow.ready()
+		macd := m.fast.peek(prev.Close) - m.slow.peek(prev.Close)
+		m.fast.commit(prev.Close)
+		m.slow.commit(prev.Close)
+		if ready {
+			m.signal.commit(macd)
+		}
+	}
+	m.macdReady = m.fast.ready() && m.slow.ready()
+	m.macd = m.fast.peek(bar.Close) - m.slow.peek(bar.Close)
+	m.sigReady = m.macdReady && m.signal.ready()
+	m.signalValue = m.signal.peek(m.macd)
+}
+
+// Ready - true, если готовы MACD и сигнальная линия
+func (m *MACD) Ready() bool {
+	return m.has && m.sigReady
+}
+
+// Value - Значение MACD
+func (m *MACD) Value() float64 {
+	return m.macd
+}
+
+// Signal - Значение сигнальной линии
+func (m *MACD) Signal() float64 {
+	return m.signalValue
+}
+
+// Histogram - Разница MACD и сигнальной линии
+func (m *MACD) Histogram() float64 {
+	return m.macd - m.signalValue
+}
+
+// BollingerBands - Полосы Боллинджера: SMA цены закрытия и полосы на k стандартных отклонений от нее
+type BollingerBands struct {
+	bars
+	window            window
+	k                 float64
+	middle, deviation float64
+}
+
+// NewBollingerBands - Создание полос Боллинджера, стандартные параметры 20, 2
+func NewBollingerBands(period int, k float64) *BollingerBands {
+	return &BollingerBands{window: newWindow(validPeriod(period)), k: k}
+}
+
+// Update - Обновление баром
+func (b *BollingerBands) Update(bar Bar) {
+	prev, commit, ok := b.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		b.window.commit(prev.Close)
+	}
+	b.middle = b.window.mean(bar.Close)
+	b.deviation = b.window.std(bar.Close)
+}
+
+// Ready - true, если баров не меньше периода
+func (b *BollingerBands) Ready() bool {
+	return b.has && b.window.ready()
+}
+
+// Value - Средняя линия
+func (b *BollingerBands) Value() float64 {
+	return b.middle
+}
+
+// Upper - Верхняя полоса
+func (b *BollingerBands) Upper() float64 {
+	return b.middle + b.k*b.deviation
+}
+
+// Lower - Нижняя полоса
+func (b *BollingerBands) Lower() float64 {
+	return b.middle - b.k*b.deviation
+}
+
+// PercentB - Положение цены закрытия текущего бара между полосами: 0 - нижняя полоса, 1 - верхняя
+func (b *BollingerBands) PercentB() float64 {
+	width := b.Upper() - b.Lower()
+	if width == 0 {
+		return 0.5
+	}
+	return (b.current.Close - b.Lower()) / width
+}
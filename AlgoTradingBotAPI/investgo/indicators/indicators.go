@@ -0,0 +1,274 @@
+// Package indicators - Технические индикаторы с инкрементальным обновлением. Каждый индикатор хранит состояние
+// по завершенным барам и отдельно текущий бар, поэтому бар из стрима с тем же временем, что и предыдущий,
+// заменяет его, а бар с новым временем завершает предыдущий. Обновление на один бар выполняется за O(1),
+// что позволяет вести индикаторы по сотням инструментов одновременно. Индикаторы не потокобезопасны,
+// для нескольких горутин используйте Tracker.
+package indicators
+
+import (
+	"math"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Bar - Бар для расчета индикаторов
+type Bar struct {
+	Time   time.Time
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+}
+
+// BarFromHistoricCandle - Бар из исторической свечи
+func BarFromHistoricCandle(c *pb.HistoricCandle) Bar {
+	return Bar{
+		Time:   c.GetTime().AsTime(),
+		Open:   c.GetOpen().ToFloat(),
+		High:   c.GetHigh().ToFloat(),
+		Low:    c.GetLow().ToFloat(),
+		Close:  c.GetClose().ToFloat(),
+		Volume: float64(c.GetVolume()),
+	}
+}
+
+// BarFromCandle - Бар из свечи стрима
+func BarFromCandle(c *pb.Candle) Bar {
+	return Bar{
+		Time:   c.GetTime().AsTime(),
+		Open:   c.GetOpen().ToFloat(),
+		High:   c.GetHigh().ToFloat(),
+		Low:    c.GetLow().ToFloat(),
+		Close:  c.GetClose().ToFloat(),
+		Volume: float64(c.GetVolume()),
+	}
+}
+
+// Typical - Типичная цена бара (High + Low + Close) / 3
+func (b Bar) Typical() float64 {
+	return (b.High + b.Low + b.Close) / 3
+}
+
+// Indicator - Индикатор, который обновляется по барам
+type Indicator interface {
+	// Update - Обновление индикатора баром. Бар с временем текущего бара заменяет его, бар с более поздним
+	// временем завершает текущий, более ранние бары отбрасываются.
+	Update(bar Bar)
+	// Ready - true, если баров достаточно для расчета индикатора
+	Ready() bool
+	// Value - Основное значение индикатора с учетом текущего бара
+	Value() float64
+}
+
+// Compute - Значения индикатора по историческим свечам, пока индикатор не готов - math.NaN()
+func Compute(ind Indicator, candles []*pb.HistoricCandle) []float64 {
+	values := make([]float64, 0, len(candles))
+	for _, c := range candles {
+		ind.Update(BarFromHistoricCandle(c))
+		if ind.Ready() {
+			values = append(values, ind.Value())
+		} else {
+			values = append(values, math.NaN())
+		}
+	}
+	return values
+}
+
+// bars - Отслеживание текущего бара: общая часть всех индикаторов
+type bars struct {
+	current Bar
+	has     bool
+	// count - Кол-во завершенных баров
+	count int
+}
+
+// next - Возвращает предыдущий бар, который нужно завершить, и true, если пришел бар с новым временем.
+// ok = false, если бар раньше текущего и его нужно отбросить.
+func (b *bars) next(bar Bar) (prev Bar, commit bool, ok bool) {
+	if b.has {
+		switch {
+		case bar.Time.Before(b.current.Time):
+			return Bar{}, false, false
+		case bar.Time.After(b.current.Time):
+			prev, commit = b.current, true
+			b.count++
+		}
+	}
+	b.current, b.has = bar, true
+	return prev, commit, true
+}
+
+// ring - Кольцевой буфер последних значений
+type ring struct {
+	values []float64
+	start  int
+	size   int
+}
+
+func newRing(capacity int) ring {
+	return ring{values: make([]float64, capacity)}
+}
+
+// push - Добавление значения, если буфер заполнен, возвращает вытесненное значение и true
+func (r *ring) push(x float64) (float64, bool) {
+	if len(r.values) == 0 {
+		return x, true
+	}
+	if r.size < len(r.values) {
+		r.values[(r.start+r.size)%len(r.values)] = x
+		r.size++
+		return 0, false
+	}
+	old := r.values[r.start]
+	r.values[r.start] = x
+	r.start = (r.start + 1) % len(r.values)
+	return old, true
+}
+
+// full - true, если буфер заполнен
+func (r *ring) full() bool {
+	return r.size == len(r.values)
+}
+
+// window - Сумма и сумма квадратов последних n - 1 завершенных значений, n-е значение - текущее
+type window struct {
+	ring  ring
+	sum   float64
+	sumSq float64
+}
+
+func newWindow(n int) window {
+	return window{ring: newRing(n - 1)}
+}
+
+func (w *window) commit(x float64) {
+	old, evicted := w.ring.push(x)
+	w.sum += x
+	w.sumSq += x * x
+	if evicted {
+		w.sum -= old
+		w.sumSq -= old * old
+	}
+}
+
+// ready - true, если вместе с текущим значением в окне n значений
+func (w *window) ready() bool {
+	return w.ring.full()
+}
+
+// mean - Среднее окна вместе с текущим значением x
+func (w *window) mean(x float64) float64 {
+	return (w.sum + x) / float64(w.ring.size+1)
+}
+
+// std - Стандартное отклонение окна вместе с текущим значением x
+func (w *window) std(x float64) float64 {
+	n := float64(w.ring.size + 1)
+	m := (w.sum + x) / n
+	v := (w.sumSq+x*x)/n - m*m
+	if v < 0 {
+		return 0
+	}
+	return math.Sqrt(v)
+}
+
+// smoother - Экспоненциальное сглаживание с коэффициентом alpha, первое значение - среднее первых period значений
+type smoother struct {
+	period int
+	alpha  float64
+	count  int
+	sum    float64
+	value  float64
+}
+
+// newEMA - Сглаживание EMA, alpha = 2 / (period + 1)
+func newEMA(period int) smoother {
+	return smoother{period: period, alpha: 2 / float64(period+1)}
+}
+
+// newWilder - Сглаживание Уайлдера, alpha = 1 / period
+func newWilder(period int) smoother {
+	return smoother{period: period, alpha: 1 / float64(period)}
+}
+
+func (s *smoother) commit(x float64) {
+	s.value = s.peek(x)
+	s.count++
+	if s.count <= s.period {
+		s.sum += x
+	}
+}
+
+// peek - Значение сглаживания вместе с текущим значением x
+func (s *smoother) peek(x float64) float64 {
+	if s.count+1 <= s.period {
+		return (s.sum + x) / float64(s.count+1)
+	}
+	return s.alpha*x + (1-s.alpha)*s.value
+}
+
+// ready - true, если вместе с текущим значением значений достаточно
+func (s *smoother) ready() bool {
+	return s.count+1 >= s.period
+}
+
+// extremum - Максимум или минимум последних n - 1 завершенных значений, монотонная очередь
+type extremum struct {
+	n     int
+	max   bool
+	index int
+	queue []extremumItem
+}
+
+type extremumItem struct {
+	index int
+	value float64
+}
+
+func newExtremum(n int, max bool) extremum {
+	return extremum{n: n, max: max, queue: make([]extremumItem, 0, n)}
+}
+
+func (e *extremum) better(a, b float64) bool {
+	if e.max {
+		return a >= b
+	}
+	return a <= b
+}
+
+func (e *extremum) commit(x float64) {
+	if e.n <= 1 {
+		return
+	}
+	for len(e.queue) > 0 && e.better(x, e.queue[len(e.queue)-1].value) {
+		e.queue = e.queue[:len(e.queue)-1]
+	}
+	e.queue = append(e.queue, extremumItem{index: e.index, value: x})
+	e.index++
+	for e.queue[0].index <= e.index-e.n {
+		e.queue = e.queue[1:]
+	}
+}
+
+// peek - Экстремум окна вместе с текущим значением x
+func (e *extremum) peek(x float64) float64 {
+	if len(e.queue) == 0 || e.better(x, e.queue[0].value) {
+		return x
+	}
+	return e.queue[0].value
+}
+
+// ready - true, если вместе с текущим значением в окне n значений
+func (e *extremum) ready() bool {
+	return e.index+1 >= e.n
+}
+
+// validPeriod - Период меньше 1 считается равным 1
+func validPeriod(period int) int {
+	if period < 1 {
+		return 1
+	}
+	return period
+}
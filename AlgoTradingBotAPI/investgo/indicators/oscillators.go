@@ -0,0 +1,223 @@
+package indicators
+
+import "math"
+
+// RSI - Индекс относительной силы по ценам закрытия со сглаживанием Уайлдера
+type RSI struct {
+	bars
+	gains, losses smoother
+	prevClose     float64
+	value         float64
+}
+
+// NewRSI - Создание RSI с периодом period, стандартный период 14
+func NewRSI(period int) *RSI {
+	period = validPeriod(period)
+	return &RSI{gains: newWilder(period), losses: newWilder(period)}
+}
+
+// Update - Обновление баром
+func (r *RSI) Update(bar Bar) {
+	prev, commit, ok := r.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		if r.count > 1 {
+			gain, loss := change(prev.Close - r.prevClose)
+			r.gains.commit(gain)
+			r.losses.commit(loss)
+		}
+		r.prevClose = prev.Close
+	}
+	if r.count == 0 {
+		r.value = 50
+		return
+	}
+	gain, loss := change(bar.Close - r.prevClose)
+	avgGain, avgLoss := r.gains.peek(gain), r.losses.peek(loss)
+	switch {
+	case avgGain == 0 && avgLoss == 0:
+		r.value = 50
+	case avgLoss == 0:
+		r.value = 100
+	default:
+		r.value = 100 - 100/(1+avgGain/avgLoss)
+	}
+}
+
+// Ready - true, если изменений цены не меньше периода
+func (r *RSI) Ready() bool {
+	return r.count > 0 && r.gains.ready()
+}
+
+// Value - Значение RSI от 0 до 100
+func (r *RSI) Value() float64 {
+	return r.value
+}
+
+// change - Рост и падение цены
+func change(diff float64) (float64, float64) {
+	if diff > 0 {
+		return diff, 0
+	}
+	return 0, -diff
+}
+
+// Stochastic - Стохастический осциллятор: %K - положение цены закрытия в диапазоне High-Low за kPeriod баров,
+// %D - SMA от %K за dPeriod баров
+type Stochastic struct {
+	bars
+	highs, lows extremum
+	d           window
+	k, dValue   float64
+}
+
+// NewStochastic - Создание стохастического осциллятора, стандартные параметры 14, 3
+func NewStochastic(kPeriod, dPeriod int) *Stochastic {
+	kPeriod = validPeriod(kPeriod)
+	return &Stochastic{
+		highs: newExtremum(kPeriod, true),
+		lows:  newExtremum(kPeriod, false),
+		d:     newWindow(validPeriod(dPeriod)),
+	}
+}
+
+// Update - Обновление баром
+func (s *Stochastic) Update(bar Bar) {
+	prev, commit, ok := s.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		// %D считается только по значениям %K, когда окно %K заполнено
+		ready := s.highs.ready()
+		k := s.percentK(prev)
+		s.highs.commit(prev.High)
+		s.lows.commit(prev.Low)
+		if ready {
+			s.d.commit(k)
+		}
+	}
+	s.k = s.percentK(bar)
+	s.dValue = s.d.mean(s.k)
+}
+
+func (s *Stochastic) percentK(bar Bar) float64 {
+	high, low := s.highs.peek(bar.High), s.lows.peek(bar.Low)
+	if high == low {
+		return 50
+	}
+	return 100 * (bar.Close - low) / (high - low)
+}
+
+// Ready - true, если готовы %K и %D
+func (s *Stochastic) Ready() bool {
+	return s.has && s.highs.ready() && s.d.ready()
+}
+
+// Value - Значение %K
+func (s *Stochastic) Value() float64 {
+	return s.k
+}
+
+// D - Значение %D
+func (s *Stochastic) D() float64 {
+	return s.dValue
+}
+
+// ADX - Индекс направленного движения со сглаживанием Уайлдера: сила тренда и направленные индикаторы +DI, -DI
+type ADX struct {
+	bars
+	tr, plusDM, minusDM    smoother
+	adx                    smoother
+	prev                   Bar
+	value, plusDI, minusDI float64
+}
+
+// NewADX - Создание ADX с периодом period, стандартный период 14
+func NewADX(period int) *ADX {
+	period = validPeriod(period)
+	return &ADX{
+		tr:      newWilder(period),
+		plusDM:  newWilder(period),
+		minusDM: newWilder(period),
+		adx:     newWilder(period),
+	}
+}
+
+// Update - Обновление баром
+func (a *ADX) Update(bar Bar) {
+	prev, commit, ok := a.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		if a.count > 1 {
+			// ADX сглаживает DX, только когда готовы +DI и -DI
+			ready := a.tr.ready()
+			tr, plus, minus := a.movement(prev)
+			_, _, dx := a.directional(tr, plus, minus)
+			a.tr.commit(tr)
+			a.plusDM.commit(plus)
+			a.minusDM.commit(minus)
+			if ready {
+				a.adx.commit(dx)
+			}
+		}
+		a.prev = prev
+	}
+	if a.count == 0 {
+		return
+	}
+	var dx float64
+	a.plusDI, a.minusDI, dx = a.directional(a.movement(bar))
+	a.value = a.adx.peek(dx)
+}
+
+// movement - Истинный диапазон и направленное движение бара относительно предыдущего
+func (a *ADX) movement(bar Bar) (float64, float64, float64) {
+	up, down := bar.High-a.prev.High, a.prev.Low-bar.Low
+	var plus, minus float64
+	if up > down && up > 0 {
+		plus = up
+	}
+	if down > up && down > 0 {
+		minus = down
+	}
+	return trueRange(bar, a.prev.Close, true), plus, minus
+}
+
+// directional - +DI, -DI и DX со сглаженными значениями с учетом текущего бара
+func (a *ADX) directional(tr, plus, minus float64) (float64, float64, float64) {
+	atr := a.tr.peek(tr)
+	if atr == 0 {
+		return 0, 0, 0
+	}
+	plusDI := 100 * a.plusDM.peek(plus) / atr
+	minusDI := 100 * a.minusDM.peek(minus) / atr
+	if plusDI+minusDI == 0 {
+		return plusDI, minusDI, 0
+	}
+	return plusDI, minusDI, 100 * math.Abs(plusDI-minusDI) / (plusDI + minusDI)
+}
+
+// Ready - true, если готовы +DI, -DI и сглаженный DX, требуется 2 * period баров
+func (a *ADX) Ready() bool {
+	return a.count > 0 && a.tr.ready() && a.adx.ready()
+}
+
+// Value - Значение ADX от 0 до 100
+func (a *ADX) Value() float64 {
+	return a.value
+}
+
+// PlusDI - Значение +DI
+func (a *ADX) PlusDI() float64 {
+	return a.plusDI
+}
+
+// MinusDI - Значение -DI
+func (a *ADX) MinusDI() float64 {
+	return a.minusDI
+}
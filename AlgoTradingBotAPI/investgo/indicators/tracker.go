@@ -0,0 +1,91 @@
+package indicators
+
+import (
+	"sync"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Set - Набор индикаторов одного инструмента по имени
+type Set map[string]Indicator
+
+// Tracker - Индикаторы по множеству инструментов, например по всем свечам из стрима SubscribeCandle.
+// Для каждого нового инструмента набор индикаторов создается функцией factory. Методы потокобезопасны.
+type Tracker struct {
+	mx      sync.RWMutex
+	factory func() Set
+	sets    map[string]Set
+}
+
+// NewTracker - Создание трекера, factory возвращает новый набор индикаторов для инструмента
+func NewTracker(factory func() Set) *Tracker {
+	return &Tracker{
+		factory: factory,
+		sets:    make(map[string]Set),
+	}
+}
+
+// Update - Обновление индикаторов инструмента id баром
+func (t *Tracker) Update(id string, bar Bar) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	set, ok := t.sets[id]
+	if !ok {
+		set = t.factory()
+		t.sets[id] = set
+	}
+	for _, ind := range set {
+		ind.Update(bar)
+	}
+}
+
+// UpdateCandle - Обновление индикаторов свечой из стрима, ключ инструмента - uid, если он есть, иначе figi
+func (t *Tracker) UpdateCandle(c *pb.Candle) {
+	id := c.GetInstrumentUid()
+	if id == "" {
+		id = c.GetFigi()
+	}
+	t.Update(id, BarFromCandle(c))
+}
+
+// LoadHistory - Начальная загрузка индикаторов инструмента id историческими свечами
+func (t *Tracker) LoadHistory(id string, candles []*pb.HistoricCandle) {
+	for _, c := range candles {
+		t.Update(id, BarFromHistoricCandle(c))
+	}
+}
+
+// Value - Значение индикатора name инструмента id, ok = false, если инструмента или индикатора нет,
+// или индикатор еще не готов
+func (t *Tracker) Value(id, name string) (float64, bool) {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	ind, ok := t.sets[id][name]
+	if !ok || !ind.Ready() {
+		return 0, false
+	}
+	return ind.Value(), true
+}
+
+// Do - Вызов fn с набором индикаторов инструмента id под блокировкой, например чтобы прочитать
+// несколько значений MACD или полос Боллинджера согласованно
+func (t *Tracker) Do(id string, fn func(set Set)) bool {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	set, ok := t.sets[id]
+	if ok {
+		fn(set)
+	}
+	return ok
+}
+
+// Instruments - Идентификаторы инструментов в трекере
+func (t *Tracker) Instruments() []string {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	ids := make([]string, 0, len(t.sets))
+	for id := range t.sets {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,99 @@
+package indicators
+
+import "math"
+
+// ATR - Средний истинный диапазон со сглаживанием Уайлдера
+type ATR struct {
+	bars
+	tr        smoother
+	prevClose float64
+	value     float64
+}
+
+// NewATR - Создание ATR с периодом period, стандартный период 14
+func NewATR(period int) *ATR {
+	return &ATR{tr: newWilder(validPeriod(period))}
+}
+
+// Update - Обновление баром
+func (a *ATR) Update(bar Bar) {
+	prev, commit, ok := a.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		a.tr.commit(trueRange(prev, a.prevClose, a.count > 1))
+		a.prevClose = prev.Close
+	}
+	a.value = a.tr.peek(trueRange(bar, a.prevClose, a.count > 0))
+}
+
+// Ready - true, если баров не меньше периода
+func (a *ATR) Ready() bool {
+	return a.has && a.tr.ready()
+}
+
+// Value - Значение ATR
+func (a *ATR) Value() float64 {
+	return a.value
+}
+
+// trueRange - Истинный диапазон бара, для первого бара - High - Low
+func trueRange(bar Bar, prevClose float64, hasPrev bool) float64 {
+	tr := bar.High - bar.Low
+	if hasPrev {
+		tr = math.Max(tr, math.Max(math.Abs(bar.High-prevClose), math.Abs(bar.Low-prevClose)))
+	}
+	return tr
+}
+
+// Donchian - Канал Дончиана: максимум High и минимум Low за period баров
+type Donchian struct {
+	bars
+	highs, lows extremum
+	upper       float64
+	lower       float64
+}
+
+// NewDonchian - Создание канала Дончиана с периодом period, стандартный период 20
+func NewDonchian(period int) *Donchian {
+	period = validPeriod(period)
+	return &Donchian{
+		highs: newExtremum(period, true),
+		lows:  newExtremum(period, false),
+	}
+}
+
+// Update - Обновление баром
+func (d *Donchian) Update(bar Bar) {
+	prev, commit, ok := d.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		d.highs.commit(prev.High)
+		d.lows.commit(prev.Low)
+	}
+	d.upper = d.highs.peek(bar.High)
+	d.lower = d.lows.peek(bar.Low)
+}
+
+// Ready - true, если баров не меньше периода
+func (d *Donchian) Ready() bool {
+	return d.has && d.highs.ready()
+}
+
+// Value - Середина канала
+func (d *Donchian) Value() float64 {
+	return (d.upper + d.lower) / 2
+}
+
+// Upper - Верхняя граница канала
+func (d *Donchian) Upper() float64 {
+	return d.upper
+}
+
+// Lower - Нижняя граница канала
+func (d *Donchian) Lower() float64 {
+	return d.lower
+}
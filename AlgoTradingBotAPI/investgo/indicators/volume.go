@@ -0,0 +1,117 @@
+package indicators
+
+import (
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+)
+
+// VWAP - Средневзвешенная по объему типичная цена с начала торгового дня. Начало дня задается
+// выравниванием investgo.BarAlignment, например полночь по Москве или начало основной сессии.
+type VWAP struct {
+	bars
+	alignment investgo.BarAlignment
+	day       time.Time
+	pv        float64
+	volume    float64
+	value     float64
+}
+
+// NewVWAP - Создание VWAP, сбрасывается в начале каждого дня alignment
+func NewVWAP(alignment investgo.BarAlignment) *VWAP {
+	return &VWAP{alignment: alignment}
+}
+
+// Update - Обновление баром
+func (v *VWAP) Update(bar Bar) {
+	prev, commit, ok := v.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		if day := v.dayStart(prev.Time); !day.Equal(v.day) {
+			v.day, v.pv, v.volume = day, 0, 0
+		}
+		v.pv += prev.Typical() * prev.Volume
+		v.volume += prev.Volume
+	}
+	pv, volume := v.pv, v.volume
+	if !v.dayStart(bar.Time).Equal(v.day) {
+		pv, volume = 0, 0
+	}
+	pv += bar.Typical() * bar.Volume
+	volume += bar.Volume
+	if volume == 0 {
+		v.value = bar.Typical()
+		return
+	}
+	v.value = pv / volume
+}
+
+func (v *VWAP) dayStart(t time.Time) time.Time {
+	start, _ := v.alignment.Bounds(t, investgo.DAY)
+	return start
+}
+
+// Ready - true после первого бара
+func (v *VWAP) Ready() bool {
+	return v.has
+}
+
+// Value - Значение VWAP
+func (v *VWAP) Value() float64 {
+	return v.value
+}
+
+// OBV - Балансовый объем: накопленный объем баров роста минус объем баров падения цены закрытия
+type OBV struct {
+	bars
+	obv       float64
+	prevClose float64
+	value     float64
+}
+
+// NewOBV - Создание OBV, значение на первом баре 0
+func NewOBV() *OBV {
+	return &OBV{}
+}
+
+// Update - Обновление баром
+func (o *OBV) Update(bar Bar) {
+	prev, commit, ok := o.next(bar)
+	if !ok {
+		return
+	}
+	if commit {
+		if o.count > 1 {
+			o.obv = o.step(prev)
+		}
+		o.prevClose = prev.Close
+	}
+	if o.count == 0 {
+		o.value = 0
+		return
+	}
+	o.value = o.step(bar)
+}
+
+// step - Значение OBV после бара bar
+func (o *OBV) step(bar Bar) float64 {
+	switch {
+	case bar.Close > o.prevClose:
+		return o.obv + bar.Volume
+	case bar.Close < o.prevClose:
+		return o.obv - bar.Volume
+	}
+	return o.obv
+}
+
+// Ready - true после первого бара
+func (o *OBV) Ready() bool {
+	return o.has
+}
+
+// Value - Значение OBV
+func (o *OBV) Value() float64 {
+	return o.value
+}
@@ -0,0 +1,319 @@
+package investgo
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KillSwitchConfig - Конфигурация аварийного выключателя
+type KillSwitchConfig struct {
+	// AccountId - Счет, по умолчанию AccountId из конфигурации клиента
+	AccountId string
+	// Signals - Сигналы процесса, по которым срабатывает выключатель, например syscall.SIGUSR1
+	Signals []os.Signal
+	// File - Путь к файлу-флагу, выключатель срабатывает при появлении файла. Пусто - без файла
+	File string
+	// PollInterval - Период проверки файла, по умолчанию 1 секунда
+	PollInterval time.Duration
+	// CloseTimeout, CloseRetryInterval - Время на закрытие позиций и пауза между попытками, см. FlattenConfig
+	CloseTimeout       time.Duration
+	CloseRetryInterval time.Duration
+	// Addr - Адрес http сервера, например 127.0.0.1:8090. POST /kill - срабатывание, GET /kill - последний отчет.
+	// Пусто - без http
+	Addr string
+	// Token - Если задан, http запрос должен содержать заголовок Authorization: Bearer <Token>
+	Token string
+	// BeforeKill - Вызывается перед каждым срабатыванием, например для остановки стратегии,
+	// чтобы она не выставила новые поручения во время закрытия позиций
+	BeforeKill func(reason string)
+	// OnKill - Вызывается после каждого срабатывания с отчетом
+	OnKill func(report *KillSwitchReport)
+}
+
+// KillSwitch - Аварийный выключатель: отменяет все активные поручения и стоп-заявки счета и закрывает все длинные
+// и короткие позиции по бумагам, фьючерсам и опционам рыночными поручениями
+type KillSwitch struct {
+	config KillSwitchConfig
+	logger Logger
+
+	ordersService     *OrdersServiceClient
+	stopOrdersService *StopOrdersServiceClient
+	flattener         *Flattener
+
+	mx   sync.Mutex
+	last *KillSwitchReport
+}
+
+// NewKillSwitch - Создание аварийного выключателя для счета из конфигурации
+func NewKillSwitch(c *Client, config KillSwitchConfig) *KillSwitch {
+	if config.AccountId == "" {
+		config.AccountId = c.Config.AccountId
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	return &KillSwitch{
+		config:            config,
+		logger:            c.Logger,
+		ordersService:     c.NewOrdersServiceClient(),
+		stopOrdersService: c.NewStopOrdersServiceClient(),
+		flattener: NewFlattener(c, FlattenConfig{
+			AccountId:     config.AccountId,
+			Timeout:       config.CloseTimeout,
+			RetryInterval: config.CloseRetryInterval,
+		}),
+	}
+}
+
+// KillSwitchReport - Отчет о срабатывании выключателя
+type KillSwitchReport struct {
+	AccountId           string           `json:"account_id"`
+	Reason              string           `json:"reason"`
+	Start               time.Time        `json:"start"`
+	End                 time.Time        `json:"end"`
+	CancelledOrders     []string         `json:"cancelled_orders"`
+	CancelledStopOrders []string         `json:"cancelled_stop_orders"`
+	ClosedPositions     []ClosedPosition `json:"closed_positions"`
+	Errors              []string         `json:"errors"`
+}
+
+// Err - Объединенная ошибка срабатывания, nil если все поручения отменены и позиции закрыты
+func (r *KillSwitchReport) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(r.Errors, "; "))
+}
+
+// WriteJSON - Запись отчета в формате json
+func (r *KillSwitchReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *KillSwitchReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "kill switch %v on account %v at %v\n", r.Reason, r.AccountId, r.Start.Format(time.DateTime))
+	fmt.Fprintf(&b, "cancelled orders: %v, cancelled stop orders: %v\n", len(r.CancelledOrders), len(r.CancelledStopOrders))
+	for _, p := range r.ClosedPositions {
+		fmt.Fprintf(&b, "%v %v: %v of %v lots closed, price %v, orders %v", p.InstrumentType, p.InstrumentUid,
+			p.ClosedLots, p.Lots, p.ExecutedPrice, len(p.Orders))
+		if p.Error != "" {
+			fmt.Fprintf(&b, ", %v", p.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(&b, "error: %v\n", e)
+	}
+	return b.String()
+}
+
+func (r *KillSwitchReport) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Kill - Срабатывание выключателя: отмена поручений и стоп-заявок, затем закрытие позиций.
+// Ошибки по отдельным поручениям и позициям не останавливают выключатель, они попадают в отчет
+func (k *KillSwitch) Kill(reason string) *KillSwitchReport {
+	if k.config.BeforeKill != nil {
+		k.config.BeforeKill(reason)
+	}
+	r := k.kill(reason)
+	if k.config.OnKill != nil {
+		k.config.OnKill(r)
+	}
+	return r
+}
+
+// kill - Одно срабатывание, параллельные срабатывания выполняются по очереди
+func (k *KillSwitch) kill(reason string) *KillSwitchReport {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	accountId := k.config.AccountId
+	k.logger.Errorf("kill switch %v: cancel orders and close positions on account %v", reason, accountId)
+	r := &KillSwitchReport{
+		AccountId:           accountId,
+		Reason:              reason,
+		Start:               time.Now(),
+		CancelledOrders:     make([]string, 0),
+		CancelledStopOrders: make([]string, 0),
+		ClosedPositions:     make([]ClosedPosition, 0),
+		Errors:              make([]string, 0),
+	}
+	k.cancelOrders(r)
+	k.cancelStopOrders(r)
+	// позиции запрашиваются после отмены поручений, чтобы заблокированные под них бумаги освободились
+	closed, err := k.flattener.Flatten(context.Background())
+	r.ClosedPositions = closed
+	if err != nil {
+		r.errorf("close positions: %v", err)
+	}
+	r.End = time.Now()
+	k.last = r
+	if err := r.Err(); err != nil {
+		k.logger.Errorf("kill switch finished with errors: %v", err.Error())
+	} else {
+		k.logger.Infof("kill switch finished: cancelled %v orders, %v stop orders, closed %v positions",
+			len(r.CancelledOrders), len(r.CancelledStopOrders), len(r.ClosedPositions))
+	}
+	return r
+}
+
+// LastReport - Отчет о последнем срабатывании, nil если выключатель не срабатывал
+func (k *KillSwitch) LastReport() *KillSwitchReport {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return k.last
+}
+
+// cancelOrders - Отмена всех активных поручений счета
+func (k *KillSwitch) cancelOrders(r *KillSwitchReport) {
+	resp, err := k.ordersService.GetOrders(r.AccountId)
+	if err != nil {
+		r.errorf("get orders: %v %v", err, MessageFromHeader(resp.GetHeader()))
+		return
+	}
+	for _, o := range resp.GetOrders() {
+		cancelResp, err := k.ordersService.CancelOrder(r.AccountId, o.GetOrderId())
+		if err != nil {
+			r.errorf("cancel order %v: %v %v", o.GetOrderId(), err, MessageFromHeader(cancelResp.GetHeader()))
+			continue
+		}
+		r.CancelledOrders = append(r.CancelledOrders, o.GetOrderId())
+	}
+}
+
+// cancelStopOrders - Отмена всех стоп-заявок счета
+func (k *KillSwitch) cancelStopOrders(r *KillSwitchReport) {
+	resp, err := k.stopOrdersService.GetStopOrders(r.AccountId)
+	if err != nil {
+		r.errorf("get stop orders: %v %v", err, MessageFromHeader(resp.GetHeader()))
+		return
+	}
+	for _, o := range resp.GetStopOrders() {
+		cancelResp, err := k.stopOrdersService.CancelStopOrder(r.AccountId, o.GetStopOrderId())
+		if err != nil {
+			r.errorf("cancel stop order %v: %v %v", o.GetStopOrderId(), err, MessageFromHeader(cancelResp.GetHeader()))
+			continue
+		}
+		r.CancelledStopOrders = append(r.CancelledStopOrders, o.GetStopOrderId())
+	}
+}
+
+// Run - Ожидание срабатывания по сигналам, файлу и http из конфигурации, блокируется до отмены контекста.
+// Возвращает ошибку, если http сервер не удалось запустить
+func (k *KillSwitch) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 1)
+
+	if k.config.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/kill", k)
+		server := &http.Server{Addr: k.config.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+				cancel()
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelShutdown()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				k.logger.Errorf("kill switch http shutdown: %v", err.Error())
+			}
+		}()
+		k.logger.Infof("kill switch listening on http://%v/kill", k.config.Addr)
+	}
+
+	var signals chan os.Signal
+	if len(k.config.Signals) > 0 {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, k.config.Signals...)
+		defer signal.Stop(signals)
+	}
+
+	var poll <-chan time.Time
+	if k.config.File != "" {
+		ticker := time.NewTicker(k.config.PollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	// файл, оставшийся с прошлого запуска, тоже считается срабатыванием
+	present := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			select {
+			case err := <-errs:
+				return err
+			default:
+				return nil
+			}
+		case s := <-signals:
+			k.Kill(fmt.Sprintf("signal %v", s))
+		case <-poll:
+			_, err := os.Stat(k.config.File)
+			exists := err == nil
+			if exists && !present {
+				k.Kill(fmt.Sprintf("file %v", k.config.File))
+			}
+			// повторное срабатывание только после удаления и нового появления файла
+			present = exists
+		}
+	}
+}
+
+// ServeHTTP - POST - срабатывание выключателя с отчетом в ответе, GET - отчет о последнем срабатывании
+func (k *KillSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if k.config.Token != "" {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.config.Token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var report *KillSwitchReport
+	switch req.Method {
+	case http.MethodPost:
+		report = k.Kill(fmt.Sprintf("http request from %v", req.RemoteAddr))
+	case http.MethodGet:
+		report = k.LastReport()
+		if report == nil {
+			http.Error(w, "kill switch has not been triggered", http.StatusNotFound)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Err() != nil && req.Method == http.MethodPost {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := report.WriteJSON(w); err != nil {
+		k.logger.Errorf("kill switch http response: %v", err.Error())
+	}
+}
@@ -143,36 +143,19 @@ func (md *MarketDataServiceClient) GetHistoricCandles(req *GetHistoricCandlesReq
 	if req.Interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
 		req.Interval = pb.CandleInterval_CANDLE_INTERVAL_HOUR
 	}
-	duration := selectDuration(req.Interval)
 	// если запрашиваемый интервал больше чем возможный, то нужно разделить его на несколько
-	intervals := make([]time.Time, 0)
-	if req.To.Sub(req.From) > duration {
-		lowTime := req.To
-		for lowTime.After(req.From) || lowTime.Equal(req.From) {
-			intervals = append(intervals, lowTime)
-			lowTime = lowTime.Add(-duration)
-		}
-		intervals = append(intervals, req.From)
-	} else {
-		intervals = []time.Time{req.To, req.From}
-	}
-	// intervals = {to, ... , from}
+	windows := splitInterval(req.From, req.To, selectDuration(req.Interval))
 
 	candles := make([]*pb.HistoricCandle, 0)
 	requests := 0
-	for i := len(intervals) - 1; i > 0; i-- {
-		// идем с конца слайса так как там более раннее время
-		// from - i элемент
-		// to - i-1 элемент
+	for _, w := range windows {
 		requests++
-		resp, err := md.GetCandles(req.Instrument, req.Interval, intervals[i], intervals[i-1])
+		// свечи вне окна [from, to) отбрасываются, поэтому на границах окон нет дублей
+		windowCandles, err := md.windowCandles(req.Instrument, req.Interval, w[0], w[1])
 		if err != nil {
 			return nil, err
 		}
-		if len(resp.GetCandles()) < 1 {
-			continue
-		}
-		candles = append(candles, resp.GetCandles()[1:]...)
+		candles = append(candles, windowCandles...)
 		if requests == 299 {
 			if md.config.DisableResourceExhaustedRetry {
 				time.Sleep(time.Minute)
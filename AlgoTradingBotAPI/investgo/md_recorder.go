@@ -0,0 +1,509 @@
+package investgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// RECORD_HEADER - Заголовок файла записи биржевой информации
+const RECORD_HEADER = "INVESTGO-MD-1\n"
+
+// REPLAY_AS_FAST_AS_POSSIBLE - Скорость воспроизведения записи без пауз между сообщениями
+const REPLAY_AS_FAST_AS_POSSIBLE = 0
+
+// MarketDataSource - Источник биржевой информации с интерфейсом MarketDataStream. Реализуется
+// MarketDataStream и MarketDataReplayer, поэтому стратегию можно запустить как на живом стриме, так и на записи.
+type MarketDataSource interface {
+	SubscribeCandle(ids []string, interval pb.SubscriptionInterval, waitingClose bool) (<-chan *pb.Candle, error)
+	SubscribeOrderBook(ids []string, depth int32) (<-chan *pb.OrderBook, error)
+	SubscribeTrade(ids []string) (<-chan *pb.Trade, error)
+	SubscribeInfo(ids []string) (<-chan *pb.TradingStatus, error)
+	SubscribeLastPrice(ids []string) (<-chan *pb.LastPrice, error)
+	Listen() error
+	Stop()
+}
+
+// RecordedResponse - Сообщение стрима биржевой информации и время его получения
+type RecordedResponse struct {
+	Time     time.Time
+	Response *pb.MarketDataResponse
+}
+
+// MarketDataRecorder - Запись сообщений стрима биржевой информации в файл. Файл только дописывается, каждая
+// запись - это длина, время получения в наносекундах и сообщение в бинарном формате protobuf.
+type MarketDataRecorder struct {
+	mx     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	buf    []byte
+}
+
+// NewMarketDataRecorder - Открытие файла записи path, если файл существует, новые сообщения дописываются в конец.
+// Недописанная последняя запись, например после аварийного завершения, отрезается, иначе чтение остановится на ней
+// и не дойдет до новых сообщений
+func NewMarketDataRecorder(path string) (*MarketDataRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	if info.Size() == 0 {
+		if _, err = file.WriteString(RECORD_HEADER); err != nil {
+			return nil, errors.Join(err, file.Close())
+		}
+	} else if err = checkRecordHeader(file); err != nil {
+		return nil, errors.Join(err, file.Close())
+	} else if err = truncateRecord(file, info.Size()); err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return &MarketDataRecorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// truncateRecord - Обрезка файла записи размера size по концу последней целой записи. Файл должен быть прочитан
+// до конца заголовка
+func truncateRecord(file *os.File, size int64) error {
+	reader := bufio.NewReader(file)
+	end := int64(len(RECORD_HEADER))
+	var prefix [binary.MaxVarintLen64]byte
+	for {
+		n, err := binary.ReadUvarint(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n < 8 {
+			return fmt.Errorf("invalid market data record size %v at offset %v", n, end)
+		}
+		next := end + int64(binary.PutUvarint(prefix[:], n)) + int64(n)
+		if n > uint64(size) || next > size {
+			break
+		}
+		if _, err = reader.Discard(int(n)); err != nil {
+			return err
+		}
+		end = next
+	}
+	if end == size {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+// Record - Запись сообщения с текущим временем
+func (r *MarketDataRecorder) Record(resp *pb.MarketDataResponse) error {
+	return r.RecordAt(time.Now(), resp)
+}
+
+// RecordAt - Запись сообщения с временем получения t
+func (r *MarketDataRecorder) RecordAt(t time.Time, resp *pb.MarketDataResponse) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	var err error
+	r.buf, err = proto.MarshalOptions{}.MarshalAppend(r.buf[:0], resp)
+	if err != nil {
+		return err
+	}
+	var prefix [binary.MaxVarintLen64 + 8]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(r.buf)+8))
+	binary.BigEndian.PutUint64(prefix[n:], uint64(t.UnixNano()))
+	if _, err = r.writer.Write(prefix[:n+8]); err != nil {
+		return err
+	}
+	_, err = r.writer.Write(r.buf)
+	return err
+}
+
+// Flush - Сброс буфера на диск
+func (r *MarketDataRecorder) Flush() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.writer.Flush()
+}
+
+// Close - Сброс буфера и закрытие файла
+func (r *MarketDataRecorder) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return errors.Join(r.writer.Flush(), r.file.Close())
+}
+
+// MarketDataReader - Последовательное чтение файла записи биржевой информации
+type MarketDataReader struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// NewMarketDataReader - Открытие файла записи path для чтения
+func NewMarketDataReader(path string) (*MarketDataReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	if err = checkRecordHeader(reader); err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return &MarketDataReader{
+		file:   file,
+		reader: reader,
+	}, nil
+}
+
+// Next - Следующее сообщение записи, в конце файла возвращает io.EOF. Недописанная последняя запись,
+// например после аварийного завершения записи, тоже считается концом файла.
+func (r *MarketDataReader) Next() (RecordedResponse, error) {
+	size, err := binary.ReadUvarint(r.reader)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return RecordedResponse{}, io.EOF
+	case err != nil:
+		return RecordedResponse{}, err
+	case size < 8:
+		return RecordedResponse{}, fmt.Errorf("invalid market data record size %v", size)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r.reader, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return RecordedResponse{}, io.EOF
+		}
+		return RecordedResponse{}, err
+	}
+	resp := &pb.MarketDataResponse{}
+	if err = proto.Unmarshal(data[8:], resp); err != nil {
+		return RecordedResponse{}, err
+	}
+	return RecordedResponse{
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(data[:8]))),
+		Response: resp,
+	}, nil
+}
+
+// Close - Закрытие файла записи
+func (r *MarketDataReader) Close() error {
+	return r.file.Close()
+}
+
+func checkRecordHeader(r io.Reader) error {
+	header := make([]byte, len(RECORD_HEADER))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("market data record header: %w", err)
+	}
+	if !bytes.Equal(header, []byte(RECORD_HEADER)) {
+		return errors.New("file is not a market data record")
+	}
+	return nil
+}
+
+// MarketDataReplayer - Воспроизведение записи биржевой информации через интерфейс MarketDataSource.
+// В каналы отправляются только сообщения по инструментам, на которые оформлена подписка: свечи - только с интервалом
+// подписки, при waitingClose - только закрытые, стаканы обрезаются до глубины подписки, как в живом стриме.
+type MarketDataReplayer struct {
+	path   string
+	speed  float64
+	logger Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	candle        chan *pb.Candle
+	trade         chan *pb.Trade
+	orderBook     chan *pb.OrderBook
+	lastPrice     chan *pb.LastPrice
+	tradingStatus chan *pb.TradingStatus
+
+	mx   sync.Mutex
+	subs subscriptions
+	// open - Последние незакрытые свечи по подпискам с waitingClose, closed - время начала последней
+	// отправленной закрытой свечи
+	open   map[replayCandleKey]*pb.Candle
+	closed map[replayCandleKey]time.Time
+}
+
+type replayCandleKey struct {
+	id       string
+	interval pb.SubscriptionInterval
+}
+
+// NewMarketDataReplayer - Создание воспроизведения записи path. speed - во сколько раз воспроизведение быстрее
+// реального времени, 1 - в реальном времени, REPLAY_AS_FAST_AS_POSSIBLE - без пауз.
+func NewMarketDataReplayer(ctx context.Context, path string, speed float64, l Logger) *MarketDataReplayer {
+	ctxReplay, cancel := context.WithCancel(ctx)
+	return &MarketDataReplayer{
+		path:          path,
+		speed:         speed,
+		logger:        l,
+		ctx:           ctxReplay,
+		cancel:        cancel,
+		candle:        make(chan *pb.Candle, 1),
+		trade:         make(chan *pb.Trade, 1),
+		orderBook:     make(chan *pb.OrderBook, 1),
+		lastPrice:     make(chan *pb.LastPrice, 1),
+		tradingStatus: make(chan *pb.TradingStatus, 1),
+		subs: subscriptions{
+			candles:         make(map[string]candleSub, 0),
+			orderBooks:      make(map[string]int32, 0),
+			trades:          make(map[string]struct{}, 0),
+			tradingStatuses: make(map[string]struct{}, 0),
+			lastPrices:      make(map[string]struct{}, 0),
+		},
+		open:   make(map[replayCandleKey]*pb.Candle),
+		closed: make(map[replayCandleKey]time.Time),
+	}
+}
+
+// SubscribeCandle - Подписка на свечи из записи, отправляются только свечи интервала interval,
+// при waitingClose - только закрытые
+func (r *MarketDataReplayer) SubscribeCandle(ids []string, interval pb.SubscriptionInterval, waitingClose bool) (<-chan *pb.Candle, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, id := range ids {
+		r.subs.candles[id] = candleSub{interval: interval, waitingClose: waitingClose}
+	}
+	return r.candle, nil
+}
+
+// SubscribeOrderBook - Подписка на стаканы из записи, стаканы обрезаются до глубины depth
+func (r *MarketDataReplayer) SubscribeOrderBook(ids []string, depth int32) (<-chan *pb.OrderBook, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, id := range ids {
+		r.subs.orderBooks[id] = depth
+	}
+	return r.orderBook, nil
+}
+
+// SubscribeTrade - Подписка на сделки из записи
+func (r *MarketDataReplayer) SubscribeTrade(ids []string) (<-chan *pb.Trade, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, id := range ids {
+		r.subs.trades[id] = struct{}{}
+	}
+	return r.trade, nil
+}
+
+// SubscribeInfo - Подписка на торговые статусы из записи
+func (r *MarketDataReplayer) SubscribeInfo(ids []string) (<-chan *pb.TradingStatus, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, id := range ids {
+		r.subs.tradingStatuses[id] = struct{}{}
+	}
+	return r.tradingStatus, nil
+}
+
+// SubscribeLastPrice - Подписка на последние цены из записи
+func (r *MarketDataReplayer) SubscribeLastPrice(ids []string) (<-chan *pb.LastPrice, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, id := range ids {
+		r.subs.lastPrices[id] = struct{}{}
+	}
+	return r.lastPrice, nil
+}
+
+// Listen - Воспроизведение записи, после окончания записи или вызова Stop каналы закрываются
+func (r *MarketDataReplayer) Listen() error {
+	defer r.shutdown()
+	reader, err := NewMarketDataReader(r.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			r.logger.Errorf(err.Error())
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := reader.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			r.logger.Infof("market data replay finished")
+			return nil
+		case err != nil:
+			return err
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.speed > 0 {
+			// ждем момента, когда сообщение пришло бы с учетом ускорения
+			wait := time.Until(start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.speed)))
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-r.ctx.Done():
+					timer.Stop()
+					return nil
+				case <-timer.C:
+				}
+			}
+		}
+		if !r.send(rec) {
+			return nil
+		}
+	}
+}
+
+// send - Отправка сообщения в канал, если на инструмент есть подписка, false если воспроизведение остановлено
+func (r *MarketDataReplayer) send(rec RecordedResponse) bool {
+	resp := rec.Response
+	r.mx.Lock()
+	subscribed := func(figi, uid string, subs map[string]struct{}) bool {
+		_, byFigi := subs[figi]
+		_, byUid := subs[uid]
+		return byFigi || byUid
+	}
+	var candles []*pb.Candle
+	var orderBook *pb.OrderBook
+	var ok bool
+	switch resp.GetPayload().(type) {
+	case *pb.MarketDataResponse_Candle:
+		candles = r.candles(rec.Time, resp.GetCandle())
+		ok = len(candles) > 0
+	case *pb.MarketDataResponse_Orderbook:
+		orderBook, ok = r.orderBookByDepth(resp.GetOrderbook())
+	case *pb.MarketDataResponse_Trade:
+		ok = subscribed(resp.GetTrade().GetFigi(), resp.GetTrade().GetInstrumentUid(), r.subs.trades)
+	case *pb.MarketDataResponse_LastPrice:
+		ok = subscribed(resp.GetLastPrice().GetFigi(), resp.GetLastPrice().GetInstrumentUid(), r.subs.lastPrices)
+	case *pb.MarketDataResponse_TradingStatus:
+		ok = subscribed(resp.GetTradingStatus().GetFigi(), resp.GetTradingStatus().GetInstrumentUid(), r.subs.tradingStatuses)
+	}
+	r.mx.Unlock()
+	if !ok {
+		return r.ctx.Err() == nil
+	}
+
+	switch resp.GetPayload().(type) {
+	case *pb.MarketDataResponse_Candle:
+		for _, c := range candles {
+			select {
+			case <-r.ctx.Done():
+				return false
+			case r.candle <- c:
+			}
+		}
+	case *pb.MarketDataResponse_Orderbook:
+		select {
+		case <-r.ctx.Done():
+			return false
+		case r.orderBook <- orderBook:
+		}
+	case *pb.MarketDataResponse_Trade:
+		select {
+		case <-r.ctx.Done():
+			return false
+		case r.trade <- resp.GetTrade():
+		}
+	case *pb.MarketDataResponse_LastPrice:
+		select {
+		case <-r.ctx.Done():
+			return false
+		case r.lastPrice <- resp.GetLastPrice():
+		}
+	case *pb.MarketDataResponse_TradingStatus:
+		select {
+		case <-r.ctx.Done():
+			return false
+		case r.tradingStatus <- resp.GetTradingStatus():
+		}
+	}
+	return true
+}
+
+// candles - Свечи для отправки по записанной в момент received свече c. Свеча другого интервала не отправляется,
+// без waitingClose свеча отправляется сразу. При waitingClose свеча считается закрытой, если она получена после
+// окончания ее интервала или пришла свеча следующего интервала, незакрытая свеча запоминается до этого момента
+func (r *MarketDataReplayer) candles(received time.Time, c *pb.Candle) []*pb.Candle {
+	id := c.GetInstrumentUid()
+	sub, ok := r.subs.candles[id]
+	if !ok {
+		id = c.GetFigi()
+		sub, ok = r.subs.candles[id]
+	}
+	if !ok || c.GetInterval() != sub.interval {
+		return nil
+	}
+	if !sub.waitingClose {
+		return []*pb.Candle{c}
+	}
+	key := replayCandleKey{id: id, interval: sub.interval}
+	start := c.GetTime().AsTime()
+	candles := make([]*pb.Candle, 0, 2)
+	if prev, ok := r.open[key]; ok && prev.GetTime().AsTime().Before(start) {
+		delete(r.open, key)
+		candles = append(candles, prev)
+		r.closed[key] = prev.GetTime().AsTime()
+	}
+	if last, ok := r.closed[key]; ok && !start.After(last) {
+		// свеча уже отправлена закрытой
+		return candles
+	}
+	if received.Before(start.Add(SubscriptionIntervalDuration(sub.interval))) {
+		r.open[key] = c
+		return candles
+	}
+	delete(r.open, key)
+	r.closed[key] = start
+	return append(candles, c)
+}
+
+// orderBookByDepth - Стакан, обрезанный до глубины подписки, false если подписки нет
+func (r *MarketDataReplayer) orderBookByDepth(ob *pb.OrderBook) (*pb.OrderBook, bool) {
+	depth, ok := r.subs.orderBooks[ob.GetInstrumentUid()]
+	if !ok {
+		depth, ok = r.subs.orderBooks[ob.GetFigi()]
+	}
+	if !ok {
+		return nil, false
+	}
+	if depth <= 0 || (len(ob.GetBids()) <= int(depth) && len(ob.GetAsks()) <= int(depth)) {
+		return ob, true
+	}
+	trimmed := proto.Clone(ob).(*pb.OrderBook)
+	trimmed.Depth = depth
+	if len(trimmed.Bids) > int(depth) {
+		trimmed.Bids = trimmed.Bids[:depth]
+	}
+	if len(trimmed.Asks) > int(depth) {
+		trimmed.Asks = trimmed.Asks[:depth]
+	}
+	return trimmed, true
+}
+
+func (r *MarketDataReplayer) shutdown() {
+	r.logger.Infof("close market data replayer")
+	close(r.candle)
+	close(r.trade)
+	close(r.lastPrice)
+	close(r.orderBook)
+	close(r.tradingStatus)
+}
+
+// Stop - Остановка воспроизведения
+func (r *MarketDataReplayer) Stop() {
+	r.cancel()
+}
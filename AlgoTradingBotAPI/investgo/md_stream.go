@@ -27,7 +27,8 @@ type MarketDataStream struct {
 	lastPrice     chan *pb.LastPrice
 	tradingStatus chan *pb.TradingStatus
 
-	subs subscriptions
+	subs     subscriptions
+	recorder *MarketDataRecorder
 }
 
 type candleSub struct {
@@ -269,6 +270,11 @@ func (mds *MarketDataStream) Listen() error {
 					return err
 				}
 			} else {
+				if mds.recorder != nil {
+					if err := mds.recorder.Record(resp); err != nil {
+						mds.mdsClient.logger.Errorf("market data record error %v", err.Error())
+					}
+				}
 				// логика определения того что пришло и отправка информации в нужный канал
 				mds.sendRespToChannel(resp)
 			}
@@ -302,6 +308,12 @@ func (mds *MarketDataStream) shutdown() {
 	close(mds.tradingStatus)
 }
 
+// Record - Запись всех сообщений стрима в recorder, вызывается до Listen. Закрывать recorder нужно
+// после завершения Listen
+func (mds *MarketDataStream) Record(recorder *MarketDataRecorder) {
+	mds.recorder = recorder
+}
+
 // Stop - Завершение работы стрима
 func (mds *MarketDataStream) Stop() {
 	mds.cancel()
@@ -595,3 +595,93 @@ type GetHistoricCandlesRequest struct {
 	File       bool
 	FileName   string
 }
+
+// DownloadCandlesRequest - Параметры массовой загрузки исторических свечей
+type DownloadCandlesRequest struct {
+	// Instruments - Идентификаторы инструментов
+	Instruments []string
+	// Interval - Интервал свечей, по умолчанию 1 час
+	Interval pb.CandleInterval
+	// From - Начало интервала загрузки, включительно
+	From time.Time
+	// To - Конец интервала загрузки, не включительно
+	To time.Time
+	// Workers - Кол-во параллельных запросов, по умолчанию CANDLES_DOWNLOAD_WORKERS
+	Workers int
+	// RequestsPerMinute - Ограничение на кол-во запросов в минуту, по умолчанию CANDLES_REQUESTS_PER_MINUTE
+	RequestsPerMinute int
+	// Sink - Приемник загруженных свечей
+	Sink CandlesSink
+	// Checkpoint - Хранилище прогресса, если nil - загрузка всегда начинается с From
+	Checkpoint CandlesCheckpoint
+	// OnProgress - Колбек, вызывается после передачи в приемник каждого временного окна
+	OnProgress func(p DownloadProgress)
+}
+
+// CandleSeriesRequest - Параметры создания ряда свечей
+type CandleSeriesRequest struct {
+	// InstrumentId - Идентификатор инструмента
+	InstrumentId string
+	// Interval - Интервал свечей, должен совпадать с интервалом подписки на свечи
+	Interval pb.CandleInterval
+	// History - Начальная история, например из хранилища свечей, по возрастанию времени
+	History []*pb.HistoricCandle
+	// From - Начало истории, если History пустая
+	From time.Time
+	// WaitingClose - Значение waitingClose, с которым оформлена подписка на свечи
+	WaitingClose bool
+	// MaxLen - Максимальное кол-во свечей в ряду, старые свечи отбрасываются. 0 - без ограничений
+	MaxLen int
+	// OnComplete - Колбек, вызывается для каждой завершенной свечи ряда
+	OnComplete func(candle *pb.HistoricCandle)
+	// MarketDataService - Клиент для загрузки истории и пропусков
+	MarketDataService *MarketDataServiceClient
+}
+
+// EngineConfig - Конфигурация движка исполнения стратегий
+type EngineConfig struct {
+	// AccountId - Счет, по умолчанию AccountId из конфигурации клиента
+	AccountId string
+	// Instruments - uid инструментов стратегии, на них оформляются подписки
+	Instruments []string
+	// CandleInterval - Интервал подписки на свечи, SUBSCRIPTION_INTERVAL_UNSPECIFIED - без подписки
+	CandleInterval pb.SubscriptionInterval
+	// WaitingClose - Присылать только завершенные свечи
+	WaitingClose bool
+	// OrderBookDepth - Глубина подписки на стаканы, 0 - без подписки
+	OrderBookDepth int32
+	// Trades - Подписка на обезличенные сделки
+	Trades bool
+	// LastPrices - Подписка на последние цены
+	LastPrices bool
+	// Exchange - Биржа, по расписанию которой движок запускает и останавливает торговую сессию.
+	// Если пусто, сессия начинается сразу и длится до остановки движка
+	Exchange string
+	// CancelAhead - Сессия завершается за CancelAhead до конца торгов
+	CancelAhead time.Duration
+	// SellOut - Закрывать позиции по инструментам стратегии в конце сессии
+	SellOut bool
+	// Currency, RequiredMoneyBalance - Перед началом сессии проверяется баланс в валюте Currency,
+	// в песочнице недостающая сумма пополняется автоматически. 0 - без проверки
+	Currency             string
+	RequiredMoneyBalance float64
+	// Orders - Исполнение поручений, по умолчанию OrdersServiceClient
+	Orders OrderRouter
+	// Positions - Начальные позиции счета, по умолчанию OperationsServiceClient
+	Positions PositionsSource
+	// MarketData - Создание источника биржевой информации на сессию, по умолчанию MarketDataStream
+	MarketData func() (MarketDataSource, error)
+	// OrderTrades - Создание источника исполнений поручений на сессию, по умолчанию TradesStream по AccountId
+	OrderTrades func() (OrderTradesSource, error)
+	// StopOrders - Исполнение стоп-заявок, по умолчанию StopOrdersServiceClient
+	StopOrders StopOrderRouter
+	// InstrumentsInfo - Информация об инструментах, для них запрос в InstrumentsService не выполняется.
+	// Вместе с Orders, Positions и Logger позволяет создать движок без клиента, например для тестирования на истории
+	InstrumentsInfo []EngineInstrument
+	// Logger - Логгер движка, по умолчанию логгер клиента
+	Logger Logger
+	// Clock - Текущее время для стратегии, по умолчанию time.Now
+	Clock func() time.Time
+	// Risk - Лимиты риск-менеджера, через который идут поручения движка. nil - без проверок
+	Risk *RiskConfig
+}
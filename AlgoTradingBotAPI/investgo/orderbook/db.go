@@ -0,0 +1,115 @@
+package orderbook
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// orderBookDB - Строка таблицы orderbooks, записанной order_book_download
+type orderBookDB struct {
+	Id            int64   `db:"id"`
+	Figi          string  `db:"figi"`
+	InstrumentUid string  `db:"instrument_uid"`
+	Depth         int32   `db:"depth"`
+	IsConsistent  bool    `db:"is_consistent"`
+	TimeUnix      int64   `db:"time_unix"`
+	LimitUp       float64 `db:"limit_up"`
+	LimitDown     float64 `db:"limit_down"`
+}
+
+// levelDB - Строка таблиц bids и asks
+type levelDB struct {
+	OrderBookId int64   `db:"orderbook_id"`
+	Price       float64 `db:"price"`
+	Quantity    int64   `db:"quantity"`
+}
+
+// LoadRequest - Параметры чтения записанных стаканов
+type LoadRequest struct {
+	// InstrumentId - figi или uid инструмента
+	InstrumentId string
+	// From, To - Интервал времени стаканов [From, To), нулевое значение To - без ограничения
+	From, To time.Time
+	// PriceStep - Шаг цены инструмента, цены в бд хранятся в float и округляются до этого шага.
+	// Если не задан, цены округляются до 1e-9
+	PriceStep *pb.Quotation
+}
+
+// LoadOrderBooks - Чтение стаканов из sqlite файла, записанного order_book_download (order_books.db),
+// стаканы возвращаются по возрастанию времени
+func LoadOrderBooks(path string, req LoadRequest) ([]*OrderBook, error) {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	to := req.To
+	if to.IsZero() {
+		to = time.Unix(1<<62, 0)
+	}
+	rows := make([]orderBookDB, 0)
+	err = db.Select(&rows, `select id, figi, instrument_uid, depth, is_consistent, time_unix, limit_up, limit_down
+		from orderbooks where (figi = ? or instrument_uid = ?) and time_unix >= ? and time_unix < ? order by time_unix, id`,
+		req.InstrumentId, req.InstrumentId, req.From.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []*OrderBook{}, nil
+	}
+
+	step := req.PriceStep
+	if step == nil {
+		step = &pb.Quotation{Nano: 1}
+	}
+	books := make([]*OrderBook, 0, len(rows))
+	byId := make(map[int64]*OrderBook, len(rows))
+	for _, r := range rows {
+		ob := &OrderBook{
+			Figi:          r.Figi,
+			InstrumentUid: r.InstrumentUid,
+			Depth:         r.Depth,
+			IsConsistent:  r.IsConsistent,
+			Time:          time.Unix(r.TimeUnix, 0).UTC(),
+			LimitUp:       investgo.FloatToQuotation(r.LimitUp, step),
+			LimitDown:     investgo.FloatToQuotation(r.LimitDown, step),
+			PriceStep:     req.PriceStep,
+			Bids:          make([]Level, 0, r.Depth),
+			Asks:          make([]Level, 0, r.Depth),
+		}
+		books = append(books, ob)
+		byId[r.Id] = ob
+	}
+
+	// уровни читаем одним запросом на сторону, rowid сохраняет порядок уровней из стрима
+	for _, table := range []string{"bids", "asks"} {
+		levels := make([]levelDB, 0)
+		err = db.Select(&levels, `select l.orderbook_id, l.price, l.quantity from `+table+` l
+			join orderbooks o on o.id = l.orderbook_id
+			where (o.figi = ? or o.instrument_uid = ?) and o.time_unix >= ? and o.time_unix < ? order by l.rowid`,
+			req.InstrumentId, req.InstrumentId, req.From.Unix(), to.Unix())
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range levels {
+			ob, ok := byId[l.OrderBookId]
+			if !ok {
+				continue
+			}
+			level := Level{Price: investgo.FloatToQuotation(l.Price, step), Quantity: l.Quantity}
+			if table == "bids" {
+				ob.Bids = append(ob.Bids, level)
+			} else {
+				ob.Asks = append(ob.Asks, level)
+			}
+		}
+	}
+	return books, nil
+}
@@ -0,0 +1,64 @@
+package orderbook
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// CSV_HEADER - Колонки csv при выгрузке стаканов
+var CSV_HEADER = []string{"time", "figi", "instrument_uid", "side", "level", "price", "quantity"}
+
+// CSVWriter - Выгрузка стаканов в csv, одна строка на ценовой уровень
+type CSVWriter struct {
+	w      *csv.Writer
+	levels int
+}
+
+// NewCSVWriter - Создание выгрузки в w, levels - сколько уровней каждой стороны выгружать, 0 - все уровни
+func NewCSVWriter(w io.Writer, levels int) (*CSVWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(CSV_HEADER); err != nil {
+		return nil, err
+	}
+	return &CSVWriter{
+		w:      cw,
+		levels: levels,
+	}, nil
+}
+
+// Write - Выгрузка стакана
+func (c *CSVWriter) Write(ob *OrderBook) error {
+	t := ob.Time.Format(time.RFC3339Nano)
+	for _, s := range []Side{BID, ASK} {
+		name := "bid"
+		if s == ASK {
+			name = "ask"
+		}
+		for i, l := range ob.side(s) {
+			if c.levels > 0 && i >= c.levels {
+				break
+			}
+			err := c.w.Write([]string{
+				t,
+				ob.Figi,
+				ob.InstrumentUid,
+				name,
+				strconv.Itoa(i),
+				strconv.FormatFloat(l.Price.ToFloat(), 'f', -1, 64),
+				strconv.FormatInt(l.Quantity, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush - Сброс выгрузки в w
+func (c *CSVWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,333 @@
+package orderbook
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Side - Сторона стакана
+type Side int
+
+const (
+	// BID - Заявки на покупку
+	BID Side = iota
+	// ASK - Заявки на продажу
+	ASK
+)
+
+// Level - Ценовой уровень стакана
+type Level struct {
+	Price    *pb.Quotation
+	Quantity int64
+}
+
+// OrderBook - Стакан по инструменту. Bids отсортированы по убыванию цены, Asks - по возрастанию.
+type OrderBook struct {
+	Figi          string
+	InstrumentUid string
+	Depth         int32
+	IsConsistent  bool
+	Time          time.Time
+	LimitUp       *pb.Quotation
+	LimitDown     *pb.Quotation
+	// PriceStep - Шаг цены инструмента, нужен для расчета спреда в шагах цены
+	PriceStep *pb.Quotation
+	Bids      []Level
+	Asks      []Level
+}
+
+// ErrEmptySide - Ошибка, если в стакане нет заявок с нужной стороны
+var ErrEmptySide = errors.New("order book side is empty")
+
+// NewOrderBook - Создание стакана из pb.OrderBook, step - шаг цены инструмента (min_price_increment), может быть nil
+func NewOrderBook(input *pb.OrderBook, step *pb.Quotation) *OrderBook {
+	ob := &OrderBook{
+		Figi:          input.GetFigi(),
+		InstrumentUid: input.GetInstrumentUid(),
+		Depth:         input.GetDepth(),
+		IsConsistent:  input.GetIsConsistent(),
+		Time:          input.GetTime().AsTime(),
+		LimitUp:       input.GetLimitUp(),
+		LimitDown:     input.GetLimitDown(),
+		PriceStep:     step,
+		Bids:          make([]Level, 0, len(input.GetBids())),
+		Asks:          make([]Level, 0, len(input.GetAsks())),
+	}
+	for _, o := range input.GetBids() {
+		ob.Bids = append(ob.Bids, Level{Price: o.GetPrice(), Quantity: o.GetQuantity()})
+	}
+	for _, o := range input.GetAsks() {
+		ob.Asks = append(ob.Asks, Level{Price: o.GetPrice(), Quantity: o.GetQuantity()})
+	}
+	return ob
+}
+
+// ToProto - Обратное преобразование в pb.OrderBook, например для воспроизведения записи стаканов в стратегии
+func (o *OrderBook) ToProto() *pb.OrderBook {
+	ob := &pb.OrderBook{
+		Figi:          o.Figi,
+		InstrumentUid: o.InstrumentUid,
+		Depth:         o.Depth,
+		IsConsistent:  o.IsConsistent,
+		Time:          timestamppb.New(o.Time),
+		LimitUp:       o.LimitUp,
+		LimitDown:     o.LimitDown,
+		Bids:          make([]*pb.Order, 0, len(o.Bids)),
+		Asks:          make([]*pb.Order, 0, len(o.Asks)),
+	}
+	for _, l := range o.Bids {
+		ob.Bids = append(ob.Bids, &pb.Order{Price: l.Price, Quantity: l.Quantity})
+	}
+	for _, l := range o.Asks {
+		ob.Asks = append(ob.Asks, &pb.Order{Price: l.Price, Quantity: l.Quantity})
+	}
+	return ob
+}
+
+// side - Уровни стороны стакана
+func (o *OrderBook) side(s Side) []Level {
+	if s == BID {
+		return o.Bids
+	}
+	return o.Asks
+}
+
+// BestBid - Лучшая цена покупки
+func (o *OrderBook) BestBid() (Level, error) {
+	if len(o.Bids) == 0 {
+		return Level{}, ErrEmptySide
+	}
+	return o.Bids[0], nil
+}
+
+// BestAsk - Лучшая цена продажи
+func (o *OrderBook) BestAsk() (Level, error) {
+	if len(o.Asks) == 0 {
+		return Level{}, ErrEmptySide
+	}
+	return o.Asks[0], nil
+}
+
+// best - Лучшие bid и ask
+func (o *OrderBook) best() (Level, Level, error) {
+	bid, err := o.BestBid()
+	if err != nil {
+		return Level{}, Level{}, err
+	}
+	ask, err := o.BestAsk()
+	if err != nil {
+		return Level{}, Level{}, err
+	}
+	return bid, ask, nil
+}
+
+// Spread - Разница между лучшей ценой продажи и лучшей ценой покупки
+func (o *OrderBook) Spread() (float64, error) {
+	bid, ask, err := o.best()
+	if err != nil {
+		return 0, err
+	}
+	return float64(nanos(ask.Price)-nanos(bid.Price)) / 1e9, nil
+}
+
+// SpreadTicks - Спред в шагах цены, требует PriceStep
+func (o *OrderBook) SpreadTicks() (int64, error) {
+	if nanos(o.PriceStep) <= 0 {
+		return 0, errors.New("price step is not set")
+	}
+	bid, ask, err := o.best()
+	if err != nil {
+		return 0, err
+	}
+	return (nanos(ask.Price) - nanos(bid.Price)) / nanos(o.PriceStep), nil
+}
+
+// Mid - Середина спреда
+func (o *OrderBook) Mid() (float64, error) {
+	bid, ask, err := o.best()
+	if err != nil {
+		return 0, err
+	}
+	return (bid.Price.ToFloat() + ask.Price.ToFloat()) / 2, nil
+}
+
+// MicroPrice - Середина спреда, взвешенная объемами лучших уровней: цена смещается к стороне с меньшим объемом
+func (o *OrderBook) MicroPrice() (float64, error) {
+	bid, ask, err := o.best()
+	if err != nil {
+		return 0, err
+	}
+	total := bid.Quantity + ask.Quantity
+	if total == 0 {
+		return (bid.Price.ToFloat() + ask.Price.ToFloat()) / 2, nil
+	}
+	return (bid.Price.ToFloat()*float64(ask.Quantity) + ask.Price.ToFloat()*float64(bid.Quantity)) / float64(total), nil
+}
+
+// CumulativeDepth - Накопленный объем в лотах по первым levels уровням стороны s, элемент i - объем уровней 0..i.
+// Если levels <= 0, учитываются все уровни.
+func (o *OrderBook) CumulativeDepth(s Side, levels int) []int64 {
+	side := o.side(s)
+	if levels <= 0 || levels > len(side) {
+		levels = len(side)
+	}
+	depth := make([]int64, levels)
+	var sum int64
+	for i := 0; i < levels; i++ {
+		sum += side[i].Quantity
+		depth[i] = sum
+	}
+	return depth
+}
+
+// TotalQuantity - Суммарный объем в лотах стороны s
+func (o *OrderBook) TotalQuantity(s Side) int64 {
+	var sum int64
+	for _, l := range o.side(s) {
+		sum += l.Quantity
+	}
+	return sum
+}
+
+// Imbalance - Дисбаланс стакана по первым levels уровням, взвешенный по глубине: уровень i имеет вес 1/(i+1).
+// Значение от -1 (только продавцы) до 1 (только покупатели). Если levels <= 0, учитываются все уровни.
+func (o *OrderBook) Imbalance(levels int) float64 {
+	weighted := func(side []Level) float64 {
+		n := levels
+		if n <= 0 || n > len(side) {
+			n = len(side)
+		}
+		var sum float64
+		for i := 0; i < n; i++ {
+			sum += float64(side[i].Quantity) / float64(i+1)
+		}
+		return sum
+	}
+	bids, asks := weighted(o.Bids), weighted(o.Asks)
+	if bids+asks == 0 {
+		return 0
+	}
+	return (bids - asks) / (bids + asks)
+}
+
+// Impact - Оценка исполнения рыночной заявки по текущему стакану
+type Impact struct {
+	// Filled - Кол-во лотов, которое можно исполнить по стакану
+	Filled int64
+	// AvgPrice - Средняя цена исполнения
+	AvgPrice float64
+	// WorstPrice - Цена самого дальнего затронутого уровня
+	WorstPrice float64
+	// Slippage - Отклонение средней цены от середины спреда в долях, всегда неотрицательное
+	Slippage float64
+}
+
+// PriceImpact - Оценка исполнения рыночной заявки на quantity лотов: покупка (BID) забирает уровни asks,
+// продажа (ASK) - уровни bids. Если объема стакана не хватает, Filled меньше quantity.
+func (o *OrderBook) PriceImpact(s Side, quantity int64) (Impact, error) {
+	levels := o.Asks
+	if s == ASK {
+		levels = o.Bids
+	}
+	if len(levels) == 0 {
+		return Impact{}, ErrEmptySide
+	}
+	impact := Impact{}
+	var cost float64
+	for _, l := range levels {
+		if impact.Filled >= quantity {
+			break
+		}
+		q := l.Quantity
+		if rest := quantity - impact.Filled; q > rest {
+			q = rest
+		}
+		impact.Filled += q
+		cost += float64(q) * l.Price.ToFloat()
+		impact.WorstPrice = l.Price.ToFloat()
+	}
+	if impact.Filled == 0 {
+		return impact, nil
+	}
+	impact.AvgPrice = cost / float64(impact.Filled)
+	if mid, err := o.Mid(); err == nil && mid > 0 {
+		impact.Slippage = math.Abs(impact.AvgPrice-mid) / mid
+	}
+	return impact, nil
+}
+
+// IsLimitUp - true, если лучшая цена покупки достигла верхней границы цены и купить дороже нельзя
+func (o *OrderBook) IsLimitUp() bool {
+	bid, err := o.BestBid()
+	return err == nil && nanos(o.LimitUp) > 0 && nanos(bid.Price) >= nanos(o.LimitUp)
+}
+
+// IsLimitDown - true, если лучшая цена продажи достигла нижней границы цены и продать дешевле нельзя
+func (o *OrderBook) IsLimitDown() bool {
+	ask, err := o.BestAsk()
+	return err == nil && nanos(o.LimitDown) > 0 && nanos(ask.Price) <= nanos(o.LimitDown)
+}
+
+// WithinLimits - true, если заявку с ценой price можно выставить с учетом границ LimitDown-LimitUp
+func (o *OrderBook) WithinLimits(price *pb.Quotation) bool {
+	p := nanos(price)
+	if nanos(o.LimitUp) > 0 && p > nanos(o.LimitUp) {
+		return false
+	}
+	return p >= nanos(o.LimitDown)
+}
+
+// LevelChange - Изменение объема на ценовом уровне между двумя снимками стакана
+type LevelChange struct {
+	Price *pb.Quotation
+	// Quantity - Объем уровня в новом снимке, 0 если уровень исчез
+	Quantity int64
+	// Delta - Изменение объема уровня
+	Delta int64
+}
+
+// BookDiff - Изменения стакана между двумя снимками
+type BookDiff struct {
+	Bids []LevelChange
+	Asks []LevelChange
+}
+
+// Diff - Изменения уровней стакана от prev к next. Уровни с неизменным объемом не попадают в результат.
+func Diff(prev, next *OrderBook) BookDiff {
+	return BookDiff{
+		Bids: diffSide(prev.Bids, next.Bids),
+		Asks: diffSide(prev.Asks, next.Asks),
+	}
+}
+
+func diffSide(prev, next []Level) []LevelChange {
+	changes := make([]LevelChange, 0)
+	old := make(map[int64]Level, len(prev))
+	for _, l := range prev {
+		old[nanos(l.Price)] = l
+	}
+	for _, l := range next {
+		key := nanos(l.Price)
+		was := old[key].Quantity
+		delete(old, key)
+		if delta := l.Quantity - was; delta != 0 {
+			changes = append(changes, LevelChange{Price: l.Price, Quantity: l.Quantity, Delta: delta})
+		}
+	}
+	// уровни, которых нет в новом снимке, в порядке исходного стакана
+	for _, l := range prev {
+		if _, ok := old[nanos(l.Price)]; ok {
+			changes = append(changes, LevelChange{Price: l.Price, Quantity: 0, Delta: -l.Quantity})
+		}
+	}
+	return changes
+}
+
+// nanos - Цена в миллиардных долях для точного сравнения
+func nanos(q *pb.Quotation) int64 {
+	return q.GetUnits()*1e9 + int64(q.GetNano())
+}
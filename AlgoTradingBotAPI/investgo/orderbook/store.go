@@ -0,0 +1,522 @@
+package orderbook
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// STORE_HEADER - Заголовок файла хранилища стаканов
+	STORE_HEADER = "INVESTGO-OB-1\n"
+	// STORE_EXT - Расширение файлов хранилища стаканов
+	STORE_EXT = ".obz"
+	// KEYFRAME_INTERVAL - Каждый KEYFRAME_INTERVAL-й стакан инструмента записывается целиком, остальные - как
+	// изменения относительно предыдущего стакана
+	KEYFRAME_INTERVAL = 100
+	// FLUSH_INTERVAL - Кол-во записанных стаканов, после которого данные сбрасываются на диск
+	FLUSH_INTERVAL = 1000
+)
+
+const (
+	recordSnapshot byte = iota + 1
+	recordDelta
+)
+
+// MSK - Часовой пояс, по которому определяется торговый день для ротации файлов
+var MSK = time.FixedZone("MSK", 3*60*60)
+
+// Store - Компактное хранилище стаканов на диске. Стаканы пишутся в сжатые gzip файлы, по одному файлу на
+// торговый день (dir/2023-10-02.obz), внутри файла для каждого инструмента периодически пишется полный
+// стакан, а между ними - только изменившиеся уровни. Методы потокобезопасны.
+type Store struct {
+	mx       sync.Mutex
+	dir      string
+	location *time.Location
+	logger   investgo.Logger
+
+	day    string
+	file   *os.File
+	gz     *gzip.Writer
+	writer *bufio.Writer
+	count  int
+	// last - Последний записанный стакан и кол-во стаканов с последнего полного по uid инструмента
+	last   map[string]*OrderBook
+	deltas map[string]int
+	buf    bytes.Buffer
+}
+
+// NewStore - Создание хранилища стаканов в директории dir, loc - часовой пояс торгового дня, если nil, то MSK
+func NewStore(dir string, loc *time.Location, l investgo.Logger) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		loc = MSK
+	}
+	return &Store{
+		dir:      dir,
+		location: loc,
+		logger:   l,
+		last:     make(map[string]*OrderBook),
+		deltas:   make(map[string]int),
+	}, nil
+}
+
+// Write - Запись стакана, при смене торгового дня текущий файл закрывается и открывается новый
+func (s *Store) Write(ob *OrderBook) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if day := ob.Time.In(s.location).Format(time.DateOnly); day != s.day {
+		if err := s.rotate(day); err != nil {
+			return err
+		}
+	}
+	s.buf.Reset()
+	prev, ok := s.last[ob.InstrumentUid]
+	if !ok || s.deltas[ob.InstrumentUid] >= KEYFRAME_INTERVAL-1 {
+		encodeSnapshot(&s.buf, ob)
+		s.deltas[ob.InstrumentUid] = 0
+	} else {
+		encodeDelta(&s.buf, ob, Diff(prev, ob))
+		s.deltas[ob.InstrumentUid]++
+	}
+	s.last[ob.InstrumentUid] = ob
+
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(s.buf.Len()))
+	if _, err := s.writer.Write(prefix[:n]); err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	s.count++
+	if s.count%FLUSH_INTERVAL == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// Flush - Сброс записанных стаканов на диск
+func (s *Store) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.flush()
+}
+
+// Close - Сброс данных и закрытие текущего файла
+func (s *Store) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.close()
+}
+
+func (s *Store) flush() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.gz.Flush()
+}
+
+func (s *Store) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := errors.Join(s.writer.Flush(), s.gz.Close(), s.file.Close())
+	s.file, s.gz, s.writer = nil, nil, nil
+	return err
+}
+
+// rotate - Открытие файла торгового дня day. Если файл дня уже есть, например после перезапуска,
+// создается следующая часть dir/day.1.obz, чтобы не дописывать в возможно поврежденный файл.
+func (s *Store) rotate(day string) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, day+STORE_EXT)
+	for part := 1; ; part++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		path = filepath.Join(s.dir, fmt.Sprintf("%v.%v%v", day, part, STORE_EXT))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.gz = gzip.NewWriter(file)
+	s.writer = bufio.NewWriter(s.gz)
+	s.day = day
+	// файл должен читаться независимо от предыдущих, поэтому начинаем с полных стаканов
+	s.last = make(map[string]*OrderBook)
+	s.deltas = make(map[string]int)
+	if s.logger != nil {
+		s.logger.Infof("order books are written to %v", path)
+	}
+	_, err = s.writer.WriteString(STORE_HEADER)
+	return err
+}
+
+// StoreReader - Последовательное чтение файла хранилища стаканов
+type StoreReader struct {
+	file   *os.File
+	gz     *gzip.Reader
+	reader *bufio.Reader
+	last   map[string]*OrderBook
+}
+
+// NewStoreReader - Открытие файла хранилища стаканов path для чтения
+func NewStoreReader(path string) (*StoreReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	reader := bufio.NewReader(gz)
+	header := make([]byte, len(STORE_HEADER))
+	if _, err = io.ReadFull(reader, header); err != nil || string(header) != STORE_HEADER {
+		return nil, errors.Join(fmt.Errorf("%v is not an order book store file", path), file.Close())
+	}
+	return &StoreReader{
+		file:   file,
+		gz:     gz,
+		reader: reader,
+		last:   make(map[string]*OrderBook),
+	}, nil
+}
+
+// Next - Следующий стакан из файла, в конце файла возвращает io.EOF. Недописанный конец файла, например
+// после аварийного завершения записи, тоже считается концом файла.
+func (r *StoreReader) Next() (*OrderBook, error) {
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, endOfStore(err)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r.reader, data); err != nil {
+		return nil, endOfStore(err)
+	}
+	ob, err := decodeRecord(bytes.NewReader(data), r.last)
+	if err != nil {
+		return nil, err
+	}
+	r.last[ob.InstrumentUid] = ob
+	return ob, nil
+}
+
+// Close - Закрытие файла
+func (r *StoreReader) Close() error {
+	return errors.Join(r.gz.Close(), r.file.Close())
+}
+
+// endOfStore - Обрыв gzip потока или записи считается концом файла
+func endOfStore(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) {
+		return io.EOF
+	}
+	return err
+}
+
+// QueryRequest - Параметры чтения стаканов из хранилища
+type QueryRequest struct {
+	// Instruments - uid или figi инструментов, если пусто - все инструменты
+	Instruments []string
+	// From, To - Интервал времени стаканов [From, To)
+	From, To time.Time
+	// Location - Часовой пояс торгового дня, с которым писалось хранилище, если nil, то MSK
+	Location *time.Location
+}
+
+// StoreFiles - Файлы хранилища в директории dir за торговые дни, пересекающиеся с [from, to), по возрастанию дня
+func StoreFiles(dir string, from, to time.Time, loc *time.Location) ([]string, error) {
+	if loc == nil {
+		loc = MSK
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	firstDay := from.In(loc).Format(time.DateOnly)
+	lastDay := to.Add(-time.Nanosecond).In(loc).Format(time.DateOnly)
+	files := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, STORE_EXT) || len(name) < len(time.DateOnly) {
+			continue
+		}
+		if day := name[:len(time.DateOnly)]; day >= firstDay && day <= lastDay {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// части одного дня идут после основного файла: 2023-10-02.obz, 2023-10-02.1.obz, ...
+	sort.Slice(files, func(i, j int) bool {
+		di, dj := filepath.Base(files[i])[:len(time.DateOnly)], filepath.Base(files[j])[:len(time.DateOnly)]
+		if di != dj {
+			return di < dj
+		}
+		return len(files[i]) < len(files[j]) || len(files[i]) == len(files[j]) && files[i] < files[j]
+	})
+	return files, nil
+}
+
+// Query - Чтение стаканов из хранилища dir за интервал [From, To), fn вызывается для каждого стакана по порядку
+// записи. Если fn возвращает ошибку, чтение прекращается.
+func Query(dir string, req QueryRequest, fn func(ob *OrderBook) error) error {
+	files, err := StoreFiles(dir, req.From, req.To, req.Location)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]struct{}, len(req.Instruments))
+	for _, id := range req.Instruments {
+		ids[id] = struct{}{}
+	}
+	for _, path := range files {
+		if err = queryFile(path, req, ids, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryFile(path string, req QueryRequest, ids map[string]struct{}, fn func(ob *OrderBook) error) error {
+	r, err := NewStoreReader(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	for {
+		ob, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ob.Time.Before(req.From) || !ob.Time.Before(req.To) {
+			continue
+		}
+		if len(ids) > 0 {
+			_, uid := ids[ob.InstrumentUid]
+			_, figi := ids[ob.Figi]
+			if !uid && !figi {
+				continue
+			}
+		}
+		if err = fn(ob); err != nil {
+			return err
+		}
+	}
+}
+
+// QueryAll - Чтение всех стаканов из хранилища за интервал в слайс
+func QueryAll(dir string, req QueryRequest) ([]*OrderBook, error) {
+	books := make([]*OrderBook, 0)
+	err := Query(dir, req, func(ob *OrderBook) error {
+		books = append(books, ob)
+		return nil
+	})
+	return books, err
+}
+
+// encodeHeader - Общая часть записи: инструмент, время, глубина, признак консистентности и лимиты цены
+func encodeHeader(w *bytes.Buffer, kind byte, ob *OrderBook) {
+	w.WriteByte(kind)
+	putString(w, ob.InstrumentUid)
+	putString(w, ob.Figi)
+	putInt(w, ob.Time.UnixNano())
+	putInt(w, int64(ob.Depth))
+	if ob.IsConsistent {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	putInt(w, nanos(ob.LimitUp))
+	putInt(w, nanos(ob.LimitDown))
+}
+
+func encodeSnapshot(w *bytes.Buffer, ob *OrderBook) {
+	encodeHeader(w, recordSnapshot, ob)
+	for _, side := range [][]Level{ob.Bids, ob.Asks} {
+		putInt(w, int64(len(side)))
+		// цены уровней пишутся как разница с предыдущим уровнем, так varint занимает 1-2 байта
+		var prev int64
+		for _, l := range side {
+			p := nanos(l.Price)
+			putInt(w, p-prev)
+			putInt(w, l.Quantity)
+			prev = p
+		}
+	}
+}
+
+func encodeDelta(w *bytes.Buffer, ob *OrderBook, diff BookDiff) {
+	encodeHeader(w, recordDelta, ob)
+	for _, side := range [][]LevelChange{diff.Bids, diff.Asks} {
+		putInt(w, int64(len(side)))
+		var prev int64
+		for _, c := range side {
+			p := nanos(c.Price)
+			putInt(w, p-prev)
+			putInt(w, c.Quantity)
+			prev = p
+		}
+	}
+}
+
+// decodeRecord - Чтение записи, для изменений нужен предыдущий стакан инструмента из last
+func decodeRecord(r *bytes.Reader, last map[string]*OrderBook) (*OrderBook, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	ob := &OrderBook{}
+	if ob.InstrumentUid, err = getString(r); err != nil {
+		return nil, err
+	}
+	if ob.Figi, err = getString(r); err != nil {
+		return nil, err
+	}
+	values := make([]int64, 2)
+	for i := range values {
+		if values[i], err = binary.ReadVarint(r); err != nil {
+			return nil, err
+		}
+	}
+	ob.Time = time.Unix(0, values[0]).UTC()
+	ob.Depth = int32(values[1])
+	consistent, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	ob.IsConsistent = consistent == 1
+	limits := make([]int64, 2)
+	for i := range limits {
+		if limits[i], err = binary.ReadVarint(r); err != nil {
+			return nil, err
+		}
+	}
+	ob.LimitUp, ob.LimitDown = quotation(limits[0]), quotation(limits[1])
+
+	sides := make([][]Level, 2)
+	for i := range sides {
+		if sides[i], err = getLevels(r); err != nil {
+			return nil, err
+		}
+	}
+	switch kind {
+	case recordSnapshot:
+		ob.Bids, ob.Asks = sides[0], sides[1]
+	case recordDelta:
+		prev, ok := last[ob.InstrumentUid]
+		if !ok {
+			return nil, fmt.Errorf("%v order book delta without snapshot", ob.InstrumentUid)
+		}
+		ob.Bids = applyChanges(prev.Bids, sides[0], true)
+		ob.Asks = applyChanges(prev.Asks, sides[1], false)
+	default:
+		return nil, fmt.Errorf("unknown order book record kind %v", kind)
+	}
+	return ob, nil
+}
+
+func getLevels(r *bytes.Reader) ([]Level, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(r.Len()) {
+		return nil, fmt.Errorf("invalid order book levels count %v", n)
+	}
+	levels := make([]Level, 0, n)
+	var price int64
+	for i := int64(0); i < n; i++ {
+		diff, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		price += diff
+		levels = append(levels, Level{Price: quotation(price), Quantity: quantity})
+	}
+	return levels, nil
+}
+
+// applyChanges - Применение изменений уровней к предыдущему стакану, уровни с нулевым объемом удаляются
+func applyChanges(prev []Level, changes []Level, desc bool) []Level {
+	levels := make(map[int64]Level, len(prev)+len(changes))
+	for _, l := range prev {
+		levels[nanos(l.Price)] = l
+	}
+	for _, c := range changes {
+		if c.Quantity == 0 {
+			delete(levels, nanos(c.Price))
+		} else {
+			levels[nanos(c.Price)] = c
+		}
+	}
+	side := make([]Level, 0, len(levels))
+	for _, l := range levels {
+		side = append(side, l)
+	}
+	sort.Slice(side, func(i, j int) bool {
+		if desc {
+			return nanos(side[i].Price) > nanos(side[j].Price)
+		}
+		return nanos(side[i].Price) < nanos(side[j].Price)
+	})
+	return side
+}
+
+func putInt(w *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func putString(w *bytes.Buffer, s string) {
+	putInt(w, int64(len(s)))
+	w.WriteString(s)
+}
+
+func getString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > int64(r.Len()) {
+		return "", fmt.Errorf("invalid string length %v", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// quotation - Цена из миллиардных долей
+func quotation(n int64) *pb.Quotation {
+	return &pb.Quotation{Units: n / investgo.BILLION, Nano: int32(n % investgo.BILLION)}
+}
@@ -0,0 +1,612 @@
+package investgo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+// RiskConfig - Лимиты риск-менеджера, нулевое значение лимита - без ограничения
+type RiskConfig struct {
+	// MaxOrderValue - Максимальная стоимость одного поручения
+	MaxOrderValue float64 `yaml:"MaxOrderValue"`
+	// MaxPositionValue - Максимальная стоимость позиции по одному инструменту с учетом активных поручений
+	MaxPositionValue float64 `yaml:"MaxPositionValue"`
+	// MaxTotalPositionValue - Максимальная стоимость позиций по всем инструментам с учетом активных поручений
+	MaxTotalPositionValue float64 `yaml:"MaxTotalPositionValue"`
+	// MaxDailyLoss - Максимальный убыток за день по зафиксированному и текущему результату,
+	// после его достижения принимаются только поручения на сокращение позиций
+	MaxDailyLoss float64 `yaml:"MaxDailyLoss"`
+	// MaxOrdersPerMinute - Максимальное кол-во поручений за последнюю минуту
+	MaxOrdersPerMinute int `yaml:"MaxOrdersPerMinute"`
+	// PriceCollar - Максимальное отклонение цены лимитного поручения от последней цены в процентах
+	PriceCollar float64 `yaml:"PriceCollar"`
+	// BlockedInstruments - uid или figi инструментов, поручения по которым запрещены
+	BlockedInstruments []string `yaml:"BlockedInstruments"`
+	// Clock - Текущее время, по умолчанию time.Now
+	Clock func() time.Time `yaml:"-"`
+}
+
+// Validate - Проверка лимитов, отрицательные значения считаются ошибкой
+func (c RiskConfig) Validate() error {
+	var errs []error
+	limits := []struct {
+		name  string
+		value float64
+	}{
+		{"MaxOrderValue", c.MaxOrderValue},
+		{"MaxPositionValue", c.MaxPositionValue},
+		{"MaxTotalPositionValue", c.MaxTotalPositionValue},
+		{"MaxDailyLoss", c.MaxDailyLoss},
+		{"MaxOrdersPerMinute", float64(c.MaxOrdersPerMinute)},
+		{"PriceCollar", c.PriceCollar},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			errs = append(errs, fmt.Errorf("Risk.%v must not be negative, got %v", l.name, l.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RiskRule - Правило риск-менеджера, по которому отклонено поручение
+type RiskRule int
+
+const (
+	// RISK_BLOCKED - Инструмент в списке запрещенных
+	RISK_BLOCKED RiskRule = iota
+	// RISK_ORDER_RATE - Превышено кол-во поручений в минуту
+	RISK_ORDER_RATE
+	// RISK_PRICE_COLLAR - Цена лимитного поручения слишком далеко от последней цены
+	RISK_PRICE_COLLAR
+	// RISK_PRICE_LIMIT - Цена лимитного поручения вне LimitUp/LimitDown
+	RISK_PRICE_LIMIT
+	// RISK_UNKNOWN_PRICE - Для рыночного поручения нет последней цены, стоимость не проверить
+	RISK_UNKNOWN_PRICE
+	// RISK_ORDER_VALUE - Превышена стоимость поручения
+	RISK_ORDER_VALUE
+	// RISK_POSITION_VALUE - Превышена стоимость позиции по инструменту
+	RISK_POSITION_VALUE
+	// RISK_TOTAL_VALUE - Превышена стоимость всех позиций
+	RISK_TOTAL_VALUE
+	// RISK_DAILY_LOSS - Достигнут дневной убыток
+	RISK_DAILY_LOSS
+)
+
+var riskRuleNames = []string{"blocked instrument", "order rate", "price collar", "price limit", "unknown price",
+	"order value", "position value", "total position value", "daily loss"}
+
+func (r RiskRule) String() string {
+	if r < 0 || int(r) >= len(riskRuleNames) {
+		return fmt.Sprintf("RiskRule(%d)", int(r))
+	}
+	return riskRuleNames[r]
+}
+
+// ErrRiskRejected - Поручение отклонено риск-менеджером, errors.Is(err, ErrRiskRejected) верно для любого RiskError
+var ErrRiskRejected = errors.New("order rejected by risk manager")
+
+// RiskError - Нарушение правила Rule по инструменту InstrumentId: значение Value при лимите Limit
+type RiskError struct {
+	Rule         RiskRule
+	InstrumentId string
+	Limit        float64
+	Value        float64
+}
+
+func (e *RiskError) Error() string {
+	return fmt.Sprintf("risk: %v %v rejected, value = %.2f, limit = %.2f", e.Rule, e.InstrumentId, e.Value, e.Limit)
+}
+
+// Is - Сравнение с ErrRiskRejected
+func (e *RiskError) Is(target error) bool {
+	return target == ErrRiskRejected
+}
+
+// pendingOrder - Неисполненный остаток поручения, прошедшего проверку
+type pendingOrder struct {
+	uid string
+	// lots - Остаток в лотах, отрицательный для продажи
+	lots int64
+}
+
+// RiskManager - Риск-менеджер, проверяет поручения перед отправкой в OrderRouter и отклоняет нарушения лимитов.
+// Позиции, результат и цены ведутся по сообщениям Handle, начальные позиции задаются SetPosition.
+// Поручения, которые только сокращают позицию, не проверяются по стоимости и убытку, чтобы выход из позиций был возможен
+type RiskManager struct {
+	orders OrderRouter
+	config RiskConfig
+	logger Logger
+
+	mx          sync.Mutex
+	instruments map[string]EngineInstrument
+	figiToUid   map[string]string
+	blocked     map[string]struct{}
+	positions   map[string]Position
+	lastPrices  map[string]float64
+	limitUp     map[string]float64
+	limitDown   map[string]float64
+	// pending - Неисполненные остатки выставленных поручений, unmatched - исполнения по биржевым id поручений,
+	// которых еще нет в pending: сделка может прийти раньше ответа на PostOrder. Оба сбрасываются в начале
+	// торгового дня, так как дневные поручения снимаются в конце сессии
+	pending    map[string]pendingOrder
+	unmatched  map[string]int64
+	orderTimes []time.Time
+	day        time.Time
+	// dayRealized - Зафиксированный результат на начало дня
+	dayRealized float64
+	rejected    int
+}
+
+// riskLocation - Торговый день считается по московскому времени
+var riskLocation = time.FixedZone("MSK", 3*60*60)
+
+// NewRiskManager - Создание риск-менеджера перед orders. Лотность инструментов берется из instruments,
+// для остальных инструментов лот считается равным 1
+func NewRiskManager(orders OrderRouter, instruments []EngineInstrument, config RiskConfig, l Logger) *RiskManager {
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	r := &RiskManager{
+		orders:      orders,
+		config:      config,
+		logger:      l,
+		instruments: make(map[string]EngineInstrument, len(instruments)),
+		figiToUid:   make(map[string]string, len(instruments)),
+		blocked:     make(map[string]struct{}, len(config.BlockedInstruments)),
+		positions:   make(map[string]Position),
+		lastPrices:  make(map[string]float64),
+		limitUp:     make(map[string]float64),
+		limitDown:   make(map[string]float64),
+		pending:     make(map[string]pendingOrder),
+		unmatched:   make(map[string]int64),
+	}
+	for _, instrument := range instruments {
+		r.instruments[instrument.Uid] = instrument
+		r.figiToUid[instrument.Figi] = instrument.Uid
+	}
+	for _, id := range config.BlockedInstruments {
+		r.blocked[id] = struct{}{}
+	}
+	return r
+}
+
+// PostOrder - Проверка и выставление поручения, при нарушении лимита возвращается *RiskError
+func (r *RiskManager) PostOrder(req *PostOrderRequest) (*PostOrderResponse, error) {
+	r.mx.Lock()
+	uid := r.uid(req.InstrumentId)
+	err := r.check(uid, req.Direction, req.Quantity, req.OrderType, req.Price)
+	if err != nil {
+		r.mx.Unlock()
+		return r.reject(err)
+	}
+	r.register(req.OrderId, uid, req.Direction, req.Quantity)
+	r.mx.Unlock()
+
+	resp, err := r.orders.PostOrder(req)
+	r.mx.Lock()
+	if err != nil || rejectedStatus(resp.GetExecutionReportStatus()) {
+		delete(r.pending, req.OrderId)
+	} else {
+		// исполнения и отмена приходят с биржевым id поручения
+		r.rekey(req.OrderId, resp.GetOrderId())
+	}
+	r.mx.Unlock()
+	return resp, err
+}
+
+// rejectedStatus - Поручение отклонено или снято сразу при выставлении, его остаток не исполнится
+func rejectedStatus(status pb.OrderExecutionReportStatus) bool {
+	return status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED ||
+		status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+}
+
+// rekey - Перенос поручения с ключа клиента на биржевой id с учетом исполнений, пришедших до ответа
+func (r *RiskManager) rekey(orderId, exchangeId string) {
+	if exchangeId == "" || exchangeId == orderId {
+		return
+	}
+	o, ok := r.pending[orderId]
+	if !ok {
+		return
+	}
+	delete(r.pending, orderId)
+	if filled, ok := r.unmatched[exchangeId]; ok {
+		delete(r.unmatched, exchangeId)
+		lots := o.lots - filled
+		if lots == 0 || (lots > 0) != (o.lots > 0) {
+			return
+		}
+		o.lots = lots
+	}
+	r.pending[exchangeId] = o
+}
+
+// Buy - Проверка и выставление поручения на покупку
+func (r *RiskManager) Buy(req *PostOrderRequestShort) (*PostOrderResponse, error) {
+	return r.PostOrder(requestWithDirection(req, pb.OrderDirection_ORDER_DIRECTION_BUY))
+}
+
+// Sell - Проверка и выставление поручения на продажу
+func (r *RiskManager) Sell(req *PostOrderRequestShort) (*PostOrderResponse, error) {
+	return r.PostOrder(requestWithDirection(req, pb.OrderDirection_ORDER_DIRECTION_SELL))
+}
+
+func requestWithDirection(req *PostOrderRequestShort, direction pb.OrderDirection) *PostOrderRequest {
+	return &PostOrderRequest{
+		InstrumentId: req.InstrumentId,
+		Quantity:     req.Quantity,
+		Price:        req.Price,
+		Direction:    direction,
+		AccountId:    req.AccountId,
+		OrderType:    req.OrderType,
+		OrderId:      req.OrderId,
+	}
+}
+
+// CancelOrder - Отмена поручения, его остаток больше не учитывается в позициях
+func (r *RiskManager) CancelOrder(accountId, orderId string) (*CancelOrderResponse, error) {
+	resp, err := r.orders.CancelOrder(accountId, orderId)
+	if err == nil {
+		r.mx.Lock()
+		delete(r.pending, orderId)
+		r.mx.Unlock()
+	}
+	return resp, err
+}
+
+// ReplaceOrder - Проверка новой цены и кол-ва и изменение поручения. OrderRouter должен поддерживать ReplaceOrder,
+// например OrdersServiceClient
+func (r *RiskManager) ReplaceOrder(req *ReplaceOrderRequest) (*PostOrderResponse, error) {
+	replacer, ok := r.orders.(interface {
+		ReplaceOrder(req *ReplaceOrderRequest) (*PostOrderResponse, error)
+	})
+	if !ok {
+		return nil, errors.New("order router does not support replace order")
+	}
+	r.mx.Lock()
+	old, known := r.pending[req.OrderId]
+	if known {
+		// старое поручение заменяется новым, поэтому его остаток не учитывается в проверке
+		delete(r.pending, req.OrderId)
+		direction := pb.OrderDirection_ORDER_DIRECTION_BUY
+		if old.lots < 0 {
+			direction = pb.OrderDirection_ORDER_DIRECTION_SELL
+		}
+		if err := r.check(old.uid, direction, req.Quantity, pb.OrderType_ORDER_TYPE_LIMIT, req.Price); err != nil {
+			r.pending[req.OrderId] = old
+			r.mx.Unlock()
+			return r.reject(err)
+		}
+		r.register(req.NewOrderId, old.uid, direction, req.Quantity)
+	}
+	r.mx.Unlock()
+
+	resp, err := replacer.ReplaceOrder(req)
+	if known {
+		r.mx.Lock()
+		switch {
+		case err != nil:
+			delete(r.pending, req.NewOrderId)
+			r.pending[req.OrderId] = old
+		case rejectedStatus(resp.GetExecutionReportStatus()):
+			delete(r.pending, req.NewOrderId)
+		default:
+			r.rekey(req.NewOrderId, resp.GetOrderId())
+		}
+		r.mx.Unlock()
+	}
+	return resp, err
+}
+
+// Check - Проверка поручения без выставления, nil или *RiskError
+func (r *RiskManager) Check(req *PostOrderRequest) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.check(r.uid(req.InstrumentId), req.Direction, req.Quantity, req.OrderType, req.Price)
+}
+
+// reject - Учет и логирование отклоненного поручения, ответ содержит причину в заголовке message
+func (r *RiskManager) reject(err error) (*PostOrderResponse, error) {
+	r.mx.Lock()
+	r.rejected++
+	r.mx.Unlock()
+	r.logger.Errorf(err.Error())
+	return &PostOrderResponse{Header: metadata.Pairs("message", err.Error())}, err
+}
+
+// check - Проверка всех правил, вызывается под мьютексом
+func (r *RiskManager) check(uid string, direction pb.OrderDirection, quantity int64, orderType pb.OrderType,
+	price *pb.Quotation) error {
+	c := r.config
+	now := c.Clock()
+	if _, ok := r.blocked[uid]; ok {
+		return &RiskError{Rule: RISK_BLOCKED, InstrumentId: uid}
+	}
+	if _, ok := r.blocked[r.instruments[uid].Figi]; ok {
+		return &RiskError{Rule: RISK_BLOCKED, InstrumentId: uid}
+	}
+	if c.MaxOrdersPerMinute > 0 {
+		r.trimOrderTimes(now)
+		if len(r.orderTimes) >= c.MaxOrdersPerMinute {
+			return &RiskError{Rule: RISK_ORDER_RATE, InstrumentId: uid, Limit: float64(c.MaxOrdersPerMinute),
+				Value: float64(len(r.orderTimes) + 1)}
+		}
+	}
+	last, known := r.lastPrices[uid]
+	orderPrice := last
+	if orderType != pb.OrderType_ORDER_TYPE_MARKET && price != nil {
+		orderPrice = price.ToFloat()
+		if up := r.limitUp[uid]; up > 0 && orderPrice > up {
+			return &RiskError{Rule: RISK_PRICE_LIMIT, InstrumentId: uid, Limit: up, Value: orderPrice}
+		}
+		if down := r.limitDown[uid]; down > 0 && orderPrice < down {
+			return &RiskError{Rule: RISK_PRICE_LIMIT, InstrumentId: uid, Limit: down, Value: orderPrice}
+		}
+		if c.PriceCollar > 0 && known && last > 0 {
+			if deviation := math.Abs(orderPrice-last) / last * 100; deviation > c.PriceCollar {
+				return &RiskError{Rule: RISK_PRICE_COLLAR, InstrumentId: uid, Limit: c.PriceCollar, Value: deviation}
+			}
+		}
+	}
+
+	lots := quantity
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		lots = -quantity
+	}
+	// поручение только сокращает позицию, если вместе с уже выставленными поручениями на сокращение
+	// оно не больше позиции
+	if remaining := r.reducible(uid); remaining != 0 && (remaining > 0) != (lots > 0) && abs(lots) <= abs(remaining) {
+		return nil
+	}
+	if c.MaxOrderValue <= 0 && c.MaxPositionValue <= 0 && c.MaxTotalPositionValue <= 0 && c.MaxDailyLoss <= 0 {
+		return nil
+	}
+	if c.MaxDailyLoss > 0 {
+		if pnl := r.dailyPnL(now); pnl <= -c.MaxDailyLoss {
+			return &RiskError{Rule: RISK_DAILY_LOSS, InstrumentId: uid, Limit: c.MaxDailyLoss, Value: -pnl}
+		}
+	}
+	if orderPrice <= 0 {
+		if c.MaxOrderValue > 0 || c.MaxPositionValue > 0 || c.MaxTotalPositionValue > 0 {
+			return &RiskError{Rule: RISK_UNKNOWN_PRICE, InstrumentId: uid}
+		}
+		return nil
+	}
+	lot := float64(r.lot(uid))
+	if value := orderPrice * float64(quantity) * lot; c.MaxOrderValue > 0 && value > c.MaxOrderValue {
+		return &RiskError{Rule: RISK_ORDER_VALUE, InstrumentId: uid, Limit: c.MaxOrderValue, Value: value}
+	}
+	exposure := r.exposure(uid) + lots
+	if value := float64(abs(exposure)) * orderPrice * lot; c.MaxPositionValue > 0 && value > c.MaxPositionValue {
+		return &RiskError{Rule: RISK_POSITION_VALUE, InstrumentId: uid, Limit: c.MaxPositionValue, Value: value}
+	}
+	if c.MaxTotalPositionValue > 0 {
+		total := float64(abs(exposure)) * orderPrice * lot
+		for id := range r.exposures() {
+			if id == uid {
+				continue
+			}
+			total += float64(abs(r.exposure(id))) * r.lastPrices[id] * float64(r.lot(id))
+		}
+		if total > c.MaxTotalPositionValue {
+			return &RiskError{Rule: RISK_TOTAL_VALUE, InstrumentId: uid, Limit: c.MaxTotalPositionValue, Value: total}
+		}
+	}
+	return nil
+}
+
+// register - Учет поручения, прошедшего проверку
+func (r *RiskManager) register(orderId, uid string, direction pb.OrderDirection, quantity int64) {
+	r.orderTimes = append(r.orderTimes, r.config.Clock())
+	lots := quantity
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		lots = -quantity
+	}
+	r.pending[orderId] = pendingOrder{uid: uid, lots: lots}
+}
+
+// trimOrderTimes - Отбрасывание поручений старше минуты
+func (r *RiskManager) trimOrderTimes(now time.Time) {
+	from := now.Add(-time.Minute)
+	i := 0
+	for i < len(r.orderTimes) && !r.orderTimes[i].After(from) {
+		i++
+	}
+	r.orderTimes = r.orderTimes[i:]
+}
+
+// exposure - Позиция в лотах с учетом неисполненных остатков поручений
+func (r *RiskManager) exposure(uid string) int64 {
+	lots := r.positions[uid].Lots
+	for _, o := range r.pending {
+		if o.uid == uid {
+			lots += o.lots
+		}
+	}
+	return lots
+}
+
+// reducible - Позиция в лотах за вычетом неисполненных остатков поручений в сторону ее сокращения
+func (r *RiskManager) reducible(uid string) int64 {
+	position := r.positions[uid].Lots
+	remaining := position
+	for _, o := range r.pending {
+		if o.uid == uid && position != 0 && (o.lots > 0) != (position > 0) {
+			remaining += o.lots
+		}
+	}
+	if remaining != 0 && (remaining > 0) != (position > 0) {
+		return 0
+	}
+	return remaining
+}
+
+// exposures - Инструменты с позициями или активными поручениями
+func (r *RiskManager) exposures() map[string]struct{} {
+	ids := make(map[string]struct{}, len(r.positions))
+	for id, p := range r.positions {
+		if p.Lots != 0 {
+			ids[id] = struct{}{}
+		}
+	}
+	for _, o := range r.pending {
+		ids[o.uid] = struct{}{}
+	}
+	return ids
+}
+
+// dailyPnL - Зафиксированный за день результат и текущий результат открытых позиций
+func (r *RiskManager) dailyPnL(now time.Time) float64 {
+	y, m, d := now.In(riskLocation).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, riskLocation)
+	var realized, unrealized float64
+	for id, p := range r.positions {
+		realized += p.RealizedPnL
+		if last, ok := r.lastPrices[id]; ok && p.Lots != 0 {
+			unrealized += (last - p.AvgPrice) * float64(p.Lots*r.lot(id))
+		}
+	}
+	if !day.Equal(r.day) {
+		r.day = day
+		r.dayRealized = realized
+		r.pending = make(map[string]pendingOrder)
+		r.unmatched = make(map[string]int64)
+	}
+	return realized - r.dayRealized + unrealized
+}
+
+// DailyPnL - Результат за текущий день: зафиксированный и текущий по последним ценам
+func (r *RiskManager) DailyPnL() float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.dailyPnL(r.config.Clock())
+}
+
+// Rejected - Кол-во отклоненных поручений
+func (r *RiskManager) Rejected() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.rejected
+}
+
+// SetPosition - Установка позиции по инструменту, например при загрузке позиций счета
+func (r *RiskManager) SetPosition(uid string, lots int64, avgPrice float64) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	p := r.positions[uid]
+	p.Lots, p.AvgPrice = lots, avgPrice
+	r.positions[uid] = p
+}
+
+// SyncOrders - Сверка неисполненных остатков с активными поручениями счета из GetOrders. Поручения, снятые вне
+// риск-менеджера или истекшие, больше не учитываются в позициях. Вызывается, когда нет выставляемых поручений,
+// иначе поручение, на которое еще не получен ответ, будет забыто
+func (r *RiskManager) SyncOrders(orders []*pb.OrderState) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	// начало дня фиксируется до сверки, иначе смена дня при первой проверке сбросит сверенные остатки
+	r.dailyPnL(r.config.Clock())
+	r.pending = make(map[string]pendingOrder, len(orders))
+	for _, o := range orders {
+		lots := o.GetLotsRequested() - o.GetLotsExecuted()
+		if lots <= 0 {
+			continue
+		}
+		if o.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_SELL {
+			lots = -lots
+		}
+		r.pending[o.GetOrderId()] = pendingOrder{uid: r.uidOf(o.GetInstrumentUid(), o.GetFigi()), lots: lots}
+	}
+}
+
+// SetPriceLimits - Установка LimitUp/LimitDown инструмента, если риск-менеджер не получает стаканы
+func (r *RiskManager) SetPriceLimits(uid string, up, down float64) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.limitUp[uid], r.limitDown[uid] = up, down
+}
+
+// Handle - Обновление состояния по сообщению: *pb.OrderTrades меняет позиции и результат, *pb.LastPrice,
+// *pb.Trade и *pb.Candle - последние цены, *pb.OrderBook - LimitUp/LimitDown. Остальные сообщения игнорируются
+func (r *RiskManager) Handle(msg any) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	switch m := msg.(type) {
+	case *pb.LastPrice:
+		r.lastPrices[r.uidOf(m.GetInstrumentUid(), m.GetFigi())] = m.GetPrice().ToFloat()
+	case *pb.Trade:
+		r.lastPrices[r.uidOf(m.GetInstrumentUid(), m.GetFigi())] = m.GetPrice().ToFloat()
+	case *pb.Candle:
+		r.lastPrices[r.uidOf(m.GetInstrumentUid(), m.GetFigi())] = m.GetClose().ToFloat()
+	case *pb.OrderBook:
+		uid := r.uidOf(m.GetInstrumentUid(), m.GetFigi())
+		if m.GetLimitUp() != nil {
+			r.limitUp[uid] = m.GetLimitUp().ToFloat()
+		}
+		if m.GetLimitDown() != nil {
+			r.limitDown[uid] = m.GetLimitDown().ToFloat()
+		}
+	case *pb.OrderTrades:
+		r.applyOrderTrades(m)
+	}
+}
+
+// applyOrderTrades - Изменение позиции и неисполненного остатка поручения по исполнению
+func (r *RiskManager) applyOrderTrades(ot *pb.OrderTrades) {
+	uid := r.uidOf(ot.GetInstrumentUid(), ot.GetFigi())
+	lot := r.lot(uid)
+	sign := int64(1)
+	if ot.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		sign = -1
+	}
+	// до первого исполнения нужно зафиксировать начало дня, иначе результат сделок попадет в базу дня
+	r.dailyPnL(r.config.Clock())
+	var filled int64
+	p := r.positions[uid]
+	for _, t := range ot.GetTrades() {
+		lots := t.GetQuantity() / lot
+		filled += lots
+		p = p.apply(sign*lots, t.GetPrice().ToFloat(), lot)
+	}
+	r.positions[uid] = p
+	o, ok := r.pending[ot.GetOrderId()]
+	if !ok {
+		// ответ на PostOrder еще не получен или поручение выставлено в обход риск-менеджера
+		r.unmatched[ot.GetOrderId()] += sign * filled
+		return
+	}
+	o.lots -= sign * filled
+	if o.lots == 0 || (o.lots > 0) != (sign > 0) {
+		delete(r.pending, ot.GetOrderId())
+	} else {
+		r.pending[ot.GetOrderId()] = o
+	}
+}
+
+// uid - uid инструмента по uid или figi
+func (r *RiskManager) uid(id string) string {
+	if uid, ok := r.figiToUid[id]; ok {
+		return uid
+	}
+	return id
+}
+
+func (r *RiskManager) uidOf(uid, figi string) string {
+	if uid != "" {
+		return uid
+	}
+	return r.uid(figi)
+}
+
+func (r *RiskManager) lot(uid string) int64 {
+	if lot := r.instruments[uid].Lot; lot > 0 {
+		return lot
+	}
+	return 1
+}
@@ -0,0 +1,318 @@
+package investgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SandboxMoney - Сумма пополнения счета песочницы
+type SandboxMoney struct {
+	Currency string  `yaml:"Currency"`
+	Amount   float64 `yaml:"Amount"`
+}
+
+// SandboxPosition - Позиция, которая открывается на счете песочницы рыночным поручением
+type SandboxPosition struct {
+	// InstrumentId - uid или figi инструмента
+	InstrumentId string `yaml:"InstrumentId"`
+	// Lots - Кол-во лотов, отрицательное - продажа, то есть короткая позиция
+	Lots int64 `yaml:"Lots"`
+}
+
+// SandboxAccountState - Состояние, к которому приводится счет песочницы
+type SandboxAccountState struct {
+	// Money - Пополнения счета, по одному на каждую валюту
+	Money []SandboxMoney `yaml:"Money"`
+	// Positions - Позиции, которые открываются после пополнения
+	Positions []SandboxPosition `yaml:"Positions"`
+}
+
+// Validate - Проверка состояния перед сбросом счета
+func (s SandboxAccountState) Validate() error {
+	var errs []error
+	for _, m := range s.Money {
+		if m.Currency == "" {
+			errs = append(errs, errors.New("money currency is required"))
+		}
+		if m.Amount <= 0 {
+			errs = append(errs, fmt.Errorf("%v amount must be positive, got %v", m.Currency, m.Amount))
+		}
+	}
+	for _, p := range s.Positions {
+		if p.InstrumentId == "" {
+			errs = append(errs, errors.New("position instrument id is required"))
+		}
+		if p.Lots == 0 {
+			errs = append(errs, fmt.Errorf("%v position lots must be non-zero", p.InstrumentId))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadSandboxAccountState - Загрузка состояния счета песочницы из .yaml файла
+func LoadSandboxAccountState(filename string) (SandboxAccountState, error) {
+	var s SandboxAccountState
+	input, err := os.ReadFile(filename)
+	if err != nil {
+		return SandboxAccountState{}, err
+	}
+	if err := yaml.Unmarshal(input, &s); err != nil {
+		return SandboxAccountState{}, err
+	}
+	return s, s.Validate()
+}
+
+// ResetSandboxAccount - Приведение счета песочницы к состоянию state: счет accountId закрывается, если он задан,
+// открывается новый счет, пополняется во всех валютах Money и позиции Positions открываются рыночными поручениями.
+// Возвращает идентификатор нового счета, в том числе если пополнение или открытие позиций завершилось ошибкой
+func (s *SandboxServiceClient) ResetSandboxAccount(accountId string, state SandboxAccountState) (string, error) {
+	if err := state.Validate(); err != nil {
+		return "", err
+	}
+	if accountId != "" {
+		if _, err := s.CloseSandboxAccount(accountId); err != nil {
+			return "", fmt.Errorf("close sandbox account %v: %w", accountId, err)
+		}
+		s.logger.Infof("sandbox account %v closed", accountId)
+	}
+	resp, err := s.OpenSandboxAccount()
+	if err != nil {
+		return "", fmt.Errorf("open sandbox account: %w", err)
+	}
+	newId := resp.GetAccountId()
+	s.logger.Infof("sandbox account %v opened", newId)
+	return newId, s.SeedSandboxAccount(newId, state)
+}
+
+// SeedSandboxAccount - Пополнение счета песочницы и открытие позиций из state без закрытия счета
+func (s *SandboxServiceClient) SeedSandboxAccount(accountId string, state SandboxAccountState) error {
+	for _, m := range state.Money {
+		amount := FloatToQuotation(m.Amount, &pb.Quotation{Nano: 1e7})
+		resp, err := s.SandboxPayIn(&SandboxPayInRequest{
+			AccountId: accountId,
+			Currency:  m.Currency,
+			Unit:      amount.GetUnits(),
+			Nano:      amount.GetNano(),
+		})
+		if err != nil {
+			return fmt.Errorf("pay in %v %v: %w", m.Amount, m.Currency, err)
+		}
+		s.logger.Infof("sandbox account %v %v balance = %v", accountId, m.Currency, resp.GetBalance().ToFloat())
+	}
+	for _, p := range state.Positions {
+		direction, lots := pb.OrderDirection_ORDER_DIRECTION_BUY, p.Lots
+		if lots < 0 {
+			direction, lots = pb.OrderDirection_ORDER_DIRECTION_SELL, -lots
+		}
+		resp, err := s.PostSandboxOrder(&PostOrderRequest{
+			InstrumentId: p.InstrumentId,
+			Quantity:     lots,
+			Direction:    direction,
+			AccountId:    accountId,
+			OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+			OrderId:      CreateUid(),
+		})
+		if err != nil {
+			return fmt.Errorf("open %v position %v lots: %w, %v", p.InstrumentId, p.Lots, err,
+				MessageFromHeader(resp.GetHeader()))
+		}
+		if status := resp.GetExecutionReportStatus(); status != pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL {
+			return fmt.Errorf("open %v position %v lots: order %v status %v", p.InstrumentId, p.Lots,
+				resp.GetOrderId(), status.String())
+		}
+		s.logger.Infof("sandbox account %v position %v = %v lots", accountId, p.InstrumentId, p.Lots)
+	}
+	return nil
+}
+
+// StaleSandboxAccounts - Открытые счета песочницы, открытые раньше before, кроме счетов keep
+func (s *SandboxServiceClient) StaleSandboxAccounts(before time.Time, keep ...string) ([]*pb.Account, error) {
+	resp, err := s.GetSandboxAccounts()
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[string]struct{}, len(keep))
+	for _, id := range keep {
+		skip[id] = struct{}{}
+	}
+	stale := make([]*pb.Account, 0)
+	for _, a := range resp.GetAccounts() {
+		if _, ok := skip[a.GetId()]; ok || a.GetStatus() == pb.AccountStatus_ACCOUNT_STATUS_CLOSED {
+			continue
+		}
+		if a.GetOpenedDate().AsTime().Before(before) {
+			stale = append(stale, a)
+		}
+	}
+	return stale, nil
+}
+
+// CloseSandboxAccounts - Закрытие счетов песочницы. Ошибка по одному счету не останавливает закрытие остальных,
+// возвращаются закрытые счета и объединенная ошибка
+func (s *SandboxServiceClient) CloseSandboxAccounts(ids []string) ([]string, error) {
+	closed := make([]string, 0, len(ids))
+	var errs []error
+	for _, id := range ids {
+		if _, err := s.CloseSandboxAccount(id); err != nil {
+			errs = append(errs, fmt.Errorf("close sandbox account %v: %w", id, err))
+			continue
+		}
+		closed = append(closed, id)
+	}
+	return closed, errors.Join(errs...)
+}
+
+// SandboxSnapshotPosition - Позиция в снимке портфеля песочницы
+type SandboxSnapshotPosition struct {
+	Figi           string  `json:"figi"`
+	InstrumentType string  `json:"instrument_type"`
+	Quantity       float64 `json:"quantity"`
+	AveragePrice   float64 `json:"average_price"`
+	CurrentPrice   float64 `json:"current_price"`
+	ExpectedYield  float64 `json:"expected_yield"`
+}
+
+// SandboxSnapshot - Снимок портфеля счета песочницы: денежные остатки по валютам и позиции по uid инструментов
+type SandboxSnapshot struct {
+	AccountId string                             `json:"account_id"`
+	Time      time.Time                          `json:"time"`
+	Money     map[string]float64                 `json:"money"`
+	Positions map[string]SandboxSnapshotPosition `json:"positions"`
+	// Total - Стоимость портфеля в рублях
+	Total float64 `json:"total"`
+}
+
+// SnapshotSandboxAccount - Снимок портфеля счета песочницы
+func (s *SandboxServiceClient) SnapshotSandboxAccount(accountId string) (*SandboxSnapshot, error) {
+	positions, err := s.GetSandboxPositions(accountId)
+	if err != nil {
+		return nil, err
+	}
+	portfolio, err := s.GetSandboxPortfolio(accountId, pb.PortfolioRequest_RUB)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SandboxSnapshot{
+		AccountId: accountId,
+		Time:      time.Now(),
+		Money:     make(map[string]float64),
+		Positions: make(map[string]SandboxSnapshotPosition),
+		Total:     portfolio.GetTotalAmountPortfolio().ToFloat(),
+	}
+	for _, m := range positions.GetMoney() {
+		snapshot.Money[m.GetCurrency()] = m.ToFloat()
+	}
+	for _, p := range portfolio.GetPositions() {
+		// валюты уже учтены в денежных остатках
+		if p.GetInstrumentType() == "currency" {
+			continue
+		}
+		snapshot.Positions[p.GetInstrumentUid()] = SandboxSnapshotPosition{
+			Figi:           p.GetFigi(),
+			InstrumentType: p.GetInstrumentType(),
+			Quantity:       p.GetQuantity().ToFloat(),
+			AveragePrice:   p.GetAveragePositionPrice().ToFloat(),
+			CurrentPrice:   p.GetCurrentPrice().ToFloat(),
+			ExpectedYield:  p.GetExpectedYield().ToFloat(),
+		}
+	}
+	return snapshot, nil
+}
+
+// WriteJSON - Запись снимка в формате json
+func (s *SandboxSnapshot) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Save - Сохранение снимка в json файл path
+func (s *SandboxSnapshot) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return errors.Join(s.WriteJSON(file), file.Close())
+}
+
+// LoadSandboxSnapshot - Загрузка снимка, сохраненного Save
+func LoadSandboxSnapshot(path string) (*SandboxSnapshot, error) {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s SandboxSnapshot
+	if err := json.Unmarshal(input, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SandboxPositionChange - Изменение позиции между двумя снимками
+type SandboxPositionChange struct {
+	InstrumentUid string
+	Figi          string
+	Before        float64
+	After         float64
+}
+
+// SandboxSnapshotDiff - Разница между снимками портфеля песочницы
+type SandboxSnapshotDiff struct {
+	// Money - Изменение денежных остатков по валютам, только ненулевые
+	Money map[string]float64
+	// Positions - Изменившиеся, открытые и закрытые позиции по uid
+	Positions []SandboxPositionChange
+	// Total - Изменение стоимости портфеля в рублях
+	Total float64
+}
+
+// Empty - Нет изменений денежных остатков и позиций
+func (d SandboxSnapshotDiff) Empty() bool {
+	return len(d.Money) == 0 && len(d.Positions) == 0
+}
+
+// CompareSandboxSnapshots - Сравнение снимков before и after
+func CompareSandboxSnapshots(before, after *SandboxSnapshot) SandboxSnapshotDiff {
+	const eps = 1e-9
+	diff := SandboxSnapshotDiff{
+		Money: make(map[string]float64),
+		Total: after.Total - before.Total,
+	}
+	for currency, amount := range after.Money {
+		if d := amount - before.Money[currency]; math.Abs(d) > eps {
+			diff.Money[currency] = d
+		}
+	}
+	for currency, amount := range before.Money {
+		if _, ok := after.Money[currency]; !ok && math.Abs(amount) > eps {
+			diff.Money[currency] = -amount
+		}
+	}
+	for uid, p := range after.Positions {
+		if q := before.Positions[uid].Quantity; math.Abs(p.Quantity-q) > eps {
+			diff.Positions = append(diff.Positions, SandboxPositionChange{
+				InstrumentUid: uid, Figi: p.Figi, Before: q, After: p.Quantity,
+			})
+		}
+	}
+	for uid, p := range before.Positions {
+		if _, ok := after.Positions[uid]; !ok && math.Abs(p.Quantity) > eps {
+			diff.Positions = append(diff.Positions, SandboxPositionChange{
+				InstrumentUid: uid, Figi: p.Figi, Before: p.Quantity,
+			})
+		}
+	}
+	sort.Slice(diff.Positions, func(i, j int) bool {
+		return diff.Positions[i].InstrumentUid < diff.Positions[j].InstrumentUid
+	})
+	return diff
+}
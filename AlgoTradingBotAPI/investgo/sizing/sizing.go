@@ -0,0 +1,348 @@
+// Package sizing - Расчет размера позиции в лотах от капитала счета, риска на сделку, расстояния до стопа
+// и волатильности инструмента. Доля капитала под риск задается фиксированно (fixed fractional) или по критерию
+// Келли с ограничением сверху. Sizer не выставляет поручения и подходит для любого исполнителя.
+package sizing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/investgo/indicators"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Mode - Способ расчета доли капитала, которой рискует одна сделка
+type Mode int
+
+const (
+	// MODE_FIXED_FRACTIONAL - Фиксированный риск RiskPercent процентов капитала на сделку
+	MODE_FIXED_FRACTIONAL Mode = iota
+	// MODE_KELLY - Доля KellyFraction от критерия Келли по WinRate и PayoffRatio, но не больше KellyCap процентов
+	MODE_KELLY
+)
+
+func (m Mode) String() string {
+	switch m {
+	case MODE_FIXED_FRACTIONAL:
+		return "fixed_fractional"
+	case MODE_KELLY:
+		return "kelly"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// MarshalText - Название способа расчета, например для yaml
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText - Способ расчета по названию: fixed_fractional или kelly
+func (m *Mode) UnmarshalText(text []byte) error {
+	for _, v := range []Mode{MODE_FIXED_FRACTIONAL, MODE_KELLY} {
+		if strings.EqualFold(v.String(), string(text)) {
+			*m = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sizing mode %q", text)
+}
+
+// Config - Параметры расчета размера позиции
+type Config struct {
+	// AccountId - Счет, капитал которого используется для расчета, по умолчанию AccountId из конфигурации клиента
+	AccountId string `yaml:"AccountId,omitempty"`
+	// Mode - Способ расчета доли капитала под риск
+	Mode Mode `yaml:"Mode"`
+	// RiskPercent - Риск на сделку в процентах капитала для MODE_FIXED_FRACTIONAL
+	RiskPercent float64 `yaml:"RiskPercent"`
+	// WinRate - Доля прибыльных сделок от 0 до 1 для MODE_KELLY
+	WinRate float64 `yaml:"WinRate"`
+	// PayoffRatio - Отношение средней прибыльной сделки к средней убыточной для MODE_KELLY
+	PayoffRatio float64 `yaml:"PayoffRatio"`
+	// KellyFraction - Доля от полного критерия Келли, по умолчанию 0.5
+	KellyFraction float64 `yaml:"KellyFraction"`
+	// KellyCap - Максимальный риск на сделку в процентах капитала для MODE_KELLY
+	KellyCap float64 `yaml:"KellyCap"`
+	// ATRPeriod - Период ATR по дневным свечам, 0 - стоп определяется только ценой стопа из запроса
+	ATRPeriod int `yaml:"ATRPeriod"`
+	// ATRMultiplier - Расстояние до стопа в ATR, по умолчанию 2. Из цены стопа и ATR берется дальнее расстояние
+	ATRMultiplier float64 `yaml:"ATRMultiplier"`
+	// MaxPositionPercent - Максимальная стоимость позиции в процентах капитала, 0 - без ограничения
+	MaxPositionPercent float64 `yaml:"MaxPositionPercent"`
+	// MaxLots - Максимальное кол-во лотов в позиции, 0 - без ограничения
+	MaxLots int64 `yaml:"MaxLots"`
+	// EquityTTL - Время, в течение которого капитал счета не запрашивается повторно, по умолчанию 1 минута
+	EquityTTL time.Duration `yaml:"EquityTTL"`
+}
+
+// Validate - Проверка параметров расчета
+func (c Config) Validate() error {
+	var errs []error
+	switch c.Mode {
+	case MODE_FIXED_FRACTIONAL:
+		if c.RiskPercent <= 0 || c.RiskPercent > 100 {
+			errs = append(errs, fmt.Errorf("Sizing.RiskPercent must be in (0, 100], got %v", c.RiskPercent))
+		}
+	case MODE_KELLY:
+		if c.WinRate <= 0 || c.WinRate >= 1 {
+			errs = append(errs, fmt.Errorf("Sizing.WinRate must be in (0, 1), got %v", c.WinRate))
+		}
+		if c.PayoffRatio <= 0 {
+			errs = append(errs, fmt.Errorf("Sizing.PayoffRatio must be positive, got %v", c.PayoffRatio))
+		}
+		if c.KellyFraction < 0 || c.KellyFraction > 1 {
+			errs = append(errs, fmt.Errorf("Sizing.KellyFraction must be in [0, 1], got %v", c.KellyFraction))
+		}
+		if c.KellyCap <= 0 || c.KellyCap > 100 {
+			errs = append(errs, fmt.Errorf("Sizing.KellyCap must be in (0, 100], got %v", c.KellyCap))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown sizing mode %v", c.Mode))
+	}
+	if c.ATRPeriod < 0 || c.ATRMultiplier < 0 || c.MaxPositionPercent < 0 || c.MaxLots < 0 || c.EquityTTL < 0 {
+		errs = append(errs, errors.New("Sizing.ATRPeriod, ATRMultiplier, MaxPositionPercent, MaxLots and EquityTTL must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Request - Позиция, для которой рассчитывается размер
+type Request struct {
+	InstrumentId string
+	// Price - Цена входа за 1 инструмент
+	Price float64
+	// StopPrice - Цена стопа за 1 инструмент, 0 - расстояние до стопа определяется только по ATR
+	StopPrice float64
+	// Lot - Лотность инструмента, по умолчанию 1
+	Lot int64
+	// ATR - Значение ATR, 0 - рассчитывается по дневным свечам, если задан ATRPeriod
+	ATR float64
+	// Currency - Валюта цены инструмента: rub, usd или eur, по умолчанию rub. Капитал счета оценивается в ней же
+	Currency string
+}
+
+// LIMIT_RISK, LIMIT_POSITION, LIMIT_MAX_LOTS - Ограничение, которым определен размер позиции
+const (
+	LIMIT_RISK     = "risk"
+	LIMIT_POSITION = "max_position_percent"
+	LIMIT_MAX_LOTS = "max_lots"
+)
+
+// Size - Рассчитанный размер позиции
+type Size struct {
+	// Lots - Кол-во лотов, 0 - риск на сделку не покрывает даже один лот
+	Lots int64
+	// Equity - Капитал счета в валюте инструмента
+	Equity float64
+	// RiskFraction - Доля капитала под риск сделки
+	RiskFraction float64
+	// RiskBudget - Допустимый убыток по сделке в валюте
+	RiskBudget float64
+	// StopDistance - Расстояние до стопа за 1 инструмент
+	StopDistance float64
+	ATR          float64
+	// Risk - Убыток по стопу для Lots лотов
+	Risk float64
+	// PositionValue - Стоимость позиции по цене входа
+	PositionValue float64
+	// Limit - Ограничение, которым определен размер: LIMIT_RISK, LIMIT_POSITION или LIMIT_MAX_LOTS
+	Limit string
+}
+
+// Sizer - Расчет размера позиции по капиталу счета из GetPortfolio и волатильности инструментов
+type Sizer struct {
+	config Config
+
+	operationsService *investgo.OperationsServiceClient
+	marketDataService *investgo.MarketDataServiceClient
+
+	mx sync.Mutex
+	// equity - Капитал счета по валютам оценки
+	equity map[pb.PortfolioRequest_CurrencyRequest]equityValue
+	// atr - ATR инструментов по uid, пересчитывается раз в день
+	atr map[string]atrValue
+}
+
+type equityValue struct {
+	value float64
+	time  time.Time
+}
+
+type atrValue struct {
+	value float64
+	day   time.Time
+}
+
+// NewSizer - Создание расчета размера позиции для счета из конфигурации
+func NewSizer(c *investgo.Client, config Config) *Sizer {
+	if config.AccountId == "" {
+		config.AccountId = c.Config.AccountId
+	}
+	if config.Mode == MODE_KELLY && config.KellyFraction == 0 {
+		config.KellyFraction = 0.5
+	}
+	if config.ATRMultiplier == 0 {
+		config.ATRMultiplier = 2
+	}
+	if config.EquityTTL == 0 {
+		config.EquityTTL = time.Minute
+	}
+	return &Sizer{
+		config:            config,
+		operationsService: c.NewOperationsServiceClient(),
+		marketDataService: c.NewMarketDataServiceClient(),
+		equity:            make(map[pb.PortfolioRequest_CurrencyRequest]equityValue),
+		atr:               make(map[string]atrValue),
+	}
+}
+
+// Size - Размер позиции по текущему капиталу счета и ATR инструмента
+func (s *Sizer) Size(req Request) (Size, error) {
+	equity, err := s.Equity(req.Currency)
+	if err != nil {
+		return Size{}, err
+	}
+	if req.ATR == 0 && s.config.ATRPeriod > 0 {
+		req.ATR, err = s.ATR(req.InstrumentId)
+		if err != nil {
+			return Size{}, err
+		}
+	}
+	return Calculate(s.config, equity, req)
+}
+
+// Equity - Стоимость портфеля счета в валюте currency: rub, usd или eur, по умолчанию rub.
+// Кэшируется на EquityTTL отдельно для каждой валюты
+func (s *Sizer) Equity(currency string) (float64, error) {
+	c, err := portfolioCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if v, ok := s.equity[c]; ok && time.Since(v.time) < s.config.EquityTTL {
+		return v.value, nil
+	}
+	resp, err := s.operationsService.GetPortfolio(s.config.AccountId, c)
+	if err != nil {
+		return 0, fmt.Errorf("get portfolio: %w, %v", err, investgo.MessageFromHeader(resp.GetHeader()))
+	}
+	v := equityValue{value: resp.GetTotalAmountPortfolio().ToFloat(), time: time.Now()}
+	s.equity[c] = v
+	return v.value, nil
+}
+
+// portfolioCurrency - Валюта оценки портфеля по валюте инструмента
+func portfolioCurrency(currency string) (pb.PortfolioRequest_CurrencyRequest, error) {
+	switch strings.ToLower(currency) {
+	case "", "rub":
+		return pb.PortfolioRequest_RUB, nil
+	case "usd":
+		return pb.PortfolioRequest_USD, nil
+	case "eur":
+		return pb.PortfolioRequest_EUR, nil
+	}
+	return 0, fmt.Errorf("portfolio can not be valued in %v", currency)
+}
+
+// ATR - ATR инструмента с периодом ATRPeriod по дневным свечам, рассчитывается один раз в день
+func (s *Sizer) ATR(instrumentId string) (float64, error) {
+	if s.config.ATRPeriod <= 0 {
+		return 0, errors.New("ATRPeriod is not set")
+	}
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	s.mx.Lock()
+	v, ok := s.atr[instrumentId]
+	s.mx.Unlock()
+	if ok && v.day.Equal(day) {
+		return v.value, nil
+	}
+	// с запасом на выходные и праздники
+	from := day.AddDate(0, 0, -2*s.config.ATRPeriod-10)
+	resp, err := s.marketDataService.GetCandles(instrumentId, pb.CandleInterval_CANDLE_INTERVAL_DAY, from, now)
+	if err != nil {
+		return 0, fmt.Errorf("%v candles: %w, %v", instrumentId, err, investgo.MessageFromHeader(resp.GetHeader()))
+	}
+	atr := indicators.NewATR(s.config.ATRPeriod)
+	for _, c := range resp.GetCandles() {
+		atr.Update(indicators.BarFromHistoricCandle(c))
+	}
+	if !atr.Ready() {
+		return 0, fmt.Errorf("%v: %v daily candles are not enough for ATR(%v)", instrumentId, len(resp.GetCandles()),
+			s.config.ATRPeriod)
+	}
+	s.mx.Lock()
+	s.atr[instrumentId] = atrValue{value: atr.Value(), day: day}
+	s.mx.Unlock()
+	return atr.Value(), nil
+}
+
+// RiskFraction - Доля капитала под риск одной сделки по конфигурации
+func RiskFraction(config Config) float64 {
+	switch config.Mode {
+	case MODE_KELLY:
+		fraction := config.KellyFraction
+		if fraction == 0 {
+			fraction = 0.5
+		}
+		// f* = W - (1 - W) / R
+		kelly := fraction * (config.WinRate - (1-config.WinRate)/config.PayoffRatio)
+		return math.Max(0, math.Min(kelly, config.KellyCap/100))
+	default:
+		return config.RiskPercent / 100
+	}
+}
+
+// Calculate - Размер позиции при капитале equity без запросов к API, например для бектеста. Капитал должен быть
+// в валюте цены инструмента. Если req.ATR = 0, расстояние до стопа определяется только ценой стопа
+func Calculate(config Config, equity float64, req Request) (Size, error) {
+	if req.Price <= 0 {
+		return Size{}, fmt.Errorf("%v: price must be positive, got %v", req.InstrumentId, req.Price)
+	}
+	if req.Lot <= 0 {
+		req.Lot = 1
+	}
+	multiplier := config.ATRMultiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	size := Size{
+		Equity:       equity,
+		RiskFraction: RiskFraction(config),
+		ATR:          req.ATR,
+		Limit:        LIMIT_RISK,
+	}
+	if req.StopPrice > 0 {
+		size.StopDistance = math.Abs(req.Price - req.StopPrice)
+	}
+	// из стопа по цене и по волатильности берется дальний, чтобы стоп не выбивало обычными колебаниями
+	size.StopDistance = math.Max(size.StopDistance, req.ATR*multiplier)
+	if size.StopDistance <= 0 {
+		return Size{}, fmt.Errorf("%v: stop distance is unknown, set stop price or ATR", req.InstrumentId)
+	}
+	if equity <= 0 {
+		return size, nil
+	}
+	size.RiskBudget = equity * size.RiskFraction
+	size.Lots = int64(math.Floor(size.RiskBudget / (size.StopDistance * float64(req.Lot))))
+	lotValue := req.Price * float64(req.Lot)
+	if config.MaxPositionPercent > 0 {
+		if limit := int64(math.Floor(equity * config.MaxPositionPercent / 100 / lotValue)); size.Lots > limit {
+			size.Lots, size.Limit = limit, LIMIT_POSITION
+		}
+	}
+	if config.MaxLots > 0 && size.Lots > config.MaxLots {
+		size.Lots, size.Limit = config.MaxLots, LIMIT_MAX_LOTS
+	}
+	if size.Lots < 0 {
+		size.Lots = 0
+	}
+	size.Risk = size.StopDistance * float64(size.Lots*req.Lot)
+	size.PositionValue = lotValue * float64(size.Lots)
+	return size, nil
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// ActionKind - Тип корпоративного действия
+type ActionKind int
+
+const (
+	// ACTION_SPLIT - Сплит или консолидация акций
+	ACTION_SPLIT ActionKind = iota + 1
+	// ACTION_DIVIDEND - Выплата дивидендов
+	ACTION_DIVIDEND
+)
+
+// CorporateAction - Корпоративное действие, после которого цена инструмента меняется скачком
+type CorporateAction struct {
+	InstrumentUid string
+	// Time - Время, начиная с которого торги идут по новой цене. Для дивидендов это начало дня после
+	// последнего дня покупки с дивидендами
+	Time time.Time
+	Kind ActionKind
+	// Ratio - Для сплита кол-во новых бумаг на одну старую, например 10 для сплита 1:10 и 0.1 для консолидации 10:1
+	Ratio float64
+	// Amount - Для дивидендов величина дивиденда на одну бумагу
+	Amount *pb.Quotation
+}
+
+// AddCorporateAction - Добавление корпоративного действия в ручную таблицу хранилища. Действие того же типа
+// с тем же временем перезаписывается.
+func (s *CandlesStorage) AddCorporateAction(a CorporateAction) error {
+	_, err := s.db.Exec(`insert or replace into corporate_actions (instrument_uid, time, kind, ratio, amount_units, amount_nano)
+		values (?, ?, ?, ?, ?, ?)`, a.InstrumentUid, a.Time.Unix(), int(a.Kind), a.Ratio,
+		a.Amount.GetUnits(), a.Amount.GetNano())
+	return err
+}
+
+// CorporateActions - Корпоративные действия по инструменту из ручной таблицы хранилища
+func (s *CandlesStorage) CorporateActions(id string) ([]CorporateAction, error) {
+	rows, err := s.db.Query(`select time, kind, ratio, amount_units, amount_nano from corporate_actions
+		where instrument_uid = ? order by time`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			s.logger.Errorf(err.Error())
+		}
+	}()
+
+	actions := make([]CorporateAction, 0)
+	for rows.Next() {
+		var t int64
+		var kind int
+		a := CorporateAction{InstrumentUid: id, Amount: &pb.Quotation{}}
+		if err = rows.Scan(&t, &kind, &a.Ratio, &a.Amount.Units, &a.Amount.Nano); err != nil {
+			return nil, err
+		}
+		a.Time = time.Unix(t, 0)
+		a.Kind = ActionKind(kind)
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// DividendActions - Дивиденды по инструменту за период [from, to) из InstrumentsServiceClient.GetDividents
+func DividendActions(is *investgo.InstrumentsServiceClient, id string, from, to time.Time) ([]CorporateAction, error) {
+	instrumentResp, err := is.InstrumentByUid(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := is.GetDividents(instrumentResp.GetInstrument().GetFigi(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]CorporateAction, 0, len(resp.GetDividends()))
+	for _, d := range resp.GetDividends() {
+		if d.GetLastBuyDate() == nil || d.GetDividendNet() == nil {
+			continue
+		}
+		actions = append(actions, CorporateAction{
+			InstrumentUid: id,
+			Time:          d.GetLastBuyDate().AsTime().Truncate(investgo.DAY).Add(investgo.DAY),
+			Kind:          ACTION_DIVIDEND,
+			Amount: &pb.Quotation{
+				Units: d.GetDividendNet().GetUnits(),
+				Nano:  d.GetDividendNet().GetNano(),
+			},
+		})
+	}
+	return actions, nil
+}
+
+// AdjustCandles - Обратная корректировка свечей на сплиты и дивиденды. Цены последней свечи остаются
+// без изменений, цены всех свечей до корпоративного действия умножаются на коэффициент действия:
+// для сплита 1/Ratio (объем умножается на Ratio), для дивиденда 1 - Amount/Close, где Close - цена закрытия
+// последней свечи перед действием. Исходный слайс не изменяется.
+func AdjustCandles(candles []*pb.HistoricCandle, actions []CorporateAction) []*pb.HistoricCandle {
+	sorted := make([]CorporateAction, len(actions))
+	copy(sorted, actions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	// коэффициенты цены и объема для свечей перед каждым действием
+	priceFactors := make([]decimal.Decimal, len(sorted))
+	volumeFactors := make([]decimal.Decimal, len(sorted))
+	for i, a := range sorted {
+		priceFactors[i], volumeFactors[i] = decimal.NewFromInt(1), decimal.NewFromInt(1)
+		switch a.Kind {
+		case ACTION_SPLIT:
+			if a.Ratio <= 0 {
+				continue
+			}
+			ratio := decimal.NewFromFloat(a.Ratio)
+			priceFactors[i] = decimal.NewFromInt(1).Div(ratio)
+			volumeFactors[i] = ratio
+		case ACTION_DIVIDEND:
+			before := sort.Search(len(candles), func(j int) bool {
+				return !candles[j].GetTime().AsTime().Before(a.Time)
+			}) - 1
+			if before < 0 {
+				continue
+			}
+			closePrice := quotationToDecimal(candles[before].GetClose())
+			amount := quotationToDecimal(a.Amount)
+			if !closePrice.IsPositive() || amount.GreaterThanOrEqual(closePrice) {
+				continue
+			}
+			priceFactors[i] = decimal.NewFromInt(1).Sub(amount.Div(closePrice))
+		}
+	}
+
+	// накопленные коэффициенты: cumPrice[k] - произведение коэффициентов всех действий, начиная с k-го
+	cumPrice := make([]decimal.Decimal, len(sorted)+1)
+	cumVolume := make([]decimal.Decimal, len(sorted)+1)
+	cumPrice[len(sorted)], cumVolume[len(sorted)] = decimal.NewFromInt(1), decimal.NewFromInt(1)
+	for k := len(sorted) - 1; k >= 0; k-- {
+		cumPrice[k] = cumPrice[k+1].Mul(priceFactors[k])
+		cumVolume[k] = cumVolume[k+1].Mul(volumeFactors[k])
+	}
+
+	adjusted := make([]*pb.HistoricCandle, len(candles))
+	for i, candle := range candles {
+		t := candle.GetTime().AsTime()
+		// первое действие, которое произошло после свечи
+		k := sort.Search(len(sorted), func(j int) bool {
+			return sorted[j].Time.After(t)
+		})
+		price, volume := cumPrice[k], cumVolume[k]
+		adjusted[i] = &pb.HistoricCandle{
+			Open:       scaleQuotation(candle.GetOpen(), price),
+			High:       scaleQuotation(candle.GetHigh(), price),
+			Low:        scaleQuotation(candle.GetLow(), price),
+			Close:      scaleQuotation(candle.GetClose(), price),
+			Volume:     decimal.NewFromInt(candle.GetVolume()).Mul(volume).Round(0).IntPart(),
+			Time:       candle.GetTime(),
+			IsComplete: candle.GetIsComplete(),
+		}
+	}
+	return adjusted
+}
+
+// AdjustedCandles - Свечи инструмента за период [from, to), скорректированные на корпоративные действия
+// из ручной таблицы хранилища и, если is не nil, на дивиденды из api. Учитываются только действия до to,
+// сырые свечи в хранилище не изменяются.
+func (s *CandlesStorage) AdjustedCandles(is *investgo.InstrumentsServiceClient, id string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	candles, err := s.Candles(id, interval, from, to)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.CorporateActions(id)
+	if err != nil {
+		return nil, err
+	}
+	if is != nil {
+		dividends, err := DividendActions(is, id, from, to)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, dividends...)
+	}
+	actions := make([]CorporateAction, 0, len(all))
+	for _, a := range all {
+		if a.Time.After(from) && !a.Time.After(to) {
+			actions = append(actions, a)
+		}
+	}
+	if len(actions) > 0 {
+		s.logger.Infof("%v adjusting candles by %v corporate actions", id, len(actions))
+	}
+	return AdjustCandles(candles, actions), nil
+}
+
+// quotationToDecimal - Точный перевод Quotation в decimal
+func quotationToDecimal(q *pb.Quotation) decimal.Decimal {
+	return decimal.NewFromInt(q.GetUnits()).Add(decimal.New(int64(q.GetNano()), -9))
+}
+
+// scaleQuotation - Умножение Quotation на коэффициент с округлением до нано
+func scaleQuotation(q *pb.Quotation, factor decimal.Decimal) *pb.Quotation {
+	scaled := quotationToDecimal(q).Mul(factor).Round(9)
+	units := scaled.IntPart()
+	nano := scaled.Sub(decimal.NewFromInt(units)).Shift(9).IntPart()
+	return &pb.Quotation{
+		Units: units,
+		Nano:  int32(nano),
+	}
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// CandlesStorage - Хранилище исторических свечей в sqlite
+type CandlesStorage struct {
+	db     *sqlx.DB
+	logger investgo.Logger
+}
+
+// NewCandlesStorage - Открытие хранилища свечей по пути path. Если файла нет, он будет создан, если схема бд
+// устарела, она будет обновлена до последней версии.
+func NewCandlesStorage(path string, l investgo.Logger) (*CandlesStorage, error) {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	s := &CandlesStorage{
+		db:     db,
+		logger: l,
+	}
+	if err := s.migrate(); err != nil {
+		if closeErr := db.Close(); closeErr != nil {
+			l.Errorf(closeErr.Error())
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close - Закрытие хранилища свечей
+func (s *CandlesStorage) Close() error {
+	return s.db.Close()
+}
+
+// candleDB - Строка таблицы candles
+type candleDB struct {
+	InstrumentUid string `db:"instrument_uid"`
+	Interval      int32  `db:"interval"`
+	Time          int64  `db:"time"`
+	OpenUnits     int64  `db:"open_units"`
+	OpenNano      int32  `db:"open_nano"`
+	HighUnits     int64  `db:"high_units"`
+	HighNano      int32  `db:"high_nano"`
+	LowUnits      int64  `db:"low_units"`
+	LowNano       int32  `db:"low_nano"`
+	CloseUnits    int64  `db:"close_units"`
+	CloseNano     int32  `db:"close_nano"`
+	Volume        int64  `db:"volume"`
+	IsComplete    bool   `db:"is_complete"`
+}
+
+func (c *candleDB) toHistoricCandle() *pb.HistoricCandle {
+	return &pb.HistoricCandle{
+		Open:       &pb.Quotation{Units: c.OpenUnits, Nano: c.OpenNano},
+		High:       &pb.Quotation{Units: c.HighUnits, Nano: c.HighNano},
+		Low:        &pb.Quotation{Units: c.LowUnits, Nano: c.LowNano},
+		Close:      &pb.Quotation{Units: c.CloseUnits, Nano: c.CloseNano},
+		Volume:     c.Volume,
+		Time:       investgo.TimeToTimestamp(time.Unix(c.Time, 0)),
+		IsComplete: c.IsComplete,
+	}
+}
+
+// Store - Сохранение свечей инструмента. Свечи с уже существующим временем перезаписываются, так что
+// незавершенная свеча заменяется завершенной при следующем обновлении.
+func (s *CandlesStorage) Store(id string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	insertCandle, err := tx.Prepare(`insert or replace into candles (instrument_uid, interval, time,
+		open_units, open_nano, high_units, high_nano, low_units, low_nano, close_units, close_nano, volume, is_complete)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.logger.Errorf(rbErr.Error())
+		}
+		return err
+	}
+	defer func() {
+		if err := insertCandle.Close(); err != nil {
+			s.logger.Errorf(err.Error())
+		}
+	}()
+
+	for _, candle := range candles {
+		_, err := insertCandle.Exec(id, int32(interval), candle.GetTime().AsTime().Unix(),
+			candle.GetOpen().GetUnits(), candle.GetOpen().GetNano(),
+			candle.GetHigh().GetUnits(), candle.GetHigh().GetNano(),
+			candle.GetLow().GetUnits(), candle.GetLow().GetNano(),
+			candle.GetClose().GetUnits(), candle.GetClose().GetNano(),
+			candle.GetVolume(), candle.GetIsComplete())
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				s.logger.Errorf(rbErr.Error())
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// WriteCandles - Реализация investgo.CandlesSink, позволяет передавать хранилище в DownloadCandles
+func (s *CandlesStorage) WriteCandles(id string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error {
+	return s.Store(id, interval, candles)
+}
+
+// Candles - Свечи инструмента с интервалом interval, время которых лежит в [from, to), по возрастанию времени
+func (s *CandlesStorage) Candles(id string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	rows, err := s.db.Queryx(`select * from candles where instrument_uid = ? and interval = ? and time >= ? and time < ?
+		order by time`, id, int32(interval), from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			s.logger.Errorf(err.Error())
+		}
+	}()
+
+	candles := make([]*pb.HistoricCandle, 0)
+	for rows.Next() {
+		dst := candleDB{}
+		if err = rows.StructScan(&dst); err != nil {
+			return nil, err
+		}
+		candles = append(candles, dst.toHistoricCandle())
+	}
+	return candles, rows.Err()
+}
+
+// CandlesAll - Все свечи инструмента с интервалом interval
+func (s *CandlesStorage) CandlesAll(id string, interval pb.CandleInterval) ([]*pb.HistoricCandle, error) {
+	return s.Candles(id, interval, time.Unix(0, 0), time.Unix(1<<62, 0))
+}
+
+// LastCandle - Последняя сохраненная свеча инструмента, nil если свечей нет
+func (s *CandlesStorage) LastCandle(id string, interval pb.CandleInterval) (*pb.HistoricCandle, error) {
+	dst := candleDB{}
+	err := s.db.Get(&dst, `select * from candles where instrument_uid = ? and interval = ? order by time desc limit 1`,
+		id, int32(interval))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return dst.toHistoricCandle(), nil
+}
+
+// Delete - Удаление свечей инструмента с интервалом interval в [from, to)
+func (s *CandlesStorage) Delete(id string, interval pb.CandleInterval, from, to time.Time) error {
+	_, err := s.db.Exec(`delete from candles where instrument_uid = ? and interval = ? and time >= ? and time < ?`,
+		id, int32(interval), from.Unix(), to.Unix())
+	return err
+}
+
+// UpdateInfo - Границы загруженной истории по инструменту
+type UpdateInfo struct {
+	InstrumentUid string
+	Interval      pb.CandleInterval
+	// FirstUpdate - Время, начиная с которого загружена история
+	FirstUpdate time.Time
+	// LastUpdate - Время, до которого загружена история
+	LastUpdate time.Time
+}
+
+// Updates - Границы загруженной истории по всем инструментам с интервалом interval
+func (s *CandlesStorage) Updates(interval pb.CandleInterval) (map[string]UpdateInfo, error) {
+	rows, err := s.db.Query(`select instrument_uid, first_time, last_time from updates where interval = ?`, int32(interval))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			s.logger.Errorf(err.Error())
+		}
+	}()
+
+	updates := make(map[string]UpdateInfo)
+	for rows.Next() {
+		var id string
+		var first, last int64
+		if err = rows.Scan(&id, &first, &last); err != nil {
+			return nil, err
+		}
+		updates[id] = UpdateInfo{
+			InstrumentUid: id,
+			Interval:      interval,
+			FirstUpdate:   time.Unix(first, 0),
+			LastUpdate:    time.Unix(last, 0),
+		}
+	}
+	return updates, rows.Err()
+}
+
+// UpdateRequest - Параметры обновления истории в хранилище
+type UpdateRequest struct {
+	// Instruments - Идентификаторы инструментов
+	Instruments []string
+	// Interval - Интервал свечей
+	Interval pb.CandleInterval
+	// From - Начало истории. Для новых инструментов история загружается с From, если у инструмента
+	// в хранилище история начинается позже From, недостающие свечи догружаются
+	From time.Time
+	// To - Время, до которого обновляется история, по умолчанию time.Now()
+	To time.Time
+	// Workers - Кол-во параллельных запросов, по умолчанию investgo.CANDLES_DOWNLOAD_WORKERS
+	Workers int
+	// OnProgress - Колбек прогресса загрузки
+	OnProgress func(p investgo.DownloadProgress)
+}
+
+// Update - Инкрементальное обновление истории: догружаются только свечи, которых нет в хранилище. Прогресс
+// сохраняется после каждого временного окна, поэтому прерванное обновление продолжится с места остановки.
+func (s *CandlesStorage) Update(ctx context.Context, mds *investgo.MarketDataServiceClient, req UpdateRequest) error {
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	updates, err := s.Updates(req.Interval)
+	if err != nil {
+		return err
+	}
+	for _, id := range req.Instruments {
+		u, ok := updates[id]
+		switch {
+		case !ok:
+			// новый инструмент, загрузка начнется с From
+			err = s.setUpdate(id, req.Interval, req.From, req.From)
+		case req.From.Before(u.FirstUpdate):
+			// догружаем более старые свечи
+			s.logger.Infof("older candles for %v not found, downloading...", id)
+			err = mds.DownloadCandles(ctx, &investgo.DownloadCandlesRequest{
+				Instruments: []string{id},
+				Interval:    req.Interval,
+				From:        req.From,
+				To:          u.FirstUpdate,
+				Workers:     req.Workers,
+				Sink:        s,
+			})
+			if err == nil {
+				err = s.setUpdate(id, req.Interval, req.From, u.LastUpdate)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return mds.DownloadCandles(ctx, &investgo.DownloadCandlesRequest{
+		Instruments: req.Instruments,
+		Interval:    req.Interval,
+		From:        req.From,
+		To:          req.To,
+		Workers:     req.Workers,
+		Sink:        s,
+		Checkpoint:  updatesCheckpoint{s: s},
+		OnProgress:  req.OnProgress,
+	})
+}
+
+// setUpdate - Запись границ загруженной истории
+func (s *CandlesStorage) setUpdate(id string, interval pb.CandleInterval, first, last time.Time) error {
+	_, err := s.db.Exec(`insert or replace into updates (instrument_uid, interval, first_time, last_time) values (?, ?, ?, ?)`,
+		id, int32(interval), first.Unix(), last.Unix())
+	return err
+}
+
+// updatesCheckpoint - Чекпоинт загрузки свечей на таблице updates
+type updatesCheckpoint struct {
+	s *CandlesStorage
+}
+
+// Load - Время, с которого нужно продолжить загрузку. Если в хранилище есть незавершенная свеча,
+// загрузка начнется с нее, чтобы заменить ее завершенной.
+func (u updatesCheckpoint) Load(id string, interval pb.CandleInterval) (time.Time, bool, error) {
+	var last int64
+	err := u.s.db.Get(&last, `select last_time from updates where instrument_uid = ? and interval = ?`, id, int32(interval))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	}
+	var incomplete sql.NullInt64
+	err = u.s.db.Get(&incomplete, `select min(time) from candles where instrument_uid = ? and interval = ? and is_complete = 0`,
+		id, int32(interval))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if incomplete.Valid && incomplete.Int64 < last {
+		last = incomplete.Int64
+	}
+	return time.Unix(last, 0), true, nil
+}
+
+// Save - Сохранение времени, до которого загружена история
+func (u updatesCheckpoint) Save(id string, interval pb.CandleInterval, t time.Time) error {
+	_, err := u.s.db.Exec(`update updates set last_time = ? where instrument_uid = ? and interval = ?`,
+		t.Unix(), id, int32(interval))
+	return err
+}
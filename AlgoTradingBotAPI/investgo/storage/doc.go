@@ -0,0 +1,25 @@
+/*
+Package storage предоставляет локальное хранилище исторических свечей в sqlite.
+
+# CandlesStorage
+
+Свечи хранятся по ключу инструмент + интервал + время, поэтому в одной базе могут лежать, например, минутные и часовые
+свечи одного инструмента. Цены хранятся в виде целой и дробной части Quotation без потери точности. Схема базы
+версионируется, при открытии файла, созданного предыдущими версиями примеров (candles.db), данные переносятся в новую
+схему автоматически.
+
+Для загрузки и обновления истории используется investgo.MarketDataServiceClient.DownloadCandles, хранилище
+одновременно является приемником свечей и чекпоинтом загрузки.
+
+# Качество данных
+
+CandlesStorage.Check сравнивает свечи с торговыми сессиями из InstrumentsServiceClient.TradingSchedules и находит
+пропуски, дубли и нарушение порядка времени, CandlesStorage.Repair повторно запрашивает только пропущенные интервалы.
+
+# Корпоративные действия
+
+CandlesStorage.AdjustedCandles возвращает свечи, обратно скорректированные на дивиденды из
+InstrumentsServiceClient.GetDividents и сплиты из ручной таблицы (CandlesStorage.AddCorporateAction). Сырые свечи
+в хранилище при этом не меняются.
+*/
+package storage
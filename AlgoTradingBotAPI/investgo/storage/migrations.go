@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// LEGACY_CANDLE_INTERVAL - Интервал свечей в базах, созданных до появления версий схемы. В старой схеме интервал
+// не хранился, а загрузчик и интервальный бот по умолчанию работали с минутными свечами.
+const LEGACY_CANDLE_INTERVAL = pb.CandleInterval_CANDLE_INTERVAL_1_MIN
+
+// migration - Переход схемы бд на версию version
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sqlx.Tx) error
+}
+
+// migrations - Все миграции схемы по возрастанию версий, новые миграции добавляются в конец
+var migrations = []migration{
+	{
+		version:     1,
+		description: "candles keyed by instrument and interval, prices as units and nano",
+		up:          migrateToV1,
+	},
+	{
+		version:     2,
+		description: "manual corporate actions table",
+		up:          migrateToV2,
+	},
+}
+
+// SchemaVersion - Текущая версия схемы хранилища
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate - Применение всех миграций, версия которых больше текущей версии схемы бд
+func (s *CandlesStorage) migrate() error {
+	if _, err := s.db.Exec(`create table if not exists schema_version (version integer not null)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.Get(&current, `select coalesce(max(version), 0) from schema_version`); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := s.db.Beginx()
+		if err != nil {
+			return err
+		}
+		if err = m.up(tx); err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				s.logger.Errorf(rbErr.Error())
+			}
+			return fmt.Errorf("migration to version %v: %w", m.version, err)
+		}
+		if _, err = tx.Exec(`insert into schema_version (version) values (?)`, m.version); err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				s.logger.Errorf(rbErr.Error())
+			}
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		s.logger.Infof("candles storage migrated to version %v: %v", m.version, m.description)
+	}
+	return nil
+}
+
+var schemaV1 = `
+create table candles (
+    instrument_uid text not null,
+    interval integer not null,
+    time integer not null,
+    open_units integer not null,
+    open_nano integer not null,
+    high_units integer not null,
+    high_nano integer not null,
+    low_units integer not null,
+    low_nano integer not null,
+    close_units integer not null,
+    close_nano integer not null,
+    volume integer not null,
+    is_complete integer not null,
+    primary key (instrument_uid, interval, time)
+) without rowid;
+
+create table updates (
+    instrument_uid text not null,
+    interval integer not null,
+    first_time integer not null,
+    last_time integer not null,
+    primary key (instrument_uid, interval)
+);
+`
+
+// migrateToV1 - Создание схемы с интервалом в ключе и точными ценами. Если в бд есть таблицы старой схемы
+// (candles без интервала с ценами типа real), их данные переносятся с интервалом LEGACY_CANDLE_INTERVAL.
+func migrateToV1(tx *sqlx.Tx) error {
+	legacyCandles, err := tableExists(tx, "candles")
+	if err != nil {
+		return err
+	}
+	legacyUpdates, err := tableExists(tx, "updates")
+	if err != nil {
+		return err
+	}
+	if legacyCandles {
+		if _, err = tx.Exec(`alter table candles rename to candles_legacy`); err != nil {
+			return err
+		}
+	}
+	if legacyUpdates {
+		if _, err = tx.Exec(`alter table updates rename to updates_legacy`); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(schemaV1); err != nil {
+		return err
+	}
+	if legacyCandles {
+		// цены в старой схеме получены из Quotation с точностью до 9 знаков, поэтому округление дробной части
+		// до нано восстанавливает исходное значение
+		// в старой схеме volume и is_complete могли быть null, новая схема их не допускает
+		_, err = tx.Exec(`insert or replace into candles
+			select instrument_uid, ?, time,
+				cast(open as integer), cast(round((open - cast(open as integer)) * 1e9) as integer),
+				cast(high as integer), cast(round((high - cast(high as integer)) * 1e9) as integer),
+				cast(low as integer), cast(round((low - cast(low as integer)) * 1e9) as integer),
+				cast(close as integer), cast(round((close - cast(close as integer)) * 1e9) as integer),
+				coalesce(volume, 0), coalesce(is_complete, 1)
+			from candles_legacy`, int32(LEGACY_CANDLE_INTERVAL))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`drop table candles_legacy`); err != nil {
+			return err
+		}
+	}
+	if legacyUpdates {
+		_, err = tx.Exec(`insert or replace into updates
+			select instrument_id, ?, first_time, last_time from updates_legacy`, int32(LEGACY_CANDLE_INTERVAL))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`drop table updates_legacy`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableExists - Проверка наличия таблицы в бд
+func tableExists(tx *sqlx.Tx, name string) (bool, error) {
+	var count int
+	err := tx.Get(&count, `select count(*) from sqlite_master where type = 'table' and name = ?`, name)
+	return count > 0, err
+}
+
+// migrateToV2 - Таблица корпоративных действий, которые нельзя получить из api, например сплитов
+func migrateToV2(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+create table corporate_actions (
+    instrument_uid text not null,
+    time integer not null,
+    kind integer not null,
+    ratio real not null,
+    amount_units integer not null,
+    amount_nano integer not null,
+    primary key (instrument_uid, time, kind)
+);`)
+	return err
+}
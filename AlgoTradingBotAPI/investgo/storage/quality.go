@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// SCHEDULE_MAX_DAYS - Максимальный период одного запроса TradingSchedules в днях
+const SCHEDULE_MAX_DAYS = 14
+
+// Session - Торговая сессия [Start, End)
+type Session struct {
+	Start, End time.Time
+}
+
+// Gap - Пропуск в свечах: ожидалось Missing свечей с временем в [From, To), но в хранилище их нет
+type Gap struct {
+	From, To time.Time
+	Missing  int
+}
+
+// QualityReport - Результат проверки свечей инструмента
+type QualityReport struct {
+	InstrumentUid string
+	Interval      pb.CandleInterval
+	// Candles - Кол-во проверенных свечей
+	Candles int
+	// Expected - Кол-во свечей, которое ожидается по расписанию торгов
+	Expected int
+	// Gaps - Пропущенные интервалы внутри торговых сессий
+	Gaps []Gap
+	// Duplicates - Время свечей, которые встречаются больше одного раза
+	Duplicates []time.Time
+	// NonMonotonic - Время свечей, которые идут раньше предыдущей свечи
+	NonMonotonic []time.Time
+}
+
+// Ok - true, если проблем в свечах не найдено
+func (r QualityReport) Ok() bool {
+	return len(r.Gaps) == 0 && len(r.Duplicates) == 0 && len(r.NonMonotonic) == 0
+}
+
+// MissingCandles - Общее кол-во пропущенных свечей
+func (r QualityReport) MissingCandles() int {
+	var missing int
+	for _, g := range r.Gaps {
+		missing += g.Missing
+	}
+	return missing
+}
+
+// String - Краткое описание отчета для логов
+func (r QualityReport) String() string {
+	return fmt.Sprintf("%v %v: candles = %v, expected = %v, gaps = %v (%v candles), duplicates = %v, non monotonic = %v",
+		r.InstrumentUid, r.Interval.String(), r.Candles, r.Expected, len(r.Gaps), r.MissingCandles(),
+		len(r.Duplicates), len(r.NonMonotonic))
+}
+
+// SessionsFromSchedule - Торговые сессии из расписания торгов, вечерняя сессия выделяется в отдельную сессию.
+// Неторговые дни пропускаются.
+func SessionsFromSchedule(days []*pb.TradingDay) []Session {
+	sessions := make([]Session, 0, len(days))
+	for _, day := range days {
+		if !day.GetIsTradingDay() {
+			continue
+		}
+		var dayEnd time.Time
+		if day.GetStartTime() != nil && day.GetEndTime() != nil {
+			sessions = append(sessions, Session{Start: day.GetStartTime().AsTime(), End: day.GetEndTime().AsTime()})
+			dayEnd = day.GetEndTime().AsTime()
+		}
+		if day.GetEveningStartTime() != nil && day.GetEveningEndTime() != nil {
+			evening := Session{Start: day.GetEveningStartTime().AsTime(), End: day.GetEveningEndTime().AsTime()}
+			// у некоторых бирж время окончания торгов уже включает вечернюю сессию
+			if evening.End.After(evening.Start) && !evening.Start.Before(dayEnd) {
+				sessions = append(sessions, evening)
+			}
+		}
+	}
+	return sessions
+}
+
+// LoadSessions - Загрузка торговых сессий биржи exchange за период [from, to)
+func LoadSessions(is *investgo.InstrumentsServiceClient, exchange string, from, to time.Time) ([]Session, error) {
+	sessions := make([]Session, 0)
+	for low := from; low.Before(to); low = low.Add(SCHEDULE_MAX_DAYS * investgo.DAY) {
+		high := low.Add(SCHEDULE_MAX_DAYS*investgo.DAY - time.Second)
+		if high.After(to) {
+			high = to
+		}
+		resp, err := is.TradingSchedules(exchange, low, high)
+		if err != nil {
+			return nil, err
+		}
+		for _, exchangeSchedule := range resp.GetExchanges() {
+			sessions = append(sessions, SessionsFromSchedule(exchangeSchedule.GetDays())...)
+		}
+	}
+	return sessions, nil
+}
+
+// expectedSlots - Время начала свечей, которые ожидаются внутри торговых сессий. Для внутридневных интервалов
+// это все начала свечей, пересекающихся с сессией, для дневных свечей - начало каждого торгового дня.
+func expectedSlots(interval pb.CandleInterval, sessions []Session) ([]time.Time, error) {
+	slots := make([]time.Time, 0)
+	seen := make(map[int64]struct{})
+	add := func(t time.Time) {
+		if _, ok := seen[t.Unix()]; ok {
+			return
+		}
+		seen[t.Unix()] = struct{}{}
+		slots = append(slots, t)
+	}
+	duration := investgo.CandleIntervalDuration(interval)
+	switch {
+	case interval == pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		for _, s := range sessions {
+			add(s.Start.Truncate(investgo.DAY))
+		}
+	case duration > 0:
+		for _, s := range sessions {
+			for t := s.Start.Truncate(duration); t.Before(s.End); t = t.Add(duration) {
+				add(t)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("gap detection for %v is not supported", interval.String())
+	}
+	return slots, nil
+}
+
+// CheckCandles - Проверка свечей на пропуски внутри торговых сессий, дубли и нарушение порядка времени.
+// Свечи могут быть получены не из хранилища, например напрямую из GetCandles, поэтому порядок не предполагается.
+// Для дневных свечей сравниваются только даты свечей и торговых дней.
+func CheckCandles(id string, interval pb.CandleInterval, candles []*pb.HistoricCandle, sessions []Session) (QualityReport, error) {
+	report := QualityReport{
+		InstrumentUid: id,
+		Interval:      interval,
+		Candles:       len(candles),
+	}
+	slots, err := expectedSlots(interval, sessions)
+	if err != nil {
+		return report, err
+	}
+	report.Expected = len(slots)
+
+	truncate := investgo.CandleIntervalDuration(interval)
+	present := make(map[int64]struct{}, len(candles))
+	var prev time.Time
+	for i, candle := range candles {
+		t := candle.GetTime().AsTime()
+		if i > 0 {
+			switch {
+			case t.Equal(prev):
+				report.Duplicates = append(report.Duplicates, t)
+			case t.Before(prev):
+				report.NonMonotonic = append(report.NonMonotonic, t)
+			}
+		}
+		prev = t
+		present[t.Truncate(truncate).Unix()] = struct{}{}
+	}
+
+	// соседние пропущенные слоты объединяются в один пропуск
+	inGap := false
+	for _, slot := range slots {
+		if _, ok := present[slot.Unix()]; ok {
+			inGap = false
+			continue
+		}
+		if last := len(report.Gaps) - 1; inGap && report.Gaps[last].To.Equal(slot) {
+			report.Gaps[last].To = slot.Add(truncate)
+			report.Gaps[last].Missing++
+			continue
+		}
+		report.Gaps = append(report.Gaps, Gap{From: slot, To: slot.Add(truncate), Missing: 1})
+		inGap = true
+	}
+	return report, nil
+}
+
+// CheckRequest - Параметры проверки свечей в хранилище
+type CheckRequest struct {
+	// Instruments - Идентификаторы инструментов, торгующихся на бирже Exchange
+	Instruments []string
+	// Exchange - Биржа, расписание которой используется для проверки, например MOEX
+	Exchange string
+	// Interval - Интервал свечей
+	Interval pb.CandleInterval
+	// From, To - Проверяемый период
+	From, To time.Time
+}
+
+// Check - Проверка свечей в хранилище по расписанию торгов биржи req.Exchange
+func (s *CandlesStorage) Check(is *investgo.InstrumentsServiceClient, req CheckRequest) ([]QualityReport, error) {
+	sessions, err := LoadSessions(is, req.Exchange, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	// сессии, которые не попадают в проверяемый период целиком, обрезаются по его границам. Начало обрезается
+	// по первой свече не раньше From, более ранних свечей в выборке из хранилища нет
+	duration := investgo.CandleIntervalDuration(req.Interval)
+	from := req.From
+	if duration > 0 && !from.Truncate(duration).Equal(from) {
+		from = from.Truncate(duration).Add(duration)
+	}
+	clipped := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		if session.Start.Before(from) {
+			session.Start = from
+		}
+		if session.End.After(req.To) {
+			session.End = req.To
+		}
+		if session.End.After(session.Start) {
+			clipped = append(clipped, session)
+		}
+	}
+	reports := make([]QualityReport, 0, len(req.Instruments))
+	for _, id := range req.Instruments {
+		candles, err := s.Candles(id, req.Interval, req.From, req.To)
+		if err != nil {
+			return nil, err
+		}
+		report, err := CheckCandles(id, req.Interval, candles, clipped)
+		if err != nil {
+			return nil, err
+		}
+		s.logger.Infof(report.String())
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Repair - Повторный запрос свечей только за пропущенные интервалы отчета, возвращает кол-во восстановленных
+// свечей. Если по инструменту не было сделок, свечей за пропуск не будет и после повторного запроса.
+func (s *CandlesStorage) Repair(ctx context.Context, mds *investgo.MarketDataServiceClient, report QualityReport) (int, error) {
+	var restored int
+	sink := investgo.CandlesSinkFunc(func(id string, interval pb.CandleInterval, candles []*pb.HistoricCandle) error {
+		restored += len(candles)
+		return s.Store(id, interval, candles)
+	})
+	for _, gap := range report.Gaps {
+		err := mds.DownloadCandles(ctx, &investgo.DownloadCandlesRequest{
+			Instruments: []string{report.InstrumentUid},
+			Interval:    report.Interval,
+			From:        gap.From,
+			To:          gap.To,
+			Workers:     1,
+			Sink:        sink,
+		})
+		if err != nil {
+			return restored, err
+		}
+	}
+	s.logger.Infof("%v %v candles restored, %v gaps requested", report.InstrumentUid, restored, len(report.Gaps))
+	return restored, nil
+}